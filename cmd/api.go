@@ -0,0 +1,282 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var apiCmd = &cobra.Command{
+	Use:   "api",
+	Short: "Call any middleware method directly, through the daemon's connection",
+}
+
+var apiCallCmd = &cobra.Command{
+	Use:   "call <method> [json params]...",
+	Short: "Call a method and print its result",
+	Long: "Call a method and print its result. Each parameter is parsed as JSON, or passed as a string if it isn't valid JSON, eg.\n" +
+		"  api call pool.dataset.query '[[\"pool\",\"=\",\"tank\"]]' '{\"select\":[\"name\"]}'\n" +
+		"Methods that start a job return its id, unless --job is given to wait for the job and print its result instead.",
+	Args: cobra.MinimumNArgs(1),
+}
+
+var apiSubscribeCmd = &cobra.Command{
+	Use:   "subscribe <collection>",
+	Short: "Print each change to a collection as a line of JSON, until interrupted",
+	Long: "Print each collection_update event for a collection, eg. pool.dataset.query or core.get_jobs, as a line of JSON\n" +
+		"holding its msg (added, changed or removed), collection, id and fields.",
+	Args: cobra.ExactArgs(1),
+}
+
+var apiMethodsCmd = &cobra.Command{
+	Use:   "methods [prefix]",
+	Short: "List the methods that the middleware provides, with their JSON schemas",
+	Args:  cobra.MaximumNArgs(1),
+}
+
+var g_apiCallEnums map[string][]string
+var g_apiMethodsEnums map[string][]string
+
+func init() {
+	apiCallCmd.RunE = WrapCommandFunc(callApi)
+	apiSubscribeCmd.RunE = WrapCommandFunc(subscribeApi)
+	apiMethodsCmd.RunE = WrapCommandFunc(listApiMethods)
+
+	apiCallCmd.Flags().Bool("job", false, "Wait for the job that the method starts, and print the job's result")
+	apiCallCmd.Flags().Int("timeout", defaultCallTimeout, "Seconds to wait for the call to return, not including the job if --job is given")
+	apiCallCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	apiCallCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	apiCallCmd.Flags().String("format", "json", "Output format. Tables show one row per object in the result "+
+		AddFlagsEnum(&g_apiCallEnums, "format", []string{"csv", "json", "table", "compact"}))
+	apiCallCmd.Flags().StringP("output", "o", "", "Output property list, for formats other than json")
+
+	apiSubscribeCmd.Flags().IntP("count", "n", 0, "Exit after printing this many events")
+
+	apiMethodsCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	apiMethodsCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	apiMethodsCmd.Flags().String("format", "table", "Output table format "+
+		AddFlagsEnum(&g_apiMethodsEnums, "format", []string{"csv", "json", "table", "compact"}))
+	apiMethodsCmd.Flags().StringP("output", "o", "", "Output property list")
+	apiMethodsCmd.Flags().BoolP("all", "a", false, "Output all properties")
+
+	apiCmd.AddCommand(apiCallCmd)
+	apiCmd.AddCommand(apiSubscribeCmd)
+	apiCmd.AddCommand(apiMethodsCmd)
+	rootCmd.AddCommand(apiCmd)
+}
+
+func callApi(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_apiCallEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	var timeout int64
+	if _, err = fmt.Sscan(options.allFlags["timeout"], &timeout); err != nil {
+		return fmt.Errorf("Invalid --timeout \"%s\"", options.allFlags["timeout"])
+	}
+
+	method := args[0]
+	params := make([]interface{}, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		params = append(params, parseApiParam(arg))
+	}
+
+	cmd.SilenceUsage = true
+
+	var result interface{}
+	if core.IsStringTrue(options.allFlags, "job") {
+		result, err = callApiJob(api, method, timeout, params)
+	} else {
+		var out json.RawMessage
+		if out, err = core.ApiCall(api, method, timeout, params); err == nil {
+			var response map[string]interface{}
+			if err = json.Unmarshal(out, &response); err == nil {
+				result = response["result"]
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return printApiResult(api, format, EnumerateOutputProperties(options.allFlags), result)
+}
+
+// parseApiParam reads a parameter as JSON, so that numbers, lists and objects can be passed, falling back to a string
+func parseApiParam(arg string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(arg), &value); err != nil {
+		return arg
+	}
+	return value
+}
+
+// callApiJob starts a job and waits for it, returning its result, or its error if it didn't succeed
+func callApiJob(api core.Session, method string, timeoutSeconds int64, params []interface{}) (interface{}, error) {
+	jobId, err := core.ApiCallAsync(api, method, timeoutSeconds, params, true)
+	if err != nil {
+		return nil, err
+	}
+	if jobId < 0 {
+		return nil, fmt.Errorf("%s did not start a job", method)
+	}
+
+	out, err := core.WaitForJob(api, jobId)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(out, &fields); err != nil {
+		return nil, err
+	}
+	return fields["result"], nil
+}
+
+// printApiResult prints a result as it was received for the json format, otherwise as a table of the objects in it
+func printApiResult(api core.Session, format string, properties []string, result interface{}) error {
+	if strings.ToLower(format) == "json" {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		PrintTable(api, string(data)+"\n")
+		return nil
+	}
+
+	var rows []map[string]interface{}
+	var items []interface{}
+	if list, isList := result.([]interface{}); isList {
+		items = list
+	} else if result != nil {
+		items = []interface{}{result}
+	}
+	for _, item := range items {
+		row, isObject := item.(map[string]interface{})
+		if !isObject {
+			row = map[string]interface{}{"value": item}
+		}
+		rows = append(rows, flattenApiRow(row))
+	}
+
+	columnsList := properties
+	if len(columnsList) == 0 {
+		columnsList = GetUsedPropertyColumns(rows, []string{})
+	}
+	str, err := core.BuildTableData(format, "result", columnsList, rows)
+	PrintTable(api, str)
+	return err
+}
+
+// flattenApiRow writes nested lists and objects as JSON, so that they fit in a table cell
+func flattenApiRow(row map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(row))
+	for key, value := range row {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			data, _ := json.Marshal(value)
+			out[key] = string(data)
+		case nil:
+			out[key] = "-"
+		default:
+			out[key] = value
+		}
+	}
+	return out
+}
+
+func subscribeApi(cmd *cobra.Command, api core.Session, args []string) error {
+	count, _ := cmd.Flags().GetInt("count")
+	cmd.SilenceUsage = true
+
+	printed := 0
+	return core.StreamCollection(api, args[0], func(event json.RawMessage) bool {
+		os.Stdout.Write(append(event, '\n'))
+		printed++
+		return count <= 0 || printed < count
+	})
+}
+
+func listApiMethods(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_apiMethodsEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	out, err := core.ApiCall(api, "core.get_methods", defaultCallTimeout, []interface{}{})
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Result map[string]map[string]interface{} `json:"result"`
+	}
+	if err = json.Unmarshal(out, &response); err != nil {
+		return err
+	}
+	if response.Result == nil {
+		return errors.New("core.get_methods did not return any methods")
+	}
+
+	prefix := ""
+	if len(args) > 0 {
+		prefix = args[0]
+	}
+	names := make([]string, 0, len(response.Result))
+	for name := range response.Result {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	// Schemas are only readable as JSON, so tables just show their outline
+	isJson := strings.ToLower(format) == "json"
+	rows := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		row := map[string]interface{}{"name": name}
+		for key, value := range response.Result[name] {
+			row[key] = value
+		}
+		if description, ok := row["description"].(string); ok && !isJson {
+			row["description"] = strings.SplitN(strings.TrimSpace(description), "\n", 2)[0]
+		}
+		if !isJson {
+			row = flattenApiRow(row)
+		}
+		rows = append(rows, row)
+	}
+
+	required := []string{"name", "job", "description"}
+	var columnsList []string
+	if core.IsStringTrue(options.allFlags, "all") {
+		columnsList = GetUsedPropertyColumns(rows, required)
+	} else if properties := EnumerateOutputProperties(options.allFlags); len(properties) > 0 {
+		columnsList = properties
+	} else if isJson {
+		columnsList = append(required, "accepts", "returns")
+	} else {
+		columnsList = required
+	}
+
+	str, err := core.BuildTableData(format, "methods", columnsList, rows)
+	PrintTable(api, str)
+	return err
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Search the local log of calls that changed something on a TrueNAS host",
+	Long: "Search the audit log, which holds a record of every mutating call made by this user, either directly or through the daemon.\n" +
+		"Jobs have a second record once they finish, with their final state.",
+	Args: cobra.NoArgs,
+}
+
+var g_auditEnums map[string][]string
+
+func init() {
+	auditCmd.RunE = WrapCommandFuncWithoutApi(searchAuditLog)
+
+	auditCmd.Flags().String("since", "", "Only show records from this time on, either RFC3339 or a duration ago, eg. 24h")
+	auditCmd.Flags().String("until", "", "Only show records up to this time, either RFC3339 or a duration ago")
+	auditCmd.Flags().String("method", "", "Only show calls to methods matching this pattern, eg. \"pool.dataset.*\"")
+	auditCmd.Flags().String("dataset", "", "Only show calls naming this dataset, or a child or snapshot of it")
+	auditCmd.Flags().String("file", "", "Audit log to read, defaults to ~/.truenas_incus_ctl/audit.log")
+
+	auditCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	auditCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	auditCmd.Flags().String("format", "table", "Output table format "+
+		AddFlagsEnum(&g_auditEnums, "format", []string{"csv", "json", "table", "compact"}))
+
+	rootCmd.AddCommand(auditCmd)
+}
+
+func searchAuditLog(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_auditEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var since, until time.Time
+	if value := options.allFlags["since"]; value != "" {
+		if since, err = parseAuditTime(value, now); err != nil {
+			return fmt.Errorf("Could not parse --since \"%s\": %v", value, err)
+		}
+	}
+	if value := options.allFlags["until"]; value != "" {
+		if until, err = parseAuditTime(value, now); err != nil {
+			return fmt.Errorf("Could not parse --until \"%s\": %v", value, err)
+		}
+	}
+	methodPattern := options.allFlags["method"]
+	if _, err = path.Match(methodPattern, ""); err != nil {
+		return fmt.Errorf("Invalid --method pattern \"%s\": %v", methodPattern, err)
+	}
+	dataset := options.allFlags["dataset"]
+	if dataset != "" {
+		dataset = strings.TrimSuffix(auditDatasetName(dataset), "/")
+	}
+
+	fileName := options.allFlags["file"]
+	if fileName == "" {
+		fileName = getDefaultAuditLogPath()
+	}
+
+	cmd.SilenceUsage = true
+
+	records, err := core.ReadAuditLog(fileName)
+	if err != nil {
+		return err
+	}
+
+	results := make([]map[string]interface{}, 0)
+	for i, record := range records {
+		if !since.IsZero() && record.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && record.Time.After(until) {
+			continue
+		}
+		if methodPattern != "" {
+			if matched, _ := path.Match(methodPattern, record.Method); !matched {
+				continue
+			}
+		}
+		if dataset != "" && !auditParamsNameDataset(record.Params, dataset) {
+			continue
+		}
+
+		params, _ := json.Marshal(record.Params)
+		row := map[string]interface{}{
+			"id":        i + 1,
+			"time":      record.Time.Format(time.RFC3339),
+			"user":      record.User,
+			"host":      record.Host,
+			"method":    record.Method,
+			"params":    string(params),
+			"error":     record.Error,
+			"job_state": record.JobState,
+		}
+		if record.JobId > 0 {
+			row["job_id"] = record.JobId
+		}
+		results = append(results, row)
+	}
+
+	columnsList := []string{"time", "user", "host", "method", "job_id", "job_state", "error", "params"}
+	str, err := core.BuildTableData(format, "audit", columnsList, results)
+	PrintTable(api, str)
+	return err
+}
+
+// parseAuditTime accepts either an absolute time or a duration before now
+func parseAuditTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC3339 time or duration")
+	}
+	return now.Add(-d), nil
+}
+
+// auditParamsNameDataset looks for a string anywhere in params that names the dataset, one of its children or one of its snapshots.
+// Zvols named as "zvol/<dataset>" and shares named by their path under /mnt count too.
+func auditParamsNameDataset(params interface{}, dataset string) bool {
+	switch value := params.(type) {
+	case string:
+		name := auditDatasetName(value)
+		return name == dataset || strings.HasPrefix(name, dataset+"/") || strings.HasPrefix(name, dataset+"@")
+	case []interface{}:
+		for _, elem := range value {
+			if auditParamsNameDataset(elem, dataset) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, elem := range value {
+			if auditParamsNameDataset(elem, dataset) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// auditDatasetName strips the "zvol/" or "/mnt/" that an extent or a share puts in front of a dataset's name
+func auditDatasetName(value string) string {
+	if strings.HasPrefix(value, "/mnt/") {
+		return strings.TrimPrefix(path.Clean(value), "/mnt/")
+	}
+	return strings.TrimPrefix(value, "zvol/")
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAuditSearch(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "audit.log")
+	lines := "{\"time\":\"2025-01-01T10:00:00Z\",\"user\":\"alice\",\"host\":\"nas\",\"method\":\"pool.dataset.create\",\"params\":[{\"name\":\"dozer/testing/test4\"}]}\n" +
+		"{\"time\":\"2025-01-01T11:00:00Z\",\"user\":\"alice\",\"host\":\"nas\",\"method\":\"zfs.snapshot.create\",\"params\":[{\"dataset\":\"dozer/testing/test5\",\"name\":\"snap\"}]}\n" +
+		"{\"time\":\"2025-01-01T12:00:00Z\",\"user\":\"alice\",\"host\":\"nas\",\"method\":\"pool.dataset.delete\",\"params\":[\"dozer/testing/test4@old\"],\"job_id\":7,\"job_state\":\"SUCCESS\"}\n" +
+		"{\"time\":\"2025-01-01T13:00:00Z\",\"user\":\"alice\",\"host\":\"nas\",\"method\":\"iscsi.extent.create\",\"params\":[{\"disk\":\"zvol/dozer/testing/test4/vol\",\"name\":\"vol\"}]}\n" +
+		"{\"time\":\"2025-01-01T14:00:00Z\",\"user\":\"alice\",\"host\":\"nas\",\"method\":\"sharing.nfs.create\",\"params\":[{\"path\":\"/mnt/dozer/testing/test4\"}]}\n" +
+		"{\"time\":\"2025-01-01T15:00:00Z\",\"user\":\"alice\",\"host\":\"nas\",\"method\":\"sharing.nfs.create\",\"params\":[{\"path\":\"/mnt/dozer/testing/test40\"}]}\n"
+	FailIf(t, os.WriteFile(fileName, []byte(lines), 0600))
+
+	api := &UnitTestSession{test: t}
+	api.tableExpected = "2025-01-01T10:00:00Z\talice\tnas\tpool.dataset.create\t-\t\t\t[{\"name\":\"dozer/testing/test4\"}]\n" +
+		"2025-01-01T12:00:00Z\talice\tnas\tpool.dataset.delete\t7\tSUCCESS\t\t[\"dozer/testing/test4@old\"]\n"
+
+	SetAuxCobraFlag(auditCmd, "file", fileName)
+	SetAuxCobraFlag(auditCmd, "dataset", "dozer/testing/test4")
+	SetAuxCobraFlag(auditCmd, "method", "pool.dataset.*")
+	SetAuxCobraFlag(auditCmd, "no_headers", true)
+	defer ResetAuxCobraFlags(auditCmd)
+	FailIf(t, searchAuditLog(auditCmd, api, nil))
+
+	api.tableExpected = "2025-01-01T12:00:00Z\talice\tnas\tpool.dataset.delete\t7\tSUCCESS\t\t[\"dozer/testing/test4@old\"]\n"
+	SetAuxCobraFlag(auditCmd, "since", "2025-01-01T10:30:00Z")
+	FailIf(t, searchAuditLog(auditCmd, api, nil))
+
+	// Extents name zvols as "zvol/<dataset>", and shares name datasets by their path
+	api.tableExpected = "2025-01-01T13:00:00Z\talice\tnas\tiscsi.extent.create\t-\t\t\t[{\"disk\":\"zvol/dozer/testing/test4/vol\",\"name\":\"vol\"}]\n" +
+		"2025-01-01T14:00:00Z\talice\tnas\tsharing.nfs.create\t-\t\t\t[{\"path\":\"/mnt/dozer/testing/test4\"}]\n"
+	SetAuxCobraFlag(auditCmd, "method", "")
+	SetAuxCobraFlag(auditCmd, "since", "2025-01-01T12:30:00Z")
+	FailIf(t, searchAuditLog(auditCmd, api, nil))
+
+	api.tableExpected = "2025-01-01T13:00:00Z\talice\tnas\tiscsi.extent.create\t-\t\t\t[{\"disk\":\"zvol/dozer/testing/test4/vol\",\"name\":\"vol\"}]\n"
+	SetAuxCobraFlag(auditCmd, "dataset", "zvol/dozer/testing/test4/vol")
+	FailIf(t, searchAuditLog(auditCmd, api, nil))
+}
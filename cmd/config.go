@@ -2,9 +2,11 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -12,7 +14,6 @@ import (
 	"truenas/truenas_incus_ctl/truenas_api"
 
 	"github.com/spf13/cobra"
-	"golang.org/x/term"
 )
 
 var configCmd = &cobra.Command{
@@ -26,7 +27,9 @@ Available Commands:
   set <name> [parameters...]    - Update parameters in config file
   list                              - Lists all saved connections
   show                              - Display the raw contents of the configuration file
-  remove <name>                 - Remove a saved connection by name`,
+  use <name>                    - Make a saved connection the default
+  remove <name>                 - Remove a saved connection by name
+  rotate-key <name>             - Replace the API key of a saved connection`,
 	Example: `  # Add a new connection interactively
   truenas_incus_ctl config login
 
@@ -36,8 +39,17 @@ Available Commands:
   # List all saved connections
   truenas_incus_ctl config list
 
+  # Connect to prod-server unless told otherwise
+  truenas_incus_ctl config use prod-server
+
+  # Show which connection would be used, and why
+  truenas_incus_ctl config show --resolved
+
   # Remove a connection
-  truenas_incus_ctl config remove truenas-production`,
+  truenas_incus_ctl config remove truenas-production
+
+  # Replace the API key of a connection, deleting the old one
+  truenas_incus_ctl config rotate-key prod-server`,
 	Run: func(cmd *cobra.Command, args []string) {
 		if len(args) == 0 {
 			cmd.HelpFunc()(cmd, args)
@@ -58,6 +70,12 @@ var configShowCmd = &cobra.Command{
 	Args:  cobra.NoArgs,
 }
 
+var configUseCmd = &cobra.Command{
+	Use:   "use <name>",
+	Short: "Make a saved connection the default, used when no --config, --host or environment variables are given",
+	Args:  cobra.ExactArgs(1),
+}
+
 var configListCmd = &cobra.Command{
 	Use:     "list",
 	Short:   "List all saved connection names",
@@ -86,29 +104,56 @@ var configSetCmd = &cobra.Command{
 	Aliases: []string{"update"},
 }
 
+var configRotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key <name>",
+	Short: "Replace the API key of a saved connection with a new one, then delete the old key from the host",
+	Args:  cobra.ExactArgs(1),
+}
+
 func init() {
 	configLoginCmd.RunE = WrapCommandFuncWithoutApi(loginToHost)
-	configShowCmd.RunE = WrapCommandFunc(showConfig)
-	configListCmd.RunE = WrapCommandFunc(listConfigs)
+	configShowCmd.RunE = WrapCommandFuncWithoutApi(showConfig)
+	configUseCmd.RunE = WrapCommandFuncWithoutApi(useConfig)
+	configListCmd.RunE = WrapCommandFuncWithoutApi(listConfigs)
 	configRemoveCmd.RunE = WrapCommandFunc(removeConfig)
 	configAddCmd.RunE = WrapCommandFuncWithoutApi(addHost)
 	configSetCmd.RunE = WrapCommandFuncWithoutApi(setConfig)
+	configRotateKeyCmd.RunE = WrapCommandFuncWithoutApi(rotateApiKey)
+
+	configSetCmd.Flags().StringArray("set-default", nil, "Default for a command's flag on this host, eg. share.iscsi.create.portal=10.0.0.5:3260. Can be repeated")
+	configSetCmd.Flags().StringArray("unset-default", nil, "Remove the default for a command's flag, eg. share.iscsi.create.portal. Can be repeated")
+	configShowCmd.Flags().Bool("resolved", false, "Show the connection settings that would be used, and where each comes from")
 
 	_configEditCommands := []*cobra.Command {configAddCmd, configSetCmd}
 	for _, c := range _configEditCommands {
 		c.Flags().Bool("no-verify", false, "Don't verify the new host and API key before updating the config")
+		c.Flags().String("api-key-env", "", "Read the API key from this environment variable on every use, instead of storing it")
+		c.Flags().String("api-key-file", "", "Read the API key from this file on every use, eg. a systemd credential")
+		c.Flags().String("api-key-command", "", "Run this shell command on every use, taking the API key from its output")
+		c.Flags().String("api-key-secret", "", "Look up the API key in the Secret Service by these attributes, eg. \"service=truenas,host=nas\"")
+		c.Flags().String("tls-fingerprint", "", "Pin the SHA-256 fingerprint of the host's certificate, which may then be self-signed")
+		c.Flags().String("ca-file", "", "Verify the host's certificate against this CA bundle instead of the system's")
+		c.Flags().Bool("read-only", false, "Refuse to make any changes through this connection")
+		c.Flags().String("allowed-roots", "", "Only allow changes to datasets under these, eg. \"tank/incus,tank/backup\"")
 	}
 
 	configCmd.AddCommand(configLoginCmd)
 	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configUseCmd)
 	configCmd.AddCommand(configListCmd)
 	configCmd.AddCommand(configRemoveCmd)
 	configCmd.AddCommand(configAddCmd)
 	configCmd.AddCommand(configSetCmd)
+	configCmd.AddCommand(configRotateKeyCmd)
 	rootCmd.AddCommand(configCmd)
 }
 
 func showConfig(cmd *cobra.Command, api core.Session, args []string) error {
+	if resolved, _ := cmd.Flags().GetBool("resolved"); resolved {
+		cmd.SilenceUsage = true
+		return showResolvedConfig()
+	}
+
 	// Get the config file path
 	configPath := g_configFileName
 	if configPath == "" {
@@ -127,6 +172,11 @@ func showConfig(cmd *cobra.Command, api core.Session, args []string) error {
 		return fmt.Errorf("Failed to parse config file %s: %v", configPath, err)
 	}
 
+	// API keys stored in plain text are hidden, but where other keys come from is shown
+	if configs, ok := jsonObj.(map[string]interface{}); ok {
+		jsonObj = redactConfig(configs)
+	}
+
 	// Pretty print the JSON with indentation
 	prettyJSON, err := json.MarshalIndent(jsonObj, "", "  ")
 	if err != nil {
@@ -138,13 +188,90 @@ func showConfig(cmd *cobra.Command, api core.Session, args []string) error {
 	return nil
 }
 
+// showResolvedConfig prints the settings that other commands would connect with, given the same flags and environment
+func showResolvedConfig() error {
+	sources, err := resolveConnection()
+	if err != nil {
+		return err
+	}
+
+	apiKey := g_apiKey
+	if apiKey != "" {
+		apiKey = core.REDACTED_STRING
+	}
+	settings := []struct {
+		key   string
+		value string
+	}{
+		{"config", g_configName},
+		{"host", g_hostName},
+		{"api_key", apiKey},
+		{"username", g_username},
+		{"allow_insecure", strconv.FormatBool(g_allowInsecure)},
+		{"tls_fingerprint", g_tlsFingerprint},
+		{"ca_file", g_caFile},
+		{"read_only", strconv.FormatBool(g_readOnly)},
+		{"allowed_roots", strings.Join(g_allowedRoots, ", ")},
+		{"debug", strconv.FormatBool(g_debug)},
+		{"daemon_socket", getDaemonSocketPath()},
+	}
+	for _, s := range settings {
+		source, exists := sources[s.key]
+		if !exists {
+			// Settings nobody gave are left out, except the socket path, which is always needed
+			if s.key != "daemon_socket" {
+				continue
+			}
+			source = "default"
+		}
+		fmt.Printf("%-15s %s (from %s)\n", s.key+":", s.value, source)
+	}
+	for _, key := range core.GetKeysSorted(g_commandDefaults) {
+		fmt.Printf("%-15s %s=%s (from %s)\n", "default:", key, formatDefaultValue(g_commandDefaults[key]), sources["defaults"])
+	}
+	return nil
+}
+
+// useConfig sets the connection picked when none is named by flags or environment variables
+func useConfig(cmd *cobra.Command, api core.Session, args []string) error {
+	name := args[0]
+
+	// Get the config file path
+	configPath := g_configFileName
+	if configPath == "" {
+		configPath = getDefaultConfigPath()
+	}
+
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	configs, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	hosts, _ := configs["hosts"].(map[string]interface{})
+	if _, exists := hosts[name]; !exists {
+		return fmt.Errorf("Connection with name '%s' not found", name)
+	}
+
+	configs["default"] = name
+	if err = saveConfig(configPath, configs); err != nil {
+		return err
+	}
+
+	fmt.Printf("Connection '%s' is now the default\n", name)
+	return nil
+}
+
 // addHost implements the non-interactive version of adding a connection to the config
 func addHost(cmd *cobra.Command, api core.Session, args []string) error {
 	// Note: 'api' parameter will be nil for this command, which is expected
 	options, _ := GetCobraFlags(cmd, true, nil)
 	name := args[0]
 	hostname := options.allFlags["host"]
-	apiKey := options.allFlags["api_key"]
 	strDebug, passedDebug := options.usedFlags["debug"]
 	strInsecure, passedInsecure := options.usedFlags["allow_insecure"]
 	sockPath, passedSockPath := options.usedFlags["daemon_socket"]
@@ -154,15 +281,6 @@ func addHost(cmd *cobra.Command, api core.Session, args []string) error {
 	if hostname == "" {
 		return fmt.Errorf("Hostname cannot be empty")
 	}
-	if apiKey == "" {
-		return fmt.Errorf("API key cannot be empty")
-	}
-
-	if !core.IsStringTrue(options.allFlags, "no_verify") {
-		if err := verifyHost(hostname, apiKey, isInsecure); err != nil {
-			return err
-		}
-	}
 
 	// Get the config file path
 	configPath := g_configFileName
@@ -170,13 +288,37 @@ func addHost(cmd *cobra.Command, api core.Session, args []string) error {
 		configPath = getDefaultConfigPath()
 	}
 
-	configs, err := loadConfig(configPath)
-
 	// Add or update host entry with URL including API endpoint
 	// Store the complete URL with /api/current path under the name
 	hostConfig := map[string]interface{}{
-		"url":     hostname,
-		"api_key": apiKey,
+		"url": hostname,
+	}
+	// With a username, the password is prompted for on every use
+	hasKey, err := setApiKeySource(hostConfig, options.allFlags)
+	if err != nil {
+		return err
+	}
+	if !hasKey {
+		return fmt.Errorf("API key cannot be empty, unless a username or another key source is given")
+	}
+	setTlsTrust(hostConfig, options.usedFlags)
+	setRestrictions(hostConfig, options.usedFlags)
+
+	if !core.IsStringTrue(options.allFlags, "no_verify") {
+		if err := verifyHostConfig(hostConfig, hostname, configPath, isInsecure); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	configs, err := loadConfig(configPath)
+	if err != nil {
+		return err
 	}
 	if passedDebug {
 		hostConfig["debug"] = strDebug == "true"
@@ -204,11 +346,6 @@ func setConfig(cmd *cobra.Command, api core.Session, args []string) error {
 	// Note: 'api' parameter will be nil for this command, which is expected
 	options, _ := GetCobraFlags(cmd, true, nil)
 	name := args[0]
-	hostname := options.allFlags["host"]
-	apiKey := options.allFlags["api_key"]
-	strDebug, passedDebug := options.usedFlags["debug"]
-	strInsecure, passedInsecure := options.usedFlags["allow_insecure"]
-	sockPath, passedSockPath := options.usedFlags["daemon_socket"]
 
 	// Get the config file path
 	configPath := g_configFileName
@@ -216,46 +353,80 @@ func setConfig(cmd *cobra.Command, api core.Session, args []string) error {
 		configPath = getDefaultConfigPath()
 	}
 
+	// Verifying connects to the host and may prompt for a password, so it's done before locking the config.
+	// The changes are then made again to the config as it is once locked, in case it was changed in the meantime.
 	configs, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	profile, hostname, err := editHostEntry(cmd, options, configs, name)
+	if err != nil {
+		return err
+	}
+
+	if !core.IsStringTrue(options.allFlags, "no_verify") {
+		isInsecure, _ := profile["allow_insecure"].(bool)
+		if err := verifyHostConfig(profile, hostname, configPath, isInsecure); err != nil {
+			return err
+		}
+	}
+
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if configs, err = loadConfig(configPath); err != nil {
+		return err
+	}
+	if _, hostname, err = editHostEntry(cmd, options, configs, name); err != nil {
+		return err
+	}
+
+	if err = saveConfig(configPath, configs); err != nil {
+		return err
+	}
+
+	fmt.Printf("Configuration for '%s' (connecting to %s) saved to %s\n", name, hostname, configPath)
+	return nil
+}
+
+// editHostEntry applies the flags passed to config set to a host entry in configs, returning the entry and its host
+func editHostEntry(cmd *cobra.Command, options FlagMap, configs map[string]interface{}, name string) (map[string]interface{}, string, error) {
+	hostname := options.allFlags["host"]
+	strDebug, passedDebug := options.usedFlags["debug"]
+	strInsecure, passedInsecure := options.usedFlags["allow_insecure"]
+	sockPath, passedSockPath := options.usedFlags["daemon_socket"]
 
 	hosts, _ := configs["hosts"].(map[string]interface{})
 	if len(hosts) == 0 {
-		return fmt.Errorf("Could not find hosts in config file")
+		return nil, "", fmt.Errorf("Could not find hosts in config file")
 	}
 	profile, _ := hosts[name].(map[string]interface{})
 	if len(profile) == 0 {
-		return fmt.Errorf("Could not find host \"%s\" in config file", name)
+		return nil, "", fmt.Errorf("Could not find host \"%s\" in config file", name)
 	}
 
 	if hostname == "" {
 		hostname, _ = profile["url"].(string)
 		if hostname == "" {
-			return fmt.Errorf("Hostname cannot be empty")
+			return nil, "", fmt.Errorf("Hostname cannot be empty")
 		}
 	} else {
 		profile["url"] = hostname
 	}
 
-	if apiKey == "" {
-		apiKey, _ = profile["api_key"].(string)
-		if apiKey == "" {
-			return fmt.Errorf("API key cannot be empty")
-		}
-	} else {
-		profile["api_key"] = apiKey
+	if _, err := setApiKeySource(profile, options.allFlags); err != nil {
+		return nil, "", err
 	}
-
-	isInsecure := false
-	if passedInsecure {
-		isInsecure = strInsecure == "true"
-	} else {
-		isInsecure, _ = profile["allow_insecure"].(bool)
+	if _, hasUsername := profile["username"]; !hasUsername && !hasApiKey(profile) {
+		return nil, "", fmt.Errorf("API key cannot be empty, unless a username or another key source is given")
 	}
-
-	if !core.IsStringTrue(options.allFlags, "no_verify") {
-		if err := verifyHost(hostname, apiKey, isInsecure); err != nil {
-			return err
-		}
+	setTlsTrust(profile, options.usedFlags)
+	setRestrictions(profile, options.usedFlags)
+	if err := editCommandDefaults(cmd, profile); err != nil {
+		return nil, "", err
 	}
 
 	if passedDebug {
@@ -270,13 +441,7 @@ func setConfig(cmd *cobra.Command, api core.Session, args []string) error {
 
 	hosts[name] = profile
 	configs["hosts"] = hosts
-
-	if err = saveConfig(configPath, configs); err != nil {
-		return err
-	}
-
-	fmt.Printf("Configuration for '%s' (connecting to %s) saved to %s\n", name, hostname, configPath)
-	return nil
+	return profile, hostname, nil
 }
 
 // listConfigs lists all connection names in the config
@@ -328,6 +493,12 @@ func removeConfig(cmd *cobra.Command, api core.Session, args []string) error {
 		configPath = getDefaultConfigPath()
 	}
 
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Read the config file
 	data, err := os.ReadFile(configPath)
 	if err != nil {
@@ -357,6 +528,9 @@ func removeConfig(cmd *cobra.Command, api core.Session, args []string) error {
 	// Remove the connection
 	delete(hosts, name)
 	configs["hosts"] = hosts
+	if configs["default"] == name {
+		delete(configs, "default")
+	}
 
 	if err = saveConfig(configPath, configs); err != nil {
 		return err
@@ -373,18 +547,83 @@ func saveConfig(configPath string, configs map[string]interface{}) error {
 		return fmt.Errorf("Failed to serialize config: %v", err)
 	}
 
-	if err := os.WriteFile(configPath, updatedData, 0600); err != nil {
+	if err = makeConfigDir(configPath); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so that the config is never left half-written.
+	// It holds API keys, so only the owner may read it
+	tempFile, err := os.CreateTemp(path.Dir(configPath), "."+path.Base(configPath)+".*")
+	if err != nil {
+		return fmt.Errorf("Failed to write config to %s: %v", configPath, err)
+	}
+	tempPath := tempFile.Name()
+	err = tempFile.Chmod(0600)
+	if err == nil {
+		_, err = tempFile.Write(updatedData)
+	}
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if errClose := tempFile.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tempPath, configPath)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
 		return fmt.Errorf("Failed to write config to %s: %v", configPath, err)
 	}
 
+	// Make sure the rename itself reaches the disk
+	if dir, err := os.Open(path.Dir(configPath)); err == nil {
+		_ = dir.Sync()
+		dir.Close()
+	}
+
 	return nil
 }
 
+// makeConfigDir creates the directory the config file lives in, readable only by its owner.
+// The default directory is tightened if needed, but a directory given with --config-file is left as it was.
+func makeConfigDir(configPath string) error {
+	configDir := path.Dir(configPath)
+	if err := os.MkdirAll(configDir, 0700); err != nil {
+		return fmt.Errorf("Failed to create config directory %s: %v", configDir, err)
+	}
+	if configDir == path.Dir(getDefaultConfigPath()) {
+		if err := os.Chmod(configDir, 0700); err != nil {
+			return fmt.Errorf("Failed to set permissions of config directory %s: %v", configDir, err)
+		}
+	}
+	return nil
+}
+
+// lockConfig takes an exclusive advisory lock for reading, changing and saving the config file, so that config
+// commands run in parallel don't lose each other's changes. Saving replaces the file, so the lock is on a separate one.
+func lockConfig(configPath string) (func(), error) {
+	if err := makeConfigDir(configPath); err != nil {
+		return nil, err
+	}
+	lockFile, err := os.OpenFile(configPath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to lock config file %s: %v", configPath, err)
+	}
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("Failed to lock config file %s: %v", configPath, err)
+	}
+	return func() {
+		_ = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+		lockFile.Close()
+	}, nil
+}
+
 func loadConfig(configPath string) (map[string]interface{}, error) {
 	// Ensure the config directory exists
-	configDir := path.Dir(configPath)
-	if err := os.MkdirAll(configDir, 0755); err != nil {
-		return nil, fmt.Errorf("Failed to create config directory %s: %v", configDir, err)
+	if err := makeConfigDir(configPath); err != nil {
+		return nil, err
 	}
 
 	// Read existing config or create new config
@@ -408,19 +647,89 @@ func loadConfig(configPath string) (map[string]interface{}, error) {
 	return configs, nil
 }
 
-func verifyHost(hostname, apiKey string, allowInsecure bool) error {
+// verifyHostConfig resolves the API key of a host entry, wherever it's kept, then checks that it works
+func verifyHostConfig(hostConfig map[string]interface{}, hostname, configPath string, allowInsecure bool) error {
+	var apiKey string
+	if hasApiKey(hostConfig) {
+		var err error
+		if apiKey, err = resolveApiKey(hostConfig, configPath); err != nil {
+			return err
+		}
+	}
+	username, _ := hostConfig["username"].(string)
+	return verifyHost(hostname, apiKey, username, getTlsTrust(hostConfig, allowInsecure))
+}
+
+// setTlsTrust updates how the certificate of a host entry is checked, from the flags passed to config add/set.
+// Passing an empty value removes the setting.
+func setTlsTrust(hostConfig map[string]interface{}, usedFlags map[string]string) {
+	for _, key := range []string{"tls_fingerprint", "ca_file"} {
+		if value, passed := usedFlags[key]; passed {
+			if value == "" {
+				delete(hostConfig, key)
+			} else {
+				hostConfig[key] = value
+			}
+		}
+	}
+}
+
+// setRestrictions updates what may be changed through a host entry, from the flags passed to config add/set
+func setRestrictions(hostConfig map[string]interface{}, usedFlags map[string]string) {
+	if value, passed := usedFlags["read_only"]; passed {
+		if value == "true" {
+			hostConfig["read_only"] = true
+		} else {
+			delete(hostConfig, "read_only")
+		}
+	}
+	if value, passed := usedFlags["allowed_roots"]; passed {
+		roots := make([]interface{}, 0)
+		for _, root := range strings.Split(value, ",") {
+			if root = strings.TrimSpace(root); root != "" {
+				roots = append(roots, root)
+			}
+		}
+		if len(roots) == 0 {
+			delete(hostConfig, "allowed_roots")
+		} else {
+			hostConfig["allowed_roots"] = roots
+		}
+	}
+}
+
+// getTlsTrust returns how the certificate of a host entry is checked
+func getTlsTrust(hostConfig map[string]interface{}, allowInsecure bool) truenas_api.TLSTrust {
+	trust := truenas_api.TLSTrust{AllowInsecure: allowInsecure}
+	trust.Fingerprint, _ = hostConfig["tls_fingerprint"].(string)
+	trust.CAFile, _ = hostConfig["ca_file"].(string)
+	return trust
+}
+
+// verifyHost logs in with the API key, or with the username and a password prompted for if there's no key
+func verifyHost(hostname, apiKey, username string, trust truenas_api.TLSTrust) error {
 	// Construct the WebSocket URL with API endpoint
 	url := core.GetApiUrlFromHostName(hostname)
 	fmt.Printf("Testing connection to %s...\n", url)
 
-	client, err := truenas_api.NewClient(url, allowInsecure)
+	client, err := truenas_api.NewClient(url, trust)
 	if err != nil {
+		if truenas_api.IsCertificateError(err) {
+			if fingerprint, fpErr := getServerFingerprint(url); fpErr == nil {
+				return fmt.Errorf("Failed to create connection to %s: %v\n"+
+					"The certificate's SHA-256 fingerprint is %s, which can be pinned with --tls-fingerprint", url, err, fingerprint)
+			}
+		}
 		return fmt.Errorf("Failed to create connection to %s: %v", url, err)
 	}
 	defer client.Close()
 
-	// Attempt to login to verify API key
-	err = client.Login("", "", apiKey)
+	// Attempt to login to verify the credentials
+	if apiKey != "" {
+		err = client.Login("", "", apiKey)
+	} else {
+		err = loginWithPassword(client, url, username)
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to login to %s: %v", url, err)
 	}
@@ -439,6 +748,64 @@ func verifyHost(hostname, apiKey string, allowInsecure bool) error {
 	return nil
 }
 
+// getServerFingerprint connects without verifying the server's certificate, to find out what its fingerprint is
+func getServerFingerprint(url string) (string, error) {
+	client, err := truenas_api.NewClient(url, truenas_api.TLSTrust{AllowInsecure: true})
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	return client.PeerFingerprint(), nil
+}
+
+// connectTrustingOnFirstUse connects to a host, asking whether to trust its certificate if the system doesn't.
+// Returns the fingerprint to pin, if the certificate was trusted that way.
+func connectTrustingOnFirstUse(url string) (*truenas_api.Client, string, error) {
+	client, err := truenas_api.NewClient(url, truenas_api.TLSTrust{})
+	if err == nil || !truenas_api.IsCertificateError(err) {
+		return client, "", err
+	}
+
+	client, err = truenas_api.NewClient(url, truenas_api.TLSTrust{AllowInsecure: true})
+	if err != nil {
+		return nil, "", err
+	}
+	fingerprint := client.PeerFingerprint()
+	fmt.Printf("The TLS certificate of %s is not trusted by this system, eg. because it is self-signed.\n", url)
+	fmt.Printf("Its SHA-256 fingerprint is:\n  %s\n", fingerprint)
+	if !promptYesNo("Trust this certificate from now on [y/n]: ") {
+		client.Close()
+		return nil, "", fmt.Errorf("The certificate of %s was not trusted", url)
+	}
+	return client, fingerprint, nil
+}
+
+func promptYesNo(prompt string) bool {
+	for {
+		var answer string
+		fmt.Print(prompt)
+		fmt.Scanln(&answer)
+		lower := strings.ToLower(answer)
+		if lower == "y" || lower == "yes" {
+			return true
+		} else if lower == "n" || lower == "no" {
+			return false
+		}
+	}
+}
+
+// loginWithPassword prompts for the password of the user, then for a one-time password if the host asks for one
+func loginWithPassword(client *truenas_api.Client, url, username string) error {
+	account := username + "@" + core.GetHostNameFromApiUrl(url)
+	password, err := promptSecret("Password for " + account)
+	if err != nil {
+		return err
+	}
+	return client.LoginWithPassword(username, password, func() (string, error) {
+		return promptSecret("One-time password for " + account)
+	})
+}
+
 // loginToHost implements the login subcommand functionality
 func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 	// Note: 'api' parameter will be nil for this command, which is expected
@@ -502,31 +869,19 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 		break
 	}
 
-	var allowInsecureStr string
-	allowInsecure := false
-	for {
-		fmt.Print("Allow self-signed certificates [y/n]: ")
-		fmt.Scanln(&allowInsecureStr)
-		lower := strings.ToLower(allowInsecureStr)
-		if lower == "y" || lower == "yes" {
-			allowInsecure = true
-		} else if lower == "n" || lower == "no" {
-			allowInsecure = false
-		} else {
-			continue
-		}
-		break
-	}
-
 	fmt.Printf("Setting up connection to TrueNAS host: %s\n", hostname)
 
 	// Prompt for authentication method
 	var authMethod string
 	for {
-		fmt.Print("Choose authentication method (1 for API Key, 2 for Username/Password): ")
+		fmt.Println("Choose authentication method:")
+		fmt.Println("  1: API key")
+		fmt.Println("  2: Username/password, to generate an API key")
+		fmt.Println("  3: Username/password, prompted for on every use")
+		fmt.Print("Authentication method [1-3]: ")
 		fmt.Scanln(&authMethod)
-		if authMethod != "1" && authMethod != "2" {
-			fmt.Println("Please enter either 1 or 2 to select your authentication method.")
+		if authMethod != "1" && authMethod != "2" && authMethod != "3" {
+			fmt.Println("Please enter 1, 2 or 3 to select your authentication method.")
 			continue
 		}
 		break
@@ -536,13 +891,15 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 	url := core.GetApiUrlFromHostName(hostname)
 	fmt.Printf("Testing connection to %s...\n", url)
 
-	// Test the connection by creating a temporary client
-	client, err := truenas_api.NewClient(url, allowInsecure)
+	// Test the connection by creating a temporary client.
+	// A certificate that isn't otherwise trusted is pinned by its fingerprint, once the user has checked it
+	client, fingerprint, err := connectTrustingOnFirstUse(url)
 	if err != nil {
 		return fmt.Errorf("Failed to create connection to %s: %v", url, err)
 	}
 
 	var apiKey string
+	var username string
 	if authMethod == "1" {
 		// Prompt for API key
 		for {
@@ -563,7 +920,6 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 		}
 	} else {
 		// Prompt for username
-		var username string
 		for {
 			fmt.Print("Enter your TrueNAS username: ")
 			fmt.Scanln(&username)
@@ -574,79 +930,23 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 			break
 		}
 
-		// Prompt for password with masking
-		var password string
-		for {
-			fmt.Print("Enter your TrueNAS password: ")
-			// ReadPassword will disable echo and read password from terminal
-			bytePassword, err := term.ReadPassword(int(syscall.Stdin))
-			fmt.Println() // Add a newline after password input
-
-			if err != nil {
-				fmt.Printf("Error reading password: %v\n", err)
-				continue
-			}
-
-			password = string(bytePassword)
-			if password == "" {
-				fmt.Println("Password cannot be empty. Please try again.")
-				continue
-			}
-			break
-		}
-
-		// Attempt to login with username and password
-		err = client.Login(username, password, "")
+		// Attempt to login with username and password, the password being prompted for without echo
+		err = loginWithPassword(client, url, username)
 		if err != nil {
 			client.Close()
 			return fmt.Errorf("Failed to login to %s with username/password: %v", url, err)
 		}
+	}
 
-		// Generate an API key using api_key.create
+	var apiKeyId int64 = -1
+	if authMethod == "2" {
+		// The password has done its job once the key exists, and is never stored
 		fmt.Println("Generating API key...")
-		currentTime := time.Now().Format("2006-01-02")
-		keyName := fmt.Sprintf("Auto-Generated by truenas_incus_ctl %s", currentTime)
-
-		// Create API key
-		params := []interface{}{
-			map[string]interface{}{
-				"name":     keyName,
-				"username": username,
-			},
-		}
-
-		res, err := client.Call("api_key.create", 30, params)
+		apiKey, apiKeyId, err = createApiKey(client, username)
 		if err != nil {
 			client.Close()
-			return fmt.Errorf("Failed to create API key: %v", err)
-		}
-
-		// Parse the response to get the API key
-		var response map[string]interface{}
-		if err := json.Unmarshal(res, &response); err != nil {
-			client.Close()
-			return fmt.Errorf("Failed to parse API key creation response: %v", err)
-		}
-
-		// Check for errors in the response
-		if errorData, exists := response["error"]; exists {
-			client.Close()
-			return fmt.Errorf("API key creation error: %v", errorData)
-		}
-
-		// Extract the API key from the result
-		result, ok := response["result"].(map[string]interface{})
-		if !ok {
-			client.Close()
-			return fmt.Errorf("Unexpected response format for API key creation")
-		}
-
-		apiKey, ok = result["key"].(string)
-		if !ok {
-			client.Close()
-			return fmt.Errorf("Could not extract API key from response")
+			return err
 		}
-
 		fmt.Println("API key successfully generated")
 	}
 
@@ -665,31 +965,203 @@ func loginToHost(cmd *cobra.Command, api core.Session, args []string) error {
 	fmt.Printf("Successfully connected to %s\n", url)
 	client.Close()
 
-	// Ensure the config directory exists
-	configDir := path.Dir(configPath)
-	if err := os.MkdirAll(configDir, 0755); err != nil {
-		return fmt.Errorf("Failed to create config directory %s: %v", configDir, err)
+	// The prompts can take a while, so the config is read again under the lock, in case it changed meanwhile
+	unlock, err := lockConfig(configPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if config, err = loadConfig(configPath); err != nil {
+		return err
+	}
+	hosts, _ = config["hosts"].(map[string]interface{})
+	if _, exists := hosts[name]; exists {
+		return fmt.Errorf("A connection with name '%s' was added while logging in", name)
 	}
 
 	// Add or update host entry with URL including API endpoint
 	// Store the complete URL with /api/current path under the name
 	hostConfig := map[string]interface{}{
 		"url":     url, // Using the same URL with /api/current path
-		"api_key": apiKey,
-		"allow_insecure": allowInsecure,
+	}
+	if fingerprint != "" {
+		hostConfig["tls_fingerprint"] = fingerprint
+	}
+	if authMethod == "3" {
+		// The password is never stored
+		hostConfig["username"] = username
+	} else {
+		hostConfig["api_key"] = apiKey
+	}
+	if apiKeyId >= 0 {
+		// Lets "config rotate-key" delete the key once it has been replaced
+		hostConfig["api_key_id"] = apiKeyId
 	}
 	hosts[name] = hostConfig
 
-	// Write the updated config back to file
-	updatedData, err := json.MarshalIndent(config, "", "  ")
+	if err = saveConfig(configPath, config); err != nil {
+		return err
+	}
+
+	fmt.Printf("Configuration for '%s' (connecting to %s) saved to %s\n", name, hostname, configPath)
+	return nil
+}
+
+func rotateApiKey(cmd *cobra.Command, api core.Session, args []string) error {
+	// Note: 'api' parameter will be nil for this command, which is expected
+	name := args[0]
+
+	// Get the config file path
+	configPath := g_configFileName
+	if configPath == "" {
+		configPath = getDefaultConfigPath()
+	}
+
+	unlock, err := lockConfig(configPath)
 	if err != nil {
-		return fmt.Errorf("Failed to serialize config: %v", err)
+		return err
 	}
+	defer unlock()
 
-	if err := os.WriteFile(configPath, updatedData, 0600); err != nil {
-		return fmt.Errorf("Failed to write config to %s: %v", configPath, err)
+	configs, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	hosts, _ := configs["hosts"].(map[string]interface{})
+	profile, _ := hosts[name].(map[string]interface{})
+	if len(profile) == 0 {
+		return fmt.Errorf("Could not find host \"%s\" in config file", name)
 	}
+	hostname, _ := profile["url"].(string)
+	if source := getApiKeySource(profile); source != "" {
+		return fmt.Errorf("The API key of host \"%s\" is read from \"%s\", which has to be updated by hand", name, source)
+	}
+	oldKey, _ := profile["api_key"].(string)
+	if hostname == "" || oldKey == "" {
+		return fmt.Errorf("Host \"%s\" does not have a URL and API key to rotate", name)
+	}
+	oldKeyId, err := getApiKeyId(profile)
+	if err != nil {
+		return err
+	}
+	allowInsecure, _ := profile["allow_insecure"].(bool)
 
-	fmt.Printf("Configuration for '%s' (connecting to %s) saved to %s\n", name, hostname, configPath)
+	cmd.SilenceUsage = true
+
+	url := core.GetApiUrlFromHostName(hostname)
+	client, err := truenas_api.NewClient(url, getTlsTrust(profile, allowInsecure))
+	if err != nil {
+		return fmt.Errorf("Failed to create connection to %s: %v", url, err)
+	}
+	defer client.Close()
+	if err = client.Login("", "", oldKey); err != nil {
+		return fmt.Errorf("Failed to login to %s with the current key: %v", url, err)
+	}
+
+	// The new key belongs to whoever the old one did
+	me, err := callAndGetResult(client, "auth.me", []interface{}{})
+	if err != nil {
+		return err
+	}
+	meMap, _ := me.(map[string]interface{})
+	username, _ := meMap["pw_name"].(string)
+	if username == "" {
+		return fmt.Errorf("Could not determine the user that the current key belongs to")
+	}
+
+	newKey, newKeyId, err := createApiKey(client, username)
+	if err != nil {
+		return err
+	}
+
+	if err = verifyHost(hostname, newKey, "", getTlsTrust(profile, allowInsecure)); err != nil {
+		return errors.Join(err, deleteApiKey(client, newKeyId))
+	}
+
+	profile["api_key"] = newKey
+	profile["api_key_id"] = newKeyId
+	if err = saveConfig(configPath, configs); err != nil {
+		return errors.Join(err, deleteApiKey(client, newKeyId))
+	}
+	fmt.Printf("Configuration for '%s' saved to %s with the new key (id %d)\n", name, configPath, newKeyId)
+
+	if err = deleteApiKey(client, oldKeyId); err != nil {
+		return fmt.Errorf("The old key (id %d) could not be deleted, and should be removed from the host by hand: %v", oldKeyId, err)
+	}
+	fmt.Printf("Deleted the old key (id %d)\n", oldKeyId)
+	return nil
+}
+
+// getApiKeyId returns the id of a host's key, either as recorded when the key was generated, or from the key itself,
+// since TrueNAS keys take the form "<id>-<secret>"
+func getApiKeyId(profile map[string]interface{}) (int64, error) {
+	if idValue, exists := profile["api_key_id"]; exists {
+		if id, ok := idValue.(float64); ok {
+			return int64(id), nil
+		}
+		return -1, fmt.Errorf("\"api_key_id\" was not a number")
+	}
+	apiKey, _ := profile["api_key"].(string)
+	if dash := strings.Index(apiKey, "-"); dash > 0 {
+		if id, err := strconv.ParseInt(apiKey[:dash], 10, 64); err == nil {
+			return id, nil
+		}
+	}
+	return -1, fmt.Errorf("Could not tell the id of the current API key, set \"api_key_id\" in the config")
+}
+
+// makeApiKeyName describes where a generated key is used, so that it can be recognised in the web UI
+func makeApiKeyName() string {
+	node, err := os.Hostname()
+	if err != nil || node == "" {
+		node = "unknown"
+	}
+	return fmt.Sprintf("truenas_incus_ctl on %s, %s", node, time.Now().Format("2006-01-02 15:04:05"))
+}
+
+// createApiKey generates a key for the user on the host the client is logged in to, returning the key and its id
+func createApiKey(client *truenas_api.Client, username string) (string, int64, error) {
+	params := []interface{}{
+		map[string]interface{}{
+			"name":     makeApiKeyName(),
+			"username": username,
+		},
+	}
+	result, err := callAndGetResult(client, "api_key.create", params)
+	if err != nil {
+		return "", -1, fmt.Errorf("Failed to create API key: %v", err)
+	}
+
+	resultMap, _ := result.(map[string]interface{})
+	apiKey, _ := resultMap["key"].(string)
+	id, ok := resultMap["id"].(float64)
+	if apiKey == "" || !ok {
+		return "", -1, fmt.Errorf("Unexpected response format for API key creation")
+	}
+	return apiKey, int64(id), nil
+}
+
+func deleteApiKey(client *truenas_api.Client, id int64) error {
+	if _, err := callAndGetResult(client, "api_key.delete", []interface{}{id}); err != nil {
+		return fmt.Errorf("Failed to delete API key %d: %v", id, err)
+	}
 	return nil
 }
+
+// callAndGetResult makes a call outside of a session, returning its result, or the error reported by the API
+func callAndGetResult(client *truenas_api.Client, method string, params []interface{}) (interface{}, error) {
+	res, err := client.Call(method, 30, params)
+	if err != nil {
+		return nil, err
+	}
+	var response map[string]interface{}
+	if err = json.Unmarshal(res, &response); err != nil {
+		return nil, fmt.Errorf("Failed to parse response to %s: %v", method, err)
+	}
+	if errorData, exists := response["error"]; exists && errorData != nil {
+		apiErr := core.NewApiError(errorData)
+		apiErr.Method = method
+		return nil, fmt.Errorf("%s error:%w", method, apiErr)
+	}
+	return response["result"], nil
+}
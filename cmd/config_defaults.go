@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Flags that are given the same value on every invocation can have a default per host, under "defaults" in the
+// host's entry. Each key is the command's path and the flag's name, eg. "share.iscsi.create.portal": "10.0.0.5:3260".
+// A default is used whenever its flag isn't passed.
+var g_commandDefaults map[string]interface{}
+
+// getCommandPath returns the path of a command as used in "defaults", eg. "share.iscsi.create"
+func getCommandPath(cmd *cobra.Command) string {
+	parts := strings.Fields(cmd.CommandPath())
+	return strings.Join(parts[1:], ".")
+}
+
+// applyCommandDefaults sets the flags of a command that weren't passed to the defaults of the host being connected to.
+// Setting them through the flag set means they're treated exactly as if they'd been passed.
+func applyCommandDefaults(cmd *cobra.Command) error {
+	if len(g_commandDefaults) == 0 {
+		return nil
+	}
+	prefix := getCommandPath(cmd) + "."
+
+	var err error
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || rootCmd.PersistentFlags().Lookup(flag.Name) != nil {
+			return
+		}
+		value, exists := g_commandDefaults[prefix+flag.Name]
+		if !exists {
+			return
+		}
+		if setErr := cmd.Flags().Set(flag.Name, formatDefaultValue(value)); setErr != nil {
+			err = fmt.Errorf("Invalid default \"%s\" in config: %v", prefix+flag.Name, setErr)
+		}
+	})
+	return err
+}
+
+// formatDefaultValue turns a value from config.json into what would be passed on the command line
+func formatDefaultValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		elems := make([]string, 0, len(v))
+		for _, elem := range v {
+			elems = append(elems, formatDefaultValue(elem))
+		}
+		return strings.Join(elems, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// normalizeDefaultKey checks that a key in "defaults" names a flag of an existing command, returning it in canonical
+// form, without aliases and with the flag's name as it's typed on the command line
+func normalizeDefaultKey(key string) (string, error) {
+	lastDot := strings.LastIndex(key, ".")
+	if lastDot <= 0 {
+		return "", fmt.Errorf("Expected <command path>.<flag>, eg. share.iscsi.create.portal, got \"%s\"", key)
+	}
+	target, rest, err := rootCmd.Find(strings.Split(key[:lastDot], "."))
+	if err != nil || len(rest) != 0 || target == rootCmd {
+		return "", fmt.Errorf("No command \"%s\", in \"%s\"", strings.ReplaceAll(key[:lastDot], ".", " "), key)
+	}
+	flagName := strings.ReplaceAll(key[lastDot+1:], "_", "-")
+	if target.Flags().Lookup(flagName) == nil || rootCmd.PersistentFlags().Lookup(flagName) != nil {
+		return "", fmt.Errorf("Command \"%s\" has no --%s flag that can have a default", strings.Join(strings.Fields(target.CommandPath())[1:], " "), flagName)
+	}
+	return getCommandPath(target) + "." + flagName, nil
+}
+
+// editCommandDefaults applies the --set-default and --unset-default flags of config set to a host entry
+func editCommandDefaults(cmd *cobra.Command, profile map[string]interface{}) error {
+	toSet, _ := cmd.Flags().GetStringArray("set-default")
+	toUnset, _ := cmd.Flags().GetStringArray("unset-default")
+	if len(toSet) == 0 && len(toUnset) == 0 {
+		return nil
+	}
+
+	defaults, _ := profile["defaults"].(map[string]interface{})
+	if defaults == nil {
+		defaults = make(map[string]interface{})
+	}
+	for _, key := range toUnset {
+		// Defaults of commands that no longer exist can still be removed
+		if normalized, err := normalizeDefaultKey(key); err == nil {
+			key = normalized
+		}
+		delete(defaults, key)
+	}
+	for _, pair := range toSet {
+		eq := strings.Index(pair, "=")
+		if eq <= 0 {
+			return fmt.Errorf("Expected <command path>.<flag>=<value> in --set-default, got \"%s\"", pair)
+		}
+		key, err := normalizeDefaultKey(pair[:eq])
+		if err != nil {
+			return err
+		}
+		defaults[key] = pair[eq+1:]
+	}
+
+	if len(defaults) == 0 {
+		delete(profile, "defaults")
+	} else {
+		profile["defaults"] = defaults
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestCommandDefaults(t *testing.T) {
+	// A command of its own, since defaults are applied by setting its flags
+	testCmd := &cobra.Command{Use: "defaults-test"}
+	testCmd.Flags().String("portal", ":", "")
+	testCmd.Flags().String("target-prefix", "", "")
+	testCmd.Flags().StringSlice("networks", nil, "")
+	shareCmd.AddCommand(testCmd)
+	defer shareCmd.RemoveCommand(testCmd)
+
+	g_commandDefaults = map[string]interface{}{
+		"share.defaults-test.portal":        "10.0.0.5:3260",
+		"share.defaults-test.target-prefix": "incus",
+		"share.defaults-test.networks":      []interface{}{"10.0.0.0/24", "10.0.1.0/24"},
+		"share.iscsi.create.portal":         "10.0.0.6:3260",
+	}
+	defer func() { g_commandDefaults = nil }()
+
+	expect := func(actual, expected string) {
+		if actual != expected {
+			t.Fatalf("Expected \"%s\", got \"%s\"", expected, actual)
+		}
+	}
+
+	// flags passed on the command line win over the host's defaults
+	FailIf(t, testCmd.Flags().Set("target-prefix", "other"))
+
+	options, err := GetCobraFlags(testCmd, false, nil)
+	FailIf(t, err)
+	expect(options.usedFlags["portal"], "10.0.0.5:3260")
+	expect(options.usedFlags["target_prefix"], "other")
+	expect(options.usedFlags["networks"], "[10.0.0.0/24,10.0.1.0/24]")
+
+	key, err := normalizeDefaultKey("share.iscsi.create.target_prefix")
+	FailIf(t, err)
+	expect(key, "share.iscsi.create.target-prefix")
+	if _, err = normalizeDefaultKey("share.iscsi.create.host"); err == nil {
+		t.Fatal("Expected global flags to be rejected")
+	}
+	if _, err = normalizeDefaultKey("share.iscsi.bogus.portal"); err == nil {
+		t.Fatal("Expected unknown commands to be rejected")
+	}
+}
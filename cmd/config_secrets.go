@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+)
+
+// The ways a host's API key can be given in config.json, besides "api_key" itself:
+//
+//	"api_key_env": "NAS_KEY"                     name of an environment variable holding the key
+//	"api_key_file": "/run/credentials/x/key"     file holding the key, eg. a systemd credential
+//	"api_key_command": "pass show nas/api-key"   shell command that prints the key
+//	"api_key_secret": {"service": "truenas"}     attributes of an item in the Secret Service, looked up with secret-tool
+var g_apiKeySources = []string{"api_key_env", "api_key_file", "api_key_command", "api_key_secret"}
+
+// hasApiKey reports whether a host entry has an API key, either in plain text or from another source
+func hasApiKey(config map[string]interface{}) bool {
+	if _, exists := config["api_key"]; exists {
+		return true
+	}
+	return getApiKeySource(config) != ""
+}
+
+func getApiKeySource(config map[string]interface{}) string {
+	for _, source := range g_apiKeySources {
+		if _, exists := config[source]; exists {
+			return source
+		}
+	}
+	return ""
+}
+
+// resolveApiKey returns the API key of a host entry, reading it from wherever the entry says it's kept
+func resolveApiKey(config map[string]interface{}, fileName string) (string, error) {
+	if _, exists := config["api_key"]; exists {
+		return getNonEmptyStringFromMapAny(config, "api_key", fileName)
+	}
+
+	source := getApiKeySource(config)
+	if source == "" {
+		return "", fmt.Errorf("Could not find \"api_key\" in config \"%s\"", fileName)
+	}
+
+	var key string
+	switch source {
+	case "api_key_secret":
+		attributes, err := getMapFromMapAny(config, source, fileName)
+		if err != nil {
+			return "", err
+		}
+		if key, err = lookupSecretService(attributes); err != nil {
+			return "", err
+		}
+	default:
+		value, err := getNonEmptyStringFromMapAny(config, source, fileName)
+		if err != nil {
+			return "", err
+		}
+		switch source {
+		case "api_key_env":
+			key = os.Getenv(value)
+			if key == "" {
+				return "", fmt.Errorf("Environment variable %s, named by \"api_key_env\" in config \"%s\", was not set", value, fileName)
+			}
+		case "api_key_file":
+			data, err := os.ReadFile(value)
+			if err != nil {
+				return "", fmt.Errorf("Failed to read API key from %s: %v", value, err)
+			}
+			key = string(data)
+		case "api_key_command":
+			out, errOut, err := core.RunCommandRaw("sh", "-c", value)
+			if err != nil {
+				return "", fmt.Errorf("API key command \"%s\" failed: %v\n%s", value, err, strings.TrimSpace(errOut))
+			}
+			key = out
+		}
+	}
+
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", fmt.Errorf("The API key given by \"%s\" in config \"%s\" was empty", source, fileName)
+	}
+	return key, nil
+}
+
+// lookupSecretService finds a secret in the freedesktop Secret Service (eg. GNOME Keyring or KWallet) over D-Bus,
+// by way of secret-tool from libsecret. The key can be stored with eg. `secret-tool store --label=nas service truenas host nas`.
+func lookupSecretService(attributes map[string]interface{}) (string, error) {
+	if len(attributes) == 0 {
+		return "", fmt.Errorf("\"api_key_secret\" needs at least one attribute to look up")
+	}
+	args := []string{"lookup"}
+	for _, attr := range core.GetKeysSorted(attributes) {
+		args = append(args, attr, fmt.Sprint(attributes[attr]))
+	}
+	out, errOut, err := core.RunCommandRaw("secret-tool", args...)
+	if err != nil {
+		return "", fmt.Errorf("Failed to look up API key in the Secret Service (secret-tool %s): %v\n%s",
+			strings.Join(args, " "), err, strings.TrimSpace(errOut))
+	}
+	return out, nil
+}
+
+// parseSecretAttributes parses the value of --api-key-secret, eg. "service=truenas,host=nas"
+func parseSecretAttributes(value string) (map[string]interface{}, error) {
+	attributes := make(map[string]interface{})
+	for _, pair := range strings.Split(value, ",") {
+		eq := strings.Index(pair, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("Expected attribute=value in --api-key-secret, got \"%s\"", pair)
+		}
+		attributes[strings.TrimSpace(pair[:eq])] = strings.TrimSpace(pair[eq+1:])
+	}
+	return attributes, nil
+}
+
+// setApiKeySource replaces however a host entry's key was given with the one passed to config add/set, if any.
+// Returns false if none of the key flags were passed.
+func setApiKeySource(profile map[string]interface{}, flags map[string]string) (bool, error) {
+	var source string
+	var value interface{}
+	for _, key := range append([]string{"api_key", "username"}, g_apiKeySources...) {
+		if flags[key] == "" {
+			continue
+		}
+		if source != "" {
+			return false, fmt.Errorf("Only one of --%s and --%s can be given",
+				strings.ReplaceAll(source, "_", "-"), strings.ReplaceAll(key, "_", "-"))
+		}
+		source = key
+		value = flags[key]
+	}
+	if source == "" {
+		return false, nil
+	}
+	if source == "api_key_secret" {
+		attributes, err := parseSecretAttributes(flags[source])
+		if err != nil {
+			return false, err
+		}
+		value = attributes
+	}
+
+	for _, key := range append([]string{"api_key", "api_key_id", "username"}, g_apiKeySources...) {
+		delete(profile, key)
+	}
+	profile[source] = value
+	return true, nil
+}
+
+// redactConfig returns a copy of the config with plain text keys hidden. Where keys come from is left visible.
+func redactConfig(configs map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(configs))
+	for k, v := range configs {
+		out[k] = v
+	}
+	hosts, ok := configs["hosts"].(map[string]interface{})
+	if !ok {
+		return out
+	}
+	redactedHosts := make(map[string]interface{}, len(hosts))
+	for name, hostObj := range hosts {
+		host, ok := hostObj.(map[string]interface{})
+		if !ok {
+			redactedHosts[name] = hostObj
+			continue
+		}
+		redacted := make(map[string]interface{}, len(host))
+		for k, v := range host {
+			if k == "api_key" {
+				v = core.REDACTED_STRING
+			}
+			redacted[k] = v
+		}
+		redactedHosts[name] = redacted
+	}
+	out["hosts"] = redactedHosts
+	return out
+}
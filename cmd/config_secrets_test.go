@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestResolveApiKey(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "key")
+	FailIf(t, os.WriteFile(keyFile, []byte("from-file\n"), 0600))
+	t.Setenv("TNC_TEST_KEY", "from-env")
+
+	cases := []struct {
+		config   map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"api_key": "plain"}, "plain"},
+		{map[string]interface{}{"api_key_env": "TNC_TEST_KEY"}, "from-env"},
+		{map[string]interface{}{"api_key_file": keyFile}, "from-file"},
+		{map[string]interface{}{"api_key_command": "echo from-command"}, "from-command"},
+	}
+	for _, c := range cases {
+		key, err := resolveApiKey(c.config, "config.json")
+		FailIf(t, err)
+		if key != c.expected {
+			t.Fatalf("Expected \"%s\", got \"%s\"", c.expected, key)
+		}
+	}
+
+	if _, err := resolveApiKey(map[string]interface{}{"api_key_env": "TNC_TEST_UNSET"}, "config.json"); err == nil {
+		t.Fatal("Expected an error for an unset environment variable")
+	}
+	if _, err := resolveApiKey(map[string]interface{}{"api_key_command": "true"}, "config.json"); err == nil {
+		t.Fatal("Expected an error for a command with no output")
+	}
+}
+
+func TestSetApiKeySource(t *testing.T) {
+	profile := map[string]interface{}{"url": "nas", "api_key": "old", "api_key_id": 5.0}
+	changed, err := setApiKeySource(profile, map[string]string{"api_key_secret": "service=truenas, host=nas"})
+	FailIf(t, err)
+	if !changed || len(profile) != 2 {
+		t.Fatalf("Expected only url and api_key_secret, got %v", profile)
+	}
+	attributes, _ := profile["api_key_secret"].(map[string]interface{})
+	if attributes["service"] != "truenas" || attributes["host"] != "nas" {
+		t.Fatalf("Unexpected attributes %v", attributes)
+	}
+
+	if _, err = setApiKeySource(profile, map[string]string{"api_key": "a", "api_key_file": "b"}); err == nil {
+		t.Fatal("Expected an error when two key sources are given")
+	}
+
+	redacted := redactConfig(map[string]interface{}{"hosts": map[string]interface{}{"nas": map[string]interface{}{"api_key": "secret"}}})
+	if redacted["hosts"].(map[string]interface{})["nas"].(map[string]interface{})["api_key"] != "********" {
+		t.Fatalf("Expected the API key to be redacted, got %v", redacted)
+	}
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentConfigUpdates(t *testing.T) {
+	configPath := path.Join(t.TempDir(), "config.json")
+	// A config left world-readable by an older version is tightened on the next save
+	FailIf(t, os.WriteFile(configPath, []byte(`{"hosts":{}}`), 0644))
+
+	const count = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			unlock, err := lockConfig(configPath)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer unlock()
+			configs, err := loadConfig(configPath)
+			if err != nil {
+				errs <- err
+				return
+			}
+			hosts := configs["hosts"].(map[string]interface{})
+			hosts[fmt.Sprint("host", i)] = map[string]interface{}{"url": fmt.Sprint("nas", i), "api_key": "key"}
+			errs <- saveConfig(configPath, configs)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		FailIf(t, err)
+	}
+
+	configs, err := loadConfig(configPath)
+	FailIf(t, err)
+	hosts := configs["hosts"].(map[string]interface{})
+	if len(hosts) != count {
+		t.Fatalf("Expected %d hosts, found %d", count, len(hosts))
+	}
+
+	info, err := os.Stat(configPath)
+	FailIf(t, err)
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("Expected config permissions 0600, got %v", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon [socket path]",
+	Short: "Run or inspect the connection caching daemon",
+	Long: "Run the connection caching daemon, listening on the given socket path, or the default path if none is given.\n" +
+		"When started by systemd socket activation, the socket passed by systemd is used instead.",
+	Args: cobra.MaximumNArgs(1),
+	Run:  runDaemon,
+}
+
+var daemonStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Print the connections held by the running daemon",
+	Args:  cobra.NoArgs,
+}
+
+var daemonStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stop the running daemon once its in-flight requests have finished",
+	Args:  cobra.NoArgs,
+}
+
+var daemonRestartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Stop the running daemon once its in-flight requests have finished, then launch a new one",
+	Args:  cobra.NoArgs,
+}
+
+var daemonInstallUnitsCmd = &cobra.Command{
+	Use:   "install-units",
+	Short: "Write systemd user units that start the daemon on demand through socket activation",
+	Args:  cobra.NoArgs,
+}
+
+var g_daemonStatusEnums map[string][]string
+
+func init() {
+	daemonStatusCmd.RunE = WrapCommandFuncWithoutApi(getDaemonStatus)
+	daemonStopCmd.RunE = WrapCommandFuncWithoutApi(stopOrRestartDaemon)
+	daemonRestartCmd.RunE = WrapCommandFuncWithoutApi(stopOrRestartDaemon)
+	daemonInstallUnitsCmd.RunE = WrapCommandFuncWithoutApi(installDaemonUnits)
+
+	daemonCmd.Flags().StringP("timeout", "t", "", "Exit the daemon if no communication occurs after this duration")
+	daemonCmd.Flags().String("heartbeat", core.DEFAULT_HEARTBEAT_INTERVAL, "Interval between keepalive pings on each connection, 0 to disable")
+	daemonCmd.Flags().String("job-retention", core.DEFAULT_JOB_RETENTION, "How long to keep the results of finished jobs that haven't been awaited")
+	daemonCmd.Flags().String("metrics-listen", "", "Serve Prometheus metrics at /metrics on this address, eg. 127.0.0.1:9464")
+	daemonCmd.Flags().String("query-cache-ttl", "", "Cache the results of *.query calls for this duration, eg. 2s. Disabled by default")
+	daemonCmd.Flags().String("audit-log", "", "File to append a record of each mutating call to, defaults to ~/.truenas_incus_ctl/audit.log")
+	daemonCmd.Flags().Bool("no-audit-log", false, "Don't record mutating calls")
+	daemonCmd.Flags().Int("max-calls-per-connection", core.DEFAULT_MAX_CALLS_PER_CONN, "Number of concurrent calls to send over one connection before opening another")
+
+	daemonStatusCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	daemonStatusCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	daemonStatusCmd.Flags().String("format", "table", "Output table format "+
+		AddFlagsEnum(&g_daemonStatusEnums, "format", []string{"csv", "json", "table", "compact"}))
+
+	_daemonStopCommands := []*cobra.Command{daemonStopCmd, daemonRestartCmd}
+	for _, c := range _daemonStopCommands {
+		c.Flags().String("deadline", core.DEFAULT_STOP_DEADLINE, "How long to wait for in-flight requests and jobs before closing their connections")
+	}
+
+	daemonInstallUnitsCmd.Flags().String("dir", "", "Directory to write the units to, defaults to $XDG_CONFIG_HOME/systemd/user")
+	daemonInstallUnitsCmd.Flags().StringP("timeout", "t", "180s", "Exit the daemon if no communication occurs after this duration, 0 to keep it running")
+	daemonInstallUnitsCmd.Flags().String("query-cache-ttl", "", "Passed on to the daemon, see \"daemon --help\"")
+	daemonInstallUnitsCmd.Flags().Bool("stdout", false, "Print the units instead of writing them")
+
+	daemonCmd.AddCommand(daemonInstallUnitsCmd)
+	daemonCmd.AddCommand(daemonStatusCmd)
+	daemonCmd.AddCommand(daemonStopCmd)
+	daemonCmd.AddCommand(daemonRestartCmd)
+	rootCmd.AddCommand(daemonCmd)
+}
+
+func runDaemon(cmd *cobra.Command, args []string) {
+	var options core.DaemonOptions
+	if f := cmd.Flags().Lookup("timeout"); f != nil {
+		options.Timeout = f.Value.String()
+	}
+	options.MaxCallsPerConn, _ = cmd.Flags().GetInt("max-calls-per-connection")
+	options.HeartbeatInterval, _ = cmd.Flags().GetString("heartbeat")
+	options.JobRetention, _ = cmd.Flags().GetString("job-retention")
+	options.MetricsListen, _ = cmd.Flags().GetString("metrics-listen")
+	options.QueryCacheTTL, _ = cmd.Flags().GetString("query-cache-ttl")
+	if noAudit, _ := cmd.Flags().GetBool("no-audit-log"); !noAudit {
+		options.AuditLog, _ = cmd.Flags().GetString("audit-log")
+		if options.AuditLog == "" {
+			options.AuditLog = getDefaultAuditLogPath()
+		}
+	}
+
+	// The path is ignored when the socket is passed by systemd
+	serverSockAddr := getDaemonSocketPath()
+	if len(args) > 0 {
+		serverSockAddr = args[0]
+	}
+	if serverSockAddr == "" {
+		log.Fatal("Error: path to server socket was not provided")
+	}
+	core.RunDaemon(serverSockAddr, options)
+}
+
+func getDaemonStatus(cmd *cobra.Command, _ core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_daemonStatusEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	api := &core.ClientSession{
+		SocketPath: getDaemonSocketPath(),
+		IsDebug:    g_debug,
+	}
+	if err = api.ConnectToExistingDaemon(); err != nil {
+		return err
+	}
+
+	data, err := api.CallDaemon("status", nil)
+	if err != nil {
+		return err
+	}
+
+	var results []map[string]interface{}
+	if err = json.Unmarshal(data, &results); err != nil {
+		return fmt.Errorf("Could not parse daemon status: %v", err)
+	}
+	for _, r := range results {
+		r["id"] = fmt.Sprintf("%v/%v", r["host"], r["channel"])
+	}
+
+	columnsList := []string{"host", "channel", "state", "connected_since", "calls_in_flight", "pending_calls", "pending_jobs", "retained_jobs", "idle_remaining"}
+	str, err := core.BuildTableData(format, "connections", columnsList, results)
+	PrintTable(api, str)
+	return err
+}
+
+func stopOrRestartDaemon(cmd *cobra.Command, _ core.Session, args []string) error {
+	cmdType := strings.Split(cmd.Use, " ")[0]
+
+	options, _ := GetCobraFlags(cmd, false, nil)
+	deadlineStr := options.allFlags["deadline"]
+	deadline, err := time.ParseDuration(deadlineStr)
+	if err != nil {
+		return fmt.Errorf("Could not parse --deadline \"%s\": %v", deadlineStr, err)
+	}
+
+	cmd.SilenceUsage = true
+
+	api := &core.ClientSession{
+		SocketPath: getDaemonSocketPath(),
+		IsDebug:    g_debug,
+	}
+
+	// A restart keeps the options of the daemon it replaces. If none was running, use the same timeout as Login()
+	daemonOptions := core.DaemonOptions{
+		Timeout:  (time.Duration(180) * time.Second).String(),
+		AuditLog: getDefaultAuditLogPath(),
+	}
+	if err = api.ConnectToExistingDaemon(); err != nil {
+		if cmdType == "stop" {
+			fmt.Println(err)
+			return nil
+		}
+	} else {
+		daemonOptions, err = api.StopDaemon(deadline)
+		if err != nil {
+			return err
+		}
+		if cmdType == "stop" {
+			fmt.Println("tncdaemon stopped")
+			return nil
+		}
+	}
+
+	// A socket that outlives the daemon belongs to systemd, which starts a new daemon on the next connection
+	if err = api.ConnectToExistingDaemon(); err == nil {
+		fmt.Println("tncdaemon restarted")
+		return nil
+	}
+	if err = api.LaunchDaemon(daemonOptions); err != nil {
+		return err
+	}
+	fmt.Println("tncdaemon restarted")
+	return nil
+}
+
+const daemonSocketUnit = `[Unit]
+Description=truenas_incus_ctl connection caching daemon socket
+
+[Socket]
+ListenStream=%t/tncdaemon.sock
+SocketMode=0600
+
+[Install]
+WantedBy=sockets.target
+`
+
+const daemonServiceUnit = `[Unit]
+Description=truenas_incus_ctl connection caching daemon
+Requires=tncdaemon.socket
+After=tncdaemon.socket
+
+[Service]
+ExecStart=%s
+`
+
+// joinSystemdCommandLine writes a command line for ExecStart=. Words that contain anything unusual are quoted, and
+// "%" and "$" are escaped, so that systemd passes them on as they are rather than expanding them (see systemd.service(5)).
+func joinSystemdCommandLine(args []string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	words := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._-+=:,@") == "" {
+			words = append(words, arg)
+		} else {
+			words = append(words, `"`+escaper.Replace(arg)+`"`)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// installDaemonUnits writes tncdaemon.socket and tncdaemon.service, so that systemd owns the daemon's socket
+// and starts the daemon when a client connects. Clients find the socket at the same default path ($XDG_RUNTIME_DIR),
+// so they never need to launch the daemon themselves.
+func installDaemonUnits(cmd *cobra.Command, _ core.Session, args []string) error {
+	options, _ := GetCobraFlags(cmd, false, nil)
+
+	timeoutStr := options.allFlags["timeout"]
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		return fmt.Errorf("Could not parse --timeout \"%s\": %v", timeoutStr, err)
+	}
+
+	cmd.SilenceUsage = true
+
+	thisExec, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if thisExec, err = filepath.EvalSymlinks(thisExec); err != nil {
+		return err
+	}
+
+	execStart := []string{thisExec, "daemon"}
+	if timeout > 0 {
+		execStart = append(execStart, "-t", timeout.String())
+	}
+	if ttl := options.allFlags["query_cache_ttl"]; ttl != "" {
+		if _, err = time.ParseDuration(ttl); err != nil {
+			return fmt.Errorf("Could not parse --query-cache-ttl \"%s\": %v", ttl, err)
+		}
+		execStart = append(execStart, "--query-cache-ttl", ttl)
+	}
+	units := map[string]string{
+		"tncdaemon.socket":  daemonSocketUnit,
+		"tncdaemon.service": fmt.Sprintf(daemonServiceUnit, joinSystemdCommandLine(execStart)),
+	}
+
+	if core.IsStringTrue(options.allFlags, "stdout") {
+		for _, name := range core.GetKeysSorted(units) {
+			fmt.Println("# " + name)
+			fmt.Println(units[name])
+		}
+		return nil
+	}
+
+	dir := options.allFlags["dir"]
+	if dir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return err
+		}
+		dir = path.Join(configDir, "systemd", "user")
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range core.GetKeysSorted(units) {
+		fileName := path.Join(dir, name)
+		if err = os.WriteFile(fileName, []byte(units[name]), 0644); err != nil {
+			return err
+		}
+		fmt.Println("Wrote", fileName)
+	}
+
+	fmt.Println("To start listening, run:")
+	fmt.Println("  systemctl --user daemon-reload")
+	fmt.Println("  systemctl --user enable --now tncdaemon.socket")
+	return nil
+}
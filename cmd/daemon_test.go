@@ -0,0 +1,17 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestJoinSystemdCommandLine(t *testing.T) {
+	expected := `"/home/me/My Tools/truenas_incus_ctl" daemon -t 3m0s`
+	if got := joinSystemdCommandLine([]string{"/home/me/My Tools/truenas_incus_ctl", "daemon", "-t", "3m0s"}); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+
+	expected = `"/opt/100%% \"real\" \\ $$HOME" ""`
+	if got := joinSystemdCommandLine([]string{`/opt/100% "real" \ $HOME`, ""}); got != expected {
+		t.Fatalf("Expected %s, got %s", expected, got)
+	}
+}
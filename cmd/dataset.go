@@ -154,6 +154,7 @@ func init() {
 	datasetDeleteCmd.Flags().BoolP("recursive", "r", false, "Also delete/destroy all children datasets. When the root dataset is specified,\n"+
 		"it will destroy all the children of the root dataset present leaving root dataset intact")
 	datasetDeleteCmd.Flags().BoolP("force", "f", false, "Force delete busy datasets")
+	AddProgressFlags(datasetDeleteCmd)
 	datasetDeleteCmd.Flags().Bool("no-smart-timeout", false, "Disable performing a recursive list on the dataset to determine a suitable deletion timeout")
 
 	datasetListCmd.Flags().BoolP("recursive", "r", false, "Retrieves properties for children")
@@ -342,6 +343,14 @@ func deleteDataset(cmd *cobra.Command, api core.Session, args []string) error {
 	options, _ := GetCobraFlags(cmd, false, nil)
 	timeout := int64(20)
 
+	progress, err := getProgressReporter(api, options)
+	if err != nil {
+		return err
+	}
+	if !core.IsStringTrue(options.allFlags, "recursive") {
+		progress = nil
+	}
+
 	if core.IsStringTrue(options.allFlags, "no_smart_timeout") {
 		RemoveFlag(options, "no_smart_timeout")
 	} else if core.IsStringTrue(options.allFlags, "recursive") {
@@ -361,7 +370,7 @@ func deleteDataset(cmd *cobra.Command, api core.Session, args []string) error {
 	params := BuildNameStrAndPropertiesJson(options, args[0])
 
 	objRemap := map[string][]interface{}{"": core.ToAnyArray(args)}
-	out, _, err := MaybeBulkApiCall(api, "pool.dataset.delete", timeout, params, objRemap, false)
+	out, err := MaybeBulkApiCallWithProgress(api, "pool.dataset.delete", timeout, params, objRemap, false, progress)
 	if err != nil {
 		return err
 	}
@@ -1,7 +1,12 @@
 package cmd
 
 import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
 	"testing"
+	"truenas/truenas_incus_ctl/core"
 )
 
 func TestDatasetCreateWithParentsTrue(t *testing.T) {
@@ -191,6 +196,65 @@ func TestDatasetDeleteRecursiveForce(t *testing.T) {
 	))
 }
 
+// fakeDaemon stands in for tncdaemon on a unix socket, answering each method from responses and keeping the
+// TNC-Timeout header that each method was last called with
+type fakeDaemon struct {
+	responses map[string]string
+	mtx       sync.Mutex
+	timeouts  map[string]string
+}
+
+func startFakeDaemon(t *testing.T, responses map[string]string) (*fakeDaemon, string) {
+	socketPath := filepath.Join(t.TempDir(), "tncdaemon.sock")
+	listener, err := net.Listen("unix", socketPath)
+	FailIf(t, err)
+	d := &fakeDaemon{responses: responses, timeouts: make(map[string]string)}
+	server := &http.Server{Handler: d}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return d, socketPath
+}
+
+func (d *fakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.Header.Get("TNC-Call-Method")
+	switch method {
+	case core.TNC_PREFIX_STRING + "ping":
+		w.Write([]byte("\"pong\""))
+	case core.TNC_PREFIX_STRING + "register":
+		w.Write([]byte("\"handle\""))
+	default:
+		d.mtx.Lock()
+		d.timeouts[method] = r.Header.Get("TNC-Timeout")
+		d.mtx.Unlock()
+		w.Write([]byte(d.responses[method]))
+	}
+}
+
+func (d *fakeDaemon) timeoutOf(method string) string {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.timeouts[method]
+}
+
+func TestDatasetDeleteRecursiveTimeoutWithProgress(t *testing.T) {
+	daemon, socketPath := startFakeDaemon(t, map[string]string{
+		"pool.dataset.query": "{\"jsonrpc\":\"2.0\",\"result\":[{\"id\":\"dozer/testing\",\"name\":\"dozer/testing\"},"+
+			"{\"id\":\"dozer/testing/a\",\"name\":\"dozer/testing/a\"},{\"id\":\"dozer/testing/b\",\"name\":\"dozer/testing/b\"}],\"id\":1}",
+		"pool.dataset.delete": "{\"jsonrpc\":\"2.0\",\"result\":true,\"id\":2}",
+	})
+	api := &core.ClientSession{HostName: "nas", ApiKey: "1-abcdef", SocketPath: socketPath}
+
+	SetAuxCobraFlag(datasetDeleteCmd, "recursive", true)
+	SetAuxCobraFlag(datasetDeleteCmd, "format", "json")
+	defer ResetAuxCobraFlags(datasetDeleteCmd)
+	FailIf(t, deleteDataset(datasetDeleteCmd, api, []string{"dozer/testing"}))
+
+	// Showing progress doesn't lose the timeout that allows for each dataset being deleted
+	if timeout := daemon.timeoutOf("pool.dataset.delete"); timeout != "40s" {
+		t.Fatalf("Expected pool.dataset.delete to be sent with a timeout of 40s, got \"%s\"", timeout)
+	}
+}
+
 func TestDatasetList(t *testing.T) {
 	FailIf(t, DoTest(
 		t,
@@ -285,3 +349,15 @@ func TestDatasetRenameUpdateShares(t *testing.T) {
 		"", // table expected
 	))
 }
+
+func TestDatasetDeleteBulkReplay(t *testing.T) {
+	FailIf(t, DoReplayTest(
+		t,
+		datasetDeleteCmd,
+		deleteDataset,
+		map[string]interface{}{"recursive":true},
+		[]string{"dozer/testing/test4","dozer/testing/test5"},
+		"testdata/dataset_delete_bulk.json",
+		"",
+	))
+}
@@ -0,0 +1,440 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+	"truenas/truenas_incus_ctl/fake_middleware"
+)
+
+// When this is set, the test binary runs the CLI instead of the tests. The end-to-end tests run each command this way,
+// and so the daemon that the command launches is this binary too.
+const ENV_E2E_RUN_CLI = "TNC_E2E_RUN_CLI"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(ENV_E2E_RUN_CLI) == "1" {
+		Execute()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type e2eEnv struct {
+	t      *testing.T
+	fm     *fake_middleware.Server
+	home   string
+	socket string
+}
+
+// startE2E starts a fake middleware, and stops it and the daemon launched by the first command once the test is done
+func startE2E(t *testing.T) *e2eEnv {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in short mode")
+	}
+	dir := t.TempDir()
+	env := &e2eEnv{
+		t:      t,
+		fm:     fake_middleware.Start(),
+		home:   dir,
+		socket: filepath.Join(dir, "tncdaemon.sock"),
+	}
+	t.Cleanup(func() {
+		if _, err := os.Stat(env.socket); err == nil {
+			_, _ = env.run("daemon", "stop", "--deadline", "2s")
+		}
+		env.fm.Close()
+	})
+	return env
+}
+
+// command prepares the CLI to run with the given arguments against the fake middleware
+func (env *e2eEnv) command(args ...string) *exec.Cmd {
+	cmdArgs := []string{
+		"--host", env.fm.URL(),
+		"--api-key", fake_middleware.DEFAULT_API_KEY,
+		"--daemon-socket", env.socket,
+		"-F", filepath.Join(env.home, "config.json"),
+	}
+	c := exec.Command(os.Args[0], append(cmdArgs, args...)...)
+	c.Env = append(os.Environ(), ENV_E2E_RUN_CLI+"=1", "HOME="+env.home, "XDG_RUNTIME_DIR="+env.home)
+	return c
+}
+
+// run runs the CLI with the given arguments against the fake middleware, returning its stdout, or its stderr as an
+// error if it fails
+func (env *e2eEnv) run(args ...string) (string, error) {
+	c := env.command(args...)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return stdout.String(), &e2eError{strings.TrimSpace(stderr.String() + stdout.String())}
+	}
+	return stdout.String(), nil
+}
+
+func (env *e2eEnv) mustRun(args ...string) string {
+	env.t.Helper()
+	out, err := env.run(args...)
+	if err != nil {
+		env.t.Fatalf("%s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+// query returns the objects of a collection in the fake middleware's model, by name
+func (env *e2eEnv) query(method string, filters ...interface{}) []interface{} {
+	env.t.Helper()
+	if filters == nil {
+		filters = []interface{}{}
+	}
+	result, err := env.fm.Call(method, filters)
+	FailIf(env.t, err)
+	list, _ := result.([]interface{})
+	return list
+}
+
+func (env *e2eEnv) exists(method string, key string, value interface{}) bool {
+	env.t.Helper()
+	return len(env.query(method, []interface{}{key, "=", value})) > 0
+}
+
+type e2eError struct {
+	output string
+}
+
+func (e *e2eError) Error() string {
+	return e.output
+}
+
+func expectLines(t *testing.T, out string, expected ...string) {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines, got %d:\n%s", len(expected), len(lines), out)
+	}
+	for i := range lines {
+		if strings.Join(strings.Fields(lines[i]), " ") != expected[i] {
+			t.Fatalf("Line %d: expected \"%s\", got \"%s\"", i+1, expected[i], lines[i])
+		}
+	}
+}
+
+func TestE2EDatasets(t *testing.T) {
+	env := startE2E(t)
+
+	env.mustRun("dataset", "create", "--comments", "first", "tank/e2e")
+	env.mustRun("dataset", "create", "-V", "1G", "tank/e2e/vol")
+	env.mustRun("dataset", "create", "-p", "tank/e2e/a/b")
+
+	out := env.mustRun("dataset", "list", "-r", "-c", "-o", "name,type", "tank/e2e")
+	expectLines(t, out,
+		"tank/e2e filesystem",
+		"tank/e2e/a filesystem",
+		"tank/e2e/a/b filesystem",
+		"tank/e2e/vol volume",
+	)
+
+	env.mustRun("dataset", "update", "--comments", "second", "tank/e2e")
+	out = env.mustRun("dataset", "list", "-c", "-o", "name,comments", "tank/e2e")
+	expectLines(t, out, "tank/e2e second")
+
+	if _, err := env.run("dataset", "create", "tank/e2e"); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("Expected creating an existing dataset to fail, got %v", err)
+	}
+
+	env.mustRun("dataset", "rename", "tank/e2e/a", "tank/e2e/c")
+	if !env.exists("pool.dataset.query", "id", "tank/e2e/c/b") || env.exists("pool.dataset.query", "id", "tank/e2e/a") {
+		t.Fatal("Expected tank/e2e/a to be renamed along with its children")
+	}
+
+	// Deleting several datasets at once goes through core.bulk, which the daemon waits on as a job
+	env.mustRun("dataset", "delete", "-r", "tank/e2e/c", "tank/e2e/vol")
+	if env.fm.CallCount("core.bulk") == 0 {
+		t.Fatal("Expected the datasets to be deleted with core.bulk")
+	}
+	out = env.mustRun("dataset", "list", "-r", "-c", "-o", "name", "tank/e2e")
+	expectLines(t, out, "tank/e2e")
+
+	// A single dataset is deleted with a direct call rather than a core.bulk job, even while showing progress
+	bulkCalls := env.fm.CallCount("core.bulk")
+	if _, err := env.run("dataset", "delete", "-r", "--format", "json", "tank/missing"); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("Expected deleting a missing dataset to fail, got %v", err)
+	}
+	env.mustRun("dataset", "delete", "-r", "--format", "json", "tank/e2e")
+	if env.exists("pool.dataset.query", "id", "tank/e2e") || env.fm.CallCount("core.bulk") != bulkCalls {
+		t.Fatal("Expected tank/e2e to be deleted without core.bulk")
+	}
+
+	// Every command after the first should have reused the daemon's connection
+	if n := env.fm.CallCount("auth.login_with_api_key"); n != 1 {
+		t.Fatalf("Expected the daemon to log in once, got %d", n)
+	}
+}
+
+func TestE2ESnapshots(t *testing.T) {
+	env := startE2E(t)
+
+	env.mustRun("dataset", "create", "tank/snaps")
+	env.mustRun("snapshot", "create", "tank/snaps@one")
+	env.mustRun("snapshot", "create", "tank/snaps@two")
+
+	out := env.mustRun("snapshot", "list", "-c", "-o", "name", "tank/snaps")
+	expectLines(t, out, "tank/snaps@one", "tank/snaps@two")
+
+	env.mustRun("snapshot", "rename", "tank/snaps@two", "tank/snaps@three")
+	env.mustRun("snapshot", "clone", "tank/snaps@one", "tank/clone")
+	if !env.exists("pool.dataset.query", "id", "tank/clone") {
+		t.Fatal("Expected tank/clone to be created")
+	}
+
+	if _, err := env.run("snapshot", "delete", "tank/snaps@one"); err == nil {
+		t.Fatal("Expected deleting a snapshot with a clone to fail")
+	}
+	env.mustRun("dataset", "delete", "tank/clone")
+	env.mustRun("snapshot", "rollback", "-r", "tank/snaps@one")
+	out = env.mustRun("snapshot", "list", "-c", "-o", "name", "tank/snaps")
+	expectLines(t, out, "tank/snaps@one")
+
+	env.mustRun("snapshot", "delete", "tank/snaps@one")
+	if len(env.query("zfs.snapshot.query")) != 0 {
+		t.Fatal("Expected every snapshot to be deleted")
+	}
+}
+
+func TestE2ENfs(t *testing.T) {
+	env := startE2E(t)
+
+	env.mustRun("dataset", "create", "tank/exports")
+	env.mustRun("share", "nfs", "create", "--comment", "e2e", "tank/exports")
+	if !env.exists("sharing.nfs.query", "path", "/mnt/tank/exports") {
+		t.Fatal("Expected an NFS share for /mnt/tank/exports")
+	}
+
+	out := env.mustRun("share", "nfs", "list", "-c", "-o", "path,comment")
+	expectLines(t, out, "/mnt/tank/exports e2e")
+
+	env.mustRun("share", "nfs", "update", "--ro", "tank/exports")
+	shares := env.query("sharing.nfs.query")
+	if len(shares) != 1 || shares[0].(map[string]interface{})["ro"] != true {
+		t.Fatalf("Expected the share to be read-only, got %v", shares)
+	}
+
+	env.mustRun("share", "nfs", "delete", "tank/exports")
+	if len(env.query("sharing.nfs.query")) != 0 {
+		t.Fatal("Expected the NFS share to be deleted")
+	}
+}
+
+func TestE2EIscsi(t *testing.T) {
+	env := startE2E(t)
+
+	env.mustRun("dataset", "create", "-V", "1G", "tank/vols/disk0", "-p")
+	env.mustRun("share", "iscsi", "create", "tank/vols/disk0")
+	if len(env.query("iscsi.target.query")) != 1 || len(env.query("iscsi.extent.query")) != 1 ||
+		len(env.query("iscsi.targetextent.query")) != 1 {
+		t.Fatal("Expected a target, an extent and an association between them")
+	}
+
+	out := env.mustRun("share", "iscsi", "extent", "list", "-c", "-o", "disk")
+	expectLines(t, out, "zvol/tank/vols/disk0")
+
+	// Logging in to the target needs iscsiadm, so tear it down through the crud commands instead
+	env.mustRun("share", "iscsi", "extent", "delete", "zvol/tank/vols/disk0")
+	if len(env.query("iscsi.extent.query")) != 0 || len(env.query("iscsi.targetextent.query")) != 0 {
+		t.Fatal("Expected the extent and its association to be deleted")
+	}
+}
+
+func TestE2EServices(t *testing.T) {
+	env := startE2E(t)
+
+	env.mustRun("service", "start", "nfs")
+	if !env.exists("service.query", "service", "nfs") || !env.exists("service.query", "state", "RUNNING") {
+		t.Fatal("Expected the nfs service to be running")
+	}
+	env.mustRun("service", "stop", "nfs")
+	if env.exists("service.query", "state", "RUNNING") {
+		t.Fatal("Expected the nfs service to be stopped")
+	}
+}
+
+func TestE2ERecordReplay(t *testing.T) {
+	env := startE2E(t)
+	recording := filepath.Join(env.home, "delete.json")
+
+	env.mustRun("dataset", "create", "-p", "tank/rec/a", "tank/rec/b")
+	env.mustRun("--record", recording, "dataset", "delete", "tank/rec/a", "tank/rec/b")
+
+	data, err := os.ReadFile(recording)
+	FailIf(t, err)
+	if strings.Contains(string(data), fake_middleware.DEFAULT_API_KEY) {
+		t.Fatal("Expected the API key to be left out of the recording")
+	}
+
+	// The datasets are gone from the fake middleware, so replaying the recording is the only way this can pass
+	FailIf(t, DoReplayTest(t, datasetDeleteCmd, deleteDataset, map[string]interface{}{}, []string{"tank/rec/a", "tank/rec/b"}, recording, ""))
+
+	// A command that makes different calls doesn't match the recording
+	if DoReplayTest(t, datasetDeleteCmd, deleteDataset, map[string]interface{}{}, []string{"tank/rec/a"}, recording, "") == nil {
+		t.Fatal("Expected replaying a different command to fail")
+	}
+}
+
+func TestE2EApi(t *testing.T) {
+	env := startE2E(t)
+
+	out := env.mustRun("api", "call", "pool.dataset.create", `{"name":"tank/api","comments":"raw"}`)
+	if !strings.Contains(out, `"id":"tank/api"`) {
+		t.Fatalf("Expected the created dataset, got %s", out)
+	}
+
+	out = env.mustRun("api", "call", "-c", "-o", "id,type", "pool.dataset.query", `[["id","=","tank/api"]]`)
+	expectLines(t, out, "tank/api FILESYSTEM")
+
+	out = env.mustRun("api", "call", "--job", "core.bulk", "pool.dataset.delete", `[["tank/api"]]`)
+	if !strings.Contains(out, `"error":null`) || env.exists("pool.dataset.query", "id", "tank/api") {
+		t.Fatalf("Expected the bulk delete to succeed, got %s", out)
+	}
+	if _, err := env.run("api", "call", "--job", "pool.dataset.query"); err == nil {
+		t.Fatal("Expected --job to fail for a method that doesn't start a job")
+	}
+
+	out = env.mustRun("api", "methods", "-c", "pool.dataset.c")
+	expectLines(t, out, "pool.dataset.create false -")
+
+	// Stream the next dataset event, once the daemon has subscribed to datasets on the command's behalf
+	subscribed := func() bool {
+		for _, call := range env.fm.Calls() {
+			if call.Method == "core.subscribe" && len(call.Params) > 0 && call.Params[0] == "pool.dataset.query" {
+				return true
+			}
+		}
+		return false
+	}
+	c := env.command("api", "subscribe", "-n", "1", "pool.dataset.query")
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+	FailIf(t, c.Start())
+	for i := 0; i < 100 && !subscribed(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	_, err := env.fm.Call("pool.dataset.create", map[string]interface{}{"name": "tank/sub"})
+	FailIf(t, err)
+	FailIf(t, c.Wait())
+
+	var event map[string]interface{}
+	FailIf(t, json.Unmarshal(stdout.Bytes(), &event))
+	if event["msg"] != "added" || event["id"] != "tank/sub" {
+		t.Fatalf("Expected an added event for tank/sub, got %s", stdout.String())
+	}
+}
+
+func TestE2EJobs(t *testing.T) {
+	env := startE2E(t)
+
+	env.mustRun("dataset", "create", "-p", "tank/jobs/a", "tank/jobs/b", "tank/jobs/c")
+
+	// --async leaves the job running and prints its id. The job is held until the command has exited, so it can only
+	// have exited without waiting for the job.
+	release := env.fm.HoldJobs()
+	defer release()
+	jobId := strings.TrimSpace(env.mustRun("--async", "dataset", "delete", "tank/jobs/a", "tank/jobs/b"))
+	if !env.exists("pool.dataset.query", "id", "tank/jobs/a") {
+		t.Fatal("Expected --async to return before the datasets were deleted")
+	}
+	// The earlier bulk create is listed too, ahead of the delete
+	out := env.mustRun("job", "list", "-c", "-o", "id,method", "--method", "core.bulk")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 || lines[1] != jobId+"\tcore.bulk" {
+		t.Fatalf("Expected two core.bulk jobs, the last being %s, got:\n%s", jobId, out)
+	}
+
+	release()
+	out = env.mustRun("job", "wait", "-c", jobId)
+	expectLines(t, out, jobId+" core.bulk SUCCESS -")
+	if env.exists("pool.dataset.query", "id", "tank/jobs/a") || env.exists("pool.dataset.query", "id", "tank/jobs/b") {
+		t.Fatal("Expected the datasets to be deleted once the job finished")
+	}
+	out = env.mustRun("job", "show", jobId)
+	if !strings.Contains(out, "state:          SUCCESS") || !strings.Contains(out, "percent:        100%") {
+		t.Fatalf("Expected job show to describe the finished job, got:\n%s", out)
+	}
+
+	// A job that is aborted makes job wait fail. It's held, so that it can't finish before it's aborted.
+	release = env.fm.HoldJobs()
+	defer release()
+	jobId = strings.TrimSpace(env.mustRun("--async", "dataset", "delete", "tank/jobs/c"))
+	env.mustRun("job", "abort", jobId)
+	if _, err := env.run("job", "wait", jobId); err == nil || !strings.Contains(err.Error(), "Job "+jobId+" aborted") {
+		t.Fatalf("Expected waiting for an aborted job to fail, got %v", err)
+	}
+	if !env.exists("pool.dataset.query", "id", "tank/jobs/c") {
+		t.Fatal("Expected the aborted job to leave the dataset")
+	}
+
+	if _, err := env.run("job", "show", "9999"); err == nil || !strings.Contains(err.Error(), "Job 9999 was not found") {
+		t.Fatalf("Expected showing an unknown job to fail, got %v", err)
+	}
+}
+
+func TestE2EApiErrors(t *testing.T) {
+	env := startE2E(t)
+
+	// Validation errors name the flag that caused them, and the traceback is only shown with --debug
+	_, err := env.run("dataset", "create", "--recordsize", "bogus", "tank/bad")
+	if err == nil || !strings.Contains(err.Error(), "\n  --recordsize: ") || strings.Contains(err.Error(), "Traceback") {
+		t.Fatalf("Expected a validation error for --recordsize, got %v", err)
+	}
+	_, err = env.run("--debug", "dataset", "create", "--recordsize", "bogus", "tank/bad")
+	if err == nil || !strings.Contains(err.Error(), "Traceback from the middleware:") {
+		t.Fatalf("Expected --debug to show the traceback, got %v", err)
+	}
+
+	// Each failed call of a bulk job is reported
+	_, err = env.run("dataset", "delete", "tank/missing1", "tank/missing2")
+	if err == nil || !strings.Contains(err.Error(), "tank/missing1") || !strings.Contains(err.Error(), "tank/missing2") {
+		t.Fatalf("Expected both deletes to fail, got %v", err)
+	}
+}
+
+func TestE2EDaemonRestart(t *testing.T) {
+	env := startE2E(t)
+
+	options := core.DaemonOptions{
+		Timeout:           "2m0s",
+		MaxCallsPerConn:   3,
+		HeartbeatInterval: "45s",
+		JobRetention:      "20m0s",
+		MetricsListen:     "127.0.0.1:0",
+		QueryCacheTTL:     "5s",
+	}
+	daemon := env.command("daemon", "-t", options.Timeout, "--max-calls-per-connection", "3", "--heartbeat", options.HeartbeatInterval,
+		"--job-retention", options.JobRetention, "--metrics-listen", options.MetricsListen, "--query-cache-ttl", options.QueryCacheTTL,
+		"--no-audit-log", env.socket)
+	FailIf(t, daemon.Start())
+	// Reaped as soon as it exits, since restart waits until the pid is gone
+	go daemon.Wait()
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(env.socket); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	env.mustRun("daemon", "restart")
+
+	// Stopping the new daemon tells us the options that it was started with
+	api := &core.ClientSession{SocketPath: env.socket}
+	FailIf(t, api.ConnectToExistingDaemon())
+	restarted, err := api.StopDaemon(2 * time.Second)
+	FailIf(t, err)
+	if restarted != options {
+		t.Fatalf("Expected the restarted daemon to keep its options %+v, got %+v", options, restarted)
+	}
+}
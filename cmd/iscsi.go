@@ -218,14 +218,14 @@ func createIscsi(cmd *cobra.Command, api core.Session, args []string) error {
 	}
 
 	if jobIdUpdate >= 0 {
-		rawResultsTargetUpdate, err = api.WaitForJob(jobIdUpdate)
+		rawResultsTargetUpdate, err = api.WaitForJob(api.Context(), jobIdUpdate)
 		if err != nil {
 			return err
 		}
 	}
 	/*
 		if jobIdCreate >= 0 {
-			rawResultsTargetCreate, err = api.WaitForJob(jobIdCreate)
+			rawResultsTargetCreate, err = api.WaitForJob(api.Context(), jobIdCreate)
 			if err != nil {
 				return err
 			}
@@ -512,7 +512,7 @@ func getIscsiSharesFromSessionAndDiscovery(options FlagMap, api core.Session, ar
 	isCreate := core.IsStringTrue(options.allFlags, "create")
 
 	sessionTargets, err := GetIscsiTargetsFromSession(api, maybeHashedToVolumeMap)
-	if !isCreate && err != nil && !strings.Contains(strings.ToLower(err.Error()), "no active sessions") {
+	if !isCreate && err != nil && !IsIscsiNothingFoundError(err) {
 		return nil, nil, err
 	}
 
@@ -98,7 +98,7 @@ var iscsiCrudFeatureMap = map[string]map[string]iscsiCrudFeature{
 
 func WrapIscsiCrudFunc(cmdFunc func(*cobra.Command, string, core.Session, []string) error, category string) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
-		api := InitializeApiClient()
+		api := InitializeApiClient(cmd.Context())
 		if api == nil {
 			return nil
 		}
@@ -109,7 +109,7 @@ func WrapIscsiCrudFunc(cmdFunc func(*cobra.Command, string, core.Session, []stri
 
 func WrapIscsiCrudFuncNoArgs(cmdFunc func(*cobra.Command, string, core.Session) error, category string) func(*cobra.Command, []string) error {
 	return func(cmd *cobra.Command, args []string) error {
-		api := InitializeApiClient()
+		api := InitializeApiClient(cmd.Context())
 		if api == nil {
 			return nil
 		}
@@ -480,6 +480,15 @@ func GetIscsiTargetsFromDiscovery(api core.Session, maybeHashedToVolumeMap map[s
 	return targets, nil
 }
 
+// iscsiadm's exit code when there's nothing to list, eg. for "iscsiadm --mode session" without any active sessions
+const ISCSI_ERR_NO_OBJS_FOUND = 21
+
+// IsIscsiNothingFoundError is true if iscsiadm failed because it had nothing to list
+func IsIscsiNothingFoundError(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == ISCSI_ERR_NO_OBJS_FOUND
+}
+
 func GetIscsiTargetsFromSession(api core.Session, maybeHashedToVolumeMap map[string]string) ([]typeIscsiLoginSpec, error) {
 	out, err := RunIscsiAdminTool(api, []string{"--mode", "session"})
 	if err != nil {
@@ -599,9 +608,9 @@ begin:
 		msg, apiErr := CheckRemoteIscsiServiceIsRunning(api)
 		if apiErr == nil {
 			if msg != "" {
-				err = errors.New(err.Error() + "\n" + msg)
+				err = fmt.Errorf("%w\n%s", err, msg)
 			} else {
-				err = errors.New(err.Error() + "\nThe iscsitarget service is running. It may need to be restarted with:\nservice restart iscsitarget")
+				err = fmt.Errorf("%w\nThe iscsitarget service is running. It may need to be restarted with:\nservice restart iscsitarget", err)
 			}
 		}
 	}
@@ -0,0 +1,345 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+)
+
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "Follow up on middleware jobs, eg. ones started with --async",
+}
+
+var jobListCmd = &cobra.Command{
+	Use:     "list",
+	Short:   "List the jobs that the host remembers, including those started by the web UI or other clients",
+	Args:    cobra.NoArgs,
+	Aliases: []string{"ls"},
+}
+
+var jobShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Print the progress, logs, result and error of a job",
+	Args:  cobra.ExactArgs(1),
+}
+
+var jobWaitCmd = &cobra.Command{
+	Use:   "wait <id>...",
+	Short: "Wait for jobs to finish. Fails unless every job succeeded",
+	Args:  cobra.MinimumNArgs(1),
+}
+
+var jobAbortCmd = &cobra.Command{
+	Use:   "abort <id>...",
+	Short: "Ask running jobs to stop",
+	Args:  cobra.MinimumNArgs(1),
+}
+
+var g_jobListEnums map[string][]string
+var g_jobStateEnums map[string][]string
+var g_jobWaitEnums map[string][]string
+
+func init() {
+	jobListCmd.RunE = WrapCommandFunc(listJobs)
+	jobShowCmd.RunE = WrapCommandFunc(showJob)
+	jobWaitCmd.RunE = WrapCommandFunc(waitForJobs)
+	jobAbortCmd.RunE = WrapCommandFunc(abortJobs)
+
+	jobListCmd.Flags().String("method", "", "Only show jobs of methods matching this pattern, eg. \"pool.dataset.*\"")
+	jobListCmd.Flags().String("state", "", "Only show jobs in this state "+
+		AddFlagsEnum(&g_jobStateEnums, "state", []string{"waiting", "running", "success", "failed", "aborted"}))
+	jobListCmd.Flags().String("since", "", "Only show jobs started from this time on, either RFC3339 or a duration ago, eg. 1h")
+	jobListCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	jobListCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	jobListCmd.Flags().String("format", "table", "Output table format "+
+		AddFlagsEnum(&g_jobListEnums, "format", []string{"csv", "json", "table", "compact"}))
+	jobListCmd.Flags().StringP("output", "o", "", "Output property list")
+	jobListCmd.Flags().BoolP("all", "a", false, "Output all properties")
+
+	jobShowCmd.Flags().BoolP("json", "j", false, "Print the job as the middleware describes it, in JSON")
+
+	jobWaitCmd.Flags().BoolP("json", "j", false, "Equivalent to --format=json")
+	jobWaitCmd.Flags().BoolP("no-headers", "c", false, "Equivalent to --format=compact. More easily parsed by scripts")
+	jobWaitCmd.Flags().String("format", "table", "Output table format "+
+		AddFlagsEnum(&g_jobWaitEnums, "format", []string{"csv", "json", "table", "compact"}))
+
+	jobCmd.AddCommand(jobListCmd)
+	jobCmd.AddCommand(jobShowCmd)
+	jobCmd.AddCommand(jobWaitCmd)
+	jobCmd.AddCommand(jobAbortCmd)
+	rootCmd.AddCommand(jobCmd)
+}
+
+func listJobs(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_jobListEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if value := options.allFlags["since"]; value != "" {
+		if since, err = parseAuditTime(value, time.Now()); err != nil {
+			return fmt.Errorf("Could not parse --since \"%s\": %v", value, err)
+		}
+	}
+	methodPattern := options.allFlags["method"]
+	if _, err = path.Match(methodPattern, ""); err != nil {
+		return fmt.Errorf("Invalid --method pattern \"%s\": %v", methodPattern, err)
+	}
+
+	// --state is optional, so it's only checked against its enum when given
+	filters := make([]interface{}, 0)
+	if state := options.allFlags["state"]; state != "" {
+		flags := map[string]string{"state": state}
+		if err = ValidateFlagEnums(&flags, g_jobStateEnums); err != nil {
+			return err
+		}
+		filters = append(filters, []interface{}{"state", "=", flags["state"]})
+	}
+
+	cmd.SilenceUsage = true
+
+	jobs, err := queryJobs(api, filters, map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+
+	isJson := strings.ToLower(format) == "json"
+	rows := make([]map[string]interface{}, 0, len(jobs))
+	for _, fields := range jobs {
+		if methodPattern != "" {
+			if matched, _ := path.Match(methodPattern, fmt.Sprint(fields["method"])); !matched {
+				continue
+			}
+		}
+		// Jobs that haven't started yet are always current
+		if started, ok := core.ParseMiddlewareDate(fields["time_started"]); ok && !since.IsZero() && started.Before(since) {
+			continue
+		}
+		rows = append(rows, jobRow(fields, isJson))
+	}
+
+	required := []string{"id", "method", "state", "percent", "progress", "time_started"}
+	var columnsList []string
+	if core.IsStringTrue(options.allFlags, "all") {
+		columnsList = GetUsedPropertyColumns(rows, required)
+	} else if properties := EnumerateOutputProperties(options.allFlags); len(properties) > 0 {
+		columnsList = properties
+	} else {
+		columnsList = required
+	}
+
+	str, err := core.BuildTableData(format, "jobs", columnsList, rows)
+	PrintTable(api, str)
+	return err
+}
+
+func showJob(cmd *cobra.Command, api core.Session, args []string) error {
+	jobIds, err := parseJobIds(args)
+	if err != nil {
+		return err
+	}
+	isJson, _ := cmd.Flags().GetBool("json")
+
+	cmd.SilenceUsage = true
+
+	fields, err := getJob(api, jobIds[0])
+	if err != nil {
+		return err
+	}
+
+	if isJson {
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		PrintTable(api, string(data)+"\n")
+		return nil
+	}
+
+	row := jobRow(fields, false)
+	var builder strings.Builder
+	for _, key := range []string{"id", "method", "state", "description", "percent", "progress", "time_started", "time_finished", "arguments", "result", "error"} {
+		value, exists := row[key]
+		if !exists {
+			value = "-"
+		}
+		fmt.Fprintf(&builder, "%-15s %v\n", key+":", value)
+	}
+	if logs, _ := fields["logs_excerpt"].(string); strings.TrimSpace(logs) != "" {
+		builder.WriteString("logs_excerpt:\n")
+		for _, line := range strings.Split(strings.TrimRight(logs, "\n"), "\n") {
+			builder.WriteString("  " + line + "\n")
+		}
+	}
+	PrintTable(api, builder.String())
+	return nil
+}
+
+func waitForJobs(cmd *cobra.Command, api core.Session, args []string) error {
+	options, err := GetCobraFlags(cmd, false, g_jobWaitEnums)
+	if err != nil {
+		return err
+	}
+
+	format, err := GetTableFormat(options.allFlags)
+	if err != nil {
+		return err
+	}
+
+	jobIds, err := parseJobIds(args)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	isJson := strings.ToLower(format) == "json"
+	rows := make([]map[string]interface{}, 0, len(jobIds))
+	var failures []error
+	for _, jobId := range jobIds {
+		fields, err := waitForJobFields(api, jobId)
+		if err != nil {
+			return err
+		}
+		if err = core.GetJobFieldsError(jobId, fields); err != nil {
+			failures = append(failures, err)
+		}
+		rows = append(rows, jobRow(fields, isJson))
+	}
+
+	str, err := core.BuildTableData(format, "jobs", []string{"id", "method", "state", "error"}, rows)
+	PrintTable(api, str)
+	if err != nil {
+		return err
+	}
+	return core.MakeErrorFromList(failures)
+}
+
+func abortJobs(cmd *cobra.Command, api core.Session, args []string) error {
+	jobIds, err := parseJobIds(args)
+	if err != nil {
+		return err
+	}
+
+	cmd.SilenceUsage = true
+
+	for _, jobId := range jobIds {
+		if _, err = core.ApiCall(api, "core.job_abort", defaultCallTimeout, []interface{}{jobId}); err != nil {
+			return fmt.Errorf("Could not abort job %d: %v", jobId, err)
+		}
+	}
+	return nil
+}
+
+func parseJobIds(args []string) ([]int64, error) {
+	jobIds := make([]int64, 0, len(args))
+	for _, arg := range args {
+		jobId, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || jobId <= 0 {
+			return nil, fmt.Errorf("Invalid job id \"%s\"", arg)
+		}
+		jobIds = append(jobIds, jobId)
+	}
+	return jobIds, nil
+}
+
+func queryJobs(api core.Session, filters []interface{}, queryOptions map[string]interface{}) ([]map[string]interface{}, error) {
+	out, err := core.ApiCall(api, "core.get_jobs", defaultCallTimeout, []interface{}{filters, queryOptions})
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Result []map[string]interface{} `json:"result"`
+	}
+	if err = json.Unmarshal(out, &response); err != nil {
+		return nil, err
+	}
+	sort.Slice(response.Result, func(a, b int) bool {
+		idA, _ := response.Result[a]["id"].(float64)
+		idB, _ := response.Result[b]["id"].(float64)
+		return idA < idB
+	})
+	return response.Result, nil
+}
+
+func getJob(api core.Session, jobId int64) (map[string]interface{}, error) {
+	jobs, err := queryJobs(api, []interface{}{[]interface{}{"id", "=", jobId}}, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("Job %d was not found", jobId)
+	}
+	return jobs[0], nil
+}
+
+// waitForJobFields returns a job's fields once it has finished. Jobs that finished a while ago are looked up instead,
+// since waiting on them would only work for as long as the daemon retains them.
+func waitForJobFields(api core.Session, jobId int64) (map[string]interface{}, error) {
+	fields, err := getJob(api, jobId)
+	if err != nil {
+		return nil, err
+	}
+	switch fields["state"] {
+	case "SUCCESS", "FAILED", "ABORTED":
+		return fields, nil
+	}
+
+	out, err := api.WaitForJob(api.Context(), jobId)
+	if err != nil {
+		return nil, err
+	}
+	fields = nil
+	if err = json.Unmarshal(out, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// jobRow lays out a job's fields for a table. Nested values are kept as they are for JSON, and written as JSON otherwise.
+func jobRow(fields map[string]interface{}, isJson bool) map[string]interface{} {
+	row := map[string]interface{}{
+		"id":           fields["id"],
+		"method":       fields["method"],
+		"state":        fields["state"],
+		"description":  fields["description"],
+		"arguments":    fields["arguments"],
+		"result":       fields["result"],
+		"error":        fields["error"],
+		"logs_excerpt": fields["logs_excerpt"],
+		"abortable":    fields["abortable"],
+	}
+	if progress, ok := fields["progress"].(map[string]interface{}); ok {
+		row["percent"] = progress["percent"]
+		row["progress"] = progress["description"]
+		if !isJson && progress["percent"] != nil {
+			row["percent"] = fmt.Sprintf("%v%%", progress["percent"])
+		}
+	}
+	for _, key := range []string{"time_started", "time_finished"} {
+		if t, ok := core.ParseMiddlewareDate(fields[key]); ok {
+			row[key] = t.Format(time.RFC3339)
+		}
+	}
+	if isJson {
+		return row
+	}
+	if logs, ok := row["logs_excerpt"].(string); ok {
+		row["logs_excerpt"] = strings.ReplaceAll(strings.TrimSpace(logs), "\n", " ")
+	}
+	return flattenApiRow(row)
+}
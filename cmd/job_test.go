@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobList(t *testing.T) {
+	FailIf(t, DoTest(
+		t,
+		jobListCmd,
+		listJobs,
+		map[string]interface{}{"state": "running", "method": "pool.*", "no_headers": true},
+		[]string{},
+		[]string{
+			"[[[\"state\",\"=\",\"RUNNING\"]],{}]",
+		},
+		[]string{
+			"{\"jsonrpc\":\"2.0\",\"result\":[" +
+				"{\"id\":12,\"method\":\"replication.run_onetime\",\"state\":\"RUNNING\",\"progress\":{\"percent\":10,\"description\":\"Sending\"}}," +
+				"{\"id\":11,\"method\":\"pool.dataset.delete\",\"state\":\"RUNNING\",\"progress\":{\"percent\":50,\"description\":\"Destroying\"}," +
+				"\"time_started\":{\"$date\":1735725600000}}" +
+				"],\"id\":1}",
+		},
+		"11\tpool.dataset.delete\tRUNNING\t50%\tDestroying\t"+time.UnixMilli(1735725600000).Format(time.RFC3339)+"\n",
+	))
+}
+
+func TestJobWaitInvalidId(t *testing.T) {
+	if err := waitForJobs(jobWaitCmd, &UnitTestSession{test: t}, []string{"12", "abc"}); err == nil || err.Error() != "Invalid job id \"abc\"" {
+		t.Fatalf("Expected an invalid job id to be rejected, got %v", err)
+	}
+}
@@ -91,6 +91,7 @@ func init() {
 	replStartCmd.Flags().String("logging-level", "warning", ""+
 		AddFlagsEnum(&g_replStartEnums, "logging-level", []string{"debug","info","warning","error"}))
 	replStartCmd.Flags().Bool("exclude-mountpoint-property", true, "")
+	AddProgressFlags(replStartCmd)
 	replStartCmd.Flags().Bool("only-from-scratch", false, "")
 
 	replCmd.AddCommand(replStartCmd)
@@ -102,6 +103,10 @@ func startReplication(cmd *cobra.Command, api core.Session, args []string) error
 	if err != nil {
 		return err
 	}
+	progress, err := getProgressReporter(api, options)
+	if err != nil {
+		return err
+	}
 
 	mainSchemaStr := options.allFlags["naming_schema_main"]
 	auxSchemaStr := options.allFlags["naming_schema_aux"]
@@ -221,13 +226,22 @@ func startReplication(cmd *cobra.Command, api core.Session, args []string) error
 
 	cmd.SilenceUsage = true
 
-	jobId, err := core.ApiCallAsync(api, "replication.run_onetime", params, false)
+	jobId, err := core.ApiCallAsync(api, "replication.run_onetime", defaultCallTimeout, params, false)
 	if err != nil {
 		return err
 	}
 
+	if g_async {
+		leaveJobRunning(api, jobId)
+		return nil
+	}
+
 	fmt.Println(jobId)
-	return nil
+	if progress != nil {
+		// The job is also awaited when the session closes, which is where any errors are reported
+		_, err = progress.waitForJob(api, jobId)
+	}
+	return err
 }
 
 func getHostAndDatasetSpecsFromString(str string) ([]string, []string, error) {
@@ -1,11 +1,15 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path"
+	"strconv"
+	"syscall"
 	"truenas/truenas_incus_ctl/core"
 
 	"github.com/spf13/cobra"
@@ -13,26 +17,45 @@ import (
 
 const USE_DAEMON = true
 
+// Environment variables read in place of the global flags, when those aren't given
+const (
+	ENV_HOST           = "TRUENAS_HOST"
+	ENV_API_KEY        = "TRUENAS_API_KEY"
+	ENV_CONFIG         = "TRUENAS_CONFIG"
+	ENV_ALLOW_INSECURE = "TRUENAS_ALLOW_INSECURE"
+)
+
 var rootCmd = &cobra.Command{
 	Use: "truenas_incus_ctl",
 }
 
-var daemonCmd = &cobra.Command{
-	Use:  "daemon",
-	Args: cobra.MinimumNArgs(1),
-	Run:  runDaemon,
-}
-
 var g_debug bool
 var g_allowInsecure bool
+var g_abortOnCancel bool
 var g_daemonSocketOverride string
 var g_configFileName string
 var g_configName string
 var g_hostName string
 var g_apiKey string
+var g_username string
+var g_tlsFingerprint string
+var g_caFile string
+var g_readOnly bool
+var g_allowedRoots []string
+var g_recordFile string
+var g_async bool
 
 func Execute() {
-	err := rootCmd.Execute()
+	// Interrupting a command cancels its context, so that pending calls stop waiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		// A second interrupt should kill the process as usual
+		stop()
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
+	stop()
 	if err != nil {
 		os.Exit(1)
 	}
@@ -40,92 +63,236 @@ func Execute() {
 
 func init() {
 	rootCmd.PersistentFlags().BoolVar(&g_debug, "debug", false, "Enable debug logs")
-	rootCmd.PersistentFlags().BoolVar(&g_allowInsecure, "allow-insecure", false, "Allow self-signed or non-trusted SSL certificates")
-	rootCmd.PersistentFlags().StringVar(&g_daemonSocketOverride, "daemon-socket", "", "Override the default daemon socket path (~/tncdaemon.sock)")
+	rootCmd.PersistentFlags().BoolVar(&g_allowInsecure, "allow-insecure", false, "Allow self-signed or non-trusted SSL certificates ($TRUENAS_ALLOW_INSECURE)")
+	rootCmd.PersistentFlags().BoolVar(&g_abortOnCancel, "abort-on-cancel", false, "Abort jobs that are being waited on if the command is interrupted")
+	rootCmd.PersistentFlags().StringVar(&g_daemonSocketOverride, "daemon-socket", "", "Override the default daemon socket path ($XDG_RUNTIME_DIR/tncdaemon.sock, or ~/tncdaemon.sock)")
 	rootCmd.PersistentFlags().StringVarP(&g_configFileName, "config-file", "F", "", "Override config filename (~/.truenas_incus_ctl/config.json)")
-	rootCmd.PersistentFlags().StringVarP(&g_configName, "config", "C", "", "Name of config to look up in config.json, defaults to first entry")
-	rootCmd.PersistentFlags().StringVarP(&g_hostName, "host", "H", "", "Server hostname or URL")
-	rootCmd.PersistentFlags().StringVarP(&g_apiKey, "api-key", "K", "", "API key")
-
-	daemonCmd.Flags().StringP("timeout", "t", "", "Exit the daemon if no communication occurs after this duration")
-
-	rootCmd.AddCommand(daemonCmd)
+	rootCmd.PersistentFlags().StringVarP(&g_configName, "config", "C", "", "Name of config to look up in config.json ($TRUENAS_CONFIG), defaults to the one set by \"config use\"")
+	rootCmd.PersistentFlags().StringVarP(&g_hostName, "host", "H", "", "Server hostname or URL ($TRUENAS_HOST)")
+	rootCmd.PersistentFlags().StringVarP(&g_apiKey, "api-key", "K", "", "API key ($TRUENAS_API_KEY)")
+	rootCmd.PersistentFlags().StringVarP(&g_username, "username", "U", "", "Log in as this user instead of with an API key, prompting for the password")
+	rootCmd.PersistentFlags().StringVar(&g_recordFile, "record", "", "Write every API call and its response to this file, with secrets redacted, for replaying in tests")
+	rootCmd.PersistentFlags().BoolVar(&g_async, "async", false, "Print the ids of the jobs that a command starts, eg. dataset delete, instead of waiting for them. See \"job\"")
 }
 
 func RemoveGlobalFlags(flags map[string]string) {
 	core.DeleteSnakeKebab(flags, "debug")
 	core.DeleteSnakeKebab(flags, "allow-insecure")
+	core.DeleteSnakeKebab(flags, "abort-on-cancel")
 	core.DeleteSnakeKebab(flags, "daemon-socket")
 	core.DeleteSnakeKebab(flags, "config-file")
 	core.DeleteSnakeKebab(flags, "config")
 	core.DeleteSnakeKebab(flags, "host")
 	core.DeleteSnakeKebab(flags, "api-key")
+	core.DeleteSnakeKebab(flags, "username")
+	core.DeleteSnakeKebab(flags, "record")
+	core.DeleteSnakeKebab(flags, "async")
 }
 
-func runDaemon(cmd *cobra.Command, args []string) {
-	var globalTimeoutStr string
-	f := cmd.Flags().Lookup("timeout")
-	if f != nil {
-		globalTimeoutStr = f.Value.String()
+func InitializeApiClient(ctx context.Context) core.Session {
+	var api core.Session
+	if _, err := resolveConnection(); err != nil {
+		log.Fatal(fmt.Errorf("Failed to parse config: %v", err))
+	}
+
+	// Passwords are never stored, so ask for one every time
+	var password string
+	var promptOtp func() (string, error)
+	if g_apiKey == "" && g_username != "" {
+		account := g_username + "@" + core.GetHostNameFromApiUrl(g_hostName)
+		var err error
+		if password, err = promptSecret("Password for " + account); err != nil {
+			log.Fatal(err)
+		}
+		promptOtp = func() (string, error) {
+			return promptSecret("One-time password for " + account)
+		}
+	}
+
+	if USE_DAEMON {
+		api = &core.ClientSession{
+			HostName:          g_hostName,
+			ApiKey:            g_apiKey,
+			Username:          g_username,
+			Password:          password,
+			PromptOtp:         promptOtp,
+			SocketPath:        getDaemonSocketPath(),
+			IsDebug:           g_debug,
+			AllowInsecure:     g_allowInsecure,
+			TLSFingerprint:    g_tlsFingerprint,
+			CAFile:            g_caFile,
+			AbortJobsOnCancel: g_abortOnCancel,
+			Ctx:               ctx,
+		}
+	} else {
+		api = &core.RealSession{
+			HostName:          g_hostName,
+			ApiKey:            g_apiKey,
+			Username:          g_username,
+			Password:          password,
+			PromptOtp:         promptOtp,
+			IsDebug:           g_debug,
+			AllowInsecure:     g_allowInsecure,
+			TLSFingerprint:    g_tlsFingerprint,
+			CAFile:            g_caFile,
+			AbortJobsOnCancel: g_abortOnCancel,
+			Ctx:               ctx,
+			AuditLog:          core.NewAuditLog(getDefaultAuditLogPath()),
+		}
 	}
-	serverSockAddr := args[0]
-	if serverSockAddr == "" {
-		log.Fatal("Error: path to server socket was not provided")
+
+	// Calls refused by a restricted config entry are never sent, so they aren't recorded either
+	if g_recordFile != "" {
+		api = core.NewRecordingSession(api, g_recordFile)
 	}
-	core.RunDaemon(serverSockAddr, globalTimeoutStr)
+
+	// Restricted config entries are enforced before calls leave this process, whichever session sends them
+	if g_readOnly || len(g_allowedRoots) > 0 {
+		api = core.NewRestrictedSession(api, g_configName, g_readOnly, g_allowedRoots)
+	}
+
+	return api
 }
 
-func InitializeApiClient() core.Session {
-	var api core.Session
-	if g_hostName == "" || g_apiKey == "" {
-		host, key, config, err := findCredsFromConfig(g_configFileName, g_configName, g_hostName, g_apiKey)
+// resolveConnection works out which host to connect to and how, filling in the global settings that weren't passed
+// as flags from the environment, then from the config file. The precedence is flags > environment > the config's
+// "default" entry > its only entry. It returns where each setting came from, for "config show --resolved".
+func resolveConnection() (map[string]string, error) {
+	sources := make(map[string]string)
+	flags := rootCmd.PersistentFlags()
+
+	fromFlagOrEnv := func(setting, flagName, envName string, value *string) {
+		if *value != "" {
+			sources[setting] = "--" + flagName
+		} else if envValue := os.Getenv(envName); envValue != "" {
+			*value = envValue
+			sources[setting] = envName
+		}
+	}
+	fromFlagOrEnv("config", "config", ENV_CONFIG, &g_configName)
+	fromFlagOrEnv("host", "host", ENV_HOST, &g_hostName)
+	fromFlagOrEnv("api_key", "api-key", ENV_API_KEY, &g_apiKey)
+	if g_username != "" {
+		sources["username"] = "--username"
+	}
+
+	if flags.Changed("allow-insecure") {
+		sources["allow_insecure"] = "--allow-insecure"
+	} else if envValue := os.Getenv(ENV_ALLOW_INSECURE); envValue != "" {
+		isInsecure, err := strconv.ParseBool(envValue)
 		if err != nil {
-			log.Fatal(fmt.Errorf("Failed to parse config: %v", err))
+			return nil, fmt.Errorf("%s should be true or false, not \"%s\"", ENV_ALLOW_INSECURE, envValue)
 		}
-		g_hostName = host
-		g_apiKey = key
-		if _, exists := config["debug"]; exists {
+		g_allowInsecure = isInsecure
+		sources["allow_insecure"] = ENV_ALLOW_INSECURE
+	}
+	if flags.Changed("debug") {
+		sources["debug"] = "--debug"
+	}
+	if g_daemonSocketOverride != "" {
+		sources["daemon_socket"] = "--daemon-socket"
+	}
+
+	if g_hostName != "" && (g_apiKey != "" || g_username != "") {
+		// Nothing is needed from the config file
+		delete(sources, "config")
+		return sources, nil
+	}
+
+	name, why, fileName, config, err := findHostInConfig(g_configFileName, g_configName, g_hostName, g_apiKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, exists := sources["config"]; !exists {
+		g_configName = name
+		sources["config"] = why
+	}
+	fromConfig := fmt.Sprintf("config \"%s\" in %s", name, fileName)
+
+	url, err := getNonEmptyStringFromMapAny(config, "url", fileName)
+	if err != nil {
+		return nil, err
+	}
+	if g_hostName == "" {
+		g_hostName = url
+		sources["host"] = fromConfig
+	}
+
+	if g_apiKey == "" && g_username == "" {
+		// Hosts that are logged in to with a password only store the username
+		if _, hasUsername := config["username"]; hasUsername && !hasApiKey(config) {
+			if g_username, err = getNonEmptyStringFromMapAny(config, "username", fileName); err != nil {
+				return nil, err
+			}
+			sources["username"] = fromConfig
+		} else {
+			if g_apiKey, err = resolveApiKey(config, fileName); err != nil {
+				return nil, err
+			}
+			sources["api_key"] = fromConfig
+			if source := getApiKeySource(config); source != "" {
+				sources["api_key"] += ", through " + source
+			}
+		}
+	}
+
+	if _, exists := sources["debug"]; !exists {
+		if _, exists = config["debug"]; exists {
 			g_debug = core.IsValueTrue(config, "debug")
+			sources["debug"] = fromConfig
 		}
-		if _, exists := config["allow_insecure"]; exists {
+	}
+	if _, exists := sources["allow_insecure"]; !exists {
+		if _, exists = config["allow_insecure"]; exists {
 			g_allowInsecure = core.IsValueTrue(config, "allow_insecure")
-		}
-		if obj, exists := config["daemon_socket"]; exists {
-			g_daemonSocketOverride, _ = obj.(string)
+			sources["allow_insecure"] = fromConfig
 		}
 	}
-	if USE_DAEMON {
-		p, err := os.UserHomeDir()
-		if err != nil {
-			log.Fatal(err)
+	if _, exists := config["read_only"]; exists {
+		g_readOnly = core.IsValueTrue(config, "read_only")
+		sources["read_only"] = fromConfig
+	}
+	if obj, exists := config["allowed_roots"]; exists {
+		roots, ok := obj.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("\"allowed_roots\" in config \"%s\" was not a list", fileName)
 		}
-		socketPath := g_daemonSocketOverride
-		if socketPath == "" {
-			socketPath = path.Join(p, "tncdaemon.sock")
+		g_allowedRoots = make([]string, 0, len(roots))
+		for _, root := range roots {
+			g_allowedRoots = append(g_allowedRoots, fmt.Sprint(root))
 		}
-		api = &core.ClientSession{
-			HostName:      g_hostName,
-			ApiKey:        g_apiKey,
-			SocketPath:    socketPath,
-			IsDebug:       g_debug,
-			AllowInsecure: g_allowInsecure,
+		sources["allowed_roots"] = fromConfig
+	}
+	if _, exists := config["defaults"]; exists {
+		if g_commandDefaults, err = getMapFromMapAny(config, "defaults", fileName); err != nil {
+			return nil, err
 		}
-	} else {
-		api = &core.RealSession{
-			HostName:      g_hostName,
-			ApiKey:        g_apiKey,
-			IsDebug:       g_debug,
-			AllowInsecure: g_allowInsecure,
+		sources["defaults"] = fromConfig
+	}
+
+	// Self-signed certificates are trusted by the fingerprint pinned when logging in, or by a CA bundle
+	if obj, exists := config["tls_fingerprint"]; exists {
+		g_tlsFingerprint, _ = obj.(string)
+		sources["tls_fingerprint"] = fromConfig
+	}
+	if obj, exists := config["ca_file"]; exists {
+		g_caFile, _ = obj.(string)
+		sources["ca_file"] = fromConfig
+	}
+	if _, exists := sources["daemon_socket"]; !exists {
+		if obj, exists := config["daemon_socket"]; exists {
+			g_daemonSocketOverride, _ = obj.(string)
+			sources["daemon_socket"] = fromConfig
 		}
 	}
 
-	return api
+	return sources, nil
 }
 
-// This method is called assuming that we're missing either a hostname or api key.
-// Additionally, we might not know the config path (in which case we use the default),
-// or the name (in which case we just pick the first config in the list)
-func findCredsFromConfig(fileName, name, existingHost, existingApiKey string) (string, string, map[string]interface{}, error) {
+// findHostInConfig picks a host entry from the config file, when we're missing either a hostname or credentials.
+// Unless a name was given, it's the entry matching the host or API key we were given, else the one named by
+// "default", else the only entry. Returns the name of the entry, why it was picked and the config file read.
+func findHostInConfig(fileName, name, existingHost, existingApiKey string) (string, string, string, map[string]interface{}, error) {
 	var data []byte
 	var err error
 
@@ -141,26 +308,28 @@ func findCredsFromConfig(fileName, name, existingHost, existingApiKey string) (s
 	}
 
 	if err != nil {
-		return "", "", nil, err
+		return "", "", "", nil, err
 	}
 
 	var obj interface{}
 	if err = json.Unmarshal(data, &obj); err != nil {
-		return "", "", nil, fmt.Errorf("\"%s\": %v", fileName, err)
+		return "", "", "", nil, fmt.Errorf("\"%s\": %v", fileName, err)
 	}
 
 	jsonObj, ok := obj.(map[string]interface{})
 	if !ok {
-		return "", "", nil, fmt.Errorf("Config was not a JSON object \"%s\"", fileName)
+		return "", "", "", nil, fmt.Errorf("Config was not a JSON object \"%s\"", fileName)
 	}
 
 	hosts, err := getMapFromMapAny(jsonObj, "hosts", fileName)
 	if err != nil {
-		return "", "", nil, err
+		return "", "", "", nil, err
 	}
 
+	var why string
 	if name == "" {
 		if existingHost != "" {
+			why = "matching host " + existingHost
 			existingHostCondensed := core.GetHostNameFromApiUrl(existingHost)
 			for key, value := range hosts {
 				if valueMap, ok := value.(map[string]interface{}); ok {
@@ -172,6 +341,7 @@ func findCredsFromConfig(fileName, name, existingHost, existingApiKey string) (s
 				}
 			}
 		} else if existingApiKey != "" {
+			why = "matching API key"
 			for key, value := range hosts {
 				if valueMap, ok := value.(map[string]interface{}); ok {
 					apiKey, _ := valueMap["api_key"].(string)
@@ -181,34 +351,44 @@ func findCredsFromConfig(fileName, name, existingHost, existingApiKey string) (s
 					}
 				}
 			}
-		} else {
-			for key, _ := range hosts {
-				if name == "" || key < name {
-					name = key
-				}
+		} else if defaultName, _ := jsonObj["default"].(string); defaultName != "" {
+			why = "\"default\" in " + fileName
+			name = defaultName
+		} else if len(hosts) == 1 {
+			why = "only entry in " + fileName
+			for key := range hosts {
+				name = key
 			}
+		} else if len(hosts) > 1 {
+			return "", "", "", nil, fmt.Errorf("There are %d hosts in config \"%s\" and none is the default. "+
+				"Pick one with --config or %s, or set the default with \"config use <name>\"", len(hosts), fileName, ENV_CONFIG)
 		}
 		if name == "" {
-			return "", "", nil, fmt.Errorf("Could not find any matching hosts in config \"%s\"", fileName)
+			return "", "", "", nil, fmt.Errorf("Could not find any matching hosts in config \"%s\"", fileName)
 		}
 	}
 
 	config, err := getMapFromMapAny(hosts, name, fileName)
 	if err != nil {
-		return "", "", nil, err
+		return "", "", "", nil, err
 	}
 
-	apiKey, err := getNonEmptyStringFromMapAny(config, "api_key", fileName)
-	if err != nil {
-		return "", "", nil, err
-	}
+	return name, why, fileName, config, nil
+}
 
-	u, err := getNonEmptyStringFromMapAny(config, "url", fileName)
+func getDaemonSocketPath() string {
+	if g_daemonSocketOverride != "" {
+		return g_daemonSocketOverride
+	}
+	// This is also where the socket unit written by "daemon install-units" listens (%t)
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return path.Join(runtimeDir, "tncdaemon.sock")
+	}
+	p, err := os.UserHomeDir()
 	if err != nil {
-		return "", "", nil, err
+		log.Fatal(err)
 	}
-
-	return u, apiKey, config, nil
+	return path.Join(p, "tncdaemon.sock")
 }
 
 func getDefaultConfigPath() string {
@@ -219,6 +399,10 @@ func getDefaultConfigPath() string {
 	return path.Join(p, ".truenas_incus_ctl", "config.json")
 }
 
+func getDefaultAuditLogPath() string {
+	return path.Join(path.Dir(getDefaultConfigPath()), "audit.log")
+}
+
 func getMapFromMapAny(dict map[string]interface{}, key, fileName string) (map[string]interface{}, error) {
 	var inner map[string]interface{}
 	if innerObj, exists := dict[key]; exists {
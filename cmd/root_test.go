@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFindHostInConfig(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "config.json")
+	writeConfig := func(data string) {
+		FailIf(t, os.WriteFile(fileName, []byte(data), 0600))
+	}
+	expectName := func(name, existingHost, expected string) {
+		found, _, _, _, err := findHostInConfig(fileName, name, existingHost, "")
+		FailIf(t, err)
+		if found != expected {
+			t.Fatalf("Expected host entry \"%s\", got \"%s\"", expected, found)
+		}
+	}
+
+	writeConfig(`{"hosts":{"prod":{"url":"prod.local","api_key":"k"}}}`)
+	expectName("", "", "prod")
+
+	// With more than one entry, the alphabetically first one is no longer picked
+	writeConfig(`{"hosts":{"a-test":{"url":"test.local","api_key":"k"},"prod":{"url":"prod.local","api_key":"k"}}}`)
+	if _, _, _, _, err := findHostInConfig(fileName, "", "", ""); err == nil {
+		t.Fatal("Expected an error with several hosts and no default")
+	}
+	expectName("a-test", "", "a-test")
+	expectName("", "wss://prod.local/api/current", "prod")
+
+	writeConfig(`{"default":"prod","hosts":{"a-test":{"url":"test.local","api_key":"k"},"prod":{"url":"prod.local","api_key":"k"}}}`)
+	expectName("", "", "prod")
+	expectName("a-test", "", "a-test")
+}
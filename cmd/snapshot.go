@@ -93,6 +93,7 @@ func init() {
 	snapshotRollbackCmd.Flags().BoolP("recursive-clones", "R", false, "like recursive, but also destroy any clones")
 	snapshotRollbackCmd.Flags().Bool("recursive-rollback", false, "perform a completem recursive rollback of each child snapshots.\n"+
 		"If any child does not have specified snapshot, this operation will fail.")
+	AddProgressFlags(snapshotRollbackCmd)
 
 	snapshotCmd.AddCommand(snapshotCloneCmd)
 	snapshotCmd.AddCommand(snapshotCreateCmd)
@@ -199,12 +200,20 @@ func deleteOrRollbackSnapshot(cmd *cobra.Command, api core.Session, args []strin
 	}
 
 	options, _ := GetCobraFlags(cmd, false, nil)
+	progress, err := getProgressReporter(api, options)
+	if err != nil {
+		return err
+	}
+	if !core.IsStringTrue(options.allFlags, "recursive_rollback") {
+		progress = nil
+	}
+
 	params := BuildNameStrAndPropertiesJson(options, snapshots[0])
 
 	cmd.SilenceUsage = true
 
 	objRemap := map[string][]interface{}{"": core.ToAnyArray(snapshots)}
-	out, _, err := MaybeBulkApiCall(api, "zfs.snapshot."+cmdType, 10, params, objRemap, false)
+	out, err := MaybeBulkApiCallWithProgress(api, "zfs.snapshot."+cmdType, 10, params, objRemap, false, progress)
 	if err != nil {
 		return err
 	}
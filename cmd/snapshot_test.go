@@ -261,3 +261,18 @@ func TestSnapshotRollback(t *testing.T) {
 		"[\"dozer/testing/test3@readonly\",{}]",
 	))
 }
+
+func TestSnapshotListReplay(t *testing.T) {
+	FailIf(t, DoReplayTest(
+		t,
+		snapshotListCmd,
+		listSnapshot,
+		map[string]interface{}{"recursive":true,"output":"name,createtxg"},
+		[]string{"dozer/testing"},
+		"testdata/snapshot_list.json",
+		"          name           | createtxg \n" +
+		"-------------------------+-----------\n" +
+		" dozer/testing/test4@one | 6         \n" +
+		" dozer/testing/test5@two | 7         \n",
+	))
+}
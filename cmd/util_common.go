@@ -5,15 +5,36 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"os"
 	"slices"
 	"strconv"
 	"strings"
 	"truenas/truenas_incus_ctl/core"
+
+	"golang.org/x/term"
 )
 
 // defautCallTimeout should be used when calling API call functions.
 const defaultCallTimeout = 30
 
+// promptSecret asks for a password or similar on the terminal, without echoing what's typed
+func promptSecret(what string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("%s is required, but stdin is not a terminal", what)
+	}
+	fmt.Fprint(os.Stderr, what+": ")
+	data, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("Could not read %s: %v", strings.ToLower(what[:1])+what[1:], err)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("%s cannot be empty", what)
+	}
+	return string(data), nil
+}
+
 type typeQueryParams struct {
 	valueOrder         []string
 	shouldSkipKeyBuild bool
@@ -637,6 +658,88 @@ func GetTableFormat(properties map[string]string) (string, error) {
 }
 
 func MaybeBulkApiCall(api core.Session, endpoint string, timeoutSeconds int64, params interface{}, remapList map[string][]interface{}, shouldWaitNow bool) (json.RawMessage, int64, error) {
+	allParams := remapBulkParams(params, remapList)
+
+	nParams := len(allParams)
+	if nParams == 0 {
+		return nil, -1, errors.New("MaybeBulkApiCall: Nothing to do")
+	} else if nParams == 1 {
+		DebugJson(allParams[0])
+		out, err := core.ApiCall(api, endpoint, timeoutSeconds, allParams[0])
+		return out, -1, err
+	}
+
+	methodAndParams := make([]interface{}, 0)
+	methodAndParams = append(methodAndParams, endpoint)
+	methodAndParams = append(methodAndParams, allParams)
+
+	DebugJson(methodAndParams)
+	jobId, err := core.ApiCallAsync(api, "core.bulk", timeoutSeconds, methodAndParams, shouldWaitNow)
+	if err == nil && jobId >= 0 && g_async && !shouldWaitNow {
+		leaveJobRunning(api, jobId)
+		return nil, jobId, nil
+	}
+	if !shouldWaitNow || err != nil || jobId < 0 {
+		return nil, jobId, err
+	}
+
+	out, err := core.WaitForJob(api, jobId)
+	return out, jobId, err
+}
+
+// MaybeBulkApiCallWithProgress is like MaybeBulkApiCall, except that when progress is being shown or --async is given,
+// the calls are submitted as a core.bulk job, so that there's a job to follow. A single call is made directly instead
+// when its progress can be shown: if isJob says that the method starts a job, it's the progress of the method's own job
+// that's shown, rather than that of core.bulk, which only goes from 0 to 100%, and otherwise there's no job to follow.
+// The job is waited on before returning, unless --async is given.
+func MaybeBulkApiCallWithProgress(api core.Session, endpoint string, timeoutSeconds int64, params interface{}, remapList map[string][]interface{}, isJob bool, progress *progressReporter) (json.RawMessage, error) {
+	if progress == nil && !g_async {
+		out, _, err := MaybeBulkApiCall(api, endpoint, timeoutSeconds, params, remapList, false)
+		return out, err
+	}
+
+	allParams := remapBulkParams(params, remapList)
+	if len(allParams) == 0 {
+		return nil, errors.New("MaybeBulkApiCallWithProgress: Nothing to do")
+	}
+
+	// Sessions that can't show progress only wait on jobs that they know were started, so they're left to core.bulk
+	if core.ReportsJobProgress(api) && len(allParams) == 1 && !g_async {
+		if !isJob {
+			out, _, err := MaybeBulkApiCall(api, endpoint, timeoutSeconds, params, remapList, false)
+			return out, err
+		}
+		DebugJson(allParams[0])
+		jobId, err := core.ApiCallAsync(api, endpoint, timeoutSeconds, allParams[0], true)
+		if err != nil {
+			return nil, err
+		}
+		if jobId < 0 {
+			return nil, fmt.Errorf("%s did not start a job", endpoint)
+		}
+		return progress.waitForJob(api, jobId)
+	}
+
+	methodAndParams := []interface{}{endpoint, allParams}
+	DebugJson(methodAndParams)
+	jobId, err := core.ApiCallAsync(api, "core.bulk", timeoutSeconds, methodAndParams, !g_async)
+	if err != nil {
+		return nil, err
+	}
+	if g_async {
+		leaveJobRunning(api, jobId)
+		return nil, nil
+	}
+	return progress.waitForJob(api, jobId)
+}
+
+// leaveJobRunning prints the id of a job that --async leaves running, and stops the session from waiting for it on close
+func leaveJobRunning(api core.Session, jobId int64) {
+	api.SkipWaitingJobOnClose(jobId)
+	fmt.Println(jobId)
+}
+
+func remapBulkParams(params interface{}, remapList map[string][]interface{}) [][]interface{} {
 	allParams := make([][]interface{}, 0)
 	for key, valueList := range remapList {
 		for i, value := range valueList {
@@ -659,28 +762,7 @@ func MaybeBulkApiCall(api core.Session, endpoint string, timeoutSeconds int64, p
 			}
 		}
 	}
-
-	nParams := len(allParams)
-	if nParams == 0 {
-		return nil, -1, errors.New("MaybeBulkApiCall: Nothing to do")
-	} else if nParams == 1 {
-		DebugJson(allParams[0])
-		out, err := core.ApiCall(api, endpoint, timeoutSeconds, allParams[0])
-		return out, -1, err
-	}
-
-	methodAndParams := make([]interface{}, 0)
-	methodAndParams = append(methodAndParams, endpoint)
-	methodAndParams = append(methodAndParams, allParams)
-
-	DebugJson(methodAndParams)
-	jobId, err := core.ApiCallAsync(api, "core.bulk", methodAndParams, shouldWaitNow)
-	if !shouldWaitNow || err != nil || jobId < 0 {
-		return nil, jobId, err
-	}
-
-	out, err := api.WaitForJob(jobId)
-	return out, jobId, err
+	return allParams
 }
 
 func MaybeBulkApiCallArray(api core.Session, endpoint string, timeoutSeconds int64 /* see: defaultCallTimeout */, paramsArray []interface{}, shouldWaitNow bool) (json.RawMessage, int64, error) {
@@ -699,11 +781,15 @@ func MaybeBulkApiCallArray(api core.Session, endpoint string, timeoutSeconds int
 	methodAndParams = append(methodAndParams, paramsArray)
 
 	DebugJson(methodAndParams)
-	jobId, err := core.ApiCallAsync(api, "core.bulk", methodAndParams, shouldWaitNow)
+	jobId, err := core.ApiCallAsync(api, "core.bulk", timeoutSeconds, methodAndParams, shouldWaitNow)
+	if err == nil && jobId >= 0 && g_async && !shouldWaitNow {
+		leaveJobRunning(api, jobId)
+		return nil, jobId, nil
+	}
 	if !shouldWaitNow || err != nil || jobId < 0 {
 		return nil, jobId, err
 	}
 
-	out, err := api.WaitForJob(jobId)
+	out, err := core.WaitForJob(api, jobId)
 	return out, jobId, err
 }
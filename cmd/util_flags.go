@@ -37,6 +37,10 @@ func ResetAuxCobraFlags(cmd *cobra.Command) {
 }
 
 func GetCobraFlags(cmd *cobra.Command, keepGlobals bool, cmdEnums map[string][]string) (FlagMap, error) {
+	if err := applyCommandDefaults(cmd); err != nil {
+		return FlagMap{}, err
+	}
+
 	fm := FlagMap{}
 	fm.usedFlags = make(map[string]string)
 	cmd.Flags().Visit(func(flag *pflag.Flag) {
@@ -196,13 +200,49 @@ func AddFlagsEnum(enumMap *map[string][]string, flagName string, newEnum []strin
 
 func WrapCommandFunc(cmdFunc func(*cobra.Command,core.Session,[]string)error) func(*cobra.Command,[]string)error {
 	return func(cmd *cobra.Command, args []string) error {
-		api := InitializeApiClient()
+		api := InitializeApiClient(cmd.Context())
 		if api == nil {
 			return nil
 		}
 		err := cmdFunc(cmd, api, args)
-		return api.Close(err)
+		return explainApiErrors(cmd, api.Close(err))
+	}
+}
+
+// explainApiErrors names the flags behind any validation errors reported by the middleware,
+// and with --debug, adds the middleware's traceback
+func explainApiErrors(cmd *cobra.Command, err error) error {
+	var details strings.Builder
+	for _, apiErr := range core.FindApiErrors(err) {
+		for _, v := range apiErr.ValidationErrors {
+			details.WriteString("\n  ")
+			details.WriteString(getValidationErrorSource(cmd, v.Attribute))
+			details.WriteString(": ")
+			details.WriteString(v.Message)
+		}
+		if g_debug && apiErr.Trace != "" {
+			details.WriteString("\nTraceback from the middleware:\n")
+			details.WriteString(apiErr.Trace)
+		}
+	}
+	if details.Len() == 0 {
+		return err
+	}
+	return fmt.Errorf("%w%s", err, details.String())
+}
+
+// getValidationErrorSource returns the flag that set the param with a validation error, eg. "--comments" for
+// "pool_dataset_create.comments", or the attribute itself if no flag matches
+func getValidationErrorSource(cmd *cobra.Command, attribute string) string {
+	path := strings.Split(attribute, ".")
+	if len(path) < 2 {
+		return attribute
+	}
+	flagName := strings.ReplaceAll(path[1], "_", "-")
+	if flag := cmd.Flags().Lookup(flagName); flag != nil && rootCmd.PersistentFlags().Lookup(flagName) == nil {
+		return "--" + flagName
 	}
+	return attribute
 }
 
 func WrapCommandFuncWithoutApi(cmdFunc func(*cobra.Command,core.Session,[]string)error) func(*cobra.Command,[]string)error {
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"truenas/truenas_incus_ctl/core"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+const progressBarWidth = 30
+
+var g_progressEnums map[string][]string
+
+// progressReporter shows the progress of a job, either as a bar drawn on a terminal or as a line of JSON per update
+type progressReporter struct {
+	isJson bool
+	out    io.Writer
+	drawn  bool
+}
+
+func AddProgressFlags(cmd *cobra.Command) {
+	cmd.Flags().String("format", "text", "Show job progress as a bar on a terminal, or as one JSON object per update "+
+		AddFlagsEnum(&g_progressEnums, "format", []string{"text", "json"}))
+}
+
+// getProgressReporter removes the flags added by AddProgressFlags, so that they aren't sent to the API.
+// Returns nil if there's nowhere to show progress, ie. neither --format=json nor a terminal that the session can report progress to.
+func getProgressReporter(api core.Session, options FlagMap) (*progressReporter, error) {
+	format, exists := options.allFlags["format"]
+	if !exists {
+		return nil, nil
+	}
+	RemoveFlag(options, "format")
+
+	flags := map[string]string{"format": format}
+	if err := ValidateFlagEnums(&flags, g_progressEnums); err != nil {
+		return nil, err
+	}
+	if flags["format"] == "JSON" {
+		return &progressReporter{isJson: true, out: os.Stdout}, nil
+	}
+	if core.ReportsJobProgress(api) && term.IsTerminal(int(os.Stderr.Fd())) {
+		return &progressReporter{out: os.Stderr}, nil
+	}
+	return nil, nil
+}
+
+func (p *progressReporter) update(progress core.JobProgress) {
+	if p.isJson {
+		data, _ := json.Marshal(progress)
+		fmt.Fprintln(p.out, string(data))
+		return
+	}
+
+	percent := progress.Percent
+	if percent < 0 {
+		percent = 0
+	} else if percent > 100 {
+		percent = 100
+	}
+	filled := int(percent * progressBarWidth / 100)
+	line := fmt.Sprintf("[%s%s] %3.0f%% %s",
+		strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled), percent, progress.Description)
+
+	if width, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && width > 0 && len(line) >= width {
+		line = line[:width-1]
+	}
+	fmt.Fprint(p.out, "\r\033[K"+line)
+	p.drawn = true
+}
+
+func (p *progressReporter) finish() {
+	if p.drawn {
+		fmt.Fprintln(p.out)
+		p.drawn = false
+	}
+}
+
+// waitForJob waits on a job, showing its progress if p isn't nil
+func (p *progressReporter) waitForJob(api core.Session, jobId int64) (json.RawMessage, error) {
+	if p == nil {
+		return core.WaitForJob(api, jobId)
+	}
+	defer p.finish()
+	return core.WaitForJobWithProgress(api, jobId, p.update)
+}
@@ -1,10 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"truenas/truenas_incus_ctl/core"
 
@@ -24,11 +26,12 @@ func (s *UnitTestSession) Login() error { return nil }
 func (s *UnitTestSession) IsLoggedIn() bool { return true }
 func (s *UnitTestSession) GetHostName() string { return "" }
 func (s *UnitTestSession) GetUrl() string { return "" }
-func (s *UnitTestSession) WaitForJob(jobId int64) (json.RawMessage, error) { return nil, nil }
+func (s *UnitTestSession) Context() context.Context { return context.Background() }
+func (s *UnitTestSession) WaitForJob(ctx context.Context, jobId int64) (json.RawMessage, error) { return nil, nil }
 func (s *UnitTestSession) SkipWaitingJobOnClose(jobId int64) {}
 func (s *UnitTestSession) Close(internalError error) error { return nil }
 
-func (s *UnitTestSession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+func (s *UnitTestSession) CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
 	if s.shouldIncCallIdx {
 		s.callIdx++
 	}
@@ -44,16 +47,24 @@ func (s *UnitTestSession) CallRaw(method string, timeoutSeconds int64, params in
 	return response, nil
 }
 
-func (s *UnitTestSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
-	_, err := s.CallRaw(method, 10, params)
+func (s *UnitTestSession) CallAsyncRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (int64, error) {
+	_, err := s.CallRaw(ctx, method, timeoutSeconds, params)
 	return -1, err
 }
 
+// ReplayTestSession serves a session recorded with --record, collecting the tables that the command prints
+type ReplayTestSession struct {
+	*core.ReplaySession
+	tables strings.Builder
+}
+
 func PrintTable(api core.Session, str string) {
 	if unit, isUnitTest := api.(*UnitTestSession); isUnitTest {
 		if unit.tableExpected != str {
 			unit.test.Error(errors.New("table:\n" + str + "did not match expected:\n" + unit.tableExpected))
 		}
+	} else if replay, isReplayTest := api.(*ReplayTestSession); isReplayTest {
+		replay.tables.WriteString(str)
 	} else {
 		os.Stdout.WriteString(str)
 	}
@@ -135,6 +146,39 @@ func DoTest(
 	return nil
 }
 
+// DoReplayTest runs a command against a recording made with --record, eg. one attached to a bug report.
+// It fails if the command makes a call that wasn't recorded, skips one that was, or prints a different table.
+func DoReplayTest(
+	t *testing.T,
+	cmd *cobra.Command,
+	commandFunc func(*cobra.Command,core.Session,[]string)error,
+	props map[string]interface{},
+	args []string,
+	recordingFile string,
+	tableExpected string,
+) error {
+	replay, err := core.NewReplaySession(recordingFile)
+	if err != nil {
+		return err
+	}
+	for key, value := range props {
+		SetAuxCobraFlag(cmd, key, value)
+	}
+	defer ResetAuxCobraFlags(cmd)
+	api := &ReplayTestSession{ReplaySession: replay}
+	// Closing waits for any jobs left running, as it does for the commands themselves
+	if err = api.Close(commandFunc(cmd, api, args)); err != nil {
+		return err
+	}
+	if unused := replay.Unused(); len(unused) > 0 {
+		return errors.New("recorded calls were not made:\n" + strings.Join(unused, "\n"))
+	}
+	if table := api.tables.String(); table != tableExpected {
+		return errors.New("table:\n" + table + "did not match expected:\n" + tableExpected)
+	}
+	return nil
+}
+
 func FailIf(t *testing.T, err error) {
 	if err != nil {
 		t.Error(err)
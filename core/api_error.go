@@ -0,0 +1,266 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// JSON-RPC error codes sent by the middleware
+const (
+	API_CODE_INVALID_PARAMS   = -32602
+	API_CODE_METHOD_NOT_FOUND = -32601
+	API_CODE_CALL_ERROR       = -32001
+)
+
+// ApiError is an error reported by the middleware, in reply to a call, as the outcome of a failed job,
+// or for one of the calls in a core.bulk job
+type ApiError struct {
+	Method           string // the method that failed, if known
+	JobId            int64  // the job that failed, or 0 for a plain call
+	State            string // FAILED or ABORTED, for jobs
+	Code             int    // JSON-RPC error code, eg. API_CODE_INVALID_PARAMS. 0 for jobs
+	Message          string // JSON-RPC error message, eg. "Invalid params"
+	Errno            int    // eg. 17
+	Errname          string // eg. "EEXIST"
+	Class            string // eg. "CallError", "ValidationErrors", or "VALIDATION" for jobs
+	Reason           string
+	ValidationErrors []ValidationError
+	Trace            string // the server's formatted traceback, if it sent one
+}
+
+// ValidationError is the complaint about one param of a call, eg. Attribute "pool_dataset_create.name"
+type ValidationError struct {
+	Attribute string
+	Message   string
+	Errno     int
+}
+
+// Error reads the same as errors extracted with ExtractApiError
+func (e *ApiError) Error() string {
+	if e.Code == 0 {
+		if e.State != "" {
+			return fmt.Sprintf("Job %d %s: %s", e.JobId, strings.ToLower(e.State), e.describe())
+		}
+		return e.describe()
+	}
+
+	var builder strings.Builder
+	builder.WriteString("\nError ")
+	builder.WriteString(fmt.Sprint(e.Code))
+	builder.WriteString("\n")
+	if e.Message != "" {
+		builder.WriteString(e.Message)
+		builder.WriteString("\n")
+	}
+	builder.WriteString(e.Reason)
+	return builder.String()
+}
+
+// describe returns the Reason, or whatever else there is to tell the error apart if the middleware didn't give one
+func (e *ApiError) describe() string {
+	for _, description := range []string{e.Reason, e.Errname, e.Class, e.Message} {
+		if description != "" {
+			return description
+		}
+	}
+	if e.Errno != 0 {
+		return fmt.Sprintf("Error %d", e.Errno)
+	}
+	return "Unknown error"
+}
+
+// IsValidation is true if the call was rejected because of its params
+func (e *ApiError) IsValidation() bool {
+	return len(e.ValidationErrors) > 0 || e.Code == API_CODE_INVALID_PARAMS
+}
+
+// NewApiError reads the "error" of a JSON-RPC response
+func NewApiError(errorValue interface{}) *ApiError {
+	errorObj, ok := errorValue.(map[string]interface{})
+	if !ok {
+		return &ApiError{Reason: fmt.Sprint(errorValue)}
+	}
+
+	e := &ApiError{}
+	if code, ok := errorObj["code"].(float64); ok {
+		e.Code = int(code)
+	}
+	if message, exists := errorObj["message"]; exists && message != nil {
+		e.Message = fmt.Sprint(message)
+	}
+	if data, ok := errorObj["data"].(map[string]interface{}); ok {
+		if errno, ok := data["error"].(float64); ok {
+			e.Errno = int(errno)
+		}
+		e.Errname, _ = data["errname"].(string)
+		if reason, exists := data["reason"]; exists && reason != nil {
+			e.Reason = fmt.Sprint(reason)
+		}
+		if trace, ok := data["trace"].(map[string]interface{}); ok {
+			e.Class, _ = trace["class"].(string)
+			e.Trace, _ = trace["formatted"].(string)
+		}
+		e.ValidationErrors = parseValidationErrors(data["extra"])
+	}
+	return e
+}
+
+// ParseApiError returns the error in a JSON-RPC response, or nil if there isn't one. A response that can't be parsed
+// is an error too.
+func ParseApiError(data json.RawMessage) *ApiError {
+	if len(data) == 0 {
+		return nil
+	}
+	var response interface{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return &ApiError{Reason: "Could not parse the response: " + err.Error()}
+	}
+	responseMap, ok := response.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	errorValue, exists := responseMap["error"]
+	if !exists || errorValue == nil {
+		return nil
+	}
+	return NewApiError(errorValue)
+}
+
+// NewJobApiError returns the error of a job from its fields as returned by core.get_jobs, or nil if it didn't fail
+func NewJobApiError(jobId int64, fields map[string]interface{}) *ApiError {
+	state, _ := fields["state"].(string)
+	if state != "FAILED" && state != "ABORTED" {
+		return nil
+	}
+
+	e := &ApiError{JobId: jobId, State: state, Class: state}
+	e.Method, _ = fields["method"].(string)
+	if reason, exists := fields["error"]; exists && reason != nil {
+		e.Reason = fmt.Sprint(reason)
+	}
+	e.Trace, _ = fields["exception"].(string)
+	if excInfo, ok := fields["exc_info"].(map[string]interface{}); ok {
+		if class, ok := excInfo["type"].(string); ok && class != "" {
+			e.Class = class
+		}
+		if errno, ok := excInfo["errno"].(float64); ok {
+			e.Errno = int(errno)
+		}
+		e.ValidationErrors = parseValidationErrors(excInfo["extra"])
+	}
+	return e
+}
+
+// NewJobWaitApiError reads the "error" of the response to core.job_wait, which the middleware sends if it couldn't wait for the job
+func NewJobWaitApiError(jobId int64, errorValue interface{}) *ApiError {
+	e := NewApiError(errorValue)
+	e.Method = JOB_WAIT_STRING
+	e.JobId = jobId
+	return e
+}
+
+// GetJobError returns the error of a finished job, given its fields as returned by WaitForJob, including the errors
+// of any calls that failed within a core.bulk job
+func GetJobError(jobId int64, data json.RawMessage) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil
+	}
+	return GetJobFieldsError(jobId, fields)
+}
+
+// GetJobFieldsError is GetJobError for fields that have already been parsed
+func GetJobFieldsError(jobId int64, fields map[string]interface{}) error {
+	// A job's error is a string, so an object is the error of the call that waited for it
+	if errorObj, ok := fields["error"].(map[string]interface{}); ok {
+		return NewJobWaitApiError(jobId, errorObj)
+	}
+	if apiErr := NewJobApiError(jobId, fields); apiErr != nil {
+		return apiErr
+	}
+	if method, _ := fields["method"].(string); method != "core.bulk" {
+		return nil
+	}
+
+	var innerMethod string
+	if args, ok := fields["arguments"].([]interface{}); ok && len(args) > 0 {
+		innerMethod, _ = args[0].(string)
+	}
+	results, _ := fields["result"].([]interface{})
+	errorList := make([]error, 0)
+	for _, result := range results {
+		resultObj, _ := result.(map[string]interface{})
+		if reason, exists := resultObj["error"]; exists && reason != nil {
+			e := &ApiError{Method: innerMethod, Reason: fmt.Sprint(reason)}
+			if innerJobId, ok := resultObj["job_id"].(float64); ok {
+				e.JobId = int64(innerJobId)
+			}
+			errorList = append(errorList, e)
+		}
+	}
+	return MakeErrorFromList(errorList)
+}
+
+// WaitForJob waits for a job, returning its fields, along with its error if it failed. Since the error has been
+// returned, the session won't report it again when it's closed.
+func WaitForJob(s Session, jobId int64) (json.RawMessage, error) {
+	out, err := s.WaitForJob(s.Context(), jobId)
+	return checkJobResult(s, jobId, out, err)
+}
+
+// checkJobResult turns the outcome of a job that was waited for into an error
+func checkJobResult(s Session, jobId int64, out json.RawMessage, err error) (json.RawMessage, error) {
+	if err != nil {
+		return out, err
+	}
+	s.SkipWaitingJobOnClose(jobId)
+	return out, GetJobError(jobId, out)
+}
+
+// parseValidationErrors reads the "extra" of a ValidationErrors, which is a list of [attribute, message, errno]
+func parseValidationErrors(extra interface{}) []ValidationError {
+	list, _ := extra.([]interface{})
+	var validationErrors []ValidationError
+	for _, elem := range list {
+		entry, ok := elem.([]interface{})
+		if !ok || len(entry) < 2 {
+			continue
+		}
+		attribute, _ := entry[0].(string)
+		message, _ := entry[1].(string)
+		v := ValidationError{Attribute: attribute, Message: message}
+		if len(entry) > 2 {
+			if errno, ok := entry[2].(float64); ok {
+				v.Errno = int(errno)
+			}
+		}
+		validationErrors = append(validationErrors, v)
+	}
+	return validationErrors
+}
+
+// FindApiErrors returns every ApiError in err, including those in a list made by MakeErrorFromList
+func FindApiErrors(err error) []*ApiError {
+	var found []*ApiError
+	var visit func(err error)
+	visit = func(err error) {
+		if err == nil {
+			return
+		}
+		if apiErr, ok := err.(*ApiError); ok {
+			found = append(found, apiErr)
+			return
+		}
+		switch wrapped := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, e := range wrapped.Unwrap() {
+				visit(e)
+			}
+		case interface{ Unwrap() error }:
+			visit(wrapped.Unwrap())
+		}
+	}
+	visit(err)
+	return found
+}
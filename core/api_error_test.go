@@ -0,0 +1,64 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestParseApiError(t *testing.T) {
+	response := json.RawMessage(`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Invalid params","data":{
+		"error":22,"errname":"EINVAL","reason":"[EINVAL] pool_dataset_create.comments: Not a string",
+		"trace":{"class":"ValidationErrors","formatted":"Traceback (most recent call last):"},
+		"extra":[["pool_dataset_create.comments","Not a string",22]]}}}`)
+
+	apiErr := ParseApiError(response)
+	if apiErr == nil {
+		t.Fatal("Expected an error")
+	}
+	AssertEqual(t, apiErr.Code, API_CODE_INVALID_PARAMS)
+	AssertEqual(t, apiErr.Errname, "EINVAL")
+	AssertEqual(t, apiErr.Class, "ValidationErrors")
+	AssertEqual(t, apiErr.Trace, "Traceback (most recent call last):")
+	AssertEqual(t, apiErr.IsValidation(), true)
+	AssertEqual(t, len(apiErr.ValidationErrors), 1)
+	AssertEqual(t, apiErr.ValidationErrors[0], ValidationError{Attribute: "pool_dataset_create.comments", Message: "Not a string", Errno: 22})
+	// Reads the same as the string errors that it replaces
+	AssertEqual(t, apiErr.Error(), ExtractApiError(response))
+
+	if ParseApiError(json.RawMessage(`{"jsonrpc":"2.0","id":1,"result":null}`)) != nil {
+		t.Fatal("Expected no error in a result")
+	}
+	if apiErr = ParseApiError(json.RawMessage(`{"jsonrpc":"2.0","id":1,"res`)); apiErr == nil || apiErr.Error() == "" {
+		t.Fatal("Expected a response that can't be parsed to be an error")
+	}
+
+	// Errors without a reason still say something
+	AssertEqual(t, NewApiError(map[string]interface{}{"data": map[string]interface{}{"error": 2.0, "errname": "ENOENT"}}).Error(), "ENOENT")
+	AssertEqual(t, (&ApiError{JobId: 4, State: "FAILED", Class: "CallError"}).Error(), "Job 4 failed: CallError")
+}
+
+func TestGetJobError(t *testing.T) {
+	failed := json.RawMessage(`{"id":5,"method":"pool.dataset.delete","state":"FAILED","error":"[EBUSY] Dataset is busy",
+		"exception":"Traceback","exc_info":{"type":"CallError","errno":16,"extra":null}}`)
+	err := GetJobError(5, failed)
+	apiErrors := FindApiErrors(err)
+	AssertEqual(t, len(apiErrors), 1)
+	AssertEqual(t, apiErrors[0].Errno, 16)
+	AssertEqual(t, apiErrors[0].Trace, "Traceback")
+	AssertEqual(t, err.Error(), "Job 5 failed: [EBUSY] Dataset is busy")
+
+	bulk := json.RawMessage(`{"id":6,"method":"core.bulk","state":"SUCCESS","arguments":["pool.dataset.delete",[["tank/a"],["tank/b"]]],
+		"result":[{"job_id":null,"result":true,"error":null},{"job_id":null,"result":null,"error":"[ENOENT] tank/b does not exist"}]}`)
+	err = GetJobError(6, bulk)
+	apiErrors = FindApiErrors(err)
+	AssertEqual(t, len(apiErrors), 1)
+	AssertEqual(t, apiErrors[0].Method, "pool.dataset.delete")
+	AssertEqual(t, apiErrors[0].Reason, "[ENOENT] tank/b does not exist")
+
+	// Errors can still be found once they've been combined and wrapped
+	combined := fmt.Errorf("Delete failed: %w", MakeErrorFromList([]error{fmt.Errorf("other"), err}))
+	AssertEqual(t, len(FindApiErrors(combined)), 1)
+
+	AssertEqual(t, GetJobError(7, json.RawMessage(`{"id":7,"state":"SUCCESS","result":true}`)), nil)
+}
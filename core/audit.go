@@ -0,0 +1,297 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const REDACTED_STRING = "********"
+
+// AuditRecord is one line of the audit log. A call that starts a job gets a record when it's made,
+// then another once the job finishes, with the same job_id.
+type AuditRecord struct {
+	Time     time.Time       `json:"time"`
+	User     string          `json:"user"`
+	Host     string          `json:"host"`
+	Method   string          `json:"method"`
+	Params   interface{}     `json:"params,omitempty"`
+	Result   json.RawMessage `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	JobId    int64           `json:"job_id,omitempty"`
+	JobState string          `json:"job_state,omitempty"`
+}
+
+// AuditLog appends a JSON line for every call that may change something on a TrueNAS host.
+// A nil *AuditLog records nothing.
+type AuditLog struct {
+	path        string
+	user        string
+	mtx         sync.Mutex
+	pendingJobs map[string]AuditRecord // jobs started by audited calls, by host and job id
+}
+
+func NewAuditLog(fileName string) *AuditLog {
+	userName := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		userName = u.Username
+	}
+	return &AuditLog{
+		path:        fileName,
+		user:        userName,
+		pendingJobs: make(map[string]AuditRecord),
+	}
+}
+
+// IsReadOnlyMethod reports whether a method only reads state, going by its name
+func IsReadOnlyMethod(method string) bool {
+	lastDot := strings.LastIndex(method, ".")
+	name := method[lastDot+1:]
+	return name == "query" || name == "get_instance" || name == "config" || strings.HasPrefix(name, "get_")
+}
+
+func isAuditedMethod(method string) bool {
+	return isMutatingMethod(method)
+}
+
+// isMutatingMethod reports whether a method may change something on the host
+func isMutatingMethod(method string) bool {
+	if IsReadOnlyMethod(method) || strings.HasPrefix(method, TNC_PREFIX_STRING) {
+		return false
+	}
+	switch method {
+	case "core.ping", "core.subscribe", "core.unsubscribe", JOB_WAIT_STRING, "service.started":
+		return false
+	// Logging in only changes the state of the connection. Other auth methods, eg. auth.generate_token, change the host's.
+	case "auth.login", "auth.login_ex", "auth.login_with_api_key", "auth.login_with_token", "auth.logout", "auth.me":
+		return false
+	}
+	return true
+}
+
+func isSecretKey(key string) bool {
+	k := strings.ToLower(key)
+	for _, word := range []string{"password", "passphrase", "secret", "token", "otp"} {
+		if strings.Contains(k, word) {
+			return true
+		}
+	}
+	return k == "key" || strings.HasSuffix(k, "_key") || strings.HasSuffix(k, "-key")
+}
+
+// RedactSecrets returns a copy of params with the values of anything that looks like a password or key replaced
+func RedactSecrets(params interface{}) interface{} {
+	switch value := params.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			if isSecretKey(k) && v != nil && v != "" {
+				out[k] = REDACTED_STRING
+			} else {
+				out[k] = RedactSecrets(v)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, v := range value {
+			out[i] = RedactSecrets(v)
+		}
+		return out
+	}
+	return params
+}
+
+// Methods whose whole result is a secret, rather than an object that RedactSecrets can find the secret in
+var g_secretResultMethods = map[string]bool{
+	"auth.generate_token": true,
+}
+
+// redactResult returns the result of a method as JSON, with any secrets in it redacted
+func redactResult(method string, result interface{}) json.RawMessage {
+	if g_secretResultMethods[method] {
+		out, _ := json.Marshal(REDACTED_STRING)
+		return out
+	}
+	return redactJson(result)
+}
+
+// RecordCall logs a call once it has returned. If it started a job, jobId should be set, and RecordJobFinished called later.
+func (a *AuditLog) RecordCall(host, method string, params interface{}, result json.RawMessage, err error, jobId int64) {
+	if a == nil || !isAuditedMethod(method) {
+		return
+	}
+	// params usually arrive as a struct or as JSON, either way the redaction works on the generic form
+	var generic interface{}
+	if data, errMarshal := json.Marshal(params); errMarshal == nil {
+		_ = json.Unmarshal(data, &generic)
+	}
+
+	record := AuditRecord{
+		Time:   time.Now(),
+		User:   a.user,
+		Host:   host,
+		Method: method,
+		Params: RedactSecrets(generic),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	} else {
+		record.Result, record.Error = splitApiResponse(result)
+		if len(record.Result) > 0 {
+			record.Result = redactResult(method, record.Result)
+		}
+	}
+	if jobId > 0 && err == nil {
+		record.JobId = jobId
+		record.Result = nil
+		a.mtx.Lock()
+		a.pendingJobs[host+"\x00"+strconv.FormatInt(jobId, 10)] = record
+		a.mtx.Unlock()
+	}
+	a.append(record)
+}
+
+// RecordJobFinished logs the final state of a job started by an audited call. Other jobs are ignored.
+func (a *AuditLog) RecordJobFinished(host string, jobId int64, state string, result interface{}, jobError interface{}) {
+	if a == nil {
+		return
+	}
+	key := host + "\x00" + strconv.FormatInt(jobId, 10)
+	a.mtx.Lock()
+	started, exists := a.pendingJobs[key]
+	delete(a.pendingJobs, key)
+	a.mtx.Unlock()
+	if !exists {
+		return
+	}
+
+	record := AuditRecord{
+		Time:     time.Now(),
+		User:     started.User,
+		Host:     host,
+		Method:   started.Method,
+		Params:   started.Params,
+		Error:    formatJobError(jobError),
+		JobId:    jobId,
+		JobState: state,
+	}
+	if result != nil {
+		record.Result = redactResult(started.Method, result)
+	}
+	a.append(record)
+}
+
+// splitApiResponse separates the result of a JSON-RPC response from its error, if it has one
+func splitApiResponse(response json.RawMessage) (json.RawMessage, string) {
+	var message map[string]json.RawMessage
+	if err := json.Unmarshal(response, &message); err != nil {
+		return response, ""
+	}
+	if _, hasError := message["error"]; hasError {
+		return nil, strings.TrimSpace(ExtractApiError(response))
+	}
+	if result, exists := message["result"]; exists {
+		return result, ""
+	}
+	return response, ""
+}
+
+// formatJobError turns the error field of a finished job into a string. It's usually one already.
+func formatJobError(value interface{}) string {
+	switch errValue := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return errValue
+	case map[string]interface{}:
+		return strings.TrimSpace(ExtractApiErrorJsonGivenError(errValue))
+	}
+	return fmt.Sprint(value)
+}
+
+func (a *AuditLog) append(record AuditRecord) {
+	data, err := json.Marshal(record)
+	if err == nil {
+		a.mtx.Lock()
+		err = appendLine(a.path, data)
+		a.mtx.Unlock()
+	}
+	if err != nil {
+		log.Println("Failed to write audit record for", record.Method, ":", err)
+	}
+}
+
+func appendLine(fileName string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// O_APPEND keeps lines from the daemon and from direct sessions intact, as long as each is written at once
+	_, err = f.Write(append(data, '\n'))
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
+
+// ReadAuditLog returns every record in the log, skipping lines that can't be parsed
+func ReadAuditLog(fileName string) ([]AuditRecord, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := make([]AuditRecord, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Println(fmt.Sprintf("%s:%d: %v", fileName, lineNo, err))
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// auditCall records a call made through the daemon. If it started a job, the job is recorded again when readMessages
+// sees it finish, or straight away if it finished before the call's response arrived.
+func (s *TruenasSession) auditCall(call CallInfo, out json.RawMessage, err error) {
+	audit := s.ctx.audit
+	if audit == nil || !isAuditedMethod(call.method) {
+		return
+	}
+	host := GetHostNameFromApiUrl(s.login.serverUrl)
+	jobId := int64(-1)
+	if call.isJob && err == nil && ExtractApiError(out) == "" {
+		jobId, _ = GetJobNumber(out)
+	}
+	audit.RecordCall(host, call.method, call.params, out, err, jobId)
+	if jobId < 0 {
+		return
+	}
+
+	s.connMtx.Lock()
+	job := s.trackJob(jobId)
+	s.connMtx.Unlock()
+	if done, data, errJob := job.future.Peek(); done && errJob == nil {
+		var fields map[string]interface{}
+		_ = json.Unmarshal(data, &fields)
+		state, _ := fields["state"].(string)
+		audit.RecordJobFinished(host, jobId, state, fields["result"], fields["error"])
+	}
+}
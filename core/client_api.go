@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -14,19 +15,30 @@ import (
 	"os/exec"
 	"path"
 	"strings"
+	"syscall"
 	"time"
 )
 
 type ClientSession struct {
 	HostName string
 	ApiKey string
+	Username string // used with Password if ApiKey is empty
+	Password string
+	PromptOtp func() (string, error) // asks for a one-time password when the host requires one
 	SocketPath string
 	IsDebug bool
 	AllowInsecure bool
+	TLSFingerprint string // pinned SHA-256 fingerprint of the host's certificate, which may then be self-signed
+	CAFile string // CA bundle to verify the host's certificate against
+	AbortJobsOnCancel bool
+	Ctx context.Context
 	client *http.Client
 	timeout time.Duration
 	jobsList []int64
 	mapSkipWaitOnClose map[int64]bool
+	noLaunch bool
+	handle string
+	otp string
 }
 
 func (s *ClientSession) IsLoggedIn() bool {
@@ -40,22 +52,25 @@ func (s *ClientSession) GetUrl() string {
 	return GetApiUrlFromHostName(s.HostName)
 }
 
+func (s *ClientSession) Context() context.Context {
+	if s.Ctx == nil {
+		return context.Background()
+	}
+	return s.Ctx
+}
+
 func (s *ClientSession) Login() error {
 	var t1 time.Time
 	if s.IsDebug {
 		t1 = time.Now()
 	}
 
-	if s.jobsList == nil {
-		s.jobsList = make([]int64, 0)
-	}
-
 	var errBuilder strings.Builder
 	if s.HostName == "" {
 		errBuilder.WriteString("Hostname was not provided\n")
 	}
-	if s.ApiKey == "" {
-		errBuilder.WriteString("API key was not provided\n")
+	if s.ApiKey == "" && (s.Username == "" || s.Password == "") {
+		errBuilder.WriteString("API key was not provided, nor username and password\n")
 	}
 	if s.SocketPath == "" {
 		errBuilder.WriteString("Socket path was not provided\n")
@@ -64,11 +79,39 @@ func (s *ClientSession) Login() error {
 		return fmt.Errorf(errBuilder.String())
 	}
 
+	if err := s.connect(true); err != nil {
+		return err
+	}
+
+	if s.IsDebug {
+		fmt.Println("tncdaemon connection time:", time.Now().Sub(t1).String())
+	}
+	return nil
+}
+
+// ConnectToExistingDaemon connects to the daemon without requiring any credentials,
+// and without launching a new daemon if one isn't already listening on SocketPath.
+func (s *ClientSession) ConnectToExistingDaemon() error {
+	if s.SocketPath == "" {
+		return fmt.Errorf("Socket path was not provided")
+	}
+	s.noLaunch = true
+	return s.connect(false)
+}
+
+func (s *ClientSession) connect(shouldLaunch bool) error {
+	if s.jobsList == nil {
+		s.jobsList = make([]int64, 0)
+	}
+
 	s.timeout = time.Duration(180) * time.Second
 
 	st, err := os.Stat(s.SocketPath)
 	if err != nil {
-		if err = launchDaemonAndAwaitSocket(s.SocketPath, s.timeout, nil); err != nil {
+		if !shouldLaunch {
+			return fmt.Errorf("tncdaemon is not running (no socket at %s)", s.SocketPath)
+		}
+		if err = launchDaemonAndAwaitSocket(s.SocketPath, []string {"-t", s.timeout.String()}, nil); err != nil {
 			return fmt.Errorf("launchDaemonAndAwaitSocket: %v", err)
 		}
 		st, err = os.Stat(s.SocketPath)
@@ -91,23 +134,85 @@ func (s *ClientSession) Login() error {
 		}
 	}
 
-	request, _ := http.NewRequest("GET", "http://unix/tnc-daemon", nil)
-	request.Header.Set("TNC-Call-Method", "tnc_daemon.ping")
-	data, err, _ := requestAndMaybeRetry(s, request)
+	data, err := s.CallDaemon("ping", nil)
 	if err != nil {
 		return err
 	}
 	if string(data) != "\"pong\"" {
 		return fmt.Errorf("Unexpected response: %s", string(data))
 	}
+	return nil
+}
+
+// CallDaemon invokes one of the daemon's own procedures (tnc_daemon.*), which don't need a TrueNAS host.
+func (s *ClientSession) CallDaemon(procedure string, params interface{}) (json.RawMessage, error) {
+	var body io.Reader
+	if params != nil {
+		paramsData, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(paramsData)
+	}
+
+	request, _ := http.NewRequest("GET", "http://unix/tnc-daemon", body)
+	request.Header.Set("TNC-Call-Method", TNC_PREFIX_STRING+procedure)
+	data, err, _ := requestAndMaybeRetry(s, request)
+	return data, err
+}
+
+// StopDaemon asks the daemon to stop accepting requests, then waits for its in-flight requests to drain
+// (up to the given deadline) and for the process to exit. The daemon's options are returned so that it can be relaunched with the same settings.
+func (s *ClientSession) StopDaemon(deadline time.Duration) (DaemonOptions, error) {
+	data, err := s.CallDaemon("stop", []interface{} {deadline.String()})
+	if err != nil {
+		return DaemonOptions{}, err
+	}
 
+	var response struct {
+		Pid int `json:"pid"`
+		InFlight int64 `json:"in_flight"`
+		Options DaemonOptions `json:"options"`
+	}
+	if err = json.Unmarshal(data, &response); err != nil {
+		return DaemonOptions{}, fmt.Errorf("Unexpected response: %s", string(data))
+	}
+
+	pid := response.Pid
 	if s.IsDebug {
-		fmt.Println("tncdaemon connection time:", time.Now().Sub(t1).String())
+		fmt.Println("Waiting for tncdaemon (pid", pid, ") with", response.InFlight, "in-flight requests")
 	}
-	return nil
+	s.client = nil
+
+	if pid <= 0 {
+		return response.Options, nil
+	}
+
+	// Allow some time past the deadline for the daemon to close its websockets
+	giveUp := time.Now().Add(deadline + time.Duration(5) * time.Second)
+	for time.Now().Before(giveUp) {
+		if err = syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return response.Options, nil
+		}
+		time.Sleep(time.Duration(100) * time.Millisecond)
+	}
+	return response.Options, fmt.Errorf("tncdaemon (pid %d) did not exit within %s", pid, deadline.String())
+}
+
+// LaunchDaemon starts a new daemon on SocketPath with the given options and connects to it.
+func (s *ClientSession) LaunchDaemon(options DaemonOptions) error {
+	if err := launchDaemonAndAwaitSocket(s.SocketPath, options.flags(), nil); err != nil {
+		return fmt.Errorf("launchDaemonAndAwaitSocket: %v", err)
+	}
+	return s.connect(false)
 }
 
-func (s *ClientSession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+func (s *ClientSession) CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	return s.callRaw(ctx, method, timeoutSeconds, params, false)
+}
+
+// callRaw sends a call through the daemon. isJob tells the daemon that the call starts a job, so that it can audit the job's outcome.
+func (s *ClientSession) callRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}, isJob bool) (json.RawMessage, error) {
 	var t1 time.Time
 	if s.IsDebug {
 		t1 = time.Now()
@@ -118,16 +223,42 @@ func (s *ClientSession) CallRaw(method string, timeoutSeconds int64, params inte
 		return nil, err
 	}
 
-	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", bytes.NewReader(paramsData))
-	request.Header.Set("TNC-Host-Url", s.GetUrl())
-	request.Header.Set("TNC-Api-Key", s.ApiKey)
-	request.Header.Set("TNC-Allow-Insecure", fmt.Sprint(s.AllowInsecure))
-	request.Header.Set("TNC-Call-Method", method)
-	if timeoutSeconds > 0 {
-		request.Header.Set("TNC-Timeout", fmt.Sprintf("%ds", timeoutSeconds))
+	if s.handle == "" {
+		if err = s.register(); err != nil {
+			return nil, err
+		}
+	}
+
+	makeRequest := func() *http.Request {
+		request, _ := http.NewRequestWithContext(ctx, "POST", "http://unix/tnc-daemon", bytes.NewReader(paramsData))
+		request.Header.Set("TNC-Session-Handle", s.handle)
+		request.Header.Set("TNC-Call-Method", method)
+		if s.AbortJobsOnCancel {
+			request.Header.Set("TNC-Abort-On-Cancel", "true")
+		}
+		if timeoutSeconds > 0 {
+			request.Header.Set("TNC-Timeout", fmt.Sprintf("%ds", timeoutSeconds))
+		}
+		if isJob {
+			request.Header.Set("TNC-Job", "true")
+		}
+		return request
 	}
 
-	data, err, completed := requestAndMaybeRetry(s, request)
+	data, err, completed := requestAndMaybeRetry(s, makeRequest())
+	if errors.Is(err, ErrUnknownSessionHandle) {
+		// The daemon was restarted since we registered
+		if err = s.register(); err != nil {
+			return nil, err
+		}
+		data, err, completed = requestAndMaybeRetry(s, makeRequest())
+	}
+	if errors.Is(err, ErrOtpRequired) && s.PromptOtp != nil {
+		if err = s.registerWithOtp(); err != nil {
+			return nil, err
+		}
+		data, err, completed = requestAndMaybeRetry(s, makeRequest())
+	}
 	if !completed {
 		return data, err
 	}
@@ -137,21 +268,213 @@ func (s *ClientSession) CallRaw(method string, timeoutSeconds int64, params inte
 	return data, err
 }
 
-func (s *ClientSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
-	data, err := s.CallRaw(method, 0, params)
+// register sends our credentials to the daemon, which hands back an opaque handle to use for subsequent calls
+func (s *ClientSession) register() error {
+	request, _ := http.NewRequest("POST", "http://unix/tnc-daemon", nil)
+	request.Header.Set("TNC-Call-Method", TNC_PREFIX_STRING+"register")
+	request.Header.Set("TNC-Host-Url", s.GetUrl())
+	if s.ApiKey != "" {
+		request.Header.Set("TNC-Api-Key", s.ApiKey)
+	} else {
+		request.Header.Set("TNC-Username", s.Username)
+		request.Header.Set("TNC-Password", s.Password)
+		if s.otp != "" {
+			request.Header.Set("TNC-Otp", s.otp)
+		}
+	}
+	request.Header.Set("TNC-Allow-Insecure", fmt.Sprint(s.AllowInsecure))
+	if s.TLSFingerprint != "" {
+		request.Header.Set("TNC-Tls-Fingerprint", s.TLSFingerprint)
+	}
+	if s.CAFile != "" {
+		request.Header.Set("TNC-Ca-File", s.CAFile)
+	}
+
+	data, err, _ := requestAndMaybeRetry(s, request)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, &s.handle); err != nil || s.handle == "" {
+		return fmt.Errorf("Unexpected response to registration: %s", string(data))
+	}
+	return nil
+}
+
+// registerWithOtp asks for a one-time password and hands it to the daemon, for the login that needs it
+func (s *ClientSession) registerWithOtp() error {
+	otp, err := s.PromptOtp()
+	if err != nil {
+		return err
+	}
+	s.otp = otp
+	err = s.register()
+	// The daemon forgets it once used, so there's no point sending it again
+	s.otp = ""
+	return err
+}
+
+func (s *ClientSession) CallAsyncRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (int64, error) {
+	data, err := s.callRaw(ctx, method, timeoutSeconds, params, true)
 	if err != nil {
 		return -1, err
 	}
+	if apiErr := ParseApiError(data); apiErr != nil {
+		apiErr.Method = method
+		return -1, apiErr
+	}
 	jobId, _ := GetJobNumber(data)
 	s.jobsList = append(s.jobsList, jobId)
 	return jobId, nil
 }
 
-func (s *ClientSession) WaitForJob(jobId int64) (json.RawMessage, error) {
-	return s.CallRaw("tnc_daemon.await_job", 0, []interface{} {jobId})
+func (s *ClientSession) WaitForJob(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	return s.CallRaw(ctx, "tnc_daemon.await_job", 0, []interface{} {jobId})
+}
+
+// WaitForJobWithProgress waits for a job with tnc_daemon.stream_job, which sends each progress update as a line of JSON,
+// followed by the job's result or an error.
+func (s *ClientSession) WaitForJobWithProgress(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	response, err, isUnreachable := s.openStream(ctx, "stream_job", []interface{} {jobId})
+	if isUnreachable {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// Leave relaunching the daemon to the usual path
+		return s.WaitForJob(ctx, jobId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+	for scanner.Scan() {
+		var line struct {
+			Progress *JobProgress `json:"progress"`
+			Result json.RawMessage `json:"result"`
+			Error interface{} `json:"error"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return nil, fmt.Errorf("Unexpected response from tncdaemon: %v", err)
+		}
+		// The daemon's own errors are strings, while the middleware's are objects
+		if message, isString := line.Error.(string); isString {
+			return nil, errors.New("Error: " + message)
+		} else if line.Error != nil {
+			return nil, NewJobWaitApiError(jobId, line.Error)
+		}
+		if line.Result != nil {
+			return line.Result, nil
+		}
+		if line.Progress != nil {
+			onProgress(*line.Progress)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return nil, fmt.Errorf("tncdaemon stopped sending updates for job %d before it finished", jobId)
+}
+
+// StreamCollection passes each collection_update event for a collection to onEvent, using tnc_daemon.stream_collection,
+// until onEvent returns false, the context is cancelled or the daemon loses its connection.
+func (s *ClientSession) StreamCollection(ctx context.Context, collection string, onEvent func(json.RawMessage) bool) error {
+	if err := MaybeLogin(s); err != nil {
+		return err
+	}
+	response, err, _ := s.openStream(ctx, "stream_collection", []interface{} {collection})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer response.Body.Close()
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+	for scanner.Scan() {
+		var line struct {
+			Event json.RawMessage `json:"event"`
+			Error *string `json:"error"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("Unexpected response from tncdaemon: %v", err)
+		}
+		if line.Error != nil {
+			return errors.New("Error: " + *line.Error)
+		}
+		if line.Event != nil && !onEvent(line.Event) {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("tncdaemon stopped streaming %s", collection)
+}
+
+// openStream starts one of the daemon's streaming procedures, registering again if the daemon has forgotten this session.
+// The last return value is true if the daemon couldn't be reached at all.
+func (s *ClientSession) openStream(ctx context.Context, procedure string, params []interface{}) (*http.Response, error, bool) {
+	paramsData, err := json.Marshal(params)
+	if err != nil {
+		return nil, err, false
+	}
+	if s.handle == "" {
+		if err = s.register(); err != nil {
+			return nil, err, false
+		}
+	}
+
+	makeRequest := func() *http.Request {
+		request, _ := http.NewRequestWithContext(ctx, "POST", "http://unix/tnc-daemon", bytes.NewReader(paramsData))
+		request.Header.Set("TNC-Session-Handle", s.handle)
+		request.Header.Set("TNC-Call-Method", TNC_PREFIX_STRING+procedure)
+		if s.AbortJobsOnCancel {
+			request.Header.Set("TNC-Abort-On-Cancel", "true")
+		}
+		return request
+	}
+
+	response, err := s.client.Do(makeRequest())
+	if err == nil && response.StatusCode == http.StatusUnauthorized {
+		response.Body.Close()
+		if err = s.register(); err != nil {
+			return nil, err, false
+		}
+		response, err = s.client.Do(makeRequest())
+	}
+	if err == nil && response.StatusCode == http.StatusForbidden && s.PromptOtp != nil {
+		response.Body.Close()
+		if err = s.registerWithOtp(); err != nil {
+			return nil, err, false
+		}
+		response, err = s.client.Do(makeRequest())
+	}
+	if err != nil {
+		return nil, err, true
+	}
+
+	if response.StatusCode >= 400 {
+		data, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		return nil, errors.New("Error: " + string(data)), false
+	}
+	return response, nil, false
 }
 
 func (s *ClientSession) SkipWaitingJobOnClose(jobId int64) {
+	if s.mapSkipWaitOnClose == nil {
+		s.mapSkipWaitOnClose = make(map[int64]bool)
+	}
 	s.mapSkipWaitOnClose[jobId] = true
 }
 
@@ -172,14 +495,15 @@ func (s *ClientSession) Close(internalError error) error {
 		if shouldSkip, _ := s.mapSkipWaitOnClose[jobId]; shouldSkip {
 			continue
 		}
-		data, err := s.CallRaw("tnc_daemon.await_job", 0, []interface{} {jobId})
+		if err := s.Context().Err(); err != nil {
+			errorList = append(errorList, fmt.Errorf("Stopped waiting for job %d: %v", jobId, err))
+			continue
+		}
+		data, err := s.WaitForJob(s.Context(), jobId)
 		if err != nil {
 			errorList = append(errorList, err)
-		} else if data != nil {
-			_, errs := GetResultsAndErrorsFromApiResponseRaw(data)
-			for _, e := range errs {
-				errorList = append(errorList, errors.New(ExtractApiErrorJsonGivenError(e)))
-			}
+		} else if err = GetJobError(jobId, data); err != nil {
+			errorList = append(errorList, err)
 		}
 	}
 
@@ -198,6 +522,9 @@ call:
 		errMsg := err.Error()
 		if strings.Contains(errMsg, ": dial unix") {
 			if err := os.Remove(s.SocketPath); err == nil {
+				if s.noLaunch {
+					return nil, fmt.Errorf("tncdaemon is not running (removed stale socket %s)", s.SocketPath), false
+				}
 				err = s.Login()
 				if err != nil {
 					return nil, err, false
@@ -207,6 +534,8 @@ call:
 			}
 			retriesLeft--
 			if retriesLeft > 0 {
+				// let the daemon count how often clients fail to reach it
+				request.Header.Set("TNC-Retries", fmt.Sprint(10 - retriesLeft))
 				goto call
 			}
 		}
@@ -219,17 +548,21 @@ call:
 	if err != nil {
 		return data, err, true
 	}
+	if response.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUnknownSessionHandle, true
+	}
+	if response.StatusCode == http.StatusForbidden {
+		return nil, ErrOtpRequired, true
+	}
 	if response.StatusCode >= 400 {
 		return nil, errors.New("Error: " + string(data)), true
 	}
 	return data, err, true
 }
 
-func launchDaemon(thisExec string, socketPath string, daemonTimeout time.Duration) error {
+func launchDaemon(thisExec string, socketPath string, flags []string) error {
 	cmd := []string { "daemon" }
-	if daemonTimeout >= time.Second {
-		cmd = append(cmd, "-t", daemonTimeout.String())
-	}
+	cmd = append(cmd, flags...)
 	cmd = append(cmd, socketPath)
 
 	if err := exec.Command(thisExec, cmd...).Start(); err != nil {
@@ -238,7 +571,8 @@ func launchDaemon(thisExec string, socketPath string, daemonTimeout time.Duratio
 	return nil
 }
 
-func launchDaemonAndAwaitSocket(socketPath string, daemonTimeout time.Duration, optWarningBuilder *strings.Builder) error {
+// launchDaemonAndAwaitSocket starts a daemon, passing it the given flags, then waits for it to create its socket
+func launchDaemonAndAwaitSocket(socketPath string, flags []string, optWarningBuilder *strings.Builder) error {
 	thisExec, err := os.Executable()
 	if err != nil {
 		return err
@@ -261,7 +595,7 @@ func launchDaemonAndAwaitSocket(socketPath string, daemonTimeout time.Duration,
 		})
 	}()
 
-	if err = launchDaemon(thisExec, socketPath, daemonTimeout); err != nil {
+	if err = launchDaemon(thisExec, socketPath, flags); err != nil {
 		return err
 	}
 
@@ -1,21 +1,24 @@
 package core
 
 import (
-	"crypto/tls"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"truenas/truenas_incus_ctl/truenas_api"
 
 	"github.com/gorilla/websocket"
 )
@@ -23,119 +26,402 @@ import (
 const TNC_PREFIX_STRING = "tnc_daemon."
 const JOB_WAIT_STRING = "core.job_wait"
 const DEFAULT_CALL_TIMEOUT = "30s" // also see: cmd.defaultCallTimeout
+const DEFAULT_STOP_DEADLINE = "60s"
+const DEFAULT_MAX_CALLS_PER_CONN = 16
+const DEFAULT_HEARTBEAT_INTERVAL = "30s"
+const HEARTBEAT_TIMEOUT = time.Duration(10) * time.Second
+const RECONNECT_MAX_ATTEMPTS = 8
+const RECONNECT_MAX_BACKOFF = time.Duration(30) * time.Second
+const DEFAULT_JOB_RETENTION = "10m"
+const JOB_AWAITED_GRACE = time.Duration(1) * time.Minute
+const JOB_SWEEP_INTERVAL = time.Duration(1) * time.Minute
 
 type TruenasSession struct {
-	url             string
-	conn            *websocket.Conn
-	ctx             *DaemonContext
-	sessionKey      string
-	channel         int
-	connMtx         *sync.Mutex
-	callInProgress_ bool
-	curCallId_      int64
-	callMap_        map[int64]*Future[json.RawMessage]
-	jobMap_         map[int64]*Future[json.RawMessage]
+	url                string
+	login              LoginInfo
+	conn               *websocket.Conn
+	ctx                *DaemonContext
+	sessionKey         string
+	channel            int
+	connMtx            *sync.Mutex
+	writeMtx           *sync.Mutex
+	connectedSince     time.Time
+	readyCh_           chan struct{} // closed once logged in and subscribed, replaced while reconnecting
+	isReady_           bool
+	isClosed_          bool
+	deadErr_           error
+	reconnects_        int
+	reconnectAttempts_ int
+	heartbeatCallId_   int64
+	callsInFlight_     int
+	curCallId_         int64
+	callMap_           map[int64]*Future[json.RawMessage]
+	jobMap_            map[int64]*trackedJob
+	subscriptions_     map[string]bool                          // collections subscribed to for the query cache or for event listeners
+	eventListeners_    map[string]map[chan json.RawMessage]bool // clients streaming each collection's events
+}
+
+// trackedJob holds the result of a job seen on the core.get_jobs subscription, which includes jobs
+// started by the web UI or other clients. Once finished, it is kept until expiresAt so that clients
+// can still await it, then removed by sweepJobs.
+type trackedJob struct {
+	future       *Future[json.RawMessage]
+	trackedSince time.Time
+	expiresAt    time.Time // zero while the job is still running
+	progress_    json.RawMessage
+	progressCh_  chan struct{} // closed when progress_ changes, created by whoever is watching
+}
+
+// Each channel is a websocket connection carrying up to maxCallsPerConn concurrent requests.
+// callsInFlight counts requests routed to the channel, including those still waiting for it to connect.
+type sessionSlot struct {
+	future        *Future[*TruenasSession]
+	callsInFlight int
+}
+
+type DaemonOptions struct {
+	Timeout           string `json:"timeout"`
+	MaxCallsPerConn   int    `json:"max_calls_per_connection"`
+	HeartbeatInterval string `json:"heartbeat"`
+	JobRetention      string `json:"job_retention"`
+	MetricsListen     string `json:"metrics_listen"`  // address for the Prometheus metrics listener, disabled if empty
+	QueryCacheTTL     string `json:"query_cache_ttl"` // how long to cache *.query results for, disabled if empty or 0
+	AuditLog          string `json:"audit_log"`       // file to append a record of each mutating call to, disabled if empty
+}
+
+// flags gives the command line flags that start a daemon with these options
+func (options DaemonOptions) flags() []string {
+	flags := make([]string, 0)
+	if options.Timeout != "" {
+		flags = append(flags, "-t", options.Timeout)
+	}
+	if options.MaxCallsPerConn > 0 {
+		flags = append(flags, "--max-calls-per-connection", strconv.Itoa(options.MaxCallsPerConn))
+	}
+	if options.HeartbeatInterval != "" {
+		flags = append(flags, "--heartbeat", options.HeartbeatInterval)
+	}
+	if options.JobRetention != "" {
+		flags = append(flags, "--job-retention", options.JobRetention)
+	}
+	if options.MetricsListen != "" {
+		flags = append(flags, "--metrics-listen", options.MetricsListen)
+	}
+	if options.QueryCacheTTL != "" {
+		flags = append(flags, "--query-cache-ttl", options.QueryCacheTTL)
+	}
+	// Left out, the daemon would fall back to the default audit log
+	if options.AuditLog != "" {
+		flags = append(flags, "--audit-log", options.AuditLog)
+	} else {
+		flags = append(flags, "--no-audit-log")
+	}
+	return flags
 }
 
 type DaemonContext struct {
-	timeoutValue time.Duration
-	timeoutTimer *time.Timer
-	mapMtx       *sync.Mutex
-	sessionMap_  map[string][]*Future[*TruenasSession]
+	options           DaemonOptions // as given, with defaults filled in, so that a restart can start the same daemon
+	timeoutValue      time.Duration
+	maxCallsPerConn   int
+	heartbeatInterval time.Duration
+	jobRetention      time.Duration
+	timeoutTimer      *time.Timer
+	mapMtx            *sync.Mutex
+	lastActivity_     time.Time
+	handleSecret      []byte
+	registrations_    map[string]*sessionRegistration
+	sessionMap_       map[string][]*sessionSlot
+	sessionHosts_     map[string]string
+	stopCh            chan time.Duration
+	stopping          atomic.Bool
+	inFlight          atomic.Int64
+	metrics           *daemonMetrics
+	queryCache        *queryCache // nil unless enabled
+	audit             *AuditLog   // nil unless enabled
 }
 
 type CallInfo struct {
-	method string
-	params []interface{}
+	method        string
+	params        []interface{}
+	abortOnCancel bool
+	onProgress    func(json.RawMessage) // set by tnc_daemon.stream_job and tnc_daemon.stream_collection
+	isJob         bool                  // the client expects the call to return a job id
 }
 
 type LoginInfo struct {
-	call          CallInfo
-	serverUrl     string
-	allowInsecure bool
+	call      CallInfo       // the API key login, unless password is set
+	password  *passwordLogin // shared by every channel using this login
+	serverUrl string
+	tlsTrust  truenas_api.TLSTrust
 }
 
-func RunDaemon(serverSockAddr string, globalTimeoutStr string) {
-	var err error
-	var daemonTimeout time.Duration
-	if globalTimeoutStr != "" {
-		daemonTimeout, err = time.ParseDuration(globalTimeoutStr)
+func RunDaemon(serverSockAddr string, options DaemonOptions) {
+	daemon, err := newDaemonContext(options)
+	if err != nil {
+		log.Fatal("Error: " + err.Error())
+	}
+	daemonTimeout := daemon.timeoutValue
+
+	// Under socket activation, systemd owns the socket, so it's neither created nor removed here
+	ls, err := listenerFromSystemd(SD_LISTEN_FDS_START)
+	if err != nil {
+		fmt.Println("Socket activation error:", err)
+		return
+	}
+	isActivated := ls != nil
+	if isActivated {
+		fmt.Println("Serving on the socket passed by systemd")
+	} else {
+		if serverSockAddr == "" {
+			fmt.Println("Error: path to server socket was not provided")
+			return
+		}
+		fmt.Println("Serving on", serverSockAddr)
+		ls, err = listenPrivateUnix(serverSockAddr)
 		if err != nil {
-			log.Fatal("Error: could not parse duration \"" + globalTimeoutStr + "\":" + err.Error())
+			fmt.Println("Listen error:", err)
+			return
 		}
 	}
 
-	fmt.Println("Serving on", serverSockAddr)
 	if daemonTimeout != 0 {
 		fmt.Println("With a daemon timeout of", daemonTimeout.String())
 	}
-
-	ls, err := net.Listen("unix", serverSockAddr)
-	if err != nil {
-		fmt.Println("Listen error:", err)
-		return
+	fmt.Println("With up to", daemon.maxCallsPerConn, "concurrent calls per connection")
+	fmt.Println("Keeping finished jobs for", daemon.jobRetention.String())
+	if daemon.queryCache != nil {
+		fmt.Println("Caching query results for", daemon.queryCache.ttl.String())
+	}
+	if daemon.audit != nil {
+		fmt.Println("Recording mutating calls in", daemon.audit.path)
 	}
 
-	var timer *time.Timer
 	if daemonTimeout != 0 {
-		timer = time.NewTimer(daemonTimeout)
+		daemon.timeoutTimer = time.NewTimer(daemonTimeout)
 	}
 
-	daemon := &DaemonContext{
-		timeoutValue: daemonTimeout,
-		timeoutTimer: timer,
-		mapMtx:       &sync.Mutex{},
-		sessionMap_:  make(map[string][]*Future[*TruenasSession]),
+	var metricsServer *http.Server
+	if options.MetricsListen != "" {
+		metricsServer, err = daemon.serveMetrics(options.MetricsListen)
+		if err != nil {
+			ls.Close()
+			fmt.Println("Metrics listen error:", err)
+			return
+		}
+		fmt.Println("Serving metrics on", options.MetricsListen)
+	}
+
+	server := &http.Server{Handler: daemon}
+	var sockInfo os.FileInfo
+	if !isActivated {
+		sockInfo, _ = os.Stat(serverSockAddr)
 	}
+	exitedCh := make(chan struct{})
+	go daemon.runJobSweeper(exitedCh)
 
-	doneCh := make(chan os.Signal)
+	doneCh := make(chan os.Signal, 1)
 	signal.Notify(doneCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
+		defer close(exitedCh)
+
+		var timeoutCh <-chan time.Time
 		if daemon.timeoutTimer != nil {
-			select {
-			case <-daemon.timeoutTimer.C:
-				log.Println("tncdaemon timed out (" + daemonTimeout.String() + " elapsed)")
-				break
-			case <-doneCh:
-				log.Println("tncdaemon exiting")
-				break
-			}
-		} else {
-			<-doneCh
-		}
-		_ = ls.Close()
-		sessions := make([]*Future[*TruenasSession], 0)
-		daemon.mapMtx.Lock()
-		for _, futures := range daemon.sessionMap_ {
-			sessions = append(sessions, futures...)
-		}
-		daemon.mapMtx.Unlock()
-		for _, future := range sessions {
-			if future != nil {
-				_, s, _ := future.Peek()
-				if s != nil {
-					s.conn.Close()
-				}
-			}
+			timeoutCh = daemon.timeoutTimer.C
+		}
+
+		deadline, _ := time.ParseDuration(DEFAULT_STOP_DEADLINE)
+		select {
+		case <-timeoutCh:
+			log.Println("tncdaemon timed out (" + daemonTimeout.String() + " elapsed)")
+		case <-doneCh:
+			log.Println("tncdaemon exiting")
+		case deadline = <-daemon.stopCh:
+			log.Println("tncdaemon stopping, waiting up to", deadline.String(), "for in-flight requests")
+		}
+
+		daemon.drainAndClose(server, deadline)
+		if metricsServer != nil {
+			_ = metricsServer.Close()
+		}
+
+		// A client may have replaced our socket with a new daemon's while we were draining
+		if st, err := os.Stat(serverSockAddr); err == nil && sockInfo != nil && os.SameFile(st, sockInfo) {
+			os.Remove(serverSockAddr)
 		}
-		os.Remove(serverSockAddr)
-		os.Exit(0)
 	}()
 
-	http.Serve(ls, daemon)
+	err = server.Serve(ls)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("Serve error:", err)
+		select {
+		case doneCh <- syscall.SIGTERM:
+		default:
+		}
+	}
+
+	<-exitedCh
+}
+
+// drainAndClose stops accepting connections, gives in-flight requests (including await_job) until
+// the deadline to finish, then closes every websocket, failing whatever is still outstanding.
+func (d *DaemonContext) drainAndClose(server *http.Server, deadline time.Duration) {
+	d.stopping.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("tncdaemon: abandoning", d.inFlight.Load(), "in-flight request(s):", err)
+		_ = server.Close()
+	}
+
+	for _, s := range d.getSessions() {
+		s.close()
+	}
+}
+
+// requestStop is called by tnc_daemon.stop. The response is written before the listener is shut down,
+// since Shutdown waits for every active request to finish, including this one.
+func (d *DaemonContext) requestStop(params []interface{}) (json.RawMessage, error) {
+	deadlineStr := DEFAULT_STOP_DEADLINE
+	if len(params) > 0 {
+		if str, ok := params[0].(string); ok && str != "" {
+			deadlineStr = str
+		}
+	}
+	deadline, err := time.ParseDuration(deadlineStr)
+	if err != nil {
+		return nil, fmt.Errorf("tnc_daemon.stop: could not parse deadline \"%s\": %v", deadlineStr, err)
+	}
+
+	select {
+	case d.stopCh <- deadline:
+	default:
+		// already stopping
+	}
 
-	doneCh <- syscall.SIGTERM
+	response := make(map[string]interface{})
+	response["pid"] = os.Getpid()
+	response["in_flight"] = d.inFlight.Load() - 1
+	response["options"] = d.options
+	return json.Marshal(response)
+}
+
+func newDaemonContext(options DaemonOptions) (*DaemonContext, error) {
+	var err error
+	var daemonTimeout time.Duration
+	if options.Timeout != "" {
+		daemonTimeout, err = time.ParseDuration(options.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse duration \"%s\": %v", options.Timeout, err)
+		}
+	}
+
+	if options.HeartbeatInterval == "" {
+		options.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	heartbeat, err := time.ParseDuration(options.HeartbeatInterval)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse heartbeat interval \"%s\": %v", options.HeartbeatInterval, err)
+	}
+
+	if options.JobRetention == "" {
+		options.JobRetention = DEFAULT_JOB_RETENTION
+	}
+	jobRetention, err := time.ParseDuration(options.JobRetention)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse job retention \"%s\": %v", options.JobRetention, err)
+	}
+	if jobRetention <= 0 {
+		return nil, fmt.Errorf("job retention must be greater than zero, got \"%s\"", options.JobRetention)
+	}
+
+	var cache *queryCache
+	if options.QueryCacheTTL != "" {
+		ttl, err := time.ParseDuration(options.QueryCacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse query cache TTL \"%s\": %v", options.QueryCacheTTL, err)
+		}
+		if ttl > 0 {
+			cache = newQueryCache(ttl)
+		}
+	}
+
+	var audit *AuditLog
+	if options.AuditLog != "" {
+		audit = NewAuditLog(options.AuditLog)
+	}
+
+	if options.MaxCallsPerConn <= 0 {
+		options.MaxCallsPerConn = DEFAULT_MAX_CALLS_PER_CONN
+	}
+
+	return &DaemonContext{
+		options:           options,
+		timeoutValue:      daemonTimeout,
+		maxCallsPerConn:   options.MaxCallsPerConn,
+		heartbeatInterval: heartbeat,
+		jobRetention:      jobRetention,
+		mapMtx:            &sync.Mutex{},
+		lastActivity_:     time.Now(),
+		handleSecret:      makeHandleSecret(),
+		registrations_:    make(map[string]*sessionRegistration),
+		sessionMap_:       make(map[string][]*sessionSlot),
+		sessionHosts_:     make(map[string]string),
+		stopCh:            make(chan time.Duration, 1),
+		metrics:           newDaemonMetrics(),
+		queryCache:        cache,
+		audit:             audit,
+	}, nil
 }
 
 func (d *DaemonContext) UpdateCountdown() {
+	d.mapMtx.Lock()
+	d.lastActivity_ = time.Now()
+	d.mapMtx.Unlock()
 	if d.timeoutTimer != nil {
 		d.timeoutTimer.Reset(d.timeoutValue)
 	}
 }
 
 func (d *DaemonContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	out, err := d.serveImpl(r)
+	if d.stopping.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "tncdaemon is shutting down")
+		return
+	}
+
+	d.inFlight.Add(1)
+	defer d.inFlight.Add(-1)
+
+	method := r.Header.Get("TNC-Call-Method")
+	if retries, err := strconv.Atoi(r.Header.Get("TNC-Retries")); err == nil && retries > 0 {
+		d.metrics.clientRetries.Add("", float64(retries))
+	}
+
+	t1 := time.Now()
+	var err error
+	if method == TNC_PREFIX_STRING+"stream_job" || method == TNC_PREFIX_STRING+"stream_collection" {
+		err = d.serveStream(w, r)
+	} else {
+		var out json.RawMessage
+		out, err = d.serveImpl(r, nil)
+		writeResponse(w, out, err)
+	}
+	d.metrics.calls.Inc(method)
+	d.metrics.callDuration.Observe(method, time.Now().Sub(t1).Seconds())
 	if err != nil {
+		d.metrics.callErrors.Inc(method)
+	}
+}
+
+func writeResponse(w http.ResponseWriter, out json.RawMessage, err error) {
+	if errors.Is(err, ErrUnknownSessionHandle) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, err.Error())
+	} else if errors.Is(err, ErrOtpRequired) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, err.Error())
+	} else if err != nil {
 		//log.Println(err)
 		w.WriteHeader(500)
 		io.WriteString(w, err.Error())
@@ -146,17 +432,64 @@ func (d *DaemonContext) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (d *DaemonContext) serveImpl(r *http.Request) (json.RawMessage, error) {
-	host := r.Header.Get("TNC-Host-Url")
-	key := r.Header.Get("TNC-Api-Key")
-	user := r.Header.Get("TNC-Username")
-	pass := r.Header.Get("TNC-Password")
+// serveStream answers tnc_daemon.stream_job with newline-delimited JSON: a {"progress": ...} line for every
+// progress update while the job runs, followed by either {"result": ...} or {"error": ...}. The error is the middleware's
+// error object if it refused to wait for the job, otherwise it's a string.
+// tnc_daemon.stream_collection is answered the same way, with an {"event": ...} line for every collection_update.
+// Errors that occur before anything was streamed are reported with a status code, as for any other call.
+func (d *DaemonContext) serveStream(w http.ResponseWriter, r *http.Request) error {
+	lineKey := "progress"
+	if r.Header.Get("TNC-Call-Method") == TNC_PREFIX_STRING+"stream_collection" {
+		lineKey = "event"
+	}
+	started := false
+	writeLine := func(key string, value interface{}) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(200)
+			started = true
+		}
+		data, _ := json.Marshal(map[string]interface{}{key: value})
+		w.Write(append(data, '\n'))
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	out, err := d.serveImpl(r, func(progress json.RawMessage) {
+		writeLine(lineKey, progress)
+	})
+	if err != nil {
+		if !started {
+			writeResponse(w, nil, err)
+		} else {
+			writeLine("error", err.Error())
+		}
+	} else if rpcError := rpcErrorOf(out); rpcError != nil {
+		writeLine("error", rpcError)
+	} else {
+		writeLine("result", out)
+	}
+	return err
+}
+
+// rpcErrorOf returns the "error" of a JSON-RPC response, or nil if there isn't one.
+// The fields of a failed job have an "error" too, but they never have "jsonrpc".
+func rpcErrorOf(data json.RawMessage) json.RawMessage {
+	var response struct {
+		JsonRpc string          `json:"jsonrpc"`
+		Error   json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil || response.JsonRpc == "" || string(response.Error) == "null" {
+		return nil
+	}
+	return response.Error
+}
+
+func (d *DaemonContext) serveImpl(r *http.Request, onProgress func(json.RawMessage)) (json.RawMessage, error) {
+	handle := r.Header.Get("TNC-Session-Handle")
 	method := r.Header.Get("TNC-Call-Method")
 	timeoutStr := r.Header.Get("TNC-Timeout")
-	allowInsecure := false
-	if str := r.Header.Get("TNC-Allow-Insecure"); str != "" {
-		allowInsecure = strings.ToLower(str) == "true"
-	}
 
 	log.Println("Received request at", r.URL.String(), "for method", method)
 
@@ -167,28 +500,26 @@ func (d *DaemonContext) serveImpl(r *http.Request) (json.RawMessage, error) {
 	if method == TNC_PREFIX_STRING+"ping" {
 		return []byte("\"pong\""), nil
 	}
-
-	if host == "" {
-		return nil, fmt.Errorf("TNC-Host-Url was not provided")
+	if method == TNC_PREFIX_STRING+"status" {
+		return d.getStatus()
 	}
-
-	var sessionKey string
-	var methodLogin string
-	var paramsLogin []interface{}
-
-	if key == "" {
-		if user == "" || pass == "" {
-			return nil, fmt.Errorf("TNC-Api-Key was not provided, nor TNC-Username nor TNC-Password")
+	if method == TNC_PREFIX_STRING+"register" {
+		return d.register(r)
+	}
+	if method == TNC_PREFIX_STRING+"stop" {
+		var params []interface{}
+		if data, err := io.ReadAll(r.Body); err == nil && len(data) > 0 {
+			if err = json.Unmarshal(data, &params); err != nil {
+				return nil, err
+			}
 		}
-		sessionKey = host + user + pass
-		methodLogin = "auth.login"
-		paramsLogin = []interface{}{user, pass}
-	} else {
-		sessionKey = host + key
-		methodLogin = "auth.login_with_api_key"
-		paramsLogin = []interface{}{key}
+		return d.requestStop(params)
+	}
+
+	registration, err := d.lookupRegistration(handle)
+	if err != nil {
+		return nil, err
 	}
-	sessionKey += fmt.Sprint(allowInsecure)
 
 	data, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -201,73 +532,78 @@ func (d *DaemonContext) serveImpl(r *http.Request) (json.RawMessage, error) {
 	}
 
 	call := CallInfo{
-		method: method,
-		params: params,
-	}
-	login := LoginInfo{
-		call: CallInfo{
-			method: methodLogin,
-			params: paramsLogin,
-		},
-		serverUrl:     host,
-		allowInsecure: allowInsecure,
+		method:        method,
+		params:        params,
+		abortOnCancel: strings.ToLower(r.Header.Get("TNC-Abort-On-Cancel")) == "true",
+		onProgress:    onProgress,
+		isJob:         strings.ToLower(r.Header.Get("TNC-Job")) == "true",
 	}
 
+	// The request's context is cancelled if the client goes away, eg. the CLI was interrupted
+	ctx := r.Context()
+
 retry:
-	out, err, shouldRetry := d.maybeCreateSessionAndCall(sessionKey, timeoutStr, call, login)
+	out, err, shouldRetry := d.maybeCreateSessionAndCall(ctx, handle, timeoutStr, call, registration.login)
 	if shouldRetry {
 		goto retry
 	}
 	return out, err
 }
 
-func (d *DaemonContext) maybeCreateSessionAndCall(sessionKey string, timeoutStr string, call CallInfo, login LoginInfo) (json.RawMessage, error, bool) {
+func (d *DaemonContext) maybeCreateSessionAndCall(ctx context.Context, sessionKey string, timeoutStr string, call CallInfo, login LoginInfo) (json.RawMessage, error, bool) {
 	shouldCreate := false
 	channel := -1
-	var future *Future[*TruenasSession]
+	var slot *sessionSlot
 
+	// Route the call to the least loaded channel that is under the limit, counting channels that are still connecting.
+	// A new websocket is only opened once every existing channel is at the limit.
 	d.mapMtx.Lock()
-	futureSessions, exists := d.sessionMap_[sessionKey]
-	if !exists {
-		channel = 0
-		future = MakeFuture[*TruenasSession]()
-		futureSessions = []*Future[*TruenasSession]{future}
-		d.sessionMap_[sessionKey] = futureSessions
-		shouldCreate = true
-	} else {
-		for i := 0; i < len(futureSessions); i++ {
-			if futureSessions[i] == nil {
-				channel = i
-				future = MakeFuture[*TruenasSession]()
-				futureSessions[i] = future
-				d.sessionMap_[sessionKey] = futureSessions
-				shouldCreate = true
-				break
-			}
-			done, session, err := futureSessions[i].Peek()
-			if !done || err != nil {
-				continue
-			}
-			session.connMtx.Lock()
-			if !session.callInProgress_ {
-				channel = i
-				future = futureSessions[i]
-			}
-			session.connMtx.Unlock()
-			if future != nil {
-				break
+	slots := d.sessionMap_[sessionKey]
+	freeChannel := -1
+	for i := 0; i < len(slots); i++ {
+		if slots[i] == nil {
+			if freeChannel < 0 {
+				freeChannel = i
 			}
+			continue
 		}
-		if channel < 0 {
-			channel = len(futureSessions)
-			future = MakeFuture[*TruenasSession]()
-			futureSessions = append(futureSessions, future)
-			d.sessionMap_[sessionKey] = futureSessions
-			shouldCreate = true
+		if done, _, err := slots[i].future.Peek(); done && err != nil {
+			continue
+		}
+		if slots[i].callsInFlight < d.maxCallsPerConn && (slot == nil || slots[i].callsInFlight < slot.callsInFlight) {
+			slot = slots[i]
+			channel = i
+		}
+	}
+	if slot == nil {
+		slot = &sessionSlot{future: MakeFuture[*TruenasSession]()}
+		if freeChannel >= 0 {
+			channel = freeChannel
+			slots[channel] = slot
+		} else {
+			channel = len(slots)
+			slots = append(slots, slot)
 		}
+		d.sessionMap_[sessionKey] = slots
+		d.sessionHosts_[sessionKey] = login.serverUrl
+		shouldCreate = true
 	}
+	slot.callsInFlight++
 	d.mapMtx.Unlock()
 
+	isReleased := false
+	release := func() {
+		d.mapMtx.Lock()
+		if !isReleased {
+			slot.callsInFlight--
+			isReleased = true
+		}
+		d.mapMtx.Unlock()
+	}
+	defer release()
+
+	future := slot.future
+
 	var s *TruenasSession
 	var err error
 
@@ -282,7 +618,11 @@ func (d *DaemonContext) maybeCreateSessionAndCall(sessionKey string, timeoutStr
 			future.Complete(s)
 		}
 	} else {
-		s, err = future.Get()
+		s, err = future.Wait(ctx)
+		if ctx.Err() != nil {
+			// The channel may well be fine, we just stopped waiting for it
+			return nil, err, false
+		}
 	}
 
 	//log.Println("Done waiting for session")
@@ -299,7 +639,17 @@ func (d *DaemonContext) maybeCreateSessionAndCall(sessionKey string, timeoutStr
 
 	//log.Println("Calling method", method)
 
-	out, err, shouldRetry := s.callJson(call.method, timeoutStr, call.params)
+	var out json.RawMessage
+	var shouldRetry bool
+	if strings.HasPrefix(call.method, TNC_PREFIX_STRING) {
+		s.ctx.UpdateCountdown()
+		out, err = s.handleDaemonProcedure(ctx, call, timeoutStr, release)
+	} else {
+		out, err, shouldRetry = s.callJsonCached(ctx, call, timeoutStr)
+		if !shouldRetry {
+			s.auditCall(call, out, err)
+		}
+	}
 	if shouldRetry {
 		d.deleteSession(sessionKey, channel)
 	}
@@ -307,82 +657,416 @@ func (d *DaemonContext) maybeCreateSessionAndCall(sessionKey string, timeoutStr
 	return out, err, shouldRetry
 }
 
-func (d *DaemonContext) createSession(sessionKey string, login LoginInfo, channel int) (*TruenasSession, error) {
+func dialTruenas(login LoginInfo) (*websocket.Conn, error) {
 	u, err := url.Parse(login.serverUrl)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid URL: %w", err)
 	}
 
-	log.Println("Daemon: creating connection with allowInsecure=" + fmt.Sprint(login.allowInsecure))
+	log.Println("Daemon: creating connection with allowInsecure=" + fmt.Sprint(login.tlsTrust.AllowInsecure) +
+		", pinned fingerprint=" + fmt.Sprint(login.tlsTrust.Fingerprint != "") + ", CA file=" + login.tlsTrust.CAFile)
 
-	// Configure WebSocket connection with insecure TLS to accept self-signed certs
+	// Self-signed certs are accepted if they're pinned, or if insecure connections are allowed
+	tlsConfig, err := login.tlsTrust.MakeTLSConfig()
+	if err != nil {
+		return nil, err
+	}
 	dialer := &websocket.Dialer{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: login.allowInsecure,
-		},
-		Proxy: http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+		Proxy:           http.ProxyFromEnvironment,
 	}
 
 	// Establish the WebSocket connection
 	conn, _, err := dialer.Dial(u.String(), nil)
 	if err != nil {
+		var mismatch *truenas_api.FingerprintMismatchError
+		if errors.As(err, &mismatch) {
+			log.Println("Daemon: refusing to connect to " + login.serverUrl + ": " + mismatch.Error())
+		}
 		return nil, fmt.Errorf("Failed to connect: %w", err)
 	}
+	return conn, nil
+}
+
+func (d *DaemonContext) createSession(sessionKey string, login LoginInfo, channel int) (*TruenasSession, error) {
+	conn, err := dialTruenas(login)
+	if err != nil {
+		return nil, err
+	}
 
 	session := &TruenasSession{
-		url:        login.serverUrl,
-		conn:       conn,
-		ctx:        d,
-		sessionKey: sessionKey,
-		channel:    channel,
-		connMtx:    &sync.Mutex{},
-		curCallId_: 0,
-		callMap_:   make(map[int64]*Future[json.RawMessage]),
-		jobMap_:    make(map[int64]*Future[json.RawMessage]),
+		url:             login.serverUrl,
+		login:           login,
+		conn:            conn,
+		ctx:             d,
+		sessionKey:      sessionKey,
+		channel:         channel,
+		connMtx:         &sync.Mutex{},
+		writeMtx:        &sync.Mutex{},
+		connectedSince:  time.Now(),
+		readyCh_:        make(chan struct{}),
+		curCallId_:      0,
+		callMap_:        make(map[int64]*Future[json.RawMessage]),
+		jobMap_:         make(map[int64]*trackedJob),
+		subscriptions_:  make(map[string]bool),
+		eventListeners_: make(map[string]map[chan json.RawMessage]bool),
 	}
 
 	go session.listen()
 
-	_, err, _ = session.callJson(login.call.method, DEFAULT_CALL_TIMEOUT, login.call.params)
-	if err != nil {
+	if err = session.authenticate(); err != nil {
+		session.close()
 		return nil, err
 	}
+	session.markReady()
 
-	_, err, _ = session.callJson("core.subscribe", DEFAULT_CALL_TIMEOUT, []interface{}{"core.get_jobs"})
-	if err != nil {
-		return nil, err
+	if d.heartbeatInterval > 0 {
+		go session.keepAlive(d.heartbeatInterval)
 	}
 
 	return session, nil
 }
 
+// authenticate logs in and subscribes to job updates on the current connection, without waiting for the session to be ready.
+func (s *TruenasSession) authenticate() error {
+	timeout, _ := time.ParseDuration(DEFAULT_CALL_TIMEOUT)
+
+	if err := s.logIn(timeout); err != nil {
+		return err
+	}
+
+	_, err, _ := s.sendAndAwait(context.Background(), "core.subscribe", timeout, []interface{}{"core.get_jobs"}, false)
+	return err
+}
+
+func (s *TruenasSession) markReady() {
+	s.connMtx.Lock()
+	if !s.isReady_ {
+		close(s.readyCh_)
+		s.isReady_ = true
+	}
+	s.connMtx.Unlock()
+}
+
+func (s *TruenasSession) close() {
+	s.connMtx.Lock()
+	s.isClosed_ = true
+	conn := s.conn
+	s.connMtx.Unlock()
+	_ = conn.Close()
+}
+
+func (s *TruenasSession) isClosed() bool {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	return s.isClosed_
+}
+
+// keepAlive pings the server periodically, so that a connection silently dropped by a NAT or a rebooted host
+// is noticed (and re-established) before a client's call is sent down it.
+func (s *TruenasSession) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	timeout := HEARTBEAT_TIMEOUT
+	if interval < timeout {
+		timeout = interval
+	}
+
+	for range ticker.C {
+		s.connMtx.Lock()
+		isClosed := s.isClosed_ || s.deadErr_ != nil
+		isReady := s.isReady_
+		conn := s.conn
+		s.connMtx.Unlock()
+
+		if isClosed {
+			return
+		}
+		if !isReady {
+			continue
+		}
+
+		if _, err, _ := s.sendAndAwait(context.Background(), "core.ping", timeout, []interface{}{}, true); err != nil {
+			log.Println("Daemon: heartbeat to", s.url, "failed:", err)
+			// listen() will notice the closed connection and reconnect
+			_ = conn.Close()
+		}
+	}
+}
+
+// reconnect dials the server again, backing off exponentially between failed attempts.
+// Logging in and re-subscribing happens in another goroutine, since the responses are read by listen().
+func (s *TruenasSession) reconnect() error {
+	for {
+		s.connMtx.Lock()
+		attempt := s.reconnectAttempts_
+		s.reconnectAttempts_++
+		s.connMtx.Unlock()
+
+		if attempt >= RECONNECT_MAX_ATTEMPTS {
+			return fmt.Errorf("gave up reconnecting to %s after %d attempts", s.url, attempt)
+		}
+		if attempt > 0 {
+			backoff := time.Second << (attempt - 1)
+			if backoff > RECONNECT_MAX_BACKOFF {
+				backoff = RECONNECT_MAX_BACKOFF
+			}
+			time.Sleep(backoff)
+		}
+		if s.isClosed() {
+			return fmt.Errorf("connection to %s was closed", s.url)
+		}
+
+		conn, err := dialTruenas(s.login)
+		if err != nil {
+			log.Println("Daemon: reconnect attempt", attempt+1, "to", s.url, "failed:", err)
+			continue
+		}
+
+		s.connMtx.Lock()
+		s.conn = conn
+		s.connMtx.Unlock()
+
+		go s.finishReconnect(conn)
+		return nil
+	}
+}
+
+func (s *TruenasSession) finishReconnect(conn *websocket.Conn) {
+	if err := s.authenticate(); err != nil {
+		log.Println("Daemon: failed to log back in to", s.url, ":", err)
+		_ = conn.Close()
+		return
+	}
+
+	// Jobs that finished while we were disconnected won't be announced again,
+	// so wait on every outstanding job to have its result sent to us.
+	pendingJobs := make([]int64, 0)
+	s.connMtx.Lock()
+	for jobId, job := range s.jobMap_ {
+		if isDone, _, _ := job.future.Peek(); !isDone {
+			pendingJobs = append(pendingJobs, jobId)
+		}
+	}
+	s.connMtx.Unlock()
+
+	timeout, _ := time.ParseDuration(DEFAULT_CALL_TIMEOUT)
+	for _, jobId := range pendingJobs {
+		if _, err, _ := s.sendAndAwait(context.Background(), JOB_WAIT_STRING, timeout, []interface{}{jobId}, false); err != nil {
+			log.Println("Daemon: failed to re-arm job", jobId, ":", err)
+		}
+	}
+
+	// Collection updates may have been missed while disconnected, and the subscriptions need to be made again
+	s.connMtx.Lock()
+	s.subscriptions_ = make(map[string]bool)
+	s.connMtx.Unlock()
+	if s.ctx.queryCache != nil {
+		s.ctx.queryCache.invalidate(s.sessionKey, "")
+	}
+	s.resubscribeEventListeners()
+
+	s.connMtx.Lock()
+	s.reconnectAttempts_ = 0
+	s.reconnects_++
+	s.connectedSince = time.Now()
+	s.connMtx.Unlock()
+	s.ctx.metrics.reconnects.Inc(GetHostNameFromApiUrl(s.url))
+
+	log.Println("Daemon: reconnected to", s.url)
+	s.markReady()
+}
+
+func (d *DaemonContext) getSessions() []*TruenasSession {
+	futures := make([]*Future[*TruenasSession], 0)
+	d.mapMtx.Lock()
+	for _, slots := range d.sessionMap_ {
+		for _, slot := range slots {
+			if slot != nil {
+				futures = append(futures, slot.future)
+			}
+		}
+	}
+	d.mapMtx.Unlock()
+
+	sessions := make([]*TruenasSession, 0, len(futures))
+	for _, future := range futures {
+		if _, s, _ := future.Peek(); s != nil {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// sweepJobs expires finished jobs across every connection
+func (d *DaemonContext) sweepJobs(now time.Time) int {
+	removed := 0
+	for _, s := range d.getSessions() {
+		removed += s.sweepJobs(now)
+	}
+	return removed
+}
+
+func (d *DaemonContext) runJobSweeper(doneCh <-chan struct{}) {
+	interval := JOB_SWEEP_INTERVAL
+	if d.jobRetention < interval {
+		interval = d.jobRetention
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doneCh:
+			return
+		case now := <-ticker.C:
+			if removed := d.sweepJobs(now); removed > 0 {
+				log.Println("Daemon: expired", removed, "finished job(s)")
+			}
+			if removed := d.sweepRegistrations(now); removed > 0 {
+				log.Println("Daemon: forgot", removed, "idle registration(s)")
+			}
+		}
+	}
+}
+
 func (d *DaemonContext) deleteSession(sessionKey string, channel int) {
 	d.mapMtx.Lock()
-	if sessionList, exists := d.sessionMap_[sessionKey]; exists {
-		if channel >= 0 && channel < len(sessionList) {
-			sessionList[channel] = nil
-			d.sessionMap_[sessionKey] = sessionList
+	if slots, exists := d.sessionMap_[sessionKey]; exists {
+		if channel >= 0 && channel < len(slots) {
+			slots[channel] = nil
 		}
 	}
 	d.mapMtx.Unlock()
 }
 
-func (s *TruenasSession) callJson(method string, timeoutStr string, request []interface{}) (json.RawMessage, error, bool) {
+// getStatus reports every channel in the session map, so that a stuck websocket can be told apart from a slow call.
+func (d *DaemonContext) getStatus() (json.RawMessage, error) {
+	type channelEntry struct {
+		host          string
+		channel       int
+		future        *Future[*TruenasSession]
+		callsInFlight int
+	}
+
+	d.mapMtx.Lock()
+	idleRemaining := "-"
+	if d.timeoutValue != 0 {
+		remaining := d.timeoutValue - time.Now().Sub(d.lastActivity_)
+		if remaining < 0 {
+			remaining = 0
+		}
+		idleRemaining = remaining.Round(time.Second).String()
+	}
+	entries := make([]channelEntry, 0)
+	for _, sessionKey := range GetKeysSorted(d.sessionMap_) {
+		for i, slot := range d.sessionMap_[sessionKey] {
+			if slot != nil {
+				entries = append(entries, channelEntry{
+					host:          d.sessionHosts_[sessionKey],
+					channel:       i,
+					future:        slot.future,
+					callsInFlight: slot.callsInFlight,
+				})
+			}
+		}
+	}
+	d.mapMtx.Unlock()
+
+	statusList := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		status := make(map[string]interface{})
+		status["host"] = GetHostNameFromApiUrl(e.host)
+		status["channel"] = e.channel
+		status["calls_in_flight"] = e.callsInFlight
+		status["idle_remaining"] = idleRemaining
+
+		isDone, s, err := e.future.Peek()
+		if !isDone {
+			status["state"] = "connecting"
+		} else if err != nil || s == nil {
+			status["state"] = "failed"
+		} else {
+			s.connMtx.Lock()
+			if s.isReady_ {
+				status["state"] = "connected"
+			} else {
+				status["state"] = "reconnecting"
+			}
+			status["connected_since"] = s.connectedSince.Format(time.RFC3339)
+			status["reconnects"] = s.reconnects_
+			status["pending_calls"] = len(s.callMap_)
+			pendingJobs, retainedJobs := 0, 0
+			for _, job := range s.jobMap_ {
+				if job.expiresAt.IsZero() {
+					pendingJobs++
+				} else {
+					retainedJobs++
+				}
+			}
+			status["pending_jobs"] = pendingJobs
+			status["retained_jobs"] = retainedJobs
+			s.connMtx.Unlock()
+		}
+		statusList = append(statusList, status)
+	}
+
+	return json.Marshal(statusList)
+}
+
+func (s *TruenasSession) callJson(ctx context.Context, method string, timeoutStr string, request []interface{}) (json.RawMessage, error, bool) {
 	s.ctx.UpdateCountdown()
 
-	if strings.HasPrefix(method, TNC_PREFIX_STRING) {
-		out, err := s.handleDaemonProcedure(method[len(TNC_PREFIX_STRING):], timeoutStr, request)
-		return out, err, false
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		timeout = time.Duration(10) * time.Second
+	}
+
+	s.connMtx.Lock()
+	readyCh := s.readyCh_
+	s.connMtx.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-readyCh:
+	case <-ctx.Done():
+		return nil, ctx.Err(), false
+	case <-timer.C:
+		return nil, fmt.Errorf("Request timed out waiting to reconnect to %s (exceeded %s)", s.url, timeout.String()), false
+	}
+
+	s.connMtx.Lock()
+	deadErr := s.deadErr_
+	s.connMtx.Unlock()
+	if deadErr != nil {
+		return nil, deadErr, true
 	}
 
+	return s.sendAndAwait(ctx, method, timeout, request, false)
+}
+
+func (s *TruenasSession) sendAndAwait(ctx context.Context, method string, timeout time.Duration, request []interface{}, isHeartbeat bool) (json.RawMessage, error, bool) {
 	s.connMtx.Lock()
 	s.curCallId_++
 	callId := s.curCallId_
 	fCall := MakeFuture[json.RawMessage]()
 	s.callMap_[callId] = fCall
-	s.callInProgress_ = true
+	s.callsInFlight_++
+	if isHeartbeat {
+		s.heartbeatCallId_ = callId
+	}
+	conn := s.conn
 	s.connMtx.Unlock()
 
+	defer func() {
+		s.connMtx.Lock()
+		delete(s.callMap_, callId)
+		s.callsInFlight_--
+		s.connMtx.Unlock()
+	}()
+
 	reqMsg := make(map[string]interface{})
 	reqMsg["jsonrpc"] = "2.0"
 	reqMsg["method"] = method
@@ -391,28 +1075,29 @@ func (s *TruenasSession) callJson(method string, timeoutStr string, request []in
 
 	//log.Println("Writing JSON request with callId:", callId, reqMsg)
 
-	if err := wrapWriteJSON(s.conn, reqMsg); err != nil {
+	// gorilla/websocket supports only one concurrent writer
+	s.writeMtx.Lock()
+	err := wrapWriteJSON(conn, reqMsg)
+	s.writeMtx.Unlock()
+
+	if err != nil {
 		errMsg := err.Error()
 		shouldRetry := strings.Contains(errMsg, "use of closed network connection") || strings.Contains(errMsg, "gorilla panic")
 		return nil, err, shouldRetry
 	}
 
-	timeout, err := time.ParseDuration(timeoutStr)
-	if err != nil {
-		timeout = time.Duration(10) * time.Second
-	}
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	isDone, dataRes, err := AwaitFutureOrTimeout(fCall, timeout)
-	if !isDone {
+	dataRes, err := fCall.Wait(callCtx)
+	if isDone, _, _ := fCall.Peek(); !isDone {
+		if ctx.Err() != nil {
+			return nil, ctx.Err(), false
+		}
 		timeoutParsed := timeout.String()
 		return nil, fmt.Errorf("Request timed out (exceeded %s)", timeoutParsed), false
 	}
 
-	s.connMtx.Lock()
-	delete(s.callMap_, callId)
-	s.callInProgress_ = false
-	s.connMtx.Unlock()
-
 	if err != nil {
 		return nil, err, false
 	}
@@ -447,24 +1132,60 @@ func (s *TruenasSession) listen() {
 			log.Println("Recovered from panic:", r)
 		}
 		internalErr := fmt.Errorf("listen() exiting: %v", err)
-		_ = s.conn.Close()
 		s.connMtx.Lock()
+		conn := s.conn
+		s.deadErr_ = internalErr
 		for _, f := range s.callMap_ {
 			f.Fail(internalErr)
 		}
-		for _, f := range s.jobMap_ {
-			f.Fail(internalErr)
+		for _, job := range s.jobMap_ {
+			job.future.Fail(internalErr)
 		}
+		s.closeEventListeners()
 		s.connMtx.Unlock()
+		_ = conn.Close()
+		// wake up any calls waiting for a reconnection
+		s.markReady()
 		s.ctx.deleteSession(s.sessionKey, s.channel)
 		log.Println("listen exiting")
 	}()
+
 	for true {
-		var message json.RawMessage
-		_, message, err = s.conn.ReadMessage()
+		s.connMtx.Lock()
+		conn := s.conn
+		s.connMtx.Unlock()
+
+		err = s.readMessages(conn)
+		if s.isClosed() {
+			return
+		}
+		log.Println("Daemon: lost connection to", s.url, "-", err)
+
+		// Calls already sent won't get a response on the new connection
+		lostErr := fmt.Errorf("Connection to %s was lost: %v", s.url, err)
+		s.connMtx.Lock()
+		if s.isReady_ {
+			s.readyCh_ = make(chan struct{})
+			s.isReady_ = false
+		}
+		for _, f := range s.callMap_ {
+			f.Fail(lostErr)
+		}
+		s.connMtx.Unlock()
+		_ = conn.Close()
+
+		if err = s.reconnect(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *TruenasSession) readMessages(conn *websocket.Conn) error {
+	for {
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("listen s.conn.ReadMessage:", err)
-			return
+			return err
 		}
 
 		var response interface{}
@@ -476,8 +1197,6 @@ func (s *TruenasSession) listen() {
 			continue
 		}
 
-		s.ctx.UpdateCountdown()
-
 		innerJobId := int64(-1)
 
 		method, _ := responseMap["method"].(string)
@@ -485,11 +1204,21 @@ func (s *TruenasSession) listen() {
 
 		if method == "collection_update" {
 			params, _ := responseMap["params"].(map[string]interface{})
+			collection, _ := params["collection"].(string)
+			s.notifyEventListeners(collection, params)
+			if collection != "core.get_jobs" {
+				s.handleCollectionEvent(collection)
+				continue
+			}
 			jobIdF, _ := params["id"].(float64)
 			fields, _ = params["fields"].(map[string]interface{})
 			state, _ := fields["state"].(string)
 
-			if state == "SUCCESS" || state == "FAILED" {
+			if state == "RUNNING" && fields != nil {
+				s.connMtx.Lock()
+				s.updateJobProgress(int64(jobIdF), fields)
+				s.connMtx.Unlock()
+			} else if state == "SUCCESS" || state == "FAILED" || state == "ABORTED" {
 				innerJobId = int64(jobIdF)
 				if innerMethod, _ := fields["method"].(string); innerMethod == JOB_WAIT_STRING {
 					if args, ok := fields["arguments"].([]interface{}); ok && len(args) > 0 {
@@ -507,35 +1236,64 @@ func (s *TruenasSession) listen() {
 			idValue = int64(idFloat)
 		}
 
+		// Heartbeats shouldn't keep an otherwise idle daemon alive
+		s.connMtx.Lock()
+		isHeartbeat := idValue >= 0 && idValue == s.heartbeatCallId_
+		s.connMtx.Unlock()
+		if !isHeartbeat {
+			s.ctx.UpdateCountdown()
+		}
+
 		var fJob *Future[json.RawMessage]
 		var fCall *Future[json.RawMessage]
-		var exists bool
+		isFirstFinish := false
 
 		if innerJobId >= 0 || idValue >= 0 {
 			s.connMtx.Lock()
-			if innerJobId >= 0 {
-				fJob, exists = s.jobMap_[innerJobId]
-				if !exists {
-					fJob = MakeFuture[json.RawMessage]()
-					s.jobMap_[innerJobId] = fJob
+			if innerJobId >= 0 && fields != nil {
+				_, wasTracked := s.jobMap_[innerJobId]
+				job := s.trackJob(innerJobId)
+				if job.expiresAt.IsZero() {
+					isFirstFinish = true
+					now := time.Now()
+					job.expiresAt = now.Add(s.ctx.jobRetention)
+					// Jobs started elsewhere are only seen once they finish, so their duration has to come from the middleware
+					duration, ok := getJobDuration(fields)
+					if !ok && wasTracked {
+						duration, ok = now.Sub(job.trackedSince), true
+					}
+					if ok {
+						state, _ := fields["state"].(string)
+						s.ctx.metrics.jobDuration.Observe(state, duration.Seconds())
+					}
 				}
+				fJob = job.future
 			}
 			if idValue >= 0 {
-				fCall, exists = s.callMap_[idValue]
+				fCall = s.callMap_[idValue]
 			}
 			s.connMtx.Unlock()
 		}
 
-		if fJob != nil && fields != nil {
+		if fJob != nil {
 			fJob.Reach(json.Marshal(fields))
 		}
+		if isFirstFinish && s.ctx.audit != nil {
+			state, _ := fields["state"].(string)
+			s.ctx.audit.RecordJobFinished(GetHostNameFromApiUrl(s.login.serverUrl), innerJobId, state, fields["result"], fields["error"])
+		}
 		if fCall != nil {
 			fCall.Complete(message)
 		}
 	}
 }
 
-func (s *TruenasSession) handleDaemonProcedure(proc string, timeoutStr string, params []interface{}) (json.RawMessage, error) {
+// handleDaemonProcedure implements the tnc_daemon.* procedures that act on a session.
+// releaseChannel is called once the procedure no longer needs to count against this channel's call limit.
+func (s *TruenasSession) handleDaemonProcedure(ctx context.Context, call CallInfo, timeoutStr string, releaseChannel func()) (json.RawMessage, error) {
+	proc := call.method[len(TNC_PREFIX_STRING):]
+	params := call.params
+
 	isFirstParamNumber := false
 	firstParamAsNumber := int64(0)
 	nParams := len(params)
@@ -557,36 +1315,61 @@ func (s *TruenasSession) handleDaemonProcedure(proc string, timeoutStr string, p
 		}
 		isDone, response, err := fJob.Peek()
 		if isDone {
+			s.markJobAwaited(firstParamAsNumber)
 			return response, err
 		}
 		return MakeIncompleteJobStatus(firstParamAsNumber)
 
-	case "await_job":
+	case "await_job", "stream_job":
 		if !isFirstParamNumber {
-			return nil, fmt.Errorf("tnc_daemon.await_job expects the first parameter to be a job number")
+			return nil, fmt.Errorf("tnc_daemon.%s expects the first parameter to be a job number", proc)
 		}
 
 		s.connMtx.Lock()
-		fJob, exists := s.jobMap_[firstParamAsNumber]
-		if !exists {
-			fJob = MakeFuture[json.RawMessage]()
-			s.jobMap_[firstParamAsNumber] = fJob
-		}
+		fJob := s.trackJob(firstParamAsNumber).future
 		s.connMtx.Unlock()
 
-		if exists {
-			isDone, response, err := fJob.Peek()
-			if isDone {
-				return response, err
-			}
+		if isDone, response, err := fJob.Peek(); isDone {
+			s.markJobAwaited(firstParamAsNumber)
+			return response, err
 		}
 
-		_, err, _ := s.callJson(JOB_WAIT_STRING, timeoutStr, []interface{}{firstParamAsNumber})
+		out, err, _ := s.callJson(ctx, JOB_WAIT_STRING, timeoutStr, []interface{}{firstParamAsNumber})
 		if err != nil {
 			return nil, err
 		}
+		// The middleware won't wait for a job that it doesn't know, so its error is passed on instead of the job's fields
+		if rpcErrorOf(out) != nil {
+			return out, nil
+		}
 
-		return fJob.Get()
+		// Waiting for the job doesn't occupy the websocket, so let other calls use this channel
+		releaseChannel()
+		response, err := s.waitForJob(ctx, firstParamAsNumber, fJob, call.onProgress)
+		if ctx.Err() == nil {
+			s.markJobAwaited(firstParamAsNumber)
+		} else if call.abortOnCancel {
+			log.Println("Client went away, aborting job", firstParamAsNumber)
+			go func() {
+				if _, err, _ := s.callJson(context.Background(), "core.job_abort", DEFAULT_CALL_TIMEOUT, []interface{}{firstParamAsNumber}); err != nil {
+					log.Println("Failed to abort job", firstParamAsNumber, ":", err)
+				}
+			}()
+		}
+		return response, err
+
+	case "stream_collection":
+		if call.onProgress == nil {
+			return nil, fmt.Errorf("tnc_daemon.stream_collection can only be streamed")
+		}
+		collection := ""
+		if nParams > 0 {
+			collection, _ = params[0].(string)
+		}
+		if err := s.streamCollection(ctx, collection, call.onProgress, releaseChannel); err != nil {
+			return nil, err
+		}
+		return json.RawMessage("null"), nil
 	}
 
 	return nil, fmt.Errorf("Unrecognised daemon command \"tnc_daemon.%s\"", proc)
@@ -595,11 +1378,112 @@ func (s *TruenasSession) handleDaemonProcedure(proc string, timeoutStr string, p
 func (s *TruenasSession) getJobFuture(id int64) *Future[json.RawMessage] {
 	s.connMtx.Lock()
 	defer s.connMtx.Unlock()
-	f, exists := s.jobMap_[id]
+	job, exists := s.jobMap_[id]
 	if !exists {
 		return nil
 	}
-	return f
+	return job.future
+}
+
+// waitForJob waits for a job to finish, passing each progress update to onProgress if it was given
+func (s *TruenasSession) waitForJob(ctx context.Context, jobId int64, fJob *Future[json.RawMessage], onProgress func(json.RawMessage)) (json.RawMessage, error) {
+	if onProgress == nil {
+		return fJob.Wait(ctx)
+	}
+
+	var lastProgress json.RawMessage
+	for {
+		var progress json.RawMessage
+		var progressCh chan struct{}
+		s.connMtx.Lock()
+		if job, exists := s.jobMap_[jobId]; exists {
+			if job.progressCh_ == nil {
+				job.progressCh_ = make(chan struct{})
+			}
+			progress = job.progress_
+			progressCh = job.progressCh_
+		}
+		s.connMtx.Unlock()
+
+		if progress != nil && !bytes.Equal(progress, lastProgress) {
+			onProgress(progress)
+			lastProgress = progress
+		}
+
+		select {
+		case <-fJob.Done():
+			return fJob.Wait(ctx)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-progressCh:
+		}
+	}
+}
+
+// updateJobProgress records the progress of a running job, if anyone is waiting on it.
+// connMtx must be held.
+func (s *TruenasSession) updateJobProgress(jobId int64, fields map[string]interface{}) {
+	job, exists := s.jobMap_[jobId]
+	if !exists || !job.expiresAt.IsZero() {
+		return
+	}
+	progressMap, ok := fields["progress"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	progress, err := json.Marshal(map[string]interface{}{
+		"id":          jobId,
+		"percent":     progressMap["percent"],
+		"description": progressMap["description"],
+	})
+	if err != nil {
+		return
+	}
+	job.progress_ = progress
+	if job.progressCh_ != nil {
+		close(job.progressCh_)
+		job.progressCh_ = nil
+	}
+}
+
+// trackJob returns the entry for a job, creating it if this is the first we've heard of it.
+// connMtx must be held.
+func (s *TruenasSession) trackJob(id int64) *trackedJob {
+	job, exists := s.jobMap_[id]
+	if !exists {
+		job = &trackedJob{future: MakeFuture[json.RawMessage](), trackedSince: time.Now()}
+		s.jobMap_[id] = job
+	}
+	return job
+}
+
+// markJobAwaited shortens the retention of a finished job once a client has received its result.
+// It's kept for a little while longer, since ClientSession.Close() waits on every job it started again.
+func (s *TruenasSession) markJobAwaited(id int64) {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	job, exists := s.jobMap_[id]
+	if !exists || job.expiresAt.IsZero() {
+		return
+	}
+	if graceEnd := time.Now().Add(JOB_AWAITED_GRACE); graceEnd.Before(job.expiresAt) {
+		job.expiresAt = graceEnd
+	}
+}
+
+// sweepJobs removes finished jobs whose retention has run out, returning how many were removed.
+// Jobs that are still running are never removed, as a client may be waiting on them.
+func (s *TruenasSession) sweepJobs(now time.Time) int {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	removed := 0
+	for id, job := range s.jobMap_ {
+		if !job.expiresAt.IsZero() && now.After(job.expiresAt) {
+			delete(s.jobMap_, id)
+			removed++
+		}
+	}
+	return removed
 }
 
 func (s *TruenasSession) getCallFuture(id int64) *Future[json.RawMessage] {
@@ -0,0 +1,375 @@
+package core
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"truenas/truenas_incus_ctl/truenas_api"
+)
+
+var ErrUnknownSessionHandle = errors.New("Unknown session handle")
+
+// ErrOtpRequired is returned when logging in with a password needs a one-time password that the client hasn't provided.
+// The client should register again with TNC-Otp set.
+var ErrOtpRequired = errors.New("A one-time password is required")
+
+// How long the tokens used to open further channels after a password login stay valid for
+const LOGIN_TOKEN_TTL_SECONDS = 3600
+
+// The first file descriptor passed by systemd socket activation
+const SD_LISTEN_FDS_START = 3
+
+// How long the credentials of a registration are kept once it's unused and all of its channels have closed
+const REGISTRATION_IDLE_TIMEOUT = time.Duration(10) * time.Minute
+
+// Credentials are only sent to the daemon once, by tnc_daemon.register. Every other request carries
+// the returned handle in TNC-Session-Handle instead.
+type sessionRegistration struct {
+	login     LoginInfo
+	lastUsed_ time.Time
+}
+
+// passwordLogin is shared by every channel of a session key that logs in with a username and password.
+// Once a channel has logged in, it generates a token that the other channels (and reconnects) log in with,
+// so that a one-time password is only needed for the first login.
+type passwordLogin struct {
+	mtx      sync.Mutex
+	username string
+	password string
+	otp      string // used by the next login that asks for one, then forgotten
+	token    string
+}
+
+func makeHandleSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("Error: could not generate session handle secret: " + err.Error())
+	}
+	return secret
+}
+
+// register returns an opaque handle for the credentials in the request headers.
+// The handle is derived from a secret that only lives in this process, so registering the same credentials again
+// returns the same handle (and the same connection pool), without the handle revealing anything about the key.
+func (d *DaemonContext) register(r *http.Request) (json.RawMessage, error) {
+	host := r.Header.Get("TNC-Host-Url")
+	key := r.Header.Get("TNC-Api-Key")
+	user := r.Header.Get("TNC-Username")
+	pass := r.Header.Get("TNC-Password")
+	allowInsecure := false
+	if str := r.Header.Get("TNC-Allow-Insecure"); str != "" {
+		allowInsecure = strings.ToLower(str) == "true"
+	}
+
+	if host == "" {
+		return nil, fmt.Errorf("TNC-Host-Url was not provided")
+	}
+
+	login := LoginInfo{
+		serverUrl: host,
+		tlsTrust: truenas_api.TLSTrust{
+			AllowInsecure: allowInsecure,
+			Fingerprint:   r.Header.Get("TNC-Tls-Fingerprint"),
+			CAFile:        r.Header.Get("TNC-Ca-File"),
+		},
+	}
+
+	mac := hmac.New(sha256.New, d.handleSecret)
+	if key == "" {
+		if user == "" || pass == "" {
+			return nil, fmt.Errorf("TNC-Api-Key was not provided, nor TNC-Username nor TNC-Password")
+		}
+		login.password = &passwordLogin{username: user, password: pass}
+		mac.Write([]byte("user\x00" + host + "\x00" + user + "\x00" + pass))
+	} else {
+		login.call = CallInfo{
+			method: "auth.login_with_api_key",
+			params: []interface{}{key},
+		}
+		mac.Write([]byte("key\x00" + host + "\x00" + key))
+	}
+	mac.Write([]byte("\x00" + fmt.Sprint(allowInsecure) + "\x00" + login.tlsTrust.Fingerprint + "\x00" + login.tlsTrust.CAFile))
+	handle := hex.EncodeToString(mac.Sum(nil))
+
+	otp := r.Header.Get("TNC-Otp")
+
+	d.mapMtx.Lock()
+	if existing, exists := d.registrations_[handle]; exists {
+		// Keep the existing login, as its channels may already hold a token
+		login = existing.login
+		existing.lastUsed_ = time.Now()
+	} else {
+		d.registrations_[handle] = &sessionRegistration{login: login, lastUsed_: time.Now()}
+	}
+	d.mapMtx.Unlock()
+
+	if otp != "" && login.password != nil {
+		login.password.mtx.Lock()
+		login.password.otp = otp
+		login.password.mtx.Unlock()
+	}
+
+	return json.Marshal(handle)
+}
+
+// logIn authenticates the session's current connection
+func (s *TruenasSession) logIn(timeout time.Duration) error {
+	if s.login.password != nil {
+		return s.logInWithPassword(timeout)
+	}
+	out, err, _ := s.sendAndAwait(context.Background(), s.login.call.method, timeout, s.login.call.params, false)
+	if err != nil {
+		return err
+	}
+	if apiErr := ParseApiError(out); apiErr != nil {
+		return fmt.Errorf("Login failed:%w", apiErr)
+	}
+	return nil
+}
+
+func (s *TruenasSession) logInWithPassword(timeout time.Duration) error {
+	auth := s.login.password
+	auth.mtx.Lock()
+	token := auth.token
+	auth.mtx.Unlock()
+
+	if token != "" {
+		state, err := s.logInEx(timeout, truenas_api.MakeTokenLoginParams(token))
+		if err == nil && state == truenas_api.LoginExSuccess {
+			s.refreshLoginToken(timeout)
+			return nil
+		}
+		// The token expired or was revoked, so fall back to the password
+		auth.mtx.Lock()
+		if auth.token == token {
+			auth.token = ""
+		}
+		auth.mtx.Unlock()
+	}
+
+	state, err := s.logInEx(timeout, truenas_api.MakePasswordLoginParams(auth.username, auth.password))
+	if errors.Is(err, truenas_api.ErrLoginExUnsupported) {
+		out, err, _ := s.sendAndAwait(context.Background(), "auth.login", timeout, []interface{}{auth.username, auth.password}, false)
+		if err != nil {
+			return err
+		}
+		if apiErr := ParseApiError(out); apiErr != nil {
+			return fmt.Errorf("Login failed:%w", apiErr)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if state == truenas_api.LoginExOtpRequired {
+		auth.mtx.Lock()
+		otp := auth.otp
+		auth.otp = ""
+		auth.mtx.Unlock()
+		if otp == "" {
+			return ErrOtpRequired
+		}
+		if state, err = s.logInEx(timeout, truenas_api.MakeOtpLoginParams(otp)); err != nil {
+			return err
+		}
+	}
+	if state != truenas_api.LoginExSuccess {
+		return fmt.Errorf("Login as %s failed: %s", auth.username, state)
+	}
+
+	s.refreshLoginToken(timeout)
+	return nil
+}
+
+func (s *TruenasSession) logInEx(timeout time.Duration, params []interface{}) (string, error) {
+	out, err, _ := s.sendAndAwait(context.Background(), "auth.login_ex", timeout, params, false)
+	if err != nil {
+		return "", err
+	}
+	return truenas_api.ParseLoginExResponse(out)
+}
+
+// refreshLoginToken replaces the token that other channels of the session key log in with.
+// If no token can be generated, they log in with the password instead, which may need another one-time password.
+func (s *TruenasSession) refreshLoginToken(timeout time.Duration) {
+	out, err, _ := s.sendAndAwait(context.Background(), "auth.generate_token", timeout, []interface{}{LOGIN_TOKEN_TTL_SECONDS, map[string]interface{}{}, true}, false)
+	if err == nil {
+		if errMsg := ExtractApiError(out); errMsg != "" {
+			err = errors.New(strings.TrimSpace(errMsg))
+		}
+	}
+	var response struct {
+		Result string `json:"result"`
+	}
+	if err == nil {
+		if err = json.Unmarshal(out, &response); err == nil && response.Result == "" {
+			err = fmt.Errorf("unexpected response: %s", string(out))
+		}
+	}
+	if err != nil {
+		log.Println("Daemon: could not generate a login token for", s.url, ":", err)
+		return
+	}
+
+	auth := s.login.password
+	auth.mtx.Lock()
+	auth.token = response.Result
+	auth.mtx.Unlock()
+}
+
+func (d *DaemonContext) lookupRegistration(handle string) (*sessionRegistration, error) {
+	if handle == "" {
+		return nil, fmt.Errorf("TNC-Session-Handle was not provided: %w", ErrUnknownSessionHandle)
+	}
+	d.mapMtx.Lock()
+	defer d.mapMtx.Unlock()
+	registration, exists := d.registrations_[handle]
+	if !exists {
+		return nil, ErrUnknownSessionHandle
+	}
+	registration.lastUsed_ = time.Now()
+	return registration, nil
+}
+
+// sweepRegistrations forgets the credentials of registrations that have been idle for REGISTRATION_IDLE_TIMEOUT
+// and have no channels left, returning how many were removed. Clients still holding their handles register again.
+func (d *DaemonContext) sweepRegistrations(now time.Time) int {
+	d.mapMtx.Lock()
+	defer d.mapMtx.Unlock()
+
+	removed := 0
+	for handle, registration := range d.registrations_ {
+		if now.Sub(registration.lastUsed_) < REGISTRATION_IDLE_TIMEOUT {
+			continue
+		}
+		hasChannels := false
+		for _, slot := range d.sessionMap_[handle] {
+			if slot != nil {
+				hasChannels = true
+				break
+			}
+		}
+		if hasChannels {
+			continue
+		}
+		delete(d.registrations_, handle)
+		delete(d.sessionMap_, handle)
+		delete(d.sessionHosts_, handle)
+		removed++
+	}
+	return removed
+}
+
+// peerCredListener only accepts connections from processes running as the same user as the daemon
+type peerCredListener struct {
+	net.Listener
+	uid int
+}
+
+func (l *peerCredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := getPeerUid(conn)
+		if err == nil && uid == l.uid {
+			return conn, nil
+		}
+		if err != nil {
+			log.Println("Refusing connection, could not read peer credentials:", err)
+		} else {
+			log.Println("Refusing connection from uid", uid)
+		}
+		_ = conn.Close()
+	}
+}
+
+func getPeerUid(conn net.Conn) (int, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return -1, err
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+	return int(cred.Uid), nil
+}
+
+// listenPrivateUnix creates the daemon's socket so that only the current user can connect to it
+func listenPrivateUnix(serverSockAddr string) (net.Listener, error) {
+	oldMask := syscall.Umask(0077)
+	ls, err := net.Listen("unix", serverSockAddr)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(serverSockAddr, 0600); err != nil {
+		ls.Close()
+		return nil, err
+	}
+	return &peerCredListener{Listener: ls, uid: os.Getuid()}, nil
+}
+
+// listenerFromSystemd returns the socket passed by systemd socket activation (see sd_listen_fds(3)),
+// or nil if this process wasn't socket activated. Only a single unix socket is supported.
+func listenerFromSystemd(startFd int) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nFds <= 0 {
+		return nil, nil
+	}
+
+	// Don't pass these on to anything we launch
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if nFds != 1 {
+		return nil, fmt.Errorf("expected 1 socket from systemd, got %d", nFds)
+	}
+
+	syscall.CloseOnExec(startFd)
+	f := os.NewFile(uintptr(startFd), "LISTEN_FD_"+strconv.Itoa(startFd))
+	ls, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ls.(*net.UnixListener); !ok {
+		ls.Close()
+		return nil, fmt.Errorf("the socket passed by systemd is not a unix socket")
+	}
+	return &peerCredListener{Listener: ls, uid: os.Getuid()}, nil
+}
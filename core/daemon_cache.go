@@ -0,0 +1,194 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queryCache holds the results of read-only *.query calls for a short while, so that a client polling the same query
+// in a loop doesn't hit the middleware every time. Entries for a namespace (eg. "pool.dataset") are dropped when a
+// mutating call in that namespace goes through the daemon, or when the middleware reports a change to the collection.
+type queryCache struct {
+	ttl         time.Duration
+	mtx         sync.Mutex
+	entries     map[string]*cachedQuery
+	generations map[string]uint64 // per session key and namespace, bumped on every invalidation
+}
+
+type cachedQuery struct {
+	sessionKey string
+	namespace  string
+	result     json.RawMessage
+	expiresAt  time.Time
+}
+
+func newQueryCache(ttl time.Duration) *queryCache {
+	return &queryCache{
+		ttl:         ttl,
+		entries:     make(map[string]*cachedQuery),
+		generations: make(map[string]uint64),
+	}
+}
+
+// getQueryNamespace returns the namespace of a cacheable query method, eg. "sharing.nfs" for "sharing.nfs.query"
+func getQueryNamespace(method string) (string, bool) {
+	if !strings.HasSuffix(method, ".query") {
+		return "", false
+	}
+	return strings.TrimSuffix(method, ".query"), true
+}
+
+// getMutatedNamespace returns the namespace a call may change, if any. Calls made through core.bulk are attributed
+// to the method they wrap.
+func getMutatedNamespace(method string, params []interface{}) (string, bool) {
+	if method == "core.bulk" && len(params) > 0 {
+		if inner, ok := params[0].(string); ok {
+			method = inner
+		}
+	}
+	lastDot := strings.LastIndex(method, ".")
+	if lastDot <= 0 || IsReadOnlyMethod(method) {
+		return "", false
+	}
+	return method[:lastDot], true
+}
+
+func makeQueryCacheKey(sessionKey, method string, params []interface{}) (string, error) {
+	// json.Marshal sorts map keys, so equivalent params give the same key
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return sessionKey + "\x00" + method + "\x00" + string(data), nil
+}
+
+func (c *queryCache) get(key string, now time.Time) (json.RawMessage, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	if now.After(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.result, true
+}
+
+func (c *queryCache) getGeneration(sessionKey, namespace string) uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.generations[sessionKey+"\x00"+namespace]
+}
+
+// put stores a result, unless the namespace was invalidated since generation was read, as the result may predate the change
+func (c *queryCache) put(key, sessionKey, namespace string, generation uint64, result json.RawMessage, now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.generations[sessionKey+"\x00"+namespace] != generation {
+		return
+	}
+	c.entries[key] = &cachedQuery{
+		sessionKey: sessionKey,
+		namespace:  namespace,
+		result:     result,
+		expiresAt:  now.Add(c.ttl),
+	}
+}
+
+// invalidate drops every entry for the namespace, or for every namespace if it's empty
+func (c *queryCache) invalidate(sessionKey, namespace string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for key, entry := range c.entries {
+		if entry.sessionKey == sessionKey && (namespace == "" || entry.namespace == namespace) {
+			delete(c.entries, key)
+		}
+	}
+	if namespace == "" {
+		for genKey := range c.generations {
+			if strings.HasPrefix(genKey, sessionKey+"\x00") {
+				c.generations[genKey]++
+			}
+		}
+	} else {
+		c.generations[sessionKey+"\x00"+namespace]++
+	}
+}
+
+// callJsonCached is callJson, going through the daemon's query cache if it's enabled
+func (s *TruenasSession) callJsonCached(ctx context.Context, call CallInfo, timeoutStr string) (json.RawMessage, error, bool) {
+	cache := s.ctx.queryCache
+	if cache == nil {
+		return s.callJson(ctx, call.method, timeoutStr, call.params)
+	}
+
+	namespace, isQuery := getQueryNamespace(call.method)
+	if !isQuery {
+		out, err, shouldRetry := s.callJson(ctx, call.method, timeoutStr, call.params)
+		if mutated, ok := getMutatedNamespace(call.method, call.params); ok {
+			cache.invalidate(s.sessionKey, mutated)
+		}
+		return out, err, shouldRetry
+	}
+
+	key, err := makeQueryCacheKey(s.sessionKey, call.method, call.params)
+	if err != nil {
+		return s.callJson(ctx, call.method, timeoutStr, call.params)
+	}
+	if out, ok := cache.get(key, time.Now()); ok {
+		s.ctx.metrics.queryCacheHits.Inc(call.method)
+		s.ctx.UpdateCountdown()
+		return out, nil, false
+	}
+	s.ctx.metrics.queryCacheMisses.Inc(call.method)
+
+	// Subscribe first, so that a change made while the query runs isn't missed
+	s.subscribeToCollection(ctx, call.method)
+
+	generation := cache.getGeneration(s.sessionKey, namespace)
+	out, err, shouldRetry := s.callJson(ctx, call.method, timeoutStr, call.params)
+	if err == nil && ExtractApiError(out) == "" {
+		cache.put(key, s.sessionKey, namespace, generation, out, time.Now())
+	}
+	return out, err, shouldRetry
+}
+
+// subscribeToCollection asks the middleware to send collection_update messages for a query's collection on this connection.
+// If that fails, the cached results for it will simply last until they expire.
+func (s *TruenasSession) subscribeToCollection(ctx context.Context, collection string) {
+	s.connMtx.Lock()
+	_, attempted := s.subscriptions_[collection]
+	if !attempted {
+		s.subscriptions_[collection] = false
+	}
+	s.connMtx.Unlock()
+	if attempted {
+		return
+	}
+
+	timeout, _ := time.ParseDuration(DEFAULT_CALL_TIMEOUT)
+	_, err, _ := s.sendAndAwait(ctx, "core.subscribe", timeout, []interface{}{collection}, false)
+	if err != nil {
+		log.Println("Daemon: could not subscribe to", collection, ":", err)
+		return
+	}
+	s.connMtx.Lock()
+	s.subscriptions_[collection] = true
+	s.connMtx.Unlock()
+}
+
+// handleCollectionEvent invalidates cached queries when the middleware reports a change to their collection
+func (s *TruenasSession) handleCollectionEvent(collection string) {
+	if s.ctx.queryCache == nil {
+		return
+	}
+	if namespace, ok := getQueryNamespace(collection); ok {
+		s.ctx.queryCache.invalidate(s.sessionKey, namespace)
+	}
+}
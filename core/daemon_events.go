@@ -0,0 +1,132 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// How many collection_update events may queue up for a slow client before they're dropped
+const EVENT_LISTENER_BUFFER = 256
+
+// streamCollection implements tnc_daemon.stream_collection. It subscribes to a collection and passes each of its
+// collection_update events to onEvent, until the client goes away or the connection is closed for good.
+func (s *TruenasSession) streamCollection(ctx context.Context, collection string, onEvent func(json.RawMessage), releaseChannel func()) error {
+	if collection == "" {
+		return fmt.Errorf("tnc_daemon.stream_collection expects the first parameter to be a collection name")
+	}
+
+	// Listen first, so that no event is missed between subscribing and listening
+	ch := make(chan json.RawMessage, EVENT_LISTENER_BUFFER)
+	s.connMtx.Lock()
+	listeners, exists := s.eventListeners_[collection]
+	if !exists {
+		listeners = make(map[chan json.RawMessage]bool)
+		s.eventListeners_[collection] = listeners
+	}
+	listeners[ch] = true
+	subscribed := s.subscriptions_[collection]
+	s.connMtx.Unlock()
+
+	defer func() {
+		s.connMtx.Lock()
+		if listeners, exists := s.eventListeners_[collection]; exists {
+			delete(listeners, ch)
+			if len(listeners) == 0 {
+				delete(s.eventListeners_, collection)
+			}
+		}
+		s.connMtx.Unlock()
+	}()
+
+	// Job updates are always subscribed to
+	if !subscribed && collection != "core.get_jobs" {
+		timeout, _ := time.ParseDuration(DEFAULT_CALL_TIMEOUT)
+		out, err, _ := s.sendAndAwait(ctx, "core.subscribe", timeout, []interface{}{collection}, false)
+		if err == nil {
+			if apiErr := ParseApiError(out); apiErr != nil {
+				err = apiErr
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Could not subscribe to %s: %v", collection, err)
+		}
+		s.connMtx.Lock()
+		s.subscriptions_[collection] = true
+		s.connMtx.Unlock()
+	}
+
+	// Streaming doesn't occupy the websocket, so let other calls use this channel
+	releaseChannel()
+
+	// The daemon shouldn't time out while a client is listening, even if nothing changes
+	var keepAliveCh <-chan time.Time
+	if s.ctx.timeoutValue > 0 {
+		ticker := time.NewTicker(s.ctx.timeoutValue / 2)
+		defer ticker.Stop()
+		keepAliveCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepAliveCh:
+			s.ctx.UpdateCountdown()
+		case event, ok := <-ch:
+			if !ok {
+				return fmt.Errorf("Connection to %s was closed", s.url)
+			}
+			onEvent(event)
+		}
+	}
+}
+
+// notifyEventListeners passes a collection_update event on to the clients streaming its collection
+func (s *TruenasSession) notifyEventListeners(collection string, params interface{}) {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	listeners := s.eventListeners_[collection]
+	if len(listeners) == 0 {
+		return
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return
+	}
+	for ch := range listeners {
+		select {
+		case ch <- data:
+		default:
+			log.Println("Daemon: dropped a", collection, "event for a client that isn't keeping up")
+		}
+	}
+}
+
+// resubscribeEventListeners subscribes again to the collections that clients are streaming, after a reconnection
+func (s *TruenasSession) resubscribeEventListeners() {
+	s.connMtx.Lock()
+	collections := make([]string, 0, len(s.eventListeners_))
+	for collection := range s.eventListeners_ {
+		if collection != "core.get_jobs" {
+			collections = append(collections, collection)
+		}
+	}
+	s.connMtx.Unlock()
+
+	for _, collection := range collections {
+		s.subscribeToCollection(context.Background(), collection)
+	}
+}
+
+// closeEventListeners ends every stream once the connection is gone for good. connMtx must be held.
+func (s *TruenasSession) closeEventListeners() {
+	for collection, listeners := range s.eventListeners_ {
+		for ch := range listeners {
+			close(ch)
+		}
+		delete(s.eventListeners_, collection)
+	}
+}
@@ -0,0 +1,827 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"truenas/truenas_incus_ctl/truenas_api"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeMiddleware is a minimal stand-in for the TrueNAS websocket API, just enough to exercise the daemon's connection handling
+type fakeMiddleware struct {
+	server      *httptest.Server
+	mtx         sync.Mutex
+	writeMtx    sync.Mutex
+	conns       []*websocket.Conn
+	logins      int
+	jobWaits    []int64
+	jobAborts   []int64
+	ignorePings bool
+	calls       map[string]int
+	otp         string          // required by auth.login_ex after the password, if set
+	tokens      map[string]bool // issued by auth.generate_token
+}
+
+func startFakeMiddleware() *fakeMiddleware {
+	return startFakeMiddlewareWith(httptest.NewServer)
+}
+
+// startFakeMiddlewareTLS serves wss:// with a self-signed certificate
+func startFakeMiddlewareTLS() *fakeMiddleware {
+	return startFakeMiddlewareWith(httptest.NewTLSServer)
+}
+
+func startFakeMiddlewareWith(newServer func(http.Handler) *httptest.Server) *fakeMiddleware {
+	fm := &fakeMiddleware{calls: make(map[string]int), tokens: make(map[string]bool)}
+	upgrader := websocket.Upgrader{}
+	fm.server = newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		fm.mtx.Lock()
+		fm.conns = append(fm.conns, conn)
+		fm.mtx.Unlock()
+		go fm.serve(conn)
+	}))
+	return fm
+}
+
+func (fm *fakeMiddleware) serve(conn *websocket.Conn) {
+	for {
+		var req map[string]interface{}
+		if err := conn.ReadJSON(&req); err != nil {
+			return
+		}
+		method, _ := req["method"].(string)
+		params, _ := req["params"].([]interface{})
+
+		fm.mtx.Lock()
+		fm.calls[method]++
+		fm.mtx.Unlock()
+
+		var result, rpcError interface{}
+		switch method {
+		case "auth.login_with_api_key":
+			fm.mtx.Lock()
+			fm.logins++
+			fm.mtx.Unlock()
+			result = true
+		case "auth.login_ex":
+			result = fm.loginEx(params)
+		case "auth.generate_token":
+			fm.mtx.Lock()
+			token := "token-" + strconv.Itoa(len(fm.tokens))
+			fm.tokens[token] = true
+			fm.mtx.Unlock()
+			result = token
+		case "core.ping":
+			fm.mtx.Lock()
+			ignore := fm.ignorePings
+			fm.mtx.Unlock()
+			if ignore {
+				continue
+			}
+			result = "pong"
+		case JOB_WAIT_STRING:
+			jobId := int64(params[0].(float64))
+			// Jobs from 900 on are unknown
+			if jobId >= 900 {
+				rpcError = map[string]interface{}{"code": API_CODE_CALL_ERROR, "message": "Method call error", "data": map[string]interface{}{
+					"error": 2, "errname": "ENOENT", "reason": "Job " + strconv.FormatInt(jobId, 10) + " does not exist",
+					"trace": map[string]interface{}{"class": "CallError", "formatted": "Traceback (most recent call last):"},
+				}}
+				break
+			}
+			fm.mtx.Lock()
+			fm.jobWaits = append(fm.jobWaits, jobId)
+			fm.mtx.Unlock()
+			result = 1000 + jobId
+		case "test.start_job":
+			result = params[0]
+		case "core.job_abort":
+			fm.mtx.Lock()
+			fm.jobAborts = append(fm.jobAborts, int64(params[0].(float64)))
+			fm.mtx.Unlock()
+			result = nil
+		default:
+			result = params
+		}
+		response := map[string]interface{}{"jsonrpc": "2.0", "id": req["id"], "result": result}
+		if rpcError != nil {
+			response = map[string]interface{}{"jsonrpc": "2.0", "id": req["id"], "error": rpcError}
+		}
+		fm.writeMtx.Lock()
+		conn.WriteJSON(response)
+		fm.writeMtx.Unlock()
+	}
+}
+
+// loginEx accepts admin/secret, followed by the OTP if one is set, or any token it issued
+func (fm *fakeMiddleware) loginEx(params []interface{}) map[string]interface{} {
+	fm.mtx.Lock()
+	defer fm.mtx.Unlock()
+	req, _ := params[0].(map[string]interface{})
+	responseType := "AUTH_ERR"
+	switch req["mechanism"] {
+	case "PASSWORD_PLAIN":
+		if req["username"] == "admin" && req["password"] == "secret" {
+			responseType = "SUCCESS"
+			if fm.otp != "" {
+				responseType = "OTP_REQUIRED"
+			}
+		}
+	case "OTP_TOKEN":
+		if fm.otp != "" && req["otp_token"] == fm.otp {
+			responseType = "SUCCESS"
+		}
+	case "TOKEN_PLAIN":
+		if token, _ := req["token"].(string); fm.tokens[token] {
+			responseType = "SUCCESS"
+		}
+	}
+	if responseType == "SUCCESS" {
+		fm.logins++
+	}
+	return map[string]interface{}{"response_type": responseType}
+}
+
+func (fm *fakeMiddleware) finishJob(jobId int64, result interface{}) {
+	fm.updateJob(1000+jobId, map[string]interface{}{
+		"method":    JOB_WAIT_STRING,
+		"arguments": []interface{}{jobId},
+		"state":     "SUCCESS",
+		"result":    result,
+	})
+}
+
+func (fm *fakeMiddleware) reportProgress(jobId int64, percent float64, description string) {
+	fm.updateJob(jobId, map[string]interface{}{
+		"method": "test.job",
+		"state":  "RUNNING",
+		"progress": map[string]interface{}{
+			"percent":     percent,
+			"description": description,
+		},
+	})
+}
+
+func (fm *fakeMiddleware) updateJob(id int64, fields map[string]interface{}) {
+	fm.updateCollection("core.get_jobs", id, fields)
+}
+
+func (fm *fakeMiddleware) updateCollection(collection string, id interface{}, fields map[string]interface{}) {
+	fm.mtx.Lock()
+	conns := fm.conns
+	fm.mtx.Unlock()
+	update := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "collection_update",
+		"params": map[string]interface{}{
+			"collection": collection,
+			"id":         id,
+			"fields":     fields,
+		},
+	}
+	// only the most recent connection is still alive
+	fm.writeMtx.Lock()
+	conns[len(conns)-1].WriteJSON(update)
+	fm.writeMtx.Unlock()
+}
+
+func (fm *fakeMiddleware) dropConnections() {
+	fm.mtx.Lock()
+	defer fm.mtx.Unlock()
+	for _, c := range fm.conns {
+		c.Close()
+	}
+}
+
+func (fm *fakeMiddleware) getLogins() int {
+	fm.mtx.Lock()
+	defer fm.mtx.Unlock()
+	return fm.logins
+}
+
+func (fm *fakeMiddleware) getJobWaits() int {
+	fm.mtx.Lock()
+	defer fm.mtx.Unlock()
+	return len(fm.jobWaits)
+}
+
+func (fm *fakeMiddleware) getCalls(method string) int {
+	fm.mtx.Lock()
+	defer fm.mtx.Unlock()
+	return fm.calls[method]
+}
+
+func (fm *fakeMiddleware) getJobAborts() int {
+	fm.mtx.Lock()
+	defer fm.mtx.Unlock()
+	return len(fm.jobAborts)
+}
+
+func (fm *fakeMiddleware) makeLogin() LoginInfo {
+	return LoginInfo{
+		call: CallInfo{
+			method: "auth.login_with_api_key",
+			params: []interface{}{"1-abcdef"},
+		},
+		serverUrl: "ws" + strings.TrimPrefix(fm.server.URL, "http"),
+	}
+}
+
+func waitUntil(t *testing.T, condition func() bool) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(time.Duration(50) * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for condition")
+}
+
+func TestDaemonReconnectsAndRearmsJobs(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := fm.makeLogin()
+
+	out, err, _ := d.maybeCreateSessionAndCall(context.Background(), "key", "5s", CallInfo{method: "test.echo", params: []interface{}{"hello"}}, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, strings.Contains(string(out), "hello"), true)
+	AssertEqual(t, fm.getLogins(), 1)
+
+	awaitCh := make(chan json.RawMessage)
+	go func() {
+		out, _, _ := d.maybeCreateSessionAndCall(context.Background(), "key", "5s", CallInfo{method: TNC_PREFIX_STRING + "await_job", params: []interface{}{float64(42)}}, login)
+		awaitCh <- out
+	}()
+	waitUntil(t, func() bool { return fm.getJobWaits() == 1 })
+
+	fm.dropConnections()
+	waitUntil(t, func() bool { return fm.getLogins() == 2 && fm.getJobWaits() == 2 })
+
+	out, err, _ = d.maybeCreateSessionAndCall(context.Background(), "key", "5s", CallInfo{method: "test.echo", params: []interface{}{"again"}}, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, strings.Contains(string(out), "again"), true)
+
+	fm.finishJob(42, "done")
+	select {
+	case out = <-awaitCh:
+		AssertEqual(t, strings.Contains(string(out), "\"done\""), true)
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("await_job did not complete after reconnecting")
+	}
+
+	d.mapMtx.Lock()
+	AssertEqual(t, len(d.sessionMap_["key"]), 1)
+	d.mapMtx.Unlock()
+}
+
+func TestDaemonHeartbeatDetectsDeadConnection(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "100ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err, _ = d.maybeCreateSessionAndCall(context.Background(), "key", "5s", CallInfo{method: "test.echo", params: []interface{}{}}, fm.makeLogin())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fm.mtx.Lock()
+	fm.ignorePings = true
+	fm.mtx.Unlock()
+	waitUntil(t, func() bool { return fm.getLogins() >= 2 })
+}
+
+func TestDaemonAbortsJobWhenClientCancels(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		call := CallInfo{method: TNC_PREFIX_STRING + "await_job", params: []interface{}{float64(7)}, abortOnCancel: true}
+		_, err, _ := d.maybeCreateSessionAndCall(ctx, "key", "5s", call, fm.makeLogin())
+		errCh <- err
+	}()
+	waitUntil(t, func() bool { return fm.getJobWaits() == 1 })
+
+	cancel()
+	select {
+	case err = <-errCh:
+		AssertEqual(t, err, context.Canceled)
+	case <-time.After(time.Duration(5) * time.Second):
+		t.Fatal("await_job did not stop waiting after being cancelled")
+	}
+	waitUntil(t, func() bool { return fm.getJobAborts() == 1 })
+}
+
+func serveTestRequest(d *DaemonContext, method string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("POST", "http://unix/tnc-daemon", bytes.NewReader([]byte(body)))
+	request.Header.Set("TNC-Call-Method", method)
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	recorder := httptest.NewRecorder()
+	d.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestDaemonSessionHandles(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := map[string]string{
+		"TNC-Host-Url": fm.makeLogin().serverUrl,
+		"TNC-Api-Key":  "1-abcdef",
+	}
+	res := serveTestRequest(d, TNC_PREFIX_STRING+"register", creds, "")
+	AssertEqual(t, res.Code, http.StatusOK)
+	var handle string
+	if err = json.Unmarshal(res.Body.Bytes(), &handle); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, strings.Contains(handle, "abcdef"), false)
+
+	// the same credentials map to the same handle, and therefore the same connections
+	res = serveTestRequest(d, TNC_PREFIX_STRING+"register", creds, "")
+	AssertEqual(t, res.Body.String(), "\""+handle+"\"")
+
+	res = serveTestRequest(d, "test.echo", map[string]string{"TNC-Session-Handle": handle}, "[\"hello\"]")
+	AssertEqual(t, res.Code, http.StatusOK)
+	AssertEqual(t, strings.Contains(res.Body.String(), "hello"), true)
+
+	// credentials alone are no longer accepted
+	res = serveTestRequest(d, "test.echo", creds, "[\"hello\"]")
+	AssertEqual(t, res.Code, http.StatusUnauthorized)
+
+	res = serveTestRequest(d, "test.echo", map[string]string{"TNC-Session-Handle": "0123"}, "[\"hello\"]")
+	AssertEqual(t, res.Code, http.StatusUnauthorized)
+}
+
+func TestDaemonForgetsIdleRegistrations(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := map[string]string{
+		"TNC-Host-Url": fm.makeLogin().serverUrl,
+		"TNC-Api-Key":  "1-abcdef",
+	}
+	handle := strings.Trim(serveTestRequest(d, TNC_PREFIX_STRING+"register", creds, "").Body.String(), "\"")
+	res := serveTestRequest(d, "test.echo", map[string]string{"TNC-Session-Handle": handle}, "[\"hello\"]")
+	AssertEqual(t, res.Code, http.StatusOK)
+
+	// registrations with a channel open are kept, however long they've been idle
+	later := time.Now().Add(REGISTRATION_IDLE_TIMEOUT + time.Second)
+	AssertEqual(t, d.sweepRegistrations(later), 0)
+
+	d.deleteSession(handle, 0)
+	AssertEqual(t, d.sweepRegistrations(time.Now()), 0)
+	AssertEqual(t, d.sweepRegistrations(later), 1)
+
+	res = serveTestRequest(d, "test.echo", map[string]string{"TNC-Session-Handle": handle}, "[\"hello\"]")
+	AssertEqual(t, res.Code, http.StatusUnauthorized)
+}
+
+func TestDaemonExpiresFinishedJobs(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s", JobRetention: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := fm.makeLogin()
+
+	_, err, _ = d.maybeCreateSessionAndCall(context.Background(), "key", "5s", CallInfo{method: "test.echo", params: []interface{}{}}, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := d.getSessions()[0]
+	countJobs := func() int {
+		s.connMtx.Lock()
+		defer s.connMtx.Unlock()
+		return len(s.jobMap_)
+	}
+
+	// nobody is waiting on these, eg. they were started from the web UI
+	fm.finishJob(1, "first")
+	fm.finishJob(2, "second")
+	waitUntil(t, func() bool { return countJobs() == 2 })
+
+	out, err, _ := d.maybeCreateSessionAndCall(context.Background(), "key", "5s", CallInfo{method: TNC_PREFIX_STRING + "await_job", params: []interface{}{float64(2)}}, login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, strings.Contains(string(out), "\"second\""), true)
+
+	now := time.Now()
+	AssertEqual(t, d.sweepJobs(now), 0)
+	// job 2 was awaited, so it only outlives the grace period
+	AssertEqual(t, d.sweepJobs(now.Add(JOB_AWAITED_GRACE+time.Second)), 1)
+	AssertEqual(t, s.getJobFuture(2) == nil, true)
+	AssertEqual(t, s.getJobFuture(1) != nil, true)
+	AssertEqual(t, d.sweepJobs(now.Add(time.Duration(2)*time.Hour)), 1)
+	AssertEqual(t, countJobs(), 0)
+
+	// jobs still running are never expired
+	s.connMtx.Lock()
+	s.trackJob(3)
+	s.connMtx.Unlock()
+	AssertEqual(t, d.sweepJobs(now.Add(time.Duration(24)*time.Hour)), 0)
+	AssertEqual(t, countJobs(), 1)
+}
+
+func TestDaemonStreamsJobProgress(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemonServer := httptest.NewServer(d)
+	defer daemonServer.Close()
+
+	creds := map[string]string{
+		"TNC-Host-Url": fm.makeLogin().serverUrl,
+		"TNC-Api-Key":  "1-abcdef",
+	}
+	handle := strings.Trim(serveTestRequest(d, TNC_PREFIX_STRING+"register", creds, "").Body.String(), "\"")
+
+	request, _ := http.NewRequest("POST", daemonServer.URL, bytes.NewReader([]byte("[9]")))
+	request.Header.Set("TNC-Call-Method", TNC_PREFIX_STRING+"stream_job")
+	request.Header.Set("TNC-Session-Handle", handle)
+	// headers aren't sent until there's something to stream
+	responseCh := make(chan *http.Response)
+	go func() {
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Error(err)
+		}
+		responseCh <- response
+	}()
+	waitUntil(t, func() bool { return fm.getJobWaits() == 1 })
+	fm.reportProgress(9, 50, "Halfway")
+
+	response := <-responseCh
+	if response == nil {
+		t.FailNow()
+	}
+	defer response.Body.Close()
+	AssertEqual(t, response.StatusCode, http.StatusOK)
+	AssertEqual(t, response.Header.Get("Content-Type"), "application/x-ndjson")
+
+	lines := bufio.NewScanner(response.Body)
+	if !lines.Scan() {
+		t.Fatal("Expected a progress update")
+	}
+	var line map[string]JobProgress
+	if err = json.Unmarshal(lines.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	AssertEqual(t, line["progress"], JobProgress{JobId: 9, Percent: 50, Description: "Halfway"})
+
+	fm.finishJob(9, "finished")
+	if !lines.Scan() {
+		t.Fatal("Expected the job's result")
+	}
+	AssertEqual(t, strings.HasPrefix(lines.Text(), "{\"result\":"), true)
+	AssertEqual(t, strings.Contains(lines.Text(), "\"finished\""), true)
+	AssertEqual(t, lines.Scan(), false)
+}
+
+func TestClientStreamsJobWaitError(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	socketPath := path.Join(t.TempDir(), "tncdaemon.sock")
+	ls, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemonServer := &http.Server{Handler: d}
+	go daemonServer.Serve(ls)
+	defer daemonServer.Close()
+
+	api := &ClientSession{HostName: fm.makeLogin().serverUrl, ApiKey: "1-abcdef", SocketPath: socketPath}
+	AssertEqual(t, api.ConnectToExistingDaemon(), nil)
+
+	// The error keeps its details whether the job is followed with progress or not
+	_, errWithProgress := WaitForJobWithProgress(api, 900, func(JobProgress) {})
+	_, errWithoutProgress := WaitForJob(api, 901)
+	for i, err := range []error{errWithProgress, errWithoutProgress} {
+		var apiErr *ApiError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("Expected an ApiError, got %v", err)
+		}
+		AssertEqual(t, apiErr.JobId, int64(900+i))
+		AssertEqual(t, apiErr.Method, JOB_WAIT_STRING)
+		AssertEqual(t, apiErr.Errno, 2)
+		AssertEqual(t, apiErr.Errname, "ENOENT")
+		AssertEqual(t, apiErr.Class, "CallError")
+		AssertEqual(t, apiErr.Reason, fmt.Sprintf("Job %d does not exist", 900+i))
+		AssertEqual(t, apiErr.Trace, "Traceback (most recent call last):")
+	}
+}
+
+func TestListenerFromSystemd(t *testing.T) {
+	ls, err := listenerFromSystemd(SD_LISTEN_FDS_START)
+	AssertEqual(t, ls == nil && err == nil, true)
+
+	sockPath := path.Join(t.TempDir(), "activated.sock")
+	original, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer original.Close()
+	f, err := original.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// listenerFromSystemd takes ownership of the descriptor it's given
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	ls, err = listenerFromSystemd(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+	AssertEqual(t, os.Getenv("LISTEN_FDS"), "")
+
+	go func() {
+		if conn, err := net.Dial("unix", sockPath); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := ls.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDaemonQueryCache(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s", QueryCacheTTL: "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := fm.makeLogin()
+	call := func(method string, params ...interface{}) {
+		if _, err, _ := d.maybeCreateSessionAndCall(context.Background(), "key", "5s", CallInfo{method: method, params: params}, login); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filterA := []interface{}{[]interface{}{"id", "=", "tank/a"}}
+	filterB := []interface{}{[]interface{}{"id", "=", "tank/b"}}
+
+	call("pool.dataset.query", filterA)
+	call("pool.dataset.query", filterA)
+	AssertEqual(t, fm.getCalls("pool.dataset.query"), 1)
+	AssertEqual(t, fm.getCalls("core.subscribe"), 2) // core.get_jobs, then pool.dataset.query
+
+	call("pool.dataset.query", filterB)
+	AssertEqual(t, fm.getCalls("pool.dataset.query"), 2)
+
+	// a mutating call in the same namespace drops its cached queries, but not those of other namespaces
+	call("sharing.nfs.query", filterA)
+	call("pool.dataset.update", "tank/a", map[string]interface{}{"comments": "hello"})
+	call("pool.dataset.query", filterA)
+	call("sharing.nfs.query", filterA)
+	AssertEqual(t, fm.getCalls("pool.dataset.query"), 3)
+	AssertEqual(t, fm.getCalls("sharing.nfs.query"), 1)
+
+	// so does a change reported by the middleware
+	fm.updateCollection("sharing.nfs.query", 1, map[string]interface{}{"enabled": false})
+	waitUntil(t, func() bool {
+		d.queryCache.mtx.Lock()
+		defer d.queryCache.mtx.Unlock()
+		return len(d.queryCache.entries) == 1
+	})
+	call("sharing.nfs.query", filterA)
+	AssertEqual(t, fm.getCalls("sharing.nfs.query"), 2)
+}
+
+func TestDaemonAuditLog(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	fileName := path.Join(t.TempDir(), "audit.log")
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s", AuditLog: fileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := fm.makeLogin()
+	call := func(info CallInfo) {
+		if _, err, _ := d.maybeCreateSessionAndCall(context.Background(), "key", "5s", info, login); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	call(CallInfo{method: "pool.dataset.query", params: []interface{}{}})
+	call(CallInfo{method: "pool.dataset.create", params: []interface{}{map[string]interface{}{
+		"name":               "dozer/secure",
+		"encryption_options": map[string]interface{}{"passphrase": "hunter2"},
+	}}})
+	call(CallInfo{method: "test.start_job", params: []interface{}{float64(5)}, isJob: true})
+	fm.finishJob(5, "done")
+
+	var records []AuditRecord
+	waitUntil(t, func() bool {
+		records, _ = ReadAuditLog(fileName)
+		return len(records) == 3
+	})
+
+	AssertEqual(t, records[0].Method, "pool.dataset.create")
+	params, _ := json.Marshal(records[0].Params)
+	AssertEqual(t, string(params), "[{\"encryption_options\":{\"passphrase\":\""+REDACTED_STRING+"\"},\"name\":\"dozer/secure\"}]")
+	AssertEqual(t, records[1].JobId, int64(5))
+	AssertEqual(t, records[1].JobState, "")
+	AssertEqual(t, records[2].Method, "test.start_job")
+	AssertEqual(t, records[2].JobState, "SUCCESS")
+	AssertEqual(t, string(records[2].Result), "\"done\"")
+	AssertEqual(t, records[2].Host, GetHostNameFromApiUrl(login.serverUrl))
+}
+
+func TestAuditLogRedactsResults(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "audit.log")
+	audit := NewAuditLog(fileName)
+
+	audit.RecordCall("nas", "api_key.create", []interface{}{map[string]interface{}{"name": "tnc"}},
+		json.RawMessage(`{"jsonrpc":"2.0","result":{"id":3,"name":"tnc","key":"3-mintedkey"},"id":1}`), nil, -1)
+	audit.RecordCall("nas", "auth.generate_token", []interface{}{600},
+		json.RawMessage(`{"jsonrpc":"2.0","result":"mintedtoken","id":2}`), nil, -1)
+	audit.RecordCall("nas", "core.bulk", []interface{}{"api_key.create", []interface{}{}}, nil, nil, 9)
+	audit.RecordJobFinished("nas", 9, "SUCCESS", []interface{}{map[string]interface{}{"result": map[string]interface{}{"key": "9-mintedkey"}}}, nil)
+
+	data, err := os.ReadFile(fileName)
+	AssertEqual(t, err, nil)
+	if strings.Contains(string(data), "minted") {
+		t.Fatalf("Expected minted keys and tokens to be redacted:\n%s", data)
+	}
+	records, err := ReadAuditLog(fileName)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(records), 4)
+	AssertEqual(t, string(records[0].Result), `{"id":3,"key":"********","name":"tnc"}`)
+	AssertEqual(t, string(records[1].Result), `"********"`)
+}
+
+func TestRedactSecrets(t *testing.T) {
+	params := []interface{}{map[string]interface{}{
+		"username":   "admin",
+		"password":   "hunter2",
+		"api_key":    "1-abcdef",
+		"keyformat":  "PASSPHRASE",
+		"otp_token":  "",
+		"attributes": []interface{}{map[string]interface{}{"secret": 1234}},
+	}}
+	data, _ := json.Marshal(RedactSecrets(params))
+	AssertEqual(t, string(data), "[{\"api_key\":\"********\",\"attributes\":[{\"secret\":\"********\"}],"+
+		"\"keyformat\":\"PASSPHRASE\",\"otp_token\":\"\",\"password\":\"********\",\"username\":\"admin\"}]")
+	// the original is left alone
+	AssertEqual(t, params[0].(map[string]interface{})["password"], "hunter2")
+}
+
+func TestDaemonPasswordLoginWithOtp(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+	fm.otp = "123456"
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := map[string]string{
+		"TNC-Host-Url": fm.makeLogin().serverUrl,
+		"TNC-Username": "admin",
+		"TNC-Password": "secret",
+	}
+	res := serveTestRequest(d, TNC_PREFIX_STRING+"register", creds, "")
+	handle := strings.Trim(res.Body.String(), "\"")
+	call := map[string]string{"TNC-Session-Handle": handle}
+
+	res = serveTestRequest(d, "test.echo", call, "[\"hello\"]")
+	AssertEqual(t, res.Code, http.StatusForbidden)
+	AssertEqual(t, fm.getLogins(), 0)
+
+	// registering again with the OTP keeps the same handle
+	creds["TNC-Otp"] = "123456"
+	res = serveTestRequest(d, TNC_PREFIX_STRING+"register", creds, "")
+	AssertEqual(t, res.Body.String(), "\""+handle+"\"")
+
+	res = serveTestRequest(d, "test.echo", call, "[\"hello\"]")
+	AssertEqual(t, res.Code, http.StatusOK)
+	AssertEqual(t, fm.getLogins(), 1)
+	AssertEqual(t, fm.getCalls("auth.generate_token"), 1)
+
+	// the OTP can't be used twice, so logging back in relies on the token
+	fm.dropConnections()
+	waitUntil(t, func() bool { return fm.getLogins() == 2 })
+	res = serveTestRequest(d, "test.echo", call, "[\"again\"]")
+	AssertEqual(t, res.Code, http.StatusOK)
+	AssertEqual(t, strings.Contains(res.Body.String(), "again"), true)
+	AssertEqual(t, fm.getCalls("auth.login_ex"), 4)
+}
+
+func TestDaemonPinnedCertificate(t *testing.T) {
+	fm := startFakeMiddlewareTLS()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callWithPin := func(fingerprint string) *httptest.ResponseRecorder {
+		creds := map[string]string{
+			"TNC-Host-Url": "wss" + strings.TrimPrefix(fm.server.URL, "https"),
+			"TNC-Api-Key":  "1-abcdef",
+		}
+		if fingerprint != "" {
+			creds["TNC-Tls-Fingerprint"] = fingerprint
+		}
+		res := serveTestRequest(d, TNC_PREFIX_STRING+"register", creds, "")
+		handle := strings.Trim(res.Body.String(), "\"")
+		return serveTestRequest(d, "test.echo", map[string]string{"TNC-Session-Handle": handle}, "[\"hello\"]")
+	}
+
+	// the self-signed certificate is accepted once pinned, in either notation
+	actual := truenas_api.CertificateFingerprint(fm.server.Certificate().Raw)
+	res := callWithPin(actual)
+	AssertEqual(t, res.Code, http.StatusOK)
+	res = callWithPin("sha256:" + strings.ToLower(strings.ReplaceAll(actual, ":", "")))
+	AssertEqual(t, res.Code, http.StatusOK)
+
+	// but not without a pin
+	res = callWithPin("")
+	if res.Code == http.StatusOK {
+		t.Fatal("Expected an unpinned self-signed certificate to be rejected")
+	}
+
+	// and a different pin reports both fingerprints
+	pinned := strings.TrimSuffix(strings.Repeat("AB:", 32), ":")
+	res = callWithPin(pinned)
+	if res.Code == http.StatusOK || !strings.Contains(res.Body.String(), pinned) || !strings.Contains(res.Body.String(), actual) {
+		t.Fatalf("Expected a fingerprint mismatch, got %d: %s", res.Code, res.Body.String())
+	}
+	AssertEqual(t, fm.getLogins(), 2)
+}
@@ -1,26 +1,24 @@
 package core
 
 import (
+	"context"
 	"sync"
-	"time"
 )
 
 type Future[T any] struct {
-	mtx      *sync.Mutex
-	cv       *sync.Cond
-	done_    bool
-	wokenUp_ bool
-	value_   T
-	err_     error
+	mtx    *sync.Mutex
+	doneCh chan struct{}
+	done_  bool
+	value_ T
+	err_   error
 }
 
 func MakeFuture[T any]() *Future[T] {
-	m := &sync.Mutex{}
 	return &Future[T]{
-		mtx: m,
-		cv: sync.NewCond(m),
-		done_: false,
-		err_: nil,
+		mtx:    &sync.Mutex{},
+		doneCh: make(chan struct{}),
+		done_:  false,
+		err_:   nil,
 	}
 }
 
@@ -40,9 +38,8 @@ func (f *Future[T]) Reach(value T, err error) {
 	if !f.done_ {
 		f.value_ = value
 		f.err_ = err
-		f.wokenUp_ = false
 		f.done_ = true
-		f.cv.Broadcast()
+		close(f.doneCh)
 	}
 }
 
@@ -58,70 +55,24 @@ func (f *Future[T]) Peek() (bool, T, error) {
 	return false, defaultValue, nil
 }
 
-func (f *Future[T]) Get() (T, error) {
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
-
-	for !f.done_ {
-		f.cv.Wait()
-	}
-
-	return f.value_, f.err_
-}
-
-func (f *Future[T]) MaybeGet() (bool, T, error) {
-	f.mtx.Lock()
-	defer f.mtx.Unlock()
-
-	f.wokenUp_ = false
-	for !f.done_ {
-		f.cv.Wait()
-		if f.wokenUp_ {
-			f.wokenUp_ = false
-			var defaultValue T
-			return false, defaultValue, nil
-		}
-	}
-
-	return true, f.value_, f.err_
+// Done returns a channel that is closed once the future has been completed or failed
+func (f *Future[T]) Done() <-chan struct{} {
+	return f.doneCh
 }
 
-func (f *Future[T]) Interrupt() {
-	f.mtx.Lock()
-	f.wokenUp_ = true
-	f.cv.Broadcast()
-	f.mtx.Unlock()
+func (f *Future[T]) Get() (T, error) {
+	<-f.doneCh
+	return f.value_, f.err_
 }
 
-// sync.Cond.WaitTimeout(...) doesn't exist yet, so we burn a goroutine and hope for the best
-func AwaitFutureOrTimeout[T any](f *Future[T], timeout time.Duration) (bool, T, error) {
-	doneCh := make(chan []interface{})
-	go func() {
-		completed, value, err := f.MaybeGet()
-		// Only send on the channel if we didn't time out, since if we did there'd be no one receiving so we'd block forever.
-		if completed {
-			doneCh <- []interface{}{value, err}
-		}
-		close(doneCh)
-	}()
-
+// Wait blocks until the future is reached or ctx is done, in which case ctx.Err() is returned.
+// Use Peek() to tell whether an error came from the future itself.
+func (f *Future[T]) Wait(ctx context.Context) (T, error) {
 	select {
-	case result := <-doneCh:
-		var value T
-		var err error
-		if result[0] != nil {
-			value = result[0].(T)
-		}
-		if result[1] != nil {
-			err = result[1].(error)
-		}
-		return true, value, err
-	case <-time.After(timeout):
-		break
+	case <-f.doneCh:
+		return f.value_, f.err_
+	case <-ctx.Done():
+		var defaultValue T
+		return defaultValue, ctx.Err()
 	}
-
-	f.Interrupt()
-
-	var defaultValue T
-	return false, defaultValue, nil
 }
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFutureWaitCompleted(t *testing.T) {
+	f := MakeFuture[int]()
+	go f.Complete(5)
+
+	value, err := f.Wait(context.Background())
+	AssertEqual(t, value, 5)
+	AssertEqual(t, err, nil)
+
+	// reaching a future twice has no effect
+	f.Fail(errors.New("too late"))
+	value, err = f.Get()
+	AssertEqual(t, value, 5)
+	AssertEqual(t, err, nil)
+}
+
+func TestFutureWaitCancelled(t *testing.T) {
+	f := MakeFuture[int]()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(10)*time.Millisecond)
+	defer cancel()
+
+	_, err := f.Wait(ctx)
+	AssertEqual(t, err, context.DeadlineExceeded)
+
+	isDone, _, _ := f.Peek()
+	AssertEqual(t, isDone, false)
+
+	f.Fail(errors.New("failed"))
+	_, err = f.Wait(context.Background())
+	AssertEqual(t, err.Error(), "failed")
+}
@@ -0,0 +1,238 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal implementation of the Prometheus text exposition format, covering only what the daemon reports.
+// Every metric has at most one label.
+
+var callDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+var jobDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mtx    sync.Mutex
+	values map[string]float64
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mtx     sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type daemonMetrics struct {
+	calls         *counterVec
+	callErrors    *counterVec
+	callDuration  *histogramVec
+	clientRetries *counterVec
+	reconnects    *counterVec
+	jobDuration   *histogramVec
+
+	queryCacheHits   *counterVec
+	queryCacheMisses *counterVec
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func newDaemonMetrics() *daemonMetrics {
+	return &daemonMetrics{
+		calls:         newCounterVec("tncdaemon_calls_total", "Calls received by the daemon", "method"),
+		callErrors:    newCounterVec("tncdaemon_call_errors_total", "Calls that returned an error", "method"),
+		callDuration:  newHistogramVec("tncdaemon_call_duration_seconds", "Time taken to serve each call", "method", callDurationBuckets),
+		clientRetries: newCounterVec("tncdaemon_client_retries_total", "Attempts clients had to repeat before reaching the daemon", ""),
+		reconnects:    newCounterVec("tncdaemon_reconnects_total", "Websocket connections re-established after being lost", "host"),
+		jobDuration:   newHistogramVec("tncdaemon_job_duration_seconds", "Time taken by finished jobs", "state", jobDurationBuckets),
+
+		queryCacheHits:   newCounterVec("tncdaemon_query_cache_hits_total", "Queries answered from the query cache", "method"),
+		queryCacheMisses: newCounterVec("tncdaemon_query_cache_misses_total", "Cacheable queries that were sent to the middleware", "method"),
+	}
+}
+
+func (c *counterVec) Add(labelValue string, delta float64) {
+	c.mtx.Lock()
+	c.values[labelValue] += delta
+	c.mtx.Unlock()
+}
+
+func (c *counterVec) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	writeMetricFamily(w, c.name, c.help, "counter", c.label, c.values)
+}
+
+func (h *histogramVec) Observe(labelValue string, value float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	series, exists := h.series[labelValue]
+	if !exists {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = series
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			series.counts[i]++
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, labelValue := range GetKeysSorted(h.series) {
+		series := h.series[labelValue]
+		prefix := ""
+		if h.label != "" {
+			prefix = h.label + "=\"" + escapeLabelValue(labelValue) + "\","
+		}
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatMetricValue(upper), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, series.count)
+		labels := formatLabels(h.label, labelValue)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatMetricValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, series.count)
+	}
+}
+
+// writeMetricFamily writes one counter or gauge, with a sample per label value
+func writeMetricFamily(w io.Writer, name, help, metricType, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	for _, labelValue := range GetKeysSorted(values) {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(label, labelValue), formatMetricValue(values[labelValue]))
+	}
+}
+
+func formatLabels(label, labelValue string) string {
+	if label == "" {
+		return ""
+	}
+	return "{" + label + "=\"" + escapeLabelValue(labelValue) + "\"}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// writeMetrics reports the daemon's counters and histograms, along with gauges sampled from the current sessions
+func (d *DaemonContext) writeMetrics(w io.Writer) {
+	d.metrics.calls.write(w)
+	d.metrics.callErrors.write(w)
+	d.metrics.callDuration.write(w)
+	d.metrics.clientRetries.write(w)
+	d.metrics.reconnects.write(w)
+	d.metrics.jobDuration.write(w)
+	d.metrics.queryCacheHits.write(w)
+	d.metrics.queryCacheMisses.write(w)
+
+	channels := make(map[string]float64)
+	d.mapMtx.Lock()
+	for sessionKey, slots := range d.sessionMap_ {
+		host := GetHostNameFromApiUrl(d.sessionHosts_[sessionKey])
+		for _, slot := range slots {
+			if slot != nil {
+				channels[host]++
+			}
+		}
+	}
+	d.mapMtx.Unlock()
+	writeMetricFamily(w, "tncdaemon_channels", "Open websocket channels", "gauge", "host", channels)
+
+	outstanding, retained := 0, 0
+	for _, s := range d.getSessions() {
+		s.connMtx.Lock()
+		for _, job := range s.jobMap_ {
+			if job.expiresAt.IsZero() {
+				outstanding++
+			} else {
+				retained++
+			}
+		}
+		s.connMtx.Unlock()
+	}
+	writeMetricFamily(w, "tncdaemon_jobs_outstanding", "Jobs being waited on that haven't finished", "gauge", "", map[string]float64{"": float64(outstanding)})
+	writeMetricFamily(w, "tncdaemon_jobs_retained", "Finished jobs whose results are still held", "gauge", "", map[string]float64{"": float64(retained)})
+	writeMetricFamily(w, "tncdaemon_requests_in_flight", "Requests currently being served", "gauge", "", map[string]float64{"": float64(d.inFlight.Load())})
+}
+
+// serveMetrics runs the metrics listener until the returned server is closed
+func (d *DaemonContext) serveMetrics(listenAddr string) (*http.Server, error) {
+	ls, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.writeMetrics(w)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: time.Duration(10) * time.Second}
+
+	go func() {
+		if err := server.Serve(ls); err != nil && err != http.ErrServerClosed {
+			log.Println("Metrics server error:", err)
+		}
+	}()
+	return server, nil
+}
+
+// getJobDuration uses the timestamps the middleware reports for a job, if it sent them
+func getJobDuration(fields map[string]interface{}) (time.Duration, bool) {
+	started, ok1 := ParseMiddlewareDate(fields["time_started"])
+	finished, ok2 := ParseMiddlewareDate(fields["time_finished"])
+	if !ok1 || !ok2 || finished.Before(started) {
+		return 0, false
+	}
+	return finished.Sub(started), true
+}
+
+// ParseMiddlewareDate reads a time sent by the middleware, eg. a job's time_started, as {"$date": <ms since epoch>}
+func ParseMiddlewareDate(value interface{}) (time.Time, bool) {
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return time.Time{}, false
+	}
+	ms, ok := obj["$date"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(int64(ms)), true
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramExposition(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test histogram", "method", []float64{0.1, 1})
+	h.Observe("a\"b", 0.05)
+	h.Observe("a\"b", 0.5)
+	h.Observe("a\"b", 5)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	expected := "# HELP test_seconds Test histogram\n" +
+		"# TYPE test_seconds histogram\n" +
+		"test_seconds_bucket{method=\"a\\\"b\",le=\"0.1\"} 1\n" +
+		"test_seconds_bucket{method=\"a\\\"b\",le=\"1\"} 2\n" +
+		"test_seconds_bucket{method=\"a\\\"b\",le=\"+Inf\"} 3\n" +
+		"test_seconds_sum{method=\"a\\\"b\"} 5.55\n" +
+		"test_seconds_count{method=\"a\\\"b\"} 3\n"
+	AssertEqual(t, buf.String(), expected)
+}
+
+func TestDaemonMetrics(t *testing.T) {
+	fm := startFakeMiddleware()
+	defer fm.server.Close()
+
+	d, err := newDaemonContext(DaemonOptions{HeartbeatInterval: "0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := map[string]string{
+		"TNC-Host-Url": fm.makeLogin().serverUrl,
+		"TNC-Api-Key":  "1-abcdef",
+	}
+	res := serveTestRequest(d, TNC_PREFIX_STRING+"register", creds, "")
+	handle := strings.Trim(res.Body.String(), "\"")
+
+	serveTestRequest(d, "test.echo", map[string]string{"TNC-Session-Handle": handle, "TNC-Retries": "2"}, "[]")
+	serveTestRequest(d, "test.echo", map[string]string{"TNC-Session-Handle": handle}, "not json")
+
+	var buf bytes.Buffer
+	d.writeMetrics(&buf)
+	out := buf.String()
+
+	AssertEqual(t, strings.Contains(out, "tncdaemon_calls_total{method=\"test.echo\"} 2\n"), true)
+	AssertEqual(t, strings.Contains(out, "tncdaemon_call_errors_total{method=\"test.echo\"} 1\n"), true)
+	AssertEqual(t, strings.Contains(out, "tncdaemon_call_duration_seconds_count{method=\"test.echo\"} 2\n"), true)
+	AssertEqual(t, strings.Contains(out, "tncdaemon_client_retries_total 2\n"), true)
+	host := GetHostNameFromApiUrl(fm.makeLogin().serverUrl)
+	AssertEqual(t, strings.Contains(out, "tncdaemon_channels{host=\""+host+"\"} 1\n"), true)
+	AssertEqual(t, strings.Contains(out, "tncdaemon_jobs_outstanding 0\n"), true)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	//"strconv"
@@ -21,13 +22,21 @@ type ApiJobResult struct {
 type RealSession struct {
 	HostName string
 	ApiKey string
+	Username string // used with Password if ApiKey is empty
+	Password string
+	PromptOtp func() (string, error) // asks for a one-time password when the host requires one
 	IsDebug bool
 	AllowInsecure bool
+	TLSFingerprint string // pinned SHA-256 fingerprint of the host's certificate, which may then be self-signed
+	CAFile string // CA bundle to verify the host's certificate against
+	AbortJobsOnCancel bool
+	Ctx context.Context
 	client *truenas_api.Client
 	subscribedToJobs bool
 	resultsQueue *SimpleQueue[ApiJobResult]
 	jobsList []int64
 	mapSkipWaitOnClose map[int64]bool
+	AuditLog *AuditLog
 }
 
 func (s *RealSession) IsLoggedIn() bool {
@@ -45,8 +54,8 @@ func (s *RealSession) Login() error {
 		_ = s.Close(nil)
 	}
 
-	if s.HostName == "" || s.ApiKey == "" {
-		return errors.New("Hostname and API key were not provided")
+	if s.HostName == "" || (s.ApiKey == "" && (s.Username == "" || s.Password == "")) {
+		return errors.New("Hostname and API key (or username and password) were not provided")
 	}
 
 	if s.resultsQueue == nil {
@@ -55,7 +64,11 @@ func (s *RealSession) Login() error {
 
 	client, err := truenas_api.NewClientWithCallback(
 		GetApiUrlFromHostName(s.HostName),
-		s.AllowInsecure,
+		truenas_api.TLSTrust{
+			AllowInsecure: s.AllowInsecure,
+			Fingerprint: s.TLSFingerprint,
+			CAFile: s.CAFile,
+		},
 		func(waitingJobId int64, innerJobId int64, params map[string]interface{}) {
 			s.HandleJobUpdate(waitingJobId, innerJobId, params)
 		},
@@ -64,7 +77,11 @@ func (s *RealSession) Login() error {
 		return errors.New("Failed to create client: " + err.Error())
 	}
 
-	err = client.Login("", "", s.ApiKey)
+	if s.ApiKey != "" {
+		err = client.Login("", "", s.ApiKey)
+	} else {
+		err = client.LoginWithPassword(s.Username, s.Password, s.PromptOtp)
+	}
 	if err != nil {
 		client.Close()
 		return errors.New("Client login failed: " + err.Error())
@@ -85,19 +102,27 @@ func (s *RealSession) GetUrl() string {
 	return GetApiUrlFromHostName(s.HostName)
 }
 
-func (s *RealSession) CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+func (s *RealSession) Context() context.Context {
+	if s.Ctx == nil {
+		return context.Background()
+	}
+	return s.Ctx
+}
+
+func (s *RealSession) CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
 	var t1 time.Time
 	if s.IsDebug {
 		t1 = time.Now()
 	}
-	out, err := s.client.Call(method, timeoutSeconds, params)
+	out, err := s.client.CallWithContext(ctx, method, timeoutSeconds, params)
 	if s.IsDebug {
 		fmt.Println(method + ":", time.Now().Sub(t1).String())
 	}
+	s.AuditLog.RecordCall(s.HostName, method, params, out, err, -1)
 	return out, err
 }
 
-func (s *RealSession) CallAsyncRaw(method string, params interface{}) (int64, error) {
+func (s *RealSession) CallAsyncRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (int64, error) {
 	if !s.subscribedToJobs {
 		// For every async call that we call "core.job_wait" on, we'll be notified whenever the original call is updated or completes.
 		// In order to get those notifications, we have to subscribe to "core.get_jobs".
@@ -109,10 +134,14 @@ func (s *RealSession) CallAsyncRaw(method string, params interface{}) (int64, er
 
 	mainJob, err := s.client.CallWithJob(method, params, nil)
 	if err != nil {
+		s.AuditLog.RecordCall(s.HostName, method, params, nil, err, -1)
 		FlushString("Main call error: " + err.Error() + "\n")
 		return mainJob.ID, err
 	}
 
+	// Recorded before core.job_wait, so that the job can't be seen finishing first
+	s.AuditLog.RecordCall(s.HostName, method, params, nil, nil, mainJob.ID)
+
 	// This is to ensure we get notified when mainJob completes.
 	_, err = s.client.CallWithJob("core.job_wait", []interface{}{mainJob.ID}, nil)
 	if err != nil {
@@ -127,7 +156,7 @@ func (s *RealSession) CallAsyncRaw(method string, params interface{}) (int64, er
 	return mainJob.ID, nil
 }
 
-func (s *RealSession) WaitForJob(jobId int64) (json.RawMessage, error) {
+func (s *RealSession) WaitForJob(ctx context.Context, jobId int64) (json.RawMessage, error) {
 	//fmt.Println([]interface{}{"Waiting for job", jobId}...)
 	idx := -1
 	for i, job := range s.jobsList {
@@ -145,7 +174,14 @@ func (s *RealSession) WaitForJob(jobId int64) (json.RawMessage, error) {
 
 	irrelevantList := make([]ApiJobResult, 0)
 	for true {
-		jr := s.resultsQueue.Take()
+		jr, errCtx := s.resultsQueue.TakeContext(ctx)
+		if errCtx != nil {
+			err = errCtx
+			if s.AbortJobsOnCancel {
+				_, _ = s.client.Call("core.job_abort", 10, []interface{}{jobId})
+			}
+			break
+		}
 		if jr.JobID == jobId {
 			res = jr.Result
 			err = jr.GetError()
@@ -172,6 +208,9 @@ func (s *RealSession) WaitForJob(jobId int64) (json.RawMessage, error) {
 }
 
 func (s *RealSession) SkipWaitingJobOnClose(jobId int64) {
+	if s.mapSkipWaitOnClose == nil {
+		s.mapSkipWaitOnClose = make(map[int64]bool)
+	}
 	s.mapSkipWaitOnClose[jobId] = true
 }
 
@@ -194,7 +233,11 @@ func (s *RealSession) Close(internalError error) error {
 	}
 
 	for len(s.jobsList) > 0 {
-		jr := s.resultsQueue.Take()
+		jr, err := s.resultsQueue.TakeContext(s.Context())
+		if err != nil {
+			errorList = append(errorList, fmt.Errorf("Stopped waiting for %d job(s): %v", len(s.jobsList), err))
+			break
+		}
 		//jr.Print()
 		for i := 0; i < len(s.jobsList); i++ {
 			if s.jobsList[i] == jr.JobID {
@@ -223,7 +266,7 @@ func (s *RealSession) HandleJobUpdate(waitingJobId int64, innerJobId int64, para
 	st, _ := params["state"].(string)
 	state := strings.ToUpper(st)
 
-	if state == "SUCCESS" || state == "FAILED" {
+	if state == "SUCCESS" || state == "FAILED" || state == "ABORTED" {
 		method, _ := params["params"].(string)
 		res, _ := params["result"]
 		err, _ := params["error"]
@@ -236,6 +279,7 @@ func (s *RealSession) HandleJobUpdate(waitingJobId int64, innerJobId int64, para
 			Error:  err,
 		}
 		s.resultsQueue.Add(jr)
+		s.AuditLog.RecordJobFinished(s.HostName, innerJobId, state, res, err)
 	}
 }
 
@@ -0,0 +1,369 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Kinds of entries in a recorded session
+const (
+	RECORD_CALL         = "call"
+	RECORD_CALL_ASYNC   = "call_async"
+	RECORD_WAIT_FOR_JOB = "wait_for_job"
+)
+
+// RecordedSession is the fixture file written by --record, and served by ReplaySession
+type RecordedSession struct {
+	Host  string         `json:"host"`
+	Url   string         `json:"url,omitempty"`
+	Calls []RecordedCall `json:"calls"`
+}
+
+// RecordedCall is one request and its response. Secrets are redacted from both.
+type RecordedCall struct {
+	Type     string          `json:"type"`
+	Method   string          `json:"method,omitempty"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	JobId    int64           `json:"job_id,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// RecordingSession passes every call on to another session, and writes the calls and their responses
+// to a file when it's closed
+type RecordingSession struct {
+	Session
+	FileName string
+	mtx      sync.Mutex
+	calls    []RecordedCall
+	jobs     pendingJobs
+}
+
+// pendingJobs are the jobs that a session waits for when it's closed, unless told to skip them
+type pendingJobs struct {
+	ids  []int64
+	skip map[int64]bool
+}
+
+func (p *pendingJobs) add(jobId int64) {
+	if jobId > 0 {
+		p.ids = append(p.ids, jobId)
+	}
+}
+
+func (p *pendingJobs) skipWaiting(jobId int64) {
+	if p.skip == nil {
+		p.skip = make(map[int64]bool)
+	}
+	p.skip[jobId] = true
+}
+
+func (p *pendingJobs) take() []int64 {
+	var ids []int64
+	for _, id := range p.ids {
+		if !p.skip[id] {
+			ids = append(ids, id)
+		}
+	}
+	p.ids = nil
+	return ids
+}
+
+// waitForJobsOnClose waits for jobs the way sessions do when they're closed, returning the errors of those that failed
+func waitForJobsOnClose(s Session, jobIds []int64) []error {
+	var errorList []error
+	for _, jobId := range jobIds {
+		if err := s.Context().Err(); err != nil {
+			errorList = append(errorList, fmt.Errorf("Stopped waiting for job %d: %v", jobId, err))
+			continue
+		}
+		data, err := s.WaitForJob(s.Context(), jobId)
+		if err != nil {
+			errorList = append(errorList, err)
+		} else if err = GetJobError(jobId, data); err != nil {
+			errorList = append(errorList, err)
+		}
+	}
+	return errorList
+}
+
+func NewRecordingSession(inner Session, fileName string) *RecordingSession {
+	return &RecordingSession{Session: inner, FileName: fileName}
+}
+
+func (s *RecordingSession) record(call RecordedCall, params interface{}, response json.RawMessage, err error) {
+	if params != nil {
+		call.Params = redactJson(params)
+	}
+	if len(response) > 0 {
+		call.Response = redactJson(response)
+	}
+	if err != nil {
+		call.Error = err.Error()
+	}
+	s.mtx.Lock()
+	s.calls = append(s.calls, call)
+	s.mtx.Unlock()
+}
+
+func (s *RecordingSession) CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	out, err := s.Session.CallRaw(ctx, method, timeoutSeconds, params)
+	s.record(RecordedCall{Type: RECORD_CALL, Method: method}, params, out, err)
+	return out, err
+}
+
+func (s *RecordingSession) CallAsyncRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (int64, error) {
+	jobId, err := s.Session.CallAsyncRaw(ctx, method, timeoutSeconds, params)
+	s.record(RecordedCall{Type: RECORD_CALL_ASYNC, Method: method, JobId: jobId}, params, nil, err)
+	if err == nil {
+		s.mtx.Lock()
+		s.jobs.add(jobId)
+		s.mtx.Unlock()
+	}
+	return jobId, err
+}
+
+func (s *RecordingSession) SkipWaitingJobOnClose(jobId int64) {
+	s.mtx.Lock()
+	s.jobs.skipWaiting(jobId)
+	s.mtx.Unlock()
+	s.Session.SkipWaitingJobOnClose(jobId)
+}
+
+func (s *RecordingSession) WaitForJob(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	out, err := s.Session.WaitForJob(ctx, jobId)
+	s.record(RecordedCall{Type: RECORD_WAIT_FOR_JOB, JobId: jobId}, nil, out, err)
+	return out, err
+}
+
+// WaitForJobWithProgress keeps reporting progress when the recorded session can
+func (s *RecordingSession) WaitForJobWithProgress(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	var out json.RawMessage
+	var err error
+	if waiter, ok := s.Session.(JobProgressWaiter); ok {
+		out, err = waiter.WaitForJobWithProgress(ctx, jobId, onProgress)
+	} else {
+		out, err = s.Session.WaitForJob(ctx, jobId)
+	}
+	s.record(RecordedCall{Type: RECORD_WAIT_FOR_JOB, JobId: jobId}, nil, out, err)
+	return out, err
+}
+
+// StreamCollection passes events through without recording them, as they can't be replayed in order with the calls
+func (s *RecordingSession) StreamCollection(ctx context.Context, collection string, onEvent func(json.RawMessage) bool) error {
+	return streamCollection(s.Session, ctx, collection, onEvent)
+}
+
+// Close waits for the jobs that the recorded session would wait for, so that the waits are recorded too,
+// then closes it and writes the recording. The file is only readable by its owner, as responses can hold
+// more than the redaction catches.
+func (s *RecordingSession) Close(internalError error) error {
+	s.mtx.Lock()
+	pending := s.jobs.take()
+	s.mtx.Unlock()
+	for _, jobId := range pending {
+		s.Session.SkipWaitingJobOnClose(jobId)
+	}
+	jobErrors := waitForJobsOnClose(s, pending)
+
+	err := s.Session.Close(internalError)
+	if len(jobErrors) > 0 {
+		if err != nil {
+			jobErrors = append([]error{err}, jobErrors...)
+		}
+		err = MakeErrorFromList(jobErrors)
+	}
+
+	s.mtx.Lock()
+	recording := RecordedSession{
+		Host:  s.Session.GetHostName(),
+		Url:   s.Session.GetUrl(),
+		Calls: s.calls,
+	}
+	if recording.Calls == nil {
+		recording.Calls = []RecordedCall{}
+	}
+	s.mtx.Unlock()
+
+	data, errMarshal := json.MarshalIndent(recording, "", "\t")
+	if errMarshal == nil {
+		errMarshal = os.WriteFile(s.FileName, append(data, '\n'), 0600)
+	}
+	if errMarshal != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write recording to %s: %v\n", s.FileName, errMarshal)
+	}
+	return err
+}
+
+// redactJson returns a value, or JSON text, as JSON with any secrets redacted.
+// Since maps are marshalled with sorted keys, equal values always give the same JSON.
+func redactJson(value interface{}) json.RawMessage {
+	data, ok := value.(json.RawMessage)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(value); err != nil {
+			return nil
+		}
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return data
+	}
+	out, _ := json.Marshal(RedactSecrets(generic))
+	return out
+}
+
+// ReplaySession serves the responses of a recorded session. Each call is matched to the first unused recording
+// of the same method with the same params, after redaction, so the calls of a command must be recorded in full,
+// though concurrent calls may arrive in any order.
+type ReplaySession struct {
+	Recording RecordedSession
+	Ctx       context.Context
+	mtx       sync.Mutex
+	used      []bool
+	jobs      pendingJobs
+}
+
+func NewReplaySession(fileName string) (*ReplaySession, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var recording RecordedSession
+	if err = json.Unmarshal(data, &recording); err != nil {
+		return nil, fmt.Errorf("Failed to parse recording %s: %v", fileName, err)
+	}
+	for i := range recording.Calls {
+		// Normalize the recorded params, which may have been edited by hand, and undo the indentation of responses
+		call := &recording.Calls[i]
+		if len(call.Params) > 0 {
+			call.Params = redactJson(call.Params)
+		}
+		var compacted bytes.Buffer
+		if len(call.Response) > 0 && json.Compact(&compacted, call.Response) == nil {
+			call.Response = compacted.Bytes()
+		}
+	}
+	return &ReplaySession{
+		Recording: recording,
+		Ctx:       context.Background(),
+		used:      make([]bool, len(recording.Calls)),
+	}, nil
+}
+
+func (s *ReplaySession) Login() error             { return nil }
+func (s *ReplaySession) IsLoggedIn() bool         { return true }
+func (s *ReplaySession) GetHostName() string      { return s.Recording.Host }
+func (s *ReplaySession) GetUrl() string           { return s.Recording.Url }
+func (s *ReplaySession) Context() context.Context { return s.Ctx }
+
+func (s *ReplaySession) SkipWaitingJobOnClose(jobId int64) {
+	s.mtx.Lock()
+	s.jobs.skipWaiting(jobId)
+	s.mtx.Unlock()
+}
+
+// Close waits for the jobs that were started, like the recorded session did
+func (s *ReplaySession) Close(internalError error) error {
+	s.mtx.Lock()
+	pending := s.jobs.take()
+	s.mtx.Unlock()
+	if len(pending) == 0 {
+		return internalError
+	}
+	var errorList []error
+	if internalError != nil {
+		errorList = append(errorList, internalError)
+	}
+	return MakeErrorFromList(append(errorList, waitForJobsOnClose(s, pending)...))
+}
+
+// take marks the first unused recording that matches as used, and returns it
+func (s *ReplaySession) take(kind, method string, params interface{}, jobId int64) (RecordedCall, error) {
+	var paramsJson string
+	if kind != RECORD_WAIT_FOR_JOB {
+		paramsJson = string(redactJson(params))
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for i, call := range s.Recording.Calls {
+		if s.used[i] || call.Type != kind || call.Method != method {
+			continue
+		}
+		if kind == RECORD_WAIT_FOR_JOB && call.JobId != jobId {
+			continue
+		}
+		if kind != RECORD_WAIT_FOR_JOB && string(call.Params) != paramsJson {
+			continue
+		}
+		s.used[i] = true
+		return call, nil
+	}
+
+	if kind == RECORD_WAIT_FOR_JOB {
+		return RecordedCall{}, fmt.Errorf("No recorded wait for job %d", jobId)
+	}
+	return RecordedCall{}, fmt.Errorf("No recorded %s of %s with params %s", kind, method, paramsJson)
+}
+
+func (call *RecordedCall) err() error {
+	if call.Error == "" {
+		return nil
+	}
+	return errors.New(call.Error)
+}
+
+func (s *ReplaySession) CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	call, err := s.take(RECORD_CALL, method, params, 0)
+	if err != nil {
+		return nil, err
+	}
+	return call.Response, call.err()
+}
+
+func (s *ReplaySession) CallAsyncRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (int64, error) {
+	call, err := s.take(RECORD_CALL_ASYNC, method, params, 0)
+	if err != nil {
+		return -1, err
+	}
+	if call.Error == "" {
+		s.mtx.Lock()
+		s.jobs.add(call.JobId)
+		s.mtx.Unlock()
+	}
+	return call.JobId, call.err()
+}
+
+func (s *ReplaySession) WaitForJob(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	call, err := s.take(RECORD_WAIT_FOR_JOB, "", nil, jobId)
+	if err != nil {
+		return nil, err
+	}
+	return call.Response, call.err()
+}
+
+// Unused describes the recorded calls that haven't been replayed, so that tests can check that a command
+// made every call it used to
+func (s *ReplaySession) Unused() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var unused []string
+	for i, call := range s.Recording.Calls {
+		if s.used[i] {
+			continue
+		}
+		if call.Type == RECORD_WAIT_FOR_JOB {
+			unused = append(unused, call.Type+" "+strconv.FormatInt(call.JobId, 10))
+		} else {
+			unused = append(unused, call.Type+" "+call.Method+" "+string(call.Params))
+		}
+	}
+	return unused
+}
@@ -0,0 +1,79 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// jobSession answers every call with its method, and every job with a result
+type jobSession struct {
+	Session
+	waited []int64
+}
+
+func (s *jobSession) IsLoggedIn() bool            { return true }
+func (s *jobSession) GetHostName() string         { return "nas" }
+func (s *jobSession) GetUrl() string              { return "wss://nas/api/current" }
+func (s *jobSession) Context() context.Context    { return context.Background() }
+func (s *jobSession) SkipWaitingJobOnClose(int64) {}
+func (s *jobSession) Close(internalError error) error {
+	return internalError
+}
+
+func (s *jobSession) CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	return json.Marshal(map[string]interface{}{"result": method, "key": "1-secret"})
+}
+
+func (s *jobSession) CallAsyncRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (int64, error) {
+	return 7, nil
+}
+
+func (s *jobSession) WaitForJob(ctx context.Context, jobId int64) (json.RawMessage, error) {
+	s.waited = append(s.waited, jobId)
+	return json.RawMessage(`{"id":7,"state":"SUCCESS","result":true}`), nil
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "recording.json")
+	inner := &jobSession{}
+	recorder := NewRecordingSession(inner, fileName)
+
+	_, err := ApiCall(recorder, "api_key.create", 10, []interface{}{map[string]interface{}{"name": "tnc", "password": "hunter2"}})
+	AssertEqual(t, err, nil)
+	_, err = ApiCallAsync(recorder, "pool.dataset.delete", 10, []interface{}{"tank/a"}, true)
+	AssertEqual(t, err, nil)
+	// The job is only waited for when the session is closed
+	AssertEqual(t, recorder.Close(nil), nil)
+	AssertEqual(t, len(inner.waited), 1)
+
+	data, err := os.ReadFile(fileName)
+	AssertEqual(t, err, nil)
+	if strings.Contains(string(data), "hunter2") || strings.Contains(string(data), "1-secret") {
+		t.Fatalf("Expected secrets to be redacted:\n%s", data)
+	}
+
+	replay, err := NewReplaySession(fileName)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, replay.GetHostName(), "nas")
+
+	// Params are matched after redaction, so a different password still matches
+	out, err := ApiCall(replay, "api_key.create", 10, []interface{}{map[string]interface{}{"password": "other", "name": "tnc"}})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, string(out), `{"key":"********","result":"api_key.create"}`)
+
+	_, err = ApiCall(replay, "api_key.create", 10, []interface{}{map[string]interface{}{"name": "tnc"}})
+	if err == nil {
+		t.Fatal("Expected a call that wasn't recorded to fail")
+	}
+
+	jobId, err := ApiCallAsync(replay, "pool.dataset.delete", 10, []interface{}{"tank/a"}, true)
+	AssertEqual(t, err, nil)
+	AssertEqual(t, jobId, int64(7))
+	AssertEqual(t, len(replay.Unused()), 1)
+	AssertEqual(t, replay.Close(nil), nil)
+	AssertEqual(t, len(replay.Unused()), 0)
+}
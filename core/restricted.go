@@ -0,0 +1,313 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// RestrictedSession wraps the session of a config entry that may only change datasets under some roots, or nothing
+// at all. The rules are checked here, before calls are sent, so that they hold for every command.
+type RestrictedSession struct {
+	Session
+	ConfigName   string
+	ReadOnly     bool
+	AllowedRoots []string // a root covers itself and every dataset, snapshot, share and zvol below it
+}
+
+// What the parameters of mutating calls refer to, by namespace
+type restrictedNamespace struct {
+	keys       []string          // keys of object params naming a dataset, snapshot, share path or zvol
+	positional bool              // whether top-level string params name datasets or snapshots
+	keyById    string            // for objects passed by id, the key holding what they refer to, looked up with <namespace>.query
+	idKeys     map[string]string // keys holding the id of an object in another namespace, which is checked in turn
+	members    string            // for objects passed by id, the namespace of the objects belonging to them, which are checked in turn
+}
+
+// Mutating calls outside of these namespaces are refused when there are allowed roots, as are calls whose params
+// don't refer to anything, as there's no telling which datasets they might change
+var g_restrictedNamespaces = map[string]restrictedNamespace{
+	"pool.dataset":       {keys: []string{"name", "new_name"}, positional: true},
+	"zfs.dataset":        {keys: []string{"new_name"}, positional: true},
+	"zfs.snapshot":       {keys: []string{"dataset", "snapshot", "dataset_dst"}, positional: true},
+	"sharing.nfs":        {keys: []string{"path", "paths"}, keyById: "path"},
+	"iscsi.extent":       {keys: []string{"disk", "path"}, keyById: "disk"},
+	"iscsi.targetextent": {keyById: "extent", idKeys: map[string]string{"extent": "iscsi.extent"}},
+	"iscsi.target":       {members: "iscsi.targetextent"},
+	"replication":        {keys: []string{"source_datasets", "target_dataset"}},
+}
+
+// Mutating calls that are allowed whatever the allowed roots, as they only create objects that don't refer to any dataset
+var g_unrestrictedMethods = map[string]bool{
+	"iscsi.target.create":    true,
+	"iscsi.portal.create":    true,
+	"iscsi.initiator.create": true,
+}
+
+func NewRestrictedSession(inner Session, configName string, readOnly bool, allowedRoots []string) *RestrictedSession {
+	roots := make([]string, 0, len(allowedRoots))
+	for _, root := range allowedRoots {
+		// "tank/incus/*" and "tank/incus" mean the same thing
+		root = strings.Trim(strings.TrimSuffix(strings.TrimSpace(root), "*"), "/")
+		if root != "" {
+			roots = append(roots, root)
+		}
+	}
+	return &RestrictedSession{
+		Session:      inner,
+		ConfigName:   configName,
+		ReadOnly:     readOnly,
+		AllowedRoots: roots,
+	}
+}
+
+func (s *RestrictedSession) CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	if err := s.CheckCall(method, params); err != nil {
+		return nil, err
+	}
+	return s.Session.CallRaw(ctx, method, timeoutSeconds, params)
+}
+
+func (s *RestrictedSession) CallAsyncRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (int64, error) {
+	if err := s.CheckCall(method, params); err != nil {
+		return -1, err
+	}
+	return s.Session.CallAsyncRaw(ctx, method, timeoutSeconds, params)
+}
+
+// WaitForJobWithProgress keeps reporting progress when the restricted session can. Waiting is always allowed.
+func (s *RestrictedSession) WaitForJobWithProgress(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	if waiter, ok := s.Session.(JobProgressWaiter); ok {
+		return waiter.WaitForJobWithProgress(ctx, jobId, onProgress)
+	}
+	return s.Session.WaitForJob(ctx, jobId)
+}
+
+// StreamCollection only reads, so it's always allowed
+func (s *RestrictedSession) StreamCollection(ctx context.Context, collection string, onEvent func(json.RawMessage) bool) error {
+	return streamCollection(s.Session, ctx, collection, onEvent)
+}
+
+// CheckCall returns an error naming the rule that a call would break, if any
+func (s *RestrictedSession) CheckCall(method string, params interface{}) error {
+	if !isMutatingMethod(method) {
+		return nil
+	}
+
+	paramsList, err := toParamsList(params)
+	if err != nil {
+		return err
+	}
+
+	// Each call in a bulk call is checked separately
+	if method == "core.bulk" && len(paramsList) >= 2 {
+		innerMethod, _ := paramsList[0].(string)
+		innerCalls, _ := paramsList[1].([]interface{})
+		for _, innerParams := range innerCalls {
+			if err = s.CheckCall(innerMethod, innerParams); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if s.ReadOnly {
+		return fmt.Errorf("Config \"%s\" is read-only (\"read_only\"), so %s is not allowed", s.ConfigName, method)
+	}
+	if len(s.AllowedRoots) == 0 || g_unrestrictedMethods[method] {
+		return nil
+	}
+
+	var namespaceName string
+	if lastDot := strings.LastIndex(method, "."); lastDot > 0 {
+		namespaceName = method[:lastDot]
+	}
+	namespace, known := g_restrictedNamespaces[namespaceName]
+	if !known {
+		return fmt.Errorf("Config \"%s\" only allows changes under %s (\"allowed_roots\"), and %s might change anything",
+			s.ConfigName, strings.Join(s.AllowedRoots, ", "), method)
+	}
+
+	refs, err := s.collectReferences(namespaceName, namespace, paramsList)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 {
+		return fmt.Errorf("Config \"%s\" only allows changes under %s (\"allowed_roots\"), and %s doesn't say what it would change",
+			s.ConfigName, strings.Join(s.AllowedRoots, ", "), method)
+	}
+	for _, ref := range refs {
+		if !s.isAllowed(ref) {
+			return fmt.Errorf("Config \"%s\" only allows changes under %s (\"allowed_roots\"), but %s would change \"%s\"",
+				s.ConfigName, strings.Join(s.AllowedRoots, ", "), method, ref)
+		}
+	}
+	return nil
+}
+
+// collectReferences finds every dataset, snapshot, share path and zvol in the params of a call
+func (s *RestrictedSession) collectReferences(namespaceName string, namespace restrictedNamespace, paramsList []interface{}) ([]string, error) {
+	isById := namespace.keyById != "" || namespace.members != ""
+	refs := make([]string, 0)
+	for i, param := range paramsList {
+		var id interface{}
+		switch value := param.(type) {
+		case string:
+			if namespace.positional {
+				refs = append(refs, value)
+			} else if _, errNotNumber := strconv.Atoi(value); errNotNumber == nil && i == 0 && isById {
+				id = value
+			}
+		case float64:
+			if i == 0 && isById {
+				id = value
+			}
+		case map[string]interface{}:
+			for _, key := range namespace.keys {
+				switch inner := value[key].(type) {
+				case string:
+					refs = append(refs, inner)
+				case []interface{}:
+					for _, elem := range inner {
+						refs = append(refs, fmt.Sprint(elem))
+					}
+				}
+			}
+			for key, refNamespace := range namespace.idKeys {
+				if value[key] == nil {
+					continue
+				}
+				objRefs, err := s.lookupReferences(refNamespace, value[key])
+				if err != nil {
+					return nil, err
+				}
+				refs = append(refs, objRefs...)
+			}
+		}
+		if id != nil {
+			objRefs, err := s.lookupReferences(namespaceName, id)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, objRefs...)
+		}
+	}
+	return refs, nil
+}
+
+// lookupReferences finds what an object passed by id refers to, eg. the path of an NFS share
+func (s *RestrictedSession) lookupReferences(namespaceName string, id interface{}) ([]string, error) {
+	idNumber, _ := strconv.ParseFloat(fmt.Sprint(id), 64)
+	objects, err := s.queryObjects(namespaceName, []interface{}{"id", "=", int64(idNumber)})
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("Config \"%s\" only allows changes under %s (\"allowed_roots\"), but %s %v could not be found to check it",
+			s.ConfigName, strings.Join(s.AllowedRoots, ", "), namespaceName, id)
+	}
+	return s.referencesOf(namespaceName, objects[0])
+}
+
+// referencesOf finds what an object refers to, following the ids it holds and the objects that belong to it
+func (s *RestrictedSession) referencesOf(namespaceName string, obj map[string]interface{}) ([]string, error) {
+	namespace := g_restrictedNamespaces[namespaceName]
+	refs := make([]string, 0)
+	if namespace.keyById != "" {
+		if refNamespace, isId := namespace.idKeys[namespace.keyById]; isId {
+			objRefs, err := s.lookupReferences(refNamespace, obj[namespace.keyById])
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, objRefs...)
+		} else if ref, ok := obj[namespace.keyById].(string); ok {
+			refs = append(refs, ref)
+		}
+	}
+	if namespace.members != "" {
+		// Members name what they belong to by the last part of its namespace, eg. "target" for iscsi.target
+		ownerKey := namespaceName[strings.LastIndex(namespaceName, ".")+1:]
+		members, err := s.queryObjects(namespace.members, []interface{}{ownerKey, "=", obj["id"]})
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			memberRefs, err := s.referencesOf(namespace.members, member)
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, memberRefs...)
+		}
+	}
+	return refs, nil
+}
+
+// queryObjects returns the objects of a namespace matching a filter
+func (s *RestrictedSession) queryObjects(namespaceName string, filter []interface{}) ([]map[string]interface{}, error) {
+	queryParams := []interface{}{
+		[]interface{}{filter},
+		map[string]interface{}{},
+	}
+	out, err := ApiCall(s.Session, namespaceName+".query", 10, queryParams)
+	if err != nil {
+		return nil, err
+	}
+	var response struct {
+		Result []map[string]interface{} `json:"result"`
+	}
+	if err = json.Unmarshal(out, &response); err != nil {
+		return nil, err
+	}
+	return response.Result, nil
+}
+
+// isAllowed checks a reference against the allowed roots, parsing it the same way as command arguments
+func (s *RestrictedSession) isAllowed(ref string) bool {
+	dataset := strings.TrimPrefix(ref, "zvol/")
+	objType, value := IdentifyObject(dataset)
+	switch objType {
+	case "share":
+		// Cleaned, so that eg. "/mnt/tank/incus/../other" can't get past the check
+		value = path.Clean(value)
+		if !strings.HasPrefix(value, "/mnt/") {
+			return false
+		}
+		dataset = strings.TrimPrefix(value, "/mnt/")
+	case "snapshot":
+		dataset = value[:strings.Index(value, "@")]
+	case "dataset", "pool":
+		dataset = value
+	default:
+		return false
+	}
+	dataset = strings.TrimSuffix(dataset, "/")
+
+	for _, root := range s.AllowedRoots {
+		if dataset == root || strings.HasPrefix(dataset, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// toParamsList gets the params of a call into the same shape they'd have once decoded by the middleware
+func toParamsList(params interface{}) ([]interface{}, error) {
+	if params == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		return nil, err
+	}
+	if list, ok := decoded.([]interface{}); ok {
+		return list, nil
+	}
+	return []interface{}{decoded}, nil
+}
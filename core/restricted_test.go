@@ -0,0 +1,172 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// queryOnlySession answers <namespace>.query calls with the objects of that namespace that match the filter, or with
+// a single object for any other namespace, and records anything else that gets through
+type queryOnlySession struct {
+	Session
+	object  map[string]interface{}
+	objects map[string][]map[string]interface{}
+	passed  []string
+}
+
+func (s *queryOnlySession) IsLoggedIn() bool         { return true }
+func (s *queryOnlySession) Context() context.Context { return context.Background() }
+
+func (s *queryOnlySession) CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	if strings.HasSuffix(method, ".query") {
+		objects, exists := s.objects[strings.TrimSuffix(method, ".query")]
+		if !exists {
+			return json.Marshal(map[string]interface{}{"result": []interface{}{s.object}})
+		}
+		// Only a single [key, "=", value] filter is supported
+		data, _ := json.Marshal(params)
+		var decoded [][][]interface{}
+		_ = json.Unmarshal(data, &decoded)
+		filter := decoded[0][0]
+		matches := make([]interface{}, 0)
+		for _, obj := range objects {
+			if fmt.Sprint(obj[filter[0].(string)]) == fmt.Sprint(filter[2]) {
+				matches = append(matches, obj)
+			}
+		}
+		return json.Marshal(map[string]interface{}{"result": matches})
+	}
+	s.passed = append(s.passed, method)
+	return json.RawMessage(`{"result":null}`), nil
+}
+
+func TestRestrictedSessionAllowedRoots(t *testing.T) {
+	inner := &queryOnlySession{
+		object: map[string]interface{}{"id": 3, "path": "/mnt/tank/other/share"},
+		objects: map[string][]map[string]interface{}{
+			"iscsi.target": {{"id": 1}, {"id": 4}},
+			"iscsi.extent": {
+				{"id": 2, "disk": "zvol/tank/incus/vm1"},
+				{"id": 7, "disk": "zvol/tank/other/vm2"},
+			},
+			"iscsi.targetextent": {
+				{"id": 5, "target": 1, "extent": 2},
+				{"id": 6, "target": 4, "extent": 7},
+			},
+		},
+	}
+	s := NewRestrictedSession(inner, "team", false, []string{"tank/incus/*", "tank/backup"})
+
+	allowed := []struct {
+		method string
+		params interface{}
+	}{
+		{"pool.dataset.query", []interface{}{}},
+		{"pool.dataset.create", []interface{}{map[string]interface{}{"name": "tank/incus/vm1", "type": "VOLUME"}}},
+		{"pool.dataset.delete", []interface{}{"tank/backup"}},
+		{"zfs.snapshot.create", []interface{}{map[string]interface{}{"dataset": "tank/incus/vm1", "name": "snap1"}}},
+		{"zfs.snapshot.delete", []interface{}{"tank/incus/vm1@snap1"}},
+		{"sharing.nfs.create", []interface{}{map[string]interface{}{"path": "/mnt/tank/incus/share"}}},
+		{"iscsi.extent.create", []interface{}{map[string]interface{}{"disk": "zvol/tank/incus/vm1"}}},
+		{"iscsi.target.create", []interface{}{map[string]interface{}{"name": "incus-vm1"}}},
+		{"iscsi.targetextent.create", []interface{}{map[string]interface{}{"target": 1, "extent": 2}}},
+		{"iscsi.target.delete", []interface{}{1, true, true}},
+		{"pool.dataset.rename", []interface{}{"tank/incus/a", map[string]interface{}{"new_name": "tank/backup/a"}}},
+		{"core.bulk", []interface{}{"pool.dataset.delete", []interface{}{[]interface{}{"tank/incus/a"}, []interface{}{"tank/incus/b"}}}},
+	}
+	for _, call := range allowed {
+		if err := s.CheckCall(call.method, call.params); err != nil {
+			t.Fatalf("Expected %s to be allowed: %v", call.method, err)
+		}
+	}
+
+	denied := []struct {
+		method string
+		params interface{}
+	}{
+		{"pool.dataset.create", []interface{}{map[string]interface{}{"name": "tank/incusx"}}},
+		{"pool.dataset.delete", []interface{}{"tank"}},
+		{"zfs.snapshot.delete", []interface{}{"tank/other@snap1"}},
+		{"sharing.nfs.create", []interface{}{map[string]interface{}{"path": "/mnt/tank/incus/../other"}}},
+		{"sharing.nfs.delete", []interface{}{3}},
+		{"iscsi.extent.create", []interface{}{map[string]interface{}{"disk": "zvol/tank/other/vm1"}}},
+		{"core.bulk", []interface{}{"pool.dataset.delete", []interface{}{[]interface{}{"tank/incus/a"}, []interface{}{"tank/other"}}}},
+		{"pool.export", []interface{}{1}},
+		{"pool.dataset.rename", []interface{}{"tank/incus/a", map[string]interface{}{"new_name": "tank/other/a"}}},
+		{"pool.dataset.delete", []interface{}{}},
+		{"iscsi.targetextent.delete", []interface{}{6}},
+		{"iscsi.targetextent.create", []interface{}{map[string]interface{}{"target": 1, "extent": 7}}},
+		{"iscsi.target.delete", []interface{}{4, true, true}},
+		{"iscsi.portal.delete", []interface{}{1}},
+		{"service.stop", []interface{}{"nfs"}},
+		{"core.job_abort", []interface{}{12}},
+	}
+	for _, call := range denied {
+		err := s.CheckCall(call.method, call.params)
+		if err == nil {
+			t.Fatalf("Expected %s %v to be refused", call.method, call.params)
+		}
+		if !strings.Contains(err.Error(), "\"allowed_roots\"") {
+			t.Fatalf("Expected the error to name the rule, got: %v", err)
+		}
+	}
+
+	// Refused calls never reach the inner session
+	_, err := s.CallRaw(context.Background(), "pool.dataset.delete", 10, []interface{}{"tank"})
+	AssertEqual(t, err != nil, true)
+	_, err = s.CallRaw(context.Background(), "pool.dataset.delete", 10, []interface{}{"tank/incus/vm1"})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(inner.passed), 1)
+}
+
+func TestRestrictedSessionReadOnly(t *testing.T) {
+	s := NewRestrictedSession(&queryOnlySession{}, "prod", true, nil)
+
+	AssertEqual(t, s.CheckCall("pool.dataset.query", []interface{}{}), nil)
+	AssertEqual(t, s.CheckCall("sharing.nfs.query", []interface{}{}), nil)
+
+	err := s.CheckCall("pool.dataset.create", []interface{}{map[string]interface{}{"name": "tank/incus/vm1"}})
+	if err == nil || !strings.Contains(err.Error(), "\"read_only\"") {
+		t.Fatalf("Expected a read-only error, got: %v", err)
+	}
+	_, err = s.CallAsyncRaw(context.Background(), "service.restart", 10, []interface{}{"nfs"})
+	if err == nil {
+		t.Fatal("Expected jobs to be refused as well")
+	}
+
+	// Logging in is allowed, but not other auth methods that change the host
+	AssertEqual(t, s.CheckCall("auth.login_ex", []interface{}{map[string]interface{}{"mechanism": "TOKEN_PLAIN"}}), nil)
+	AssertEqual(t, s.CheckCall("service.started", []interface{}{"iscsitarget"}), nil)
+	if err = s.CheckCall("auth.generate_token", []interface{}{600}); err == nil {
+		t.Fatal("Expected auth.generate_token to be refused")
+	}
+}
+
+// progressSession reports one progress update for any job that it waits on
+type progressSession struct {
+	queryOnlySession
+}
+
+func (s *progressSession) WaitForJobWithProgress(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	onProgress(JobProgress{JobId: jobId, Percent: 50, Description: "Halfway"})
+	return json.RawMessage(`{"id":1,"state":"SUCCESS","result":true}`), nil
+}
+
+func (s *progressSession) SkipWaitingJobOnClose(jobId int64) {}
+
+func TestRestrictedSessionReportsProgress(t *testing.T) {
+	s := NewRestrictedSession(&progressSession{}, "team", false, []string{"tank/incus"})
+	AssertEqual(t, ReportsJobProgress(s), true)
+	AssertEqual(t, ReportsJobProgress(NewRestrictedSession(&queryOnlySession{}, "prod", true, nil)), false)
+
+	updates := make([]JobProgress, 0)
+	_, err := WaitForJobWithProgress(s, 1, func(progress JobProgress) {
+		updates = append(updates, progress)
+	})
+	AssertEqual(t, err, nil)
+	AssertEqual(t, len(updates), 1)
+	AssertEqual(t, updates[0].Description, "Halfway")
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	//"fmt"
@@ -11,9 +12,11 @@ type Session interface {
 	IsLoggedIn() bool
 	GetHostName() string
 	GetUrl() string
-	CallRaw(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error)
-	CallAsyncRaw(method string, params interface{}) (int64, error)
-	WaitForJob(jobId int64) (json.RawMessage, error)
+	// Context is cancelled when the command is interrupted. ApiCall and ApiCallAsync pass it to the calls below.
+	Context() context.Context
+	CallRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error)
+	CallAsyncRaw(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (int64, error)
+	WaitForJob(ctx context.Context, jobId int64) (json.RawMessage, error)
 	SkipWaitingJobOnClose(jobId int64)
 	Close(error) error
 }
@@ -29,23 +32,77 @@ func ApiCall(s Session, method string, timeoutSeconds int64, params interface{})
 	if err := MaybeLogin(s); err != nil {
 		return nil, err
 	}
-	out, err := s.CallRaw(method, timeoutSeconds, params)
+	out, err := s.CallRaw(s.Context(), method, timeoutSeconds, params)
 	if err != nil {
 		return out, err
 	}
-	if errMsg := ExtractApiError(out); errMsg != "" {
-		return out, errors.New(errMsg)
+	if apiErr := ParseApiError(out); apiErr != nil {
+		apiErr.Method = method
+		return out, apiErr
 	}
 	return out, nil
 }
 
-func ApiCallAsync(s Session, method string, params interface{}, awaitThisJob bool) (int64, error) {
+func ApiCallAsync(s Session, method string, timeoutSeconds int64, params interface{}, awaitThisJob bool) (int64, error) {
 	if err := MaybeLogin(s); err != nil {
 		return -1, err
 	}
-	jobId, err := s.CallAsyncRaw(method, params)
+	jobId, err := s.CallAsyncRaw(s.Context(), method, timeoutSeconds, params)
 	if err != nil && jobId > 0 && !awaitThisJob {
 		s.SkipWaitingJobOnClose(jobId)
 	}
 	return jobId, err
 }
+
+type JobProgress struct {
+	JobId       int64   `json:"id"`
+	Percent     float64 `json:"percent"`
+	Description string  `json:"description"`
+}
+
+// JobProgressWaiter is implemented by sessions that can report a job's progress while it's being waited on
+type JobProgressWaiter interface {
+	WaitForJobWithProgress(ctx context.Context, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error)
+}
+
+// ReportsJobProgress is true if a session, or the one that it wraps, reports progress while waiting on jobs
+func ReportsJobProgress(s Session) bool {
+	switch wrapper := s.(type) {
+	case *RecordingSession:
+		return ReportsJobProgress(wrapper.Session)
+	case *RestrictedSession:
+		return ReportsJobProgress(wrapper.Session)
+	}
+	_, ok := s.(JobProgressWaiter)
+	return ok
+}
+
+// WaitForJobWithProgress calls onProgress as the job progresses, if the session supports it, otherwise it just waits for the job.
+// Like WaitForJob, it returns the job's error if it failed.
+func WaitForJobWithProgress(s Session, jobId int64, onProgress func(JobProgress)) (json.RawMessage, error) {
+	if waiter, ok := s.(JobProgressWaiter); ok && onProgress != nil {
+		out, err := waiter.WaitForJobWithProgress(s.Context(), jobId, onProgress)
+		return checkJobResult(s, jobId, out, err)
+	}
+	return WaitForJob(s, jobId)
+}
+
+// CollectionStreamer is implemented by sessions that can pass on the middleware's collection_update events
+type CollectionStreamer interface {
+	StreamCollection(ctx context.Context, collection string, onEvent func(json.RawMessage) bool) error
+}
+
+// StreamCollection calls onEvent with each collection_update event for a collection, until it returns false
+// or the session's context is cancelled
+func StreamCollection(s Session, collection string, onEvent func(json.RawMessage) bool) error {
+	return streamCollection(s, s.Context(), collection, onEvent)
+}
+
+// streamCollection lets sessions that wrap another pass streams through
+func streamCollection(s Session, ctx context.Context, collection string, onEvent func(json.RawMessage) bool) error {
+	streamer, ok := s.(CollectionStreamer)
+	if !ok {
+		return errors.New("Subscribing to collections needs the daemon")
+	}
+	return streamer.StreamCollection(ctx, collection, onEvent)
+}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"context"
 	"sync"
 )
 
@@ -66,6 +67,31 @@ func (q *SimpleQueue[T]) Take() T {
 	return item.value
 }
 
+// TakeContext is like Take, except that it gives up once ctx is done
+func (q *SimpleQueue[T]) TakeContext(ctx context.Context) (T, error) {
+	stop := context.AfterFunc(ctx, func() {
+		q.mtx.Lock()
+		q.cv.Broadcast()
+		q.mtx.Unlock()
+	})
+	defer stop()
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for q.head == nil {
+		if err := ctx.Err(); err != nil {
+			var defaultValue T
+			return defaultValue, err
+		}
+		q.cv.Wait()
+	}
+
+	item := q.head
+	q.head = q.head.next
+	return item.value, nil
+}
+
 func (q *SimpleQueue[T]) Poll() (T, bool) {
 	q.mtx.Lock()
 	defer q.mtx.Unlock()
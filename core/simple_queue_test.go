@@ -2,9 +2,11 @@ package core
 
 import (
 	//"fmt"
+	"context"
 	"runtime/debug"
 	"sync"
 	"testing"
+	"time"
 )
 
 func AssertEqual[T comparable](test *testing.T, a T, b T) {
@@ -130,3 +132,20 @@ func TestSimpleQueueAddTake(t *testing.T) {
 	AssertPanics(t, func(){sq.Take()})
 	AssertEqual(t, c.WaitCalls, 1)
 }
+
+func TestSimpleQueueTakeContext(t *testing.T) {
+	sq := MakeSimpleQueue[int]()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+		cancel()
+	}()
+	_, err := sq.TakeContext(ctx)
+	AssertEqual(t, err, context.Canceled)
+
+	sq.Add(7)
+	value, err := sq.TakeContext(context.Background())
+	AssertEqual(t, value, 7)
+	AssertEqual(t, err, nil)
+}
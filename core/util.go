@@ -126,18 +126,29 @@ func AppendIfMissing[T comparable](arr []T, value T) []T {
 	return append(arr, value)
 }
 
-func MakeErrorFromList(errorList []error) error {
-	if len(errorList) == 0 {
-		return nil
-	}
+// multiError keeps the errors it was made from, so that errors.As and FindApiErrors can still find them
+type multiError struct {
+	errs []error
+}
 
+func (e *multiError) Error() string {
 	var combinedErrMsg strings.Builder
-	for _, e := range errorList {
+	for _, err := range e.errs {
 		combinedErrMsg.WriteString("\n")
-		combinedErrMsg.WriteString(e.Error())
+		combinedErrMsg.WriteString(err.Error())
 	}
+	return combinedErrMsg.String()
+}
 
-	return errors.New(combinedErrMsg.String())
+func (e *multiError) Unwrap() []error {
+	return e.errs
+}
+
+func MakeErrorFromList(errorList []error) error {
+	if len(errorList) == 0 {
+		return nil
+	}
+	return &multiError{errs: errorList}
 }
 
 func GetKeysSorted[T any](dict map[string]T) []string {
@@ -300,22 +311,21 @@ func RunCommandRaw(prog string, args ...string) (string, string, error) {
 	return outBuf.String(), errBuf.String(), err
 }
 
+// RunCommand returns the output of a command, or its stderr as an error. If it failed, the error wraps the *exec.ExitError,
+// so that its exit code can be checked.
 func RunCommand(prog string, args ...string) (string, error) {
 	out, warn, err := RunCommandRaw(prog, args...)
 	var errMsg strings.Builder
-	isError := false
 	if warn != "" {
 		errMsg.WriteString(warn)
 		if warn[len(warn)-1] != '\n' {
 			errMsg.WriteString("\n")
 		}
-		isError = true
 	}
 	if err != nil {
-		errMsg.WriteString(err.Error())
-		isError = true
+		return "", fmt.Errorf("%s%w", errMsg.String(), err)
 	}
-	if isError {
+	if warn != "" {
 		return "", errors.New(errMsg.String())
 	}
 	return out, nil
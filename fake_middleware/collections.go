@@ -0,0 +1,286 @@
+package fake_middleware
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// collection is a set of objects with numeric ids, like NFS shares or iSCSI targets,
+// that can be queried, created, updated and deleted
+type collection struct {
+	name     string
+	items    map[int64]map[string]interface{}
+	lastId   int64
+	defaults map[string]interface{}
+	// validate checks an object about to be created or updated, and may fill in derived fields
+	validate func(s *Server, item map[string]interface{}) error
+	// onDelete is called before an object is deleted, with the params after its id
+	onDelete func(s *Server, item map[string]interface{}, params []interface{}) error
+}
+
+func makeCollections() map[string]*collection {
+	collections := []*collection{
+		{
+			name: "sharing.nfs",
+			defaults: map[string]interface{}{
+				"aliases": []interface{}{}, "comment": "", "networks": []interface{}{}, "hosts": []interface{}{},
+				"ro": false, "maproot_user": nil, "maproot_group": nil, "mapall_user": nil, "mapall_group": nil,
+				"security": []interface{}{}, "enabled": true, "locked": false, "expose_snapshots": false,
+			},
+			validate: validateNfsShare,
+		},
+		{
+			name: "iscsi.target",
+			defaults: map[string]interface{}{
+				"alias": nil, "mode": "ISCSI", "groups": []interface{}{}, "auth_networks": []interface{}{},
+			},
+			validate: func(s *Server, item map[string]interface{}) error {
+				return s.checkUnique("iscsi.target", item, "name", "alias")
+			},
+			onDelete: func(s *Server, item map[string]interface{}, params []interface{}) error {
+				deleteExtents := len(params) > 2 && params[2] == true // params are id, force, delete_extents
+				for id, te := range s.collections["iscsi.targetextent"].items {
+					if te["target"] == item["id"] {
+						s.deleteItem(s.collections["iscsi.targetextent"], id)
+						if extentId, ok := te["extent"].(float64); ok && deleteExtents {
+							s.deleteItem(s.collections["iscsi.extent"], int64(extentId))
+						}
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "iscsi.extent",
+			defaults: map[string]interface{}{
+				"type": "DISK", "ro": false, "enabled": true, "comment": "", "blocksize": 512, "rpm": "SSD",
+				"insecure_tpc": true, "xen": false, "avail_threshold": nil,
+			},
+			validate: validateExtent,
+			onDelete: func(s *Server, item map[string]interface{}, params []interface{}) error {
+				for id, te := range s.collections["iscsi.targetextent"].items {
+					if te["extent"] == item["id"] {
+						s.deleteItem(s.collections["iscsi.targetextent"], id)
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name:     "iscsi.targetextent",
+			defaults: map[string]interface{}{"lunid": 0},
+			validate: validateTargetExtent,
+		},
+		{
+			name:     "iscsi.portal",
+			defaults: map[string]interface{}{"comment": "", "listen": []interface{}{}},
+			validate: func(s *Server, item map[string]interface{}) error {
+				s.collections["iscsi.portal"].fillTag(item)
+				return nil
+			},
+		},
+		{
+			name:     "iscsi.initiator",
+			defaults: map[string]interface{}{"comment": "", "initiators": []interface{}{}},
+			validate: func(s *Server, item map[string]interface{}) error {
+				s.collections["iscsi.initiator"].fillTag(item)
+				return nil
+			},
+		},
+	}
+
+	byName := make(map[string]*collection)
+	for _, c := range collections {
+		c.items = make(map[int64]map[string]interface{})
+		byName[c.name] = c
+	}
+	return byName
+}
+
+// fillTag numbers portals and initiator groups the way the middleware does
+func (c *collection) fillTag(item map[string]interface{}) {
+	if _, exists := item["tag"]; !exists {
+		item["tag"] = item["id"]
+	}
+}
+
+func (c *collection) sortedItems() []map[string]interface{} {
+	ids := make([]int64, 0, len(c.items))
+	for id := range c.items {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+	items := make([]map[string]interface{}, len(ids))
+	for i, id := range ids {
+		items[i] = c.items[id]
+	}
+	return items
+}
+
+// callCollection implements <collection>.query, get_instance, create, update and delete. mtx must be held.
+func (s *Server) callCollection(c *collection, op string, params []interface{}) (interface{}, error) {
+	switch op {
+	case "query":
+		return queryItems(c.sortedItems(), getList(params, 0), getMap(params, 1))
+
+	case "get_instance":
+		id, _ := getNumber(params, 0)
+		item, exists := c.items[int64(id)]
+		if !exists {
+			return nil, errNotFound("%s %v does not exist", c.name, params[0])
+		}
+		return item, nil
+
+	case "create":
+		item, _ := normalize(getMap(params, 0)).(map[string]interface{})
+		for key, value := range c.defaults {
+			if _, exists := item[key]; !exists {
+				item[key] = normalize(value)
+			}
+		}
+		item["id"] = float64(c.lastId + 1)
+		if c.validate != nil {
+			if err := c.validate(s, item); err != nil {
+				return nil, err
+			}
+		}
+		c.lastId++
+		c.items[c.lastId] = item
+		s.emit(c.name+".query", "added", item["id"], item)
+		return item, nil
+
+	case "update":
+		id, _ := getNumber(params, 0)
+		existing, exists := c.items[int64(id)]
+		if !exists {
+			return nil, errNotFound("%s %v does not exist", c.name, getOrNil(params, 0))
+		}
+		item, _ := normalize(existing).(map[string]interface{})
+		for key, value := range getMap(params, 1) {
+			if key != "id" {
+				item[key] = normalize(value)
+			}
+		}
+		if c.validate != nil {
+			if err := c.validate(s, item); err != nil {
+				return nil, err
+			}
+		}
+		c.items[int64(id)] = item
+		s.emit(c.name+".query", "changed", item["id"], item)
+		return item, nil
+
+	case "delete":
+		id, _ := getNumber(params, 0)
+		item, exists := c.items[int64(id)]
+		if !exists {
+			return nil, errNotFound("%s %v does not exist", c.name, getOrNil(params, 0))
+		}
+		if c.onDelete != nil {
+			if err := c.onDelete(s, item, params); err != nil {
+				return nil, err
+			}
+		}
+		s.deleteItem(c, int64(id))
+		return true, nil
+	}
+	return nil, &Error{Code: CODE_METHOD_NOT_FOUND, Message: "Method not found", Reason: fmt.Sprintf("Method \"%s.%s\" not found", c.name, op)}
+}
+
+func (s *Server) deleteItem(c *collection, id int64) {
+	if item, exists := c.items[id]; exists {
+		delete(c.items, id)
+		s.emit(c.name+".query", "removed", item["id"], map[string]interface{}{"id": item["id"]})
+	}
+}
+
+// checkUnique fails if another object in the collection has the same value for any of the keys
+func (s *Server) checkUnique(name string, item map[string]interface{}, keys ...string) error {
+	for _, key := range keys {
+		value := item[key]
+		if value == nil || value == "" {
+			continue
+		}
+		for _, other := range s.collections[name].items {
+			if other["id"] != item["id"] && other[key] == value {
+				return errValidation(strings.ReplaceAll(name, ".", "_")+"."+key, "%v is already in use", value)
+			}
+		}
+	}
+	return nil
+}
+
+func validateNfsShare(s *Server, item map[string]interface{}) error {
+	sharePath, _ := item["path"].(string)
+	cleaned := path.Clean(sharePath)
+	if !strings.HasPrefix(cleaned, "/mnt/") {
+		return errValidation("sharingnfs.path", "The path must reside within a pool mount point")
+	}
+	ds, exists := s.datasets[strings.TrimPrefix(cleaned, "/mnt/")]
+	if !exists || ds.typ != "FILESYSTEM" {
+		return errValidation("sharingnfs.path", "Path %s does not exist", sharePath)
+	}
+	item["path"] = cleaned
+	return s.checkUnique("sharing.nfs", item, "path")
+}
+
+func validateExtent(s *Server, item map[string]interface{}) error {
+	if err := s.checkUnique("iscsi.extent", item, "name"); err != nil {
+		return err
+	}
+	if item["type"] != "DISK" {
+		return nil
+	}
+	disk, _ := item["disk"].(string)
+	name := strings.TrimPrefix(disk, "zvol/")
+	if !strings.HasPrefix(disk, "zvol/") {
+		return errValidation("iscsi_extent.disk", "Disk must be a zvol, got \"%s\"", disk)
+	}
+	volume := name
+	if at := strings.Index(name, "@"); at > 0 {
+		volume = name[:at]
+		if _, exists := s.snapshots[name]; !exists {
+			return errValidation("iscsi_extent.disk", "Snapshot %s does not exist", name)
+		}
+	}
+	if ds, exists := s.datasets[volume]; !exists || ds.typ != "VOLUME" {
+		return errValidation("iscsi_extent.disk", "zvol %s does not exist", volume)
+	}
+	item["path"] = disk
+	if _, exists := item["serial"]; !exists {
+		item["serial"] = fmt.Sprintf("%015x", int64(item["id"].(float64)))
+	}
+	return s.checkUnique("iscsi.extent", item, "disk")
+}
+
+func validateTargetExtent(s *Server, item map[string]interface{}) error {
+	targetId, _ := item["target"].(float64)
+	if _, exists := s.collections["iscsi.target"].items[int64(targetId)]; !exists {
+		return errValidation("iscsi_targetextent.target", "Target %v does not exist", item["target"])
+	}
+	extentId, _ := item["extent"].(float64)
+	if _, exists := s.collections["iscsi.extent"].items[int64(extentId)]; !exists {
+		return errValidation("iscsi_targetextent.extent", "Extent %v does not exist", item["extent"])
+	}
+	for _, other := range s.collections["iscsi.targetextent"].items {
+		if other["id"] == item["id"] || other["target"] != item["target"] {
+			continue
+		}
+		if other["extent"] == item["extent"] {
+			return errValidation("iscsi_targetextent.extent", "Extent is already in this target")
+		}
+		if other["lunid"] == item["lunid"] {
+			return errValidation("iscsi_targetextent.lunid", "LUN ID is already being used for this target")
+		}
+	}
+	return nil
+}
+
+func getOrNil(params []interface{}, index int) interface{} {
+	if index < len(params) {
+		return params[index]
+	}
+	return nil
+}
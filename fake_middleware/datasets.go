@@ -0,0 +1,817 @@
+package fake_middleware
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type dataset struct {
+	name      string
+	typ       string            // FILESYSTEM or VOLUME
+	props     map[string]string // properties set on this dataset, as their raw zfs values
+	userProps map[string]string // user properties set on this dataset, eg. "org.incus:content_type"
+	origin    string            // the snapshot this dataset is a clone of, if any
+	createtxg int64
+}
+
+type snapshot struct {
+	dataset   string
+	name      string // the part after the @
+	createtxg int64
+	userProps map[string]string
+}
+
+func (snap *snapshot) id() string {
+	return snap.dataset + "@" + snap.name
+}
+
+// Defaults of the properties that can be set, by dataset type
+var g_defaultProperties = map[string]map[string]string{
+	"FILESYSTEM": {
+		"aclmode": "discard", "acltype": "posix", "atime": "on", "casesensitivity": "sensitive", "checksum": "on",
+		"comments": "", "compression": "lz4", "copies": "1", "deduplication": "off", "exec": "on", "managedby": "",
+		"quota": "0", "readonly": "off", "recordsize": "131072", "refquota": "0", "refreservation": "0",
+		"reservation": "0", "snapdir": "hidden", "special_small_block_size": "0", "sync": "standard",
+	},
+	"VOLUME": {
+		"checksum": "on", "comments": "", "compression": "lz4", "copies": "1", "deduplication": "off",
+		"managedby": "", "readonly": "off", "refreservation": "0", "reservation": "0", "sync": "standard",
+		"volblocksize": "16384", "volsize": "0",
+	},
+}
+
+// Properties that only apply to the dataset they're set on
+var g_localOnlyProperties = map[string]bool{
+	"quota": true, "refquota": true, "refreservation": true, "reservation": true,
+	"volsize": true, "volblocksize": true,
+}
+
+// Keys of pool.dataset.create and update params that aren't properties
+var g_nonPropertyKeys = map[string]bool{
+	"name": true, "type": true, "create_ancestors": true, "user_properties": true, "user_properties_update": true,
+	"share_type": true, "sparse": true, "force_size": true, "inherit_encryption": true, "encryption": true,
+	"encryption_options": true,
+}
+
+// Properties whose values the middleware shows in upper case
+var g_enumProperties = map[string]bool{
+	"aclmode": true, "acltype": true, "casesensitivity": true, "checksum": true, "compression": true,
+	"deduplication": true, "snapdir": true, "sync": true,
+}
+
+var g_sizeProperties = map[string]bool{
+	"quota": true, "recordsize": true, "refquota": true, "refreservation": true, "reservation": true,
+	"special_small_block_size": true, "volblocksize": true, "volsize": true, "used": true, "available": true,
+	"referenced": true, "usedbysnapshots": true,
+}
+
+// newDataset makes a dataset with nothing set on it. mtx must be held.
+func (s *Server) newDataset(name, typ string) *dataset {
+	s.txg++
+	return &dataset{
+		name:      name,
+		typ:       typ,
+		props:     make(map[string]string),
+		userProps: make(map[string]string),
+		createtxg: s.txg,
+	}
+}
+
+func parentOf(name string) string {
+	if slash := strings.LastIndex(name, "/"); slash > 0 {
+		return name[:slash]
+	}
+	return ""
+}
+
+func poolOf(name string) string {
+	return strings.SplitN(strings.SplitN(name, "@", 2)[0], "/", 2)[0]
+}
+
+func isBelow(name, ancestor string) bool {
+	return name == ancestor || strings.HasPrefix(name, ancestor+"/")
+}
+
+// getProperty returns the value of a property and where it came from, following inheritance
+func (s *Server) getProperty(ds *dataset, prop string) (string, string) {
+	if value, exists := ds.props[prop]; exists {
+		return value, "LOCAL"
+	}
+	if !g_localOnlyProperties[prop] {
+		for parent := s.datasets[parentOf(ds.name)]; parent != nil; parent = s.datasets[parentOf(parent.name)] {
+			if value, exists := parent.props[prop]; exists {
+				return value, "INHERITED"
+			}
+		}
+	}
+	return g_defaultProperties[ds.typ][prop], "DEFAULT"
+}
+
+// makeProperty formats a property the way the middleware does, eg. {"value": "128K", "rawvalue": "131072", "parsed": 131072}
+func makeProperty(prop, raw, source string) map[string]interface{} {
+	var parsed interface{} = raw
+	value := raw
+	if g_sizeProperties[prop] {
+		n, _ := strconv.ParseInt(raw, 10, 64)
+		parsed = n
+		value = humanizeSize(n)
+	} else if raw == "on" || raw == "off" {
+		parsed = raw == "on"
+		value = strings.ToUpper(raw)
+	} else if g_enumProperties[prop] {
+		value = strings.ToUpper(raw)
+	}
+	return map[string]interface{}{"value": value, "rawvalue": raw, "parsed": parsed, "source": source}
+}
+
+func humanizeSize(n int64) string {
+	if n == 0 {
+		return "0"
+	}
+	units := []string{"B", "K", "M", "G", "T", "P"}
+	unit := 0
+	value := float64(n)
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprint(n, "B")
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(fmt.Sprintf("%.2f", value), "0"), ".0") + units[unit]
+}
+
+// parseSize reads sizes given as numbers or strings like "128K"
+func parseSize(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), nil
+	case string:
+		str := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(v), "B"))
+		multiplier := int64(1)
+		for i, suffix := range []string{"K", "M", "G", "T", "P"} {
+			if strings.HasSuffix(str, suffix) {
+				multiplier = int64(1) << (10 * (i + 1))
+				str = strings.TrimSuffix(str, suffix)
+				break
+			}
+		}
+		n, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64(n * float64(multiplier)), nil
+	}
+	return 0, fmt.Errorf("not a size: %v", value)
+}
+
+// datasetObject builds a pool.dataset.query result. props lists the properties to include, or all of them if nil.
+func (s *Server) datasetObject(ds *dataset, props []string, withUserProps bool) map[string]interface{} {
+	obj := map[string]interface{}{
+		"id":        ds.name,
+		"name":      ds.name,
+		"pool":      poolOf(ds.name),
+		"type":      ds.typ,
+		"encrypted": false,
+		"children":  []interface{}{},
+	}
+	if ds.typ == "FILESYSTEM" {
+		obj["mountpoint"] = "/mnt/" + ds.name
+	}
+
+	all := make(map[string]map[string]interface{})
+	for prop := range g_defaultProperties[ds.typ] {
+		raw, source := s.getProperty(ds, prop)
+		all[prop] = makeProperty(prop, raw, source)
+	}
+	used := int64(0)
+	if ds.typ == "VOLUME" {
+		raw, _ := s.getProperty(ds, "volsize")
+		used, _ = strconv.ParseInt(raw, 10, 64)
+	}
+	all["used"] = makeProperty("used", fmt.Sprint(used), "NONE")
+	all["referenced"] = makeProperty("referenced", fmt.Sprint(used), "NONE")
+	all["available"] = makeProperty("available", fmt.Sprint(int64(1)<<40), "NONE")
+	all["origin"] = makeProperty("origin", ds.origin, "NONE")
+	all["createtxg"] = makeProperty("createtxg", fmt.Sprint(ds.createtxg), "NONE")
+
+	for prop, value := range all {
+		if props == nil || containsString(props, prop) {
+			obj[prop] = value
+		}
+	}
+
+	if withUserProps {
+		userProps := make(map[string]interface{})
+		for key, value := range ds.userProps {
+			userProps[key] = map[string]interface{}{"value": value, "rawvalue": value, "parsed": value, "source": "LOCAL"}
+		}
+		obj["user_properties"] = userProps
+	}
+	return obj
+}
+
+func (s *Server) snapshotObject(snap *snapshot, props []string) map[string]interface{} {
+	clones := make([]string, 0)
+	for _, name := range sortedKeys(s.datasets) {
+		if s.datasets[name].origin == snap.id() {
+			clones = append(clones, name)
+		}
+	}
+	all := map[string]interface{}{
+		"name":       makeProperty("name", snap.id(), "NONE"),
+		"createtxg":  makeProperty("createtxg", fmt.Sprint(snap.createtxg), "NONE"),
+		"used":       makeProperty("used", "0", "NONE"),
+		"referenced": makeProperty("referenced", "0", "NONE"),
+		"clones":     makeProperty("clones", strings.Join(clones, ","), "NONE"),
+	}
+	for key, value := range snap.userProps {
+		all[key] = map[string]interface{}{"value": value, "rawvalue": value, "parsed": value, "source": "LOCAL"}
+	}
+	properties := make(map[string]interface{})
+	for prop, value := range all {
+		if props == nil || containsString(props, prop) {
+			properties[prop] = value
+		}
+	}
+	return map[string]interface{}{
+		"id":            snap.id(),
+		"name":          snap.id(),
+		"dataset":       snap.dataset,
+		"pool":          poolOf(snap.dataset),
+		"snapshot_name": snap.name,
+		"type":          "SNAPSHOT",
+		"createtxg":     fmt.Sprint(snap.createtxg),
+		"holds":         map[string]interface{}{},
+		"properties":    properties,
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, elem := range list {
+		if elem == value {
+			return true
+		}
+	}
+	return false
+}
+
+// getQueryExtra reads the "extra" query-options of pool.dataset.query and zfs.snapshot.query
+func getQueryExtra(options map[string]interface{}) (props []string, withUserProps, flat, retrieveChildren bool) {
+	extra, _ := options["extra"].(map[string]interface{})
+	if list, ok := extra["properties"].([]interface{}); ok {
+		props = make([]string, 0, len(list))
+		for _, prop := range list {
+			props = append(props, fmt.Sprint(prop))
+		}
+	}
+	withUserProps = true
+	if value, ok := extra["user_properties"].(bool); ok {
+		withUserProps = value
+	}
+	flat = true
+	if value, ok := extra["flat"].(bool); ok {
+		flat = value
+	}
+	retrieveChildren = true
+	if value, ok := extra["retrieve_children"].(bool); ok {
+		retrieveChildren = value
+	}
+	return
+}
+
+// snapshotsOf returns the snapshots of a dataset, oldest first
+func (s *Server) snapshotsOf(name string) []*snapshot {
+	snaps := make([]*snapshot, 0)
+	for _, snap := range s.snapshots {
+		if snap.dataset == name {
+			snaps = append(snaps, snap)
+		}
+	}
+	sort.Slice(snaps, func(a, b int) bool { return snaps[a].createtxg < snaps[b].createtxg })
+	return snaps
+}
+
+// descendantsOf returns the names of a dataset and everything below it, parents first
+func (s *Server) descendantsOf(name string) []string {
+	names := make([]string, 0)
+	for _, other := range sortedKeys(s.datasets) {
+		if isBelow(other, name) {
+			names = append(names, other)
+		}
+	}
+	return names
+}
+
+// setProperties applies the properties in the params of pool.dataset.create or update
+func (s *Server) setProperties(ds *dataset, params map[string]interface{}) error {
+	for key, value := range params {
+		if g_nonPropertyKeys[key] {
+			continue
+		}
+		if _, known := g_defaultProperties[ds.typ][key]; !known {
+			return errValidation("pool_dataset."+key, "Not a property of a %s", strings.ToLower(ds.typ))
+		}
+		if value == "INHERIT" {
+			delete(ds.props, key)
+			continue
+		}
+		if g_sizeProperties[key] {
+			n, err := parseSize(value)
+			if err != nil {
+				return errValidation("pool_dataset."+key, "%v", err)
+			}
+			ds.props[key] = fmt.Sprint(n)
+		} else if str, ok := value.(string); ok && key != "comments" && key != "managedby" {
+			ds.props[key] = strings.ToLower(str)
+		} else {
+			ds.props[key] = fmt.Sprint(value)
+		}
+	}
+	if list, ok := params["user_properties"].([]interface{}); ok {
+		for _, elem := range list {
+			prop, _ := elem.(map[string]interface{})
+			ds.userProps[fmt.Sprint(prop["key"])] = fmt.Sprint(prop["value"])
+		}
+	}
+	if list, ok := params["user_properties_update"].([]interface{}); ok {
+		for _, elem := range list {
+			prop, _ := elem.(map[string]interface{})
+			if getBool(prop, "remove") {
+				delete(ds.userProps, fmt.Sprint(prop["key"]))
+			} else {
+				ds.userProps[fmt.Sprint(prop["key"])] = fmt.Sprint(prop["value"])
+			}
+		}
+	}
+	return nil
+}
+
+// deleteDatasets removes datasets along with their snapshots, and the shares and extents that use them
+func (s *Server) deleteDatasets(names []string) {
+	for i := len(names) - 1; i >= 0; i-- {
+		name := names[i]
+		for _, snap := range s.snapshotsOf(name) {
+			s.deleteSnapshot(snap)
+		}
+		for id, share := range s.collections["sharing.nfs"].items {
+			if sharePath, _ := share["path"].(string); isBelow(sharePath, "/mnt/"+name) {
+				s.deleteItem(s.collections["sharing.nfs"], id)
+			}
+		}
+		for id, extent := range s.collections["iscsi.extent"].items {
+			if disk, _ := extent["disk"].(string); disk == "zvol/"+name || strings.HasPrefix(disk, "zvol/"+name+"@") {
+				s.callCollection(s.collections["iscsi.extent"], "delete", []interface{}{float64(id)})
+			}
+		}
+		delete(s.datasets, name)
+		s.emit("pool.dataset.query", "removed", name, map[string]interface{}{"id": name})
+	}
+}
+
+func (s *Server) deleteSnapshot(snap *snapshot) {
+	delete(s.snapshots, snap.id())
+	s.emit("zfs.snapshot.query", "removed", snap.id(), map[string]interface{}{"id": snap.id()})
+}
+
+// checkNoDependentClones fails if any snapshot about to be destroyed has clones that aren't being destroyed too
+func (s *Server) checkNoDependentClones(snaps []*snapshot, destroying []string) error {
+	for _, snap := range snaps {
+		for _, name := range sortedKeys(s.datasets) {
+			if s.datasets[name].origin == snap.id() && !containsString(destroying, name) {
+				return errBusy("Cannot destroy %s: snapshot has dependent clones, eg. %s", snap.id(), name)
+			}
+		}
+	}
+	return nil
+}
+
+func registerDatasetMethods() {
+	g_methods["pool.dataset.query"] = func(s *Server, params []interface{}) (interface{}, error) {
+		options := getMap(params, 1)
+		props, withUserProps, flat, retrieveChildren := getQueryExtra(options)
+
+		names := sortedKeys(s.datasets)
+		objects := make(map[string]map[string]interface{})
+		matched := make([]map[string]interface{}, 0)
+		for _, name := range names {
+			objects[name] = s.datasetObject(s.datasets[name], props, withUserProps)
+			// Filters can refer to any property, not just the ones being returned
+			ok, err := matchFilters(s.datasetObject(s.datasets[name], nil, true), getList(params, 0))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matched = append(matched, objects[name])
+			}
+		}
+
+		if retrieveChildren {
+			// Parents come before their children in names, so each child is complete by the time it's added
+			for i := len(names) - 1; i >= 0; i-- {
+				if parent, exists := objects[parentOf(names[i])]; exists {
+					parent["children"] = append([]interface{}{objects[names[i]]}, parent["children"].([]interface{})...)
+				}
+			}
+		}
+		if !flat {
+			// Datasets that are already among the children of another result aren't repeated
+			isMatched := make(map[string]bool)
+			for _, obj := range matched {
+				isMatched[obj["name"].(string)] = true
+			}
+			topLevel := make([]map[string]interface{}, 0)
+			for _, obj := range matched {
+				hasMatchedAncestor := false
+				for parent := parentOf(obj["name"].(string)); parent != "" && retrieveChildren; parent = parentOf(parent) {
+					hasMatchedAncestor = hasMatchedAncestor || isMatched[parent]
+				}
+				if !hasMatchedAncestor {
+					topLevel = append(topLevel, obj)
+				}
+			}
+			matched = topLevel
+		}
+
+		delete(options, "extra")
+		return queryItems(matched, nil, options)
+	}
+
+	g_methods["pool.dataset.create"] = func(s *Server, params []interface{}) (interface{}, error) {
+		req := getMap(params, 0)
+		name, _ := req["name"].(string)
+		typ, _ := req["type"].(string)
+		if typ == "" {
+			typ = "FILESYSTEM"
+		}
+		if name == "" || strings.Contains(name, "@") {
+			return nil, errValidation("pool_dataset_create.name", "Invalid dataset name \"%s\"", name)
+		}
+		if typ != "FILESYSTEM" && typ != "VOLUME" {
+			return nil, errValidation("pool_dataset_create.type", "Invalid type \"%s\"", typ)
+		}
+		if typ == "VOLUME" {
+			if _, exists := req["volsize"]; !exists {
+				return nil, errValidation("pool_dataset_create.volsize", "This field is required for VOLUME")
+			}
+		}
+		if _, exists := s.datasets[name]; exists {
+			return nil, errExists("Failed to create dataset: cannot create '%s': dataset already exists", name)
+		}
+		if _, exists := s.datasets[poolOf(name)]; !exists {
+			return nil, errNotFound("pool_dataset_create.name: Pool %s does not exist", poolOf(name))
+		}
+
+		missing := make([]string, 0)
+		for parent := parentOf(name); parent != ""; parent = parentOf(parent) {
+			ds, exists := s.datasets[parent]
+			if exists {
+				if ds.typ != "FILESYSTEM" {
+					return nil, errValidation("pool_dataset_create.name", "Parent %s is not a filesystem", parent)
+				}
+				break
+			}
+			missing = append(missing, parent)
+		}
+		if len(missing) > 0 && !getBool(req, "create_ancestors") {
+			return nil, errNotFound("Failed to create dataset: cannot create '%s': parent does not exist", name)
+		}
+
+		ds := s.newDataset(name, typ)
+		if err := s.setProperties(ds, req); err != nil {
+			return nil, err
+		}
+		for i := len(missing) - 1; i >= 0; i-- {
+			s.datasets[missing[i]] = s.newDataset(missing[i], "FILESYSTEM")
+			s.emit("pool.dataset.query", "added", missing[i], s.datasetObject(s.datasets[missing[i]], nil, true))
+		}
+		s.datasets[name] = ds
+		obj := s.datasetObject(ds, nil, true)
+		s.emit("pool.dataset.query", "added", name, obj)
+		return obj, nil
+	}
+
+	g_methods["pool.dataset.update"] = func(s *Server, params []interface{}) (interface{}, error) {
+		name := getString(params, 0)
+		ds, exists := s.datasets[name]
+		if !exists {
+			return nil, errNotFound("%s not found", name)
+		}
+		// Changes are made to a copy, so that nothing changes if any of them are invalid
+		updated := *ds
+		updated.props = make(map[string]string)
+		updated.userProps = make(map[string]string)
+		for key, value := range ds.props {
+			updated.props[key] = value
+		}
+		for key, value := range ds.userProps {
+			updated.userProps[key] = value
+		}
+		if err := s.setProperties(&updated, getMap(params, 1)); err != nil {
+			return nil, err
+		}
+		*ds = updated
+		obj := s.datasetObject(ds, nil, true)
+		s.emit("pool.dataset.query", "changed", name, obj)
+		return obj, nil
+	}
+
+	g_methods["pool.dataset.delete"] = func(s *Server, params []interface{}) (interface{}, error) {
+		name := getString(params, 0)
+		if _, exists := s.datasets[name]; !exists {
+			return nil, errNotFound("%s does not exist", name)
+		}
+		if parentOf(name) == "" {
+			return nil, errInvalid("The root dataset of a pool cannot be deleted")
+		}
+		names := s.descendantsOf(name)
+		if len(names) > 1 && !getBool(getMap(params, 1), "recursive") {
+			return nil, errBusy("Failed to delete dataset: cannot destroy '%s': filesystem has children", name)
+		}
+		snaps := make([]*snapshot, 0)
+		for _, n := range names {
+			snaps = append(snaps, s.snapshotsOf(n)...)
+		}
+		if err := s.checkNoDependentClones(snaps, names); err != nil {
+			return nil, err
+		}
+		s.deleteDatasets(names)
+		return true, nil
+	}
+
+	g_methods["pool.dataset.promote"] = func(s *Server, params []interface{}) (interface{}, error) {
+		name := getString(params, 0)
+		ds, exists := s.datasets[name]
+		if !exists {
+			return nil, errNotFound("%s does not exist", name)
+		}
+		origin, isClone := s.snapshots[ds.origin]
+		if !isClone {
+			return nil, errInvalid("Only cloned datasets can be promoted")
+		}
+
+		// The origin snapshot and those before it move to the clone, which takes over as the parent
+		source := s.datasets[origin.dataset]
+		for _, snap := range s.snapshotsOf(source.name) {
+			if snap.createtxg > origin.createtxg {
+				continue
+			}
+			oldId := snap.id()
+			delete(s.snapshots, oldId)
+			snap.dataset = name
+			s.snapshots[snap.id()] = snap
+			for _, other := range s.datasets {
+				if other.origin == oldId {
+					other.origin = snap.id()
+				}
+			}
+		}
+		ds.origin, source.origin = source.origin, origin.id()
+		return nil, nil
+	}
+
+	g_methods["zfs.dataset.rename"] = func(s *Server, params []interface{}) (interface{}, error) {
+		name := getString(params, 0)
+		newName, _ := getMap(params, 1)["new_name"].(string)
+		if _, exists := s.datasets[name]; !exists {
+			return nil, errNotFound("%s does not exist", name)
+		}
+		if _, exists := s.datasets[newName]; exists {
+			return nil, errExists("Failed to rename dataset: %s already exists", newName)
+		}
+		if poolOf(newName) != poolOf(name) || parentOf(newName) == "" || isBelow(newName, name) {
+			return nil, errInvalid("Cannot rename %s to %s", name, newName)
+		}
+		if _, exists := s.datasets[parentOf(newName)]; !exists {
+			return nil, errNotFound("Failed to rename dataset: parent of %s does not exist", newName)
+		}
+
+		renames := make(map[string]string)
+		for _, old := range s.descendantsOf(name) {
+			renamed := newName + strings.TrimPrefix(old, name)
+			ds := s.datasets[old]
+			delete(s.datasets, old)
+			ds.name = renamed
+			s.datasets[renamed] = ds
+			for _, snap := range s.snapshotsOf(old) {
+				oldId := snap.id()
+				delete(s.snapshots, oldId)
+				snap.dataset = renamed
+				s.snapshots[snap.id()] = snap
+				renames[oldId] = snap.id()
+			}
+			s.emit("pool.dataset.query", "removed", old, map[string]interface{}{"id": old})
+			s.emit("pool.dataset.query", "added", renamed, s.datasetObject(ds, nil, true))
+		}
+		for _, ds := range s.datasets {
+			if renamed, exists := renames[ds.origin]; exists {
+				ds.origin = renamed
+			}
+		}
+		return nil, nil
+	}
+
+	g_methods["zfs.snapshot.query"] = func(s *Server, params []interface{}) (interface{}, error) {
+		options := getMap(params, 1)
+		props, _, _, _ := getQueryExtra(options)
+		snaps := make([]*snapshot, 0, len(s.snapshots))
+		for _, snap := range s.snapshots {
+			snaps = append(snaps, snap)
+		}
+		sort.Slice(snaps, func(a, b int) bool { return snaps[a].createtxg < snaps[b].createtxg })
+
+		items := make([]map[string]interface{}, 0, len(snaps))
+		for _, snap := range snaps {
+			ok, err := matchFilters(s.snapshotObject(snap, nil), getList(params, 0))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				items = append(items, s.snapshotObject(snap, props))
+			}
+		}
+		delete(options, "extra")
+		return queryItems(items, nil, options)
+	}
+
+	g_methods["zfs.snapshot.create"] = func(s *Server, params []interface{}) (interface{}, error) {
+		req := getMap(params, 0)
+		datasetName, _ := req["dataset"].(string)
+		name, _ := req["name"].(string)
+		if name == "" || strings.ContainsAny(name, "@/") {
+			return nil, errValidation("zfs_snapshot_create.name", "Invalid snapshot name \"%s\"", name)
+		}
+		if _, exists := s.datasets[datasetName]; !exists {
+			return nil, errNotFound("Failed to snapshot %s@%s: dataset does not exist", datasetName, name)
+		}
+
+		targets := []string{datasetName}
+		if getBool(req, "recursive") {
+			exclude := make([]string, 0)
+			for _, e := range getList([]interface{}{req["exclude"]}, 0) {
+				exclude = append(exclude, fmt.Sprint(e))
+			}
+			targets = make([]string, 0)
+			for _, n := range s.descendantsOf(datasetName) {
+				if !containsString(exclude, n) {
+					targets = append(targets, n)
+				}
+			}
+		}
+		for _, n := range targets {
+			if _, exists := s.snapshots[n+"@"+name]; exists {
+				return nil, errExists("Failed to snapshot %s@%s: dataset already exists", n, name)
+			}
+		}
+
+		s.txg++
+		var first *snapshot
+		for _, n := range targets {
+			snap := &snapshot{dataset: n, name: name, createtxg: s.txg, userProps: make(map[string]string)}
+			for key, value := range getMap([]interface{}{req["properties"]}, 0) {
+				snap.userProps[key] = fmt.Sprint(value)
+			}
+			s.snapshots[snap.id()] = snap
+			s.emit("zfs.snapshot.query", "added", snap.id(), s.snapshotObject(snap, nil))
+			if first == nil {
+				first = snap
+			}
+		}
+		return s.snapshotObject(first, nil), nil
+	}
+
+	g_methods["zfs.snapshot.delete"] = func(s *Server, params []interface{}) (interface{}, error) {
+		id := getString(params, 0)
+		snap, exists := s.snapshots[id]
+		if !exists {
+			return nil, errNotFound("%s does not exist", id)
+		}
+		snaps := []*snapshot{snap}
+		if getBool(getMap(params, 1), "recursive") {
+			for _, n := range s.descendantsOf(snap.dataset)[1:] {
+				if child, exists := s.snapshots[n+"@"+snap.name]; exists {
+					snaps = append(snaps, child)
+				}
+			}
+		}
+		if err := s.checkNoDependentClones(snaps, nil); err != nil {
+			return nil, err
+		}
+		for _, sn := range snaps {
+			s.deleteSnapshot(sn)
+		}
+		return true, nil
+	}
+
+	g_methods["zfs.snapshot.rollback"] = func(s *Server, params []interface{}) (interface{}, error) {
+		id := getString(params, 0)
+		snap, exists := s.snapshots[id]
+		if !exists {
+			return nil, errNotFound("%s does not exist", id)
+		}
+		options := getMap(params, 1)
+
+		targets := []*snapshot{snap}
+		if getBool(options, "recursive_rollback") {
+			for _, n := range s.descendantsOf(snap.dataset)[1:] {
+				child, exists := s.snapshots[n+"@"+snap.name]
+				if !exists {
+					return nil, errNotFound("Failed to rollback %s: %s has no snapshot %s", id, n, snap.name)
+				}
+				targets = append(targets, child)
+			}
+		}
+
+		// Rolling back destroys the snapshots taken since
+		later := make([]*snapshot, 0)
+		clones := make([]string, 0)
+		for _, target := range targets {
+			for _, other := range s.snapshotsOf(target.dataset) {
+				if other.createtxg > target.createtxg {
+					later = append(later, other)
+				}
+			}
+		}
+		if len(later) > 0 && !getBool(options, "recursive") && !getBool(options, "recursive_clones") {
+			return nil, errInvalid("Failed to rollback %s: more recent snapshots or bookmarks exist, eg. %s", id, later[0].id())
+		}
+		if getBool(options, "recursive_clones") {
+			for _, other := range later {
+				for _, name := range sortedKeys(s.datasets) {
+					if s.datasets[name].origin == other.id() {
+						clones = append(clones, s.descendantsOf(name)...)
+					}
+				}
+			}
+		}
+		if err := s.checkNoDependentClones(later, clones); err != nil {
+			return nil, err
+		}
+		s.deleteDatasets(clones)
+		for _, other := range later {
+			s.deleteSnapshot(other)
+		}
+		return nil, nil
+	}
+
+	g_methods["zfs.snapshot.rename"] = func(s *Server, params []interface{}) (interface{}, error) {
+		id := getString(params, 0)
+		newId := getString(params, 1)
+		if newId == "" {
+			newId, _ = getMap(params, 1)["new_name"].(string)
+		}
+		snap, exists := s.snapshots[id]
+		if !exists {
+			return nil, errNotFound("%s does not exist", id)
+		}
+		if !strings.HasPrefix(newId, snap.dataset+"@") || len(newId) == len(snap.dataset)+1 {
+			return nil, errInvalid("Snapshots can only be renamed within the same dataset, got \"%s\"", newId)
+		}
+		if _, exists := s.snapshots[newId]; exists {
+			return nil, errExists("Failed to rename %s: %s already exists", id, newId)
+		}
+		delete(s.snapshots, id)
+		snap.name = newId[len(snap.dataset)+1:]
+		s.snapshots[newId] = snap
+		for _, ds := range s.datasets {
+			if ds.origin == id {
+				ds.origin = newId
+			}
+		}
+		s.emit("zfs.snapshot.query", "removed", id, map[string]interface{}{"id": id})
+		s.emit("zfs.snapshot.query", "added", newId, s.snapshotObject(snap, nil))
+		return nil, nil
+	}
+
+	g_methods["zfs.snapshot.clone"] = func(s *Server, params []interface{}) (interface{}, error) {
+		req := getMap(params, 0)
+		id, _ := req["snapshot"].(string)
+		dst, _ := req["dataset_dst"].(string)
+		snap, exists := s.snapshots[id]
+		if !exists {
+			return nil, errNotFound("Failed to clone %s: snapshot does not exist", id)
+		}
+		if _, exists := s.datasets[dst]; exists {
+			return nil, errExists("Failed to clone %s: %s already exists", id, dst)
+		}
+		if parent, exists := s.datasets[parentOf(dst)]; !exists || parent.typ != "FILESYSTEM" || poolOf(dst) != poolOf(id) {
+			return nil, errNotFound("Failed to clone %s: parent of %s does not exist", id, dst)
+		}
+		source := s.datasets[snap.dataset]
+		ds := s.newDataset(dst, source.typ)
+		for key, value := range source.props {
+			if g_localOnlyProperties[key] {
+				ds.props[key] = value
+			}
+		}
+		if err := s.setProperties(ds, getMap([]interface{}{req["dataset_properties"]}, 0)); err != nil {
+			return nil, err
+		}
+		ds.origin = id
+		s.datasets[dst] = ds
+		s.emit("pool.dataset.query", "added", dst, s.datasetObject(ds, nil, true))
+		return true, nil
+	}
+}
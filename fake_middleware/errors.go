@@ -0,0 +1,177 @@
+package fake_middleware
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSON-RPC error codes used by the middleware
+const (
+	CODE_INVALID_PARAMS   = -32602
+	CODE_METHOD_NOT_FOUND = -32601
+	CODE_CALL_ERROR       = -32001
+)
+
+const (
+	ENOENT = 2
+	EACCES = 13
+	EBUSY  = 16
+	EEXIST = 17
+	EINVAL = 22
+)
+
+var g_errnoNames = map[int]string{
+	ENOENT: "ENOENT",
+	EACCES: "EACCES",
+	EBUSY:  "EBUSY",
+	EEXIST: "EEXIST",
+	EINVAL: "EINVAL",
+}
+
+// Error is returned to clients in the "error" of a response, the way the middleware reports a CallError,
+// or ValidationErrors if Attribute is set
+type Error struct {
+	Code      int
+	Message   string
+	Errno     int
+	Errname   string
+	Reason    string
+	Attribute string // the param that failed validation, eg. "pool_dataset_create.name"
+	Detail    string // the validation error without its attribute
+}
+
+func (e *Error) Error() string {
+	return e.Reason
+}
+
+func newCallError(errno int, format string, args ...interface{}) *Error {
+	reason := fmt.Sprintf(format, args...)
+	return &Error{
+		Code:    CODE_CALL_ERROR,
+		Errno:   errno,
+		Errname: g_errnoNames[errno],
+		Reason:  fmt.Sprintf("[%s] %s", g_errnoNames[errno], reason),
+	}
+}
+
+func errNotFound(format string, args ...interface{}) *Error {
+	return newCallError(ENOENT, format, args...)
+}
+
+func errExists(format string, args ...interface{}) *Error {
+	return newCallError(EEXIST, format, args...)
+}
+
+func errBusy(format string, args ...interface{}) *Error {
+	return newCallError(EBUSY, format, args...)
+}
+
+func errInvalid(format string, args ...interface{}) *Error {
+	return newCallError(EINVAL, format, args...)
+}
+
+// errValidation rejects one param of a call, the way the middleware reports ValidationErrors
+func errValidation(attribute string, format string, args ...interface{}) *Error {
+	detail := fmt.Sprintf(format, args...)
+	return &Error{
+		Code:      CODE_INVALID_PARAMS,
+		Message:   "Invalid params",
+		Errno:     EINVAL,
+		Errname:   "EINVAL",
+		Reason:    fmt.Sprintf("[EINVAL] %s: %s", attribute, detail),
+		Attribute: attribute,
+		Detail:    detail,
+	}
+}
+
+// class is the name of the exception that the middleware would have raised
+func (e *Error) class() string {
+	if e.Attribute != "" {
+		return "ValidationErrors"
+	}
+	return "CallError"
+}
+
+// extra lists the validation errors as [attribute, message, errno], as the middleware does
+func (e *Error) extra() []interface{} {
+	if e.Attribute == "" {
+		return []interface{}{}
+	}
+	return []interface{}{[]interface{}{e.Attribute, e.Detail, e.Errno}}
+}
+
+// traceback imitates the one that the middleware formats for an exception
+func (e *Error) traceback() string {
+	return "Traceback (most recent call last):\n" +
+		"  File \"/usr/lib/python3/dist-packages/middlewared/main.py\", line 1, in call_method\n" +
+		"middlewared.service_exception." + e.class() + ": " + e.Reason
+}
+
+func toRpcError(err error) map[string]interface{} {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: CODE_CALL_ERROR, Errno: EINVAL, Errname: "EINVAL", Reason: err.Error()}
+	}
+	message := e.Message
+	if message == "" {
+		message = "Method call error"
+	}
+	return map[string]interface{}{
+		"code":    e.Code,
+		"message": message,
+		"data": map[string]interface{}{
+			"error":   e.Errno,
+			"errname": e.Errname,
+			"reason":  e.Reason,
+			"trace": map[string]interface{}{
+				"class":     e.class(),
+				"frames":    []interface{}{},
+				"formatted": e.traceback(),
+			},
+			"extra": e.extra(),
+		},
+	}
+}
+
+// normalize gives a value the same types it would have after being sent as JSON, so that values from clients and
+// from the model can be compared directly
+func normalize(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	data, _ := json.Marshal(value)
+	var out interface{}
+	_ = json.Unmarshal(data, &out)
+	return out
+}
+
+func getString(params []interface{}, index int) string {
+	if index >= len(params) {
+		return ""
+	}
+	str, _ := params[index].(string)
+	return str
+}
+
+func getMap(params []interface{}, index int) map[string]interface{} {
+	if index < len(params) {
+		if m, ok := params[index].(map[string]interface{}); ok {
+			return m
+		}
+	}
+	return map[string]interface{}{}
+}
+
+func getList(params []interface{}, index int) []interface{} {
+	if index < len(params) {
+		if list, ok := params[index].([]interface{}); ok {
+			return list
+		}
+	}
+	return nil
+}
+
+func getBool(m map[string]interface{}, key string) bool {
+	value, _ := m[key].(bool)
+	return value
+}
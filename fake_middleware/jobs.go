@@ -0,0 +1,239 @@
+package fake_middleware
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// job is a long running call. Its id is returned straight away, and its progress and result are then sent as
+// collection_update events on core.get_jobs.
+type job struct {
+	s       *Server
+	id      int64
+	fields  map[string]interface{} // as returned by core.get_jobs
+	err     error
+	work    func(j *job) (interface{}, error)
+	doneCh  chan struct{}
+	abortCh chan struct{}
+}
+
+// newJob registers a job, to be started once its id has been sent. mtx must be held.
+func (s *Server) newJob(method string, args []interface{}, work func(j *job) (interface{}, error)) *job {
+	s.nextId++
+	j := &job{
+		s:  s,
+		id: s.nextId,
+		fields: map[string]interface{}{
+			"id":            s.nextId,
+			"method":        method,
+			"arguments":     args,
+			"transient":     false,
+			"abortable":     true,
+			"description":   nil,
+			"logs_excerpt":  nil,
+			"progress":      map[string]interface{}{"percent": 0, "description": "", "extra": nil},
+			"result":        nil,
+			"error":         nil,
+			"exception":     nil,
+			"exc_info":      nil,
+			"state":         "WAITING",
+			"time_started":  nil,
+			"time_finished": nil,
+		},
+		work:    work,
+		doneCh:  make(chan struct{}),
+		abortCh: make(chan struct{}),
+	}
+	s.jobs[j.id] = j
+	return j
+}
+
+func (j *job) run() {
+	s := j.s
+	s.mtx.Lock()
+	j.fields["state"] = "RUNNING"
+	j.fields["time_started"] = makeDate(time.Now())
+	s.emit("core.get_jobs", "added", j.id, j.fields)
+	s.mtx.Unlock()
+
+	result, err := j.work(j)
+
+	s.mtx.Lock()
+	j.err = err
+	j.fields["time_finished"] = makeDate(time.Now())
+	if err != nil {
+		j.fields["state"] = "FAILED"
+		if j.isAborted() {
+			j.fields["state"] = "ABORTED"
+		}
+		j.fields["error"] = err.Error()
+		if e, ok := err.(*Error); ok {
+			excType := e.class()
+			if e.Attribute != "" {
+				excType = "VALIDATION"
+			}
+			j.fields["exc_info"] = map[string]interface{}{"type": excType, "errno": e.Errno, "extra": e.extra(), "repr": e.Reason}
+			j.fields["exception"] = e.traceback()
+		}
+	} else {
+		j.fields["state"] = "SUCCESS"
+		j.fields["result"] = normalize(result)
+		j.fields["progress"] = map[string]interface{}{"percent": 100, "description": "", "extra": nil}
+	}
+	s.emit("core.get_jobs", "changed", j.id, j.fields)
+	s.mtx.Unlock()
+	close(j.doneCh)
+}
+
+func (j *job) isAborted() bool {
+	select {
+	case <-j.abortCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetJobDelay sets how long each step of a job takes, so that tests can watch jobs progress
+func (s *Server) SetJobDelay(delay time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.jobDelay = delay
+}
+
+// HoldJobs stops jobs from taking their next step until the returned function is called, so that tests can check
+// on jobs while they run, or abort them, without depending on timing
+func (s *Server) HoldJobs() (release func()) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.jobsHeldCh == nil {
+		s.jobsHeldCh = make(chan struct{})
+	}
+	heldCh := s.jobsHeldCh
+	return func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		if s.jobsHeldCh == heldCh {
+			close(heldCh)
+			s.jobsHeldCh = nil
+		}
+	}
+}
+
+// step waits while jobs are held, then for the server's job delay, returning an error if the job is aborted in the meantime
+func (j *job) step() error {
+	j.s.mtx.Lock()
+	delay := j.s.jobDelay
+	heldCh := j.s.jobsHeldCh
+	j.s.mtx.Unlock()
+	if heldCh != nil {
+		select {
+		case <-j.abortCh:
+			return fmt.Errorf("[EINTR] Job %d was aborted", j.id)
+		case <-heldCh:
+		}
+	}
+	select {
+	case <-j.abortCh:
+		return fmt.Errorf("[EINTR] Job %d was aborted", j.id)
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+func (j *job) setProgress(percent float64, description string) {
+	j.s.mtx.Lock()
+	defer j.s.mtx.Unlock()
+	j.fields["progress"] = map[string]interface{}{"percent": percent, "description": description, "extra": nil}
+	j.s.emit("core.get_jobs", "changed", j.id, j.fields)
+}
+
+func makeDate(t time.Time) map[string]interface{} {
+	return map[string]interface{}{"$date": t.UnixMilli()}
+}
+
+func registerJobMethods() {
+	// core.bulk runs a method once for each list of params, reporting progress as it goes
+	g_methods["core.bulk"] = func(s *Server, params []interface{}) (interface{}, error) {
+		method := getString(params, 0)
+		calls := getList(params, 1)
+		return s.newJob("core.bulk", params, func(j *job) (interface{}, error) {
+			results := make([]interface{}, 0, len(calls))
+			for i, callParams := range calls {
+				if err := j.step(); err != nil {
+					return nil, err
+				}
+				paramsList, _ := callParams.([]interface{})
+
+				s.mtx.Lock()
+				result, err := s.dispatch(nil, method, paramsList)
+				s.mtx.Unlock()
+				var jobId interface{}
+				if inner, isJob := result.(*job); isJob {
+					jobId = inner.id
+					inner.run()
+					result, err = inner.fields["result"], inner.err
+				}
+
+				entry := map[string]interface{}{"job_id": jobId, "result": result, "error": nil}
+				if err != nil {
+					entry["result"] = nil
+					entry["error"] = err.Error()
+				}
+				results = append(results, entry)
+				j.setProgress(float64(100*(i+1)/len(calls)), fmt.Sprintf("%d/%d: %s", i+1, len(calls), method))
+			}
+			return results, nil
+		}), nil
+	}
+
+	// core.job_wait is a job that finishes when another one does, with the same result
+	g_methods["core.job_wait"] = func(s *Server, params []interface{}) (interface{}, error) {
+		id, _ := getNumber(params, 0)
+		target, exists := s.jobs[int64(id)]
+		if !exists {
+			return nil, errNotFound("Job %d not found", int64(id))
+		}
+		return s.newJob("core.job_wait", params, func(j *job) (interface{}, error) {
+			<-target.doneCh
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			return target.fields["result"], target.err
+		}), nil
+	}
+
+	g_methods["core.job_abort"] = func(s *Server, params []interface{}) (interface{}, error) {
+		id, _ := getNumber(params, 0)
+		target, exists := s.jobs[int64(id)]
+		if !exists {
+			return nil, errNotFound("Job %d not found", int64(id))
+		}
+		if !target.isAborted() {
+			close(target.abortCh)
+		}
+		return nil, nil
+	}
+
+	g_methods["core.get_jobs"] = func(s *Server, params []interface{}) (interface{}, error) {
+		ids := make([]int64, 0, len(s.jobs))
+		for id := range s.jobs {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+		items := make([]map[string]interface{}, 0, len(ids))
+		for _, id := range ids {
+			fields, _ := normalize(s.jobs[id].fields).(map[string]interface{})
+			items = append(items, fields)
+		}
+		return queryItems(items, getList(params, 0), getMap(params, 1))
+	}
+}
+
+func getNumber(params []interface{}, index int) (float64, bool) {
+	if index >= len(params) {
+		return 0, false
+	}
+	n, ok := params[index].(float64)
+	return n, ok
+}
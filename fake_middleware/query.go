@@ -0,0 +1,217 @@
+package fake_middleware
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// queryItems applies query-filters and query-options to a list of objects, the way the middleware's filter_list does
+func queryItems(items []map[string]interface{}, filters []interface{}, options map[string]interface{}) (interface{}, error) {
+	matched := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		ok, err := matchFilters(item, filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, item)
+		}
+	}
+
+	if orderBy, ok := options["order_by"].([]interface{}); ok {
+		sortItems(matched, orderBy)
+	}
+	if offset, ok := options["offset"].(float64); ok && offset > 0 {
+		matched = matched[min(int(offset), len(matched)):]
+	}
+	if limit, ok := options["limit"].(float64); ok && limit > 0 {
+		matched = matched[:min(int(limit), len(matched))]
+	}
+	if getBool(options, "count") {
+		return len(matched), nil
+	}
+	if selectKeys, ok := options["select"].([]interface{}); ok && len(selectKeys) > 0 {
+		for i, item := range matched {
+			selected := make(map[string]interface{})
+			for _, key := range selectKeys {
+				if value, exists := lookupKey(item, fmt.Sprint(key)); exists {
+					selected[fmt.Sprint(key)] = value
+				}
+			}
+			matched[i] = selected
+		}
+	}
+	if getBool(options, "get") {
+		if len(matched) == 0 {
+			return nil, errNotFound("Object not found")
+		}
+		return matched[0], nil
+	}
+
+	results := make([]interface{}, len(matched))
+	for i, item := range matched {
+		results[i] = item
+	}
+	return results, nil
+}
+
+// matchFilters reports whether an object matches every filter in a list
+func matchFilters(item map[string]interface{}, filters []interface{}) (bool, error) {
+	for _, f := range filters {
+		filter, ok := f.([]interface{})
+		if !ok {
+			return false, errInvalid("Invalid filter %v", f)
+		}
+		matched, err := matchFilter(item, filter)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchFilter(item map[string]interface{}, filter []interface{}) (bool, error) {
+	if len(filter) == 2 && filter[0] == "OR" {
+		branches, _ := filter[1].([]interface{})
+		for _, branch := range branches {
+			// each branch is either a single filter or a list of filters that must all match
+			branchList, _ := branch.([]interface{})
+			var matched bool
+			var err error
+			if len(branchList) > 0 {
+				if _, isNested := branchList[0].([]interface{}); isNested {
+					matched, err = matchFilters(item, branchList)
+				} else {
+					matched, err = matchFilter(item, branchList)
+				}
+			}
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+		return false, nil
+	}
+	if len(filter) != 3 {
+		return false, errInvalid("Invalid filter %v", filter)
+	}
+
+	key, _ := filter[0].(string)
+	op, _ := filter[1].(string)
+	expected := filter[2]
+	actual, _ := lookupKey(item, key)
+
+	switch op {
+	case "=":
+		return reflect.DeepEqual(actual, expected), nil
+	case "!=":
+		return !reflect.DeepEqual(actual, expected), nil
+	case "in", "nin":
+		list, _ := expected.([]interface{})
+		found := containsValue(list, actual)
+		return found == (op == "in"), nil
+	case "rin", "rnin":
+		list, _ := actual.([]interface{})
+		found := containsValue(list, expected)
+		return found == (op == "rin"), nil
+	case "^", "!^", "$", "!$":
+		actualStr, isStr := actual.(string)
+		expectedStr, _ := expected.(string)
+		if !isStr {
+			return op[0] == '!', nil
+		}
+		var matched bool
+		if strings.HasSuffix(op, "^") {
+			matched = strings.HasPrefix(actualStr, expectedStr)
+		} else {
+			matched = strings.HasSuffix(actualStr, expectedStr)
+		}
+		return matched != (op[0] == '!'), nil
+	case "~":
+		re, err := regexp.Compile(fmt.Sprint(expected))
+		if err != nil {
+			return false, errInvalid("Invalid regex %v: %v", expected, err)
+		}
+		actualStr, isStr := actual.(string)
+		return isStr && re.MatchString(actualStr), nil
+	case ">", "<", ">=", "<=":
+		cmp, ok := compareValues(actual, expected)
+		if !ok {
+			return false, nil
+		}
+		switch op {
+		case ">":
+			return cmp > 0, nil
+		case "<":
+			return cmp < 0, nil
+		case ">=":
+			return cmp >= 0, nil
+		}
+		return cmp <= 0, nil
+	}
+	return false, errInvalid("Invalid operation %s", op)
+}
+
+// lookupKey finds a value in an object, where "a.b" means key b of the object under a
+func lookupKey(item map[string]interface{}, key string) (interface{}, bool) {
+	if value, exists := item[key]; exists {
+		return value, true
+	}
+	if dot := strings.Index(key, "."); dot > 0 {
+		if inner, ok := item[key[:dot]].(map[string]interface{}); ok {
+			return lookupKey(inner, key[dot+1:])
+		}
+	}
+	return nil, false
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, elem := range list {
+		if reflect.DeepEqual(elem, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// compareValues orders two numbers or two strings
+func compareValues(a, b interface{}) (int, bool) {
+	switch aValue := a.(type) {
+	case float64:
+		if bValue, ok := b.(float64); ok {
+			switch {
+			case aValue < bValue:
+				return -1, true
+			case aValue > bValue:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if bValue, ok := b.(string); ok {
+			return strings.Compare(aValue, bValue), true
+		}
+	}
+	return 0, false
+}
+
+// sortItems orders objects by keys, each optionally prefixed with "-" for descending order
+func sortItems(items []map[string]interface{}, orderBy []interface{}) {
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, o := range orderBy {
+			key := fmt.Sprint(o)
+			descending := strings.HasPrefix(key, "-")
+			key = strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(key, "-"), "nulls_first:"), "nulls_last:")
+			a, _ := lookupKey(items[i], key)
+			b, _ := lookupKey(items[j], key)
+			cmp, ok := compareValues(a, b)
+			if !ok || cmp == 0 {
+				continue
+			}
+			return (cmp < 0) != descending
+		}
+		return false
+	})
+}
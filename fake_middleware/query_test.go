@@ -0,0 +1,57 @@
+package fake_middleware
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQueryItems(t *testing.T) {
+	items := []map[string]interface{}{
+		{"id": float64(1), "name": "tank/a", "props": map[string]interface{}{"size": float64(30)}},
+		{"id": float64(2), "name": "tank/b", "props": map[string]interface{}{"size": float64(10)}},
+		{"id": float64(3), "name": "pool/c", "props": map[string]interface{}{"size": float64(20)}},
+	}
+	names := func(result interface{}) []string {
+		var out []string
+		for _, item := range result.([]interface{}) {
+			out = append(out, item.(map[string]interface{})["name"].(string))
+		}
+		return out
+	}
+	query := func(filters []interface{}, options map[string]interface{}) interface{} {
+		t.Helper()
+		result, err := queryItems(items, filters, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	expect := func(actual, expected interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("Expected %v, got %v", expected, actual)
+		}
+	}
+
+	expect(names(query(nil, nil)), []string{"tank/a", "tank/b", "pool/c"})
+	expect(names(query([]interface{}{[]interface{}{"name", "^", "tank/"}}, nil)), []string{"tank/a", "tank/b"})
+	expect(names(query([]interface{}{[]interface{}{"props.size", ">=", float64(20)}}, nil)), []string{"tank/a", "pool/c"})
+	expect(names(query([]interface{}{[]interface{}{"id", "in", []interface{}{float64(1), float64(3)}}}, nil)), []string{"tank/a", "pool/c"})
+	expect(names(query([]interface{}{[]interface{}{"OR", []interface{}{
+		[]interface{}{"name", "=", "tank/b"},
+		[]interface{}{"name", "$", "/c"},
+	}}}, nil)), []string{"tank/b", "pool/c"})
+
+	expect(names(query(nil, map[string]interface{}{"order_by": []interface{}{"props.size"}})), []string{"tank/b", "pool/c", "tank/a"})
+	expect(names(query(nil, map[string]interface{}{"order_by": []interface{}{"-name"}, "limit": float64(2)})), []string{"tank/b", "tank/a"})
+	expect(query(nil, map[string]interface{}{"count": true}), 3)
+	expect(query([]interface{}{[]interface{}{"id", "=", float64(2)}}, map[string]interface{}{"get": true, "select": []interface{}{"name"}}),
+		map[string]interface{}{"name": "tank/b"})
+
+	if _, err := queryItems(items, []interface{}{[]interface{}{"id", "=", float64(4)}}, map[string]interface{}{"get": true}); err == nil {
+		t.Fatal("Expected get to fail when nothing matches")
+	}
+	if _, err := queryItems(items, []interface{}{[]interface{}{"id", "?", float64(4)}}, nil); err == nil {
+		t.Fatal("Expected an unknown operator to fail")
+	}
+}
@@ -0,0 +1,445 @@
+// Package fake_middleware is an in-memory stand-in for the TrueNAS middleware's websocket API. It speaks the same
+// JSON-RPC 2.0 protocol, keeps a model of datasets, snapshots, NFS shares, iSCSI objects and services, runs jobs and
+// sends collection_update events, so that commands can be tested end to end through the daemon without a TrueNAS host.
+package fake_middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const DEFAULT_API_KEY = "1-fakemiddlewarekey"
+
+// Call is a record of a method called on the server, in the order they arrived
+type Call struct {
+	Method string
+	Params []interface{}
+}
+
+type Server struct {
+	ApiKey   string // accepted by auth.login_with_api_key and the API_KEY_PLAIN mechanism of auth.login_ex
+	Username string // with Password, accepted by the PASSWORD_PLAIN mechanism of auth.login_ex
+	Password string
+
+	http *httptest.Server
+
+	// mtx guards everything below, including the model. Methods are run with it held.
+	mtx         sync.Mutex
+	conns       map[*conn]bool
+	calls       []Call
+	nextId      int64
+	tokens      map[string]bool
+	txg         int64
+	datasets    map[string]*dataset
+	snapshots   map[string]*snapshot
+	collections map[string]*collection
+	services    map[string]map[string]interface{}
+	jobs        map[int64]*job
+	jobDelay    time.Duration // see SetJobDelay
+	jobsHeldCh  chan struct{} // see HoldJobs. nil unless jobs are held
+}
+
+type conn struct {
+	ws            *websocket.Conn
+	writeMtx      sync.Mutex
+	authenticated bool
+	subscriptions map[string]string // collection by subscription id
+}
+
+// Start serves the fake middleware over ws://, with a single empty pool, "tank"
+func Start() *Server {
+	return StartWith(httptest.NewServer)
+}
+
+// StartTLS serves the fake middleware over wss://, with a self-signed certificate
+func StartTLS() *Server {
+	return StartWith(httptest.NewTLSServer)
+}
+
+func StartWith(newServer func(http.Handler) *httptest.Server) *Server {
+	s := &Server{
+		ApiKey:      DEFAULT_API_KEY,
+		conns:       make(map[*conn]bool),
+		tokens:      make(map[string]bool),
+		datasets:    make(map[string]*dataset),
+		snapshots:   make(map[string]*snapshot),
+		collections: makeCollections(),
+		services:    makeServices(),
+		jobs:        make(map[int64]*job),
+	}
+	s.AddPool("tank")
+
+	upgrader := websocket.Upgrader{}
+	s.http = newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := &conn{ws: ws, subscriptions: make(map[string]string)}
+		s.mtx.Lock()
+		s.conns[c] = true
+		s.mtx.Unlock()
+		go s.serve(c)
+	}))
+	return s
+}
+
+// URL returns the address to pass as --host
+func (s *Server) URL() string {
+	return "ws" + strings.TrimPrefix(s.http.URL, "http") + "/api/current"
+}
+
+// Certificate returns the DER encoded certificate served by StartTLS
+func (s *Server) Certificate() []byte {
+	return s.http.Certificate().Raw
+}
+
+func (s *Server) Close() {
+	s.DropConnections()
+	s.http.Close()
+}
+
+// DropConnections closes every websocket, as if the middleware had restarted
+func (s *Server) DropConnections() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for c := range s.conns {
+		c.ws.Close()
+	}
+}
+
+// AddPool creates a pool with its root dataset
+func (s *Server) AddPool(name string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.datasets[name] = s.newDataset(name, "FILESYSTEM")
+}
+
+// Call runs a method on the model directly, eg. to set up or inspect the state of the server in a test.
+// It isn't recorded in Calls. Jobs are run to completion before returning.
+func (s *Server) Call(method string, params ...interface{}) (interface{}, error) {
+	normalized, _ := normalize(params).([]interface{})
+	s.mtx.Lock()
+	result, err := s.dispatch(nil, method, normalized)
+	s.mtx.Unlock()
+	if j, isJob := result.(*job); isJob {
+		j.run()
+		return j.fields["result"], j.err
+	}
+	return result, err
+}
+
+// Calls returns the methods called by clients so far, except for core.ping
+func (s *Server) Calls() []Call {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// CallCount returns how many times a method has been called by clients
+func (s *Server) CallCount(method string) int {
+	count := 0
+	for _, call := range s.Calls() {
+		if call.Method == method {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Server) serve(c *conn) {
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, c)
+		s.mtx.Unlock()
+		c.ws.Close()
+	}()
+
+	for {
+		var req struct {
+			Id     interface{}     `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := c.ws.ReadJSON(&req); err != nil {
+			return
+		}
+		var params []interface{}
+		if len(req.Params) > 0 {
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				c.reply(req.Id, nil, &Error{Code: CODE_INVALID_PARAMS, Message: "Invalid params", Reason: err.Error()})
+				continue
+			}
+		}
+
+		s.mtx.Lock()
+		if req.Method != "core.ping" {
+			s.calls = append(s.calls, Call{Method: req.Method, Params: params})
+		}
+		var result interface{}
+		var err error
+		if !c.authenticated && !g_noAuthMethods[req.Method] {
+			err = &Error{Code: CODE_CALL_ERROR, Errno: EACCES, Errname: "ENOTAUTHENTICATED", Reason: "Not authenticated"}
+		} else {
+			result, err = s.dispatch(c, req.Method, params)
+		}
+		s.mtx.Unlock()
+
+		// Jobs only start once their id has been sent, so that their events always come after it, as they do for real
+		if j, isJob := result.(*job); isJob {
+			c.reply(req.Id, j.id, nil)
+			go j.run()
+		} else {
+			c.reply(req.Id, result, err)
+		}
+	}
+}
+
+func (c *conn) reply(id interface{}, result interface{}, err error) {
+	response := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if err != nil {
+		response["error"] = toRpcError(err)
+	} else {
+		response["result"] = result
+	}
+	c.send(response)
+}
+
+func (c *conn) send(message interface{}) {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	_ = c.ws.WriteJSON(message)
+}
+
+// dispatch runs a method. c is nil when called through Server.Call. mtx must be held.
+func (s *Server) dispatch(c *conn, method string, params []interface{}) (interface{}, error) {
+	if handler, exists := g_connMethods[method]; exists {
+		if c == nil {
+			return nil, errInvalid("%s needs a connection", method)
+		}
+		return handler(s, c, params)
+	}
+	if handler, exists := g_methods[method]; exists {
+		return handler(s, params)
+	}
+	// Any collection kept in s.collections can be queried, created, updated and deleted
+	if lastDot := strings.LastIndex(method, "."); lastDot > 0 {
+		if coll, exists := s.collections[method[:lastDot]]; exists {
+			return s.callCollection(coll, method[lastDot+1:], params)
+		}
+	}
+	return nil, &Error{Code: CODE_METHOD_NOT_FOUND, Message: "Method not found", Reason: fmt.Sprintf("Method \"%s\" not found", method)}
+}
+
+type methodFunc func(s *Server, params []interface{}) (interface{}, error)
+type connMethodFunc func(s *Server, c *conn, params []interface{}) (interface{}, error)
+
+var g_noAuthMethods = map[string]bool{
+	"core.ping":               true,
+	"auth.login_with_api_key": true,
+	"auth.login_ex":           true,
+	"auth.login":              true,
+}
+
+// Methods that act on the connection they were called on
+var g_connMethods = map[string]connMethodFunc{
+	"auth.login_with_api_key": func(s *Server, c *conn, params []interface{}) (interface{}, error) {
+		c.authenticated = getString(params, 0) == s.ApiKey || s.tokens[getString(params, 0)]
+		return c.authenticated, nil
+	},
+	"auth.login": func(s *Server, c *conn, params []interface{}) (interface{}, error) {
+		c.authenticated = s.Username != "" && getString(params, 0) == s.Username && getString(params, 1) == s.Password
+		return c.authenticated, nil
+	},
+	"auth.login_ex": func(s *Server, c *conn, params []interface{}) (interface{}, error) {
+		req := getMap(params, 0)
+		switch req["mechanism"] {
+		case "API_KEY_PLAIN":
+			c.authenticated = req["api_key"] == s.ApiKey
+		case "PASSWORD_PLAIN":
+			c.authenticated = s.Username != "" && req["username"] == s.Username && req["password"] == s.Password
+		case "TOKEN_PLAIN":
+			token, _ := req["token"].(string)
+			c.authenticated = s.tokens[token]
+		default:
+			return nil, errInvalid("Unsupported mechanism %v", req["mechanism"])
+		}
+		if !c.authenticated {
+			return map[string]interface{}{"response_type": "AUTH_ERR"}, nil
+		}
+		return map[string]interface{}{"response_type": "SUCCESS"}, nil
+	},
+	"core.subscribe": func(s *Server, c *conn, params []interface{}) (interface{}, error) {
+		s.nextId++
+		id := fmt.Sprint("sub-", s.nextId)
+		c.subscriptions[id] = getString(params, 0)
+		return id, nil
+	},
+	"core.unsubscribe": func(s *Server, c *conn, params []interface{}) (interface{}, error) {
+		delete(c.subscriptions, getString(params, 0))
+		return nil, nil
+	},
+}
+
+var g_methods = map[string]methodFunc{}
+
+func init() {
+	g_methods["core.ping"] = func(s *Server, params []interface{}) (interface{}, error) {
+		return "pong", nil
+	}
+	g_methods["auth.me"] = func(s *Server, params []interface{}) (interface{}, error) {
+		return map[string]interface{}{"pw_name": s.Username, "pw_uid": 950}, nil
+	}
+	g_methods["auth.generate_token"] = func(s *Server, params []interface{}) (interface{}, error) {
+		s.nextId++
+		token := fmt.Sprint("token-", s.nextId)
+		s.tokens[token] = true
+		return token, nil
+	}
+	g_methods["api_key.create"] = func(s *Server, params []interface{}) (interface{}, error) {
+		s.nextId++
+		key := fmt.Sprint(s.nextId, "-fakekey")
+		s.tokens[key] = true
+		return map[string]interface{}{"id": s.nextId, "name": getMap(params, 0)["name"], "key": key}, nil
+	}
+	g_methods["api_key.delete"] = func(s *Server, params []interface{}) (interface{}, error) {
+		return true, nil
+	}
+	registerJobMethods()
+	registerDatasetMethods()
+	registerServiceMethods()
+
+	// core.get_methods describes every method, optionally only those of one service, though without real schemas
+	g_methods["core.get_methods"] = func(s *Server, params []interface{}) (interface{}, error) {
+		names := append(sortedKeys(g_methods), sortedKeys(g_connMethods)...)
+		for _, name := range sortedKeys(s.collections) {
+			for _, op := range []string{"query", "get_instance", "create", "update", "delete"} {
+				names = append(names, name+"."+op)
+			}
+		}
+		service := getString(params, 0)
+		methods := make(map[string]interface{})
+		for _, name := range names {
+			if service != "" && !strings.HasPrefix(name, service+".") {
+				continue
+			}
+			methods[name] = map[string]interface{}{
+				"description": nil,
+				"job":         g_jobMethods[name],
+				"filterable":  strings.HasSuffix(name, ".query"),
+				"accepts":     []interface{}{},
+				"returns":     []interface{}{},
+			}
+		}
+		return methods, nil
+	}
+}
+
+// Methods that return a job id
+var g_jobMethods = map[string]bool{
+	"core.bulk":     true,
+	"core.job_wait": true,
+}
+
+// emit sends a collection_update event to every connection subscribed to the collection. mtx must be held.
+func (s *Server) emit(collection, msg string, id interface{}, fields map[string]interface{}) {
+	event := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "collection_update",
+		"params": map[string]interface{}{
+			"msg":        msg,
+			"collection": collection,
+			"id":         id,
+			"fields":     normalize(fields),
+		},
+	}
+	for c := range s.conns {
+		for _, subscribed := range c.subscriptions {
+			if subscribed == collection {
+				c.send(event)
+				break
+			}
+		}
+	}
+}
+
+func makeServices() map[string]map[string]interface{} {
+	services := make(map[string]map[string]interface{})
+	for i, name := range []string{"cifs", "iscsitarget", "nfs", "ssh"} {
+		services[name] = map[string]interface{}{"id": float64(i + 1), "service": name, "enable": false, "state": "STOPPED", "pids": []interface{}{}}
+	}
+	return services
+}
+
+func registerServiceMethods() {
+	g_methods["service.query"] = func(s *Server, params []interface{}) (interface{}, error) {
+		items := make([]map[string]interface{}, 0, len(s.services))
+		for _, name := range sortedKeys(s.services) {
+			items = append(items, s.services[name])
+		}
+		return queryItems(items, getList(params, 0), getMap(params, 1))
+	}
+	g_methods["service.update"] = func(s *Server, params []interface{}) (interface{}, error) {
+		service, err := s.findService(params)
+		if err != nil {
+			return nil, err
+		}
+		if enable, ok := getMap(params, 1)["enable"].(bool); ok {
+			service["enable"] = enable
+		}
+		s.emit("service.query", "changed", service["id"], service)
+		return service["id"], nil
+	}
+	g_methods["service.started"] = func(s *Server, params []interface{}) (interface{}, error) {
+		service, err := s.findService(params)
+		if err != nil {
+			return nil, err
+		}
+		return service["state"] == "RUNNING", nil
+	}
+	for _, action := range []string{"start", "stop", "restart", "reload"} {
+		state := "RUNNING"
+		if action == "stop" {
+			state = "STOPPED"
+		}
+		g_methods["service."+action] = func(s *Server, params []interface{}) (interface{}, error) {
+			service, err := s.findService(params)
+			if err != nil {
+				return nil, err
+			}
+			service["state"] = state
+			s.emit("service.query", "changed", service["id"], service)
+			return true, nil
+		}
+	}
+}
+
+// findService looks a service up by the name or id in the first param
+func (s *Server) findService(params []interface{}) (map[string]interface{}, error) {
+	if len(params) == 0 {
+		return nil, errInvalid("Expected a service name")
+	}
+	for _, service := range s.services {
+		if service["service"] == params[0] || service["id"] == params[0] {
+			return service, nil
+		}
+	}
+	return nil, errNotFound("Service %v not found", params[0])
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
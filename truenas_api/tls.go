@@ -0,0 +1,115 @@
+package truenas_api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSTrust decides which server certificates are accepted. With none of its fields set, the certificate has to
+// verify against the system's roots as usual.
+type TLSTrust struct {
+	AllowInsecure bool   // accept any certificate
+	Fingerprint   string // SHA-256 fingerprint the certificate must have. It's then accepted even if self-signed
+	CAFile        string // PEM bundle to verify the certificate against, instead of the system's roots
+}
+
+// FingerprintMismatchError is returned when a server presents a different certificate to the one that was pinned
+type FingerprintMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *FingerprintMismatchError) Error() string {
+	return fmt.Sprintf("The server's TLS certificate does not match the pinned fingerprint!\n"+
+		"  pinned:   %s\n  received: %s\n"+
+		"Either the certificate was replaced, or someone is intercepting the connection.", e.Expected, e.Actual)
+}
+
+// CertificateFingerprint returns the SHA-256 fingerprint of a DER encoded certificate, as colon separated hex
+func CertificateFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexStr := strings.ToUpper(hex.EncodeToString(sum[:]))
+	pairs := make([]string, 0, len(sum))
+	for i := 0; i < len(hexStr); i += 2 {
+		pairs = append(pairs, hexStr[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// normalizeFingerprint lets fingerprints be compared whether or not they have colons or a "sha256:" prefix
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(fingerprint)), "sha256:")
+	return strings.NewReplacer(":", "", " ", "").Replace(fingerprint)
+}
+
+// MakeTLSConfig builds the TLS configuration for connecting to a server with this trust
+func (t TLSTrust) MakeTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: t.AllowInsecure,
+	}
+
+	if t.CAFile != "" {
+		data, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", t.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if t.Fingerprint != "" {
+		expected := normalizeFingerprint(t.Fingerprint)
+		if len(expected) != sha256.Size*2 {
+			return nil, fmt.Errorf("Invalid SHA-256 fingerprint \"%s\"", t.Fingerprint)
+		}
+		// The pin replaces chain verification, unless there's a CA bundle to verify against as well
+		if t.CAFile == "" {
+			config.InsecureSkipVerify = true
+		}
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("The server did not present a TLS certificate")
+			}
+			actual := CertificateFingerprint(rawCerts[0])
+			if normalizeFingerprint(actual) != expected {
+				return &FingerprintMismatchError{Expected: t.Fingerprint, Actual: actual}
+			}
+			return nil
+		}
+	}
+
+	return config, nil
+}
+
+// IsCertificateError reports whether connecting failed because the server's certificate could not be verified
+func IsCertificateError(err error) bool {
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &verifyErr) || errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// PeerFingerprint returns the SHA-256 fingerprint of the certificate the server presented,
+// or an empty string if the connection doesn't use TLS
+func (c *Client) PeerFingerprint() string {
+	tlsConn, ok := c.conn.UnderlyingConn().(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return CertificateFingerprint(certs[0].Raw)
+}
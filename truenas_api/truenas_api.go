@@ -1,7 +1,7 @@
 package truenas_api
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -113,7 +113,7 @@ func (j *Jobs) UpdateJobState(jobID int64, state string, progress float64, resul
 	}
 	job.State = state
 	job.Progress = progress
-	if state == "SUCCESS" || state == "FAILED" {
+	if state == "SUCCESS" || state == "FAILED" || state == "ABORTED" {
 		job.Finished = true
 		job.Result = result
 		job.DoneCh <- err     // Send error (if any) to the done channel
@@ -141,18 +141,19 @@ func (c *Client) SubscribeToJobs() error {
 }
 
 // NewClient creates a new WebSocket client connection.
-func NewClient(serverURL string, verifySSL bool) (*Client, error) {
-	return NewClientWithCallback(serverURL, verifySSL, nil)
+func NewClient(serverURL string, trust TLSTrust) (*Client, error) {
+	return NewClientWithCallback(serverURL, trust, nil)
 }
 
-func NewClientWithCallback(serverURL string, verifySSL bool, jobsCallback func(int64, int64, map[string]interface{})) (*Client, error) {
+func NewClientWithCallback(serverURL string, trust TLSTrust, jobsCallback func(int64, int64, map[string]interface{})) (*Client, error) {
 	u, err := url.Parse(serverURL)
 	if err != nil {
 		return nil, fmt.Errorf("invalid URL: %w", err)
 	}
 
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: verifySSL,
+	tlsConfig, err := trust.MakeTLSConfig()
+	if err != nil {
+		return nil, err
 	}
 
 	dialer := &websocket.Dialer{
@@ -201,6 +202,11 @@ func (c *Client) Close() error {
 
 // Call sends an RPC call to the server and waits for a response.
 func (c *Client) Call(method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
+	return c.CallWithContext(context.Background(), method, timeoutSeconds, params)
+}
+
+// CallWithContext is like Call, but stops waiting for the response if ctx is done.
+func (c *Client) CallWithContext(ctx context.Context, method string, timeoutSeconds int64, params interface{}) (json.RawMessage, error) {
 	timeout := time.Duration(timeoutSeconds) * time.Second
 
 	c.mu.Lock()
@@ -235,6 +241,8 @@ func (c *Client) Call(method string, timeoutSeconds int64, params interface{}) (
 		return res, nil
 	case <-time.After(timeout):
 		return nil, errors.New("call timed out")
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
@@ -416,3 +424,102 @@ func (c *Client) Login(username, password, apiKey string) error {
 
 	return errors.New("login failed, unexpected response")
 }
+
+// Values of response_type in the result of auth.login_ex that the client acts on.
+const (
+	LoginExSuccess     = "SUCCESS"
+	LoginExOtpRequired = "OTP_REQUIRED"
+)
+
+// ErrLoginExUnsupported is returned by ParseLoginExResponse when the server predates auth.login_ex.
+var ErrLoginExUnsupported = errors.New("auth.login_ex is not supported by this server")
+
+// MakePasswordLoginParams returns the params of auth.login_ex for a username and password.
+func MakePasswordLoginParams(username, password string) []interface{} {
+	return []interface{}{map[string]interface{}{
+		"mechanism": "PASSWORD_PLAIN",
+		"username":  username,
+		"password":  password,
+	}}
+}
+
+// MakeOtpLoginParams returns the params of auth.login_ex for the second step of a two-factor login.
+func MakeOtpLoginParams(otp string) []interface{} {
+	return []interface{}{map[string]interface{}{
+		"mechanism": "OTP_TOKEN",
+		"otp_token": otp,
+	}}
+}
+
+// MakeTokenLoginParams returns the params of auth.login_ex for a token made by auth.generate_token.
+func MakeTokenLoginParams(token string) []interface{} {
+	return []interface{}{map[string]interface{}{
+		"mechanism": "TOKEN_PLAIN",
+		"token":     token,
+	}}
+}
+
+// ParseLoginExResponse returns the response_type of an auth.login_ex response.
+func ParseLoginExResponse(res json.RawMessage) (string, error) {
+	var response struct {
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Result struct {
+			ResponseType string `json:"response_type"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(res, &response); err != nil {
+		return "", fmt.Errorf("failed to parse login response: %w", err)
+	}
+	if response.Error != nil {
+		// -32601 is the JSON-RPC code for an unknown method
+		if response.Error.Code == -32601 {
+			return "", ErrLoginExUnsupported
+		}
+		return "", fmt.Errorf("login error: %s", response.Error.Message)
+	}
+	if response.Result.ResponseType == "" {
+		return "", errors.New("login failed, unexpected response")
+	}
+	return response.Result.ResponseType, nil
+}
+
+// LoginWithPassword logs in with auth.login_ex, calling getOtp if the account requires a one-time password.
+// Servers without auth.login_ex are logged in to with auth.login instead, which doesn't support two-factor authentication.
+func (c *Client) LoginWithPassword(username, password string, getOtp func() (string, error)) error {
+	res, err := c.Call("auth.login_ex", 10, MakePasswordLoginParams(username, password))
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	state, err := ParseLoginExResponse(res)
+	if errors.Is(err, ErrLoginExUnsupported) {
+		return c.Login(username, password, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	if state == LoginExOtpRequired {
+		if getOtp == nil {
+			return errors.New("login failed, a one-time password is required")
+		}
+		otp, err := getOtp()
+		if err != nil {
+			return err
+		}
+		res, err = c.Call("auth.login_ex", 10, MakeOtpLoginParams(otp))
+		if err != nil {
+			return fmt.Errorf("login failed: %w", err)
+		}
+		if state, err = ParseLoginExResponse(res); err != nil {
+			return err
+		}
+	}
+
+	if state != LoginExSuccess {
+		return fmt.Errorf("login failed: %s", state)
+	}
+	return nil
+}